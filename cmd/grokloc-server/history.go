@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/grokloc/grokloc-server/pkg/app/analysis"
+	"github.com/grokloc/grokloc-server/pkg/app/config"
+	"github.com/grokloc/grokloc-server/pkg/app/repository"
+	"github.com/grokloc/grokloc-server/pkg/app/state"
+)
+
+// historyCmd analyzes and stores the history of the mirrored repository
+// named in args
+func historyCmd(cfg *config.Config, args []string) error {
+	if len(args) < 2 {
+		return errors.New(Usage)
+	}
+
+	var sample analysis.Sample
+	switch args[1] {
+	case "daily":
+		if len(args) != 2 {
+			return errors.New(Usage)
+		}
+		sample.Daily = true
+	case "every":
+		if len(args) != 3 {
+			return errors.New(Usage)
+		}
+		every, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("every: %w", err)
+		}
+		sample.Every = every
+	default:
+		return errors.New(Usage)
+	}
+	err := sample.Validate()
+	if err != nil {
+		return err
+	}
+
+	db, err := state.Master(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close() // nolint
+
+	ctx := context.Background()
+	r, err := repository.Read(ctx, args[0], db)
+	if err != nil {
+		return fmt.Errorf("repository %s: %w", args[0], err)
+	}
+
+	points, err := analysis.CreateHistory(ctx, r, "HEAD", sample, db)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "COMMITTED\tCOMMIT\tCODE\tCOMMENT\tBLANK")
+	for _, p := range points {
+		fmt.Fprintf(w, "%s\t%.12s\t%d\t%d\t%d\n",
+			time.Unix(p.Committed, 0).UTC().Format(time.RFC3339),
+			p.Commit,
+			p.Total.Code,
+			p.Total.Comment,
+			p.Total.Blank)
+	}
+	return w.Flush()
+}
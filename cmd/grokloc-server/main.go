@@ -0,0 +1,63 @@
+// Command grokloc-server runs the GrokLOC app server
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/grokloc/grokloc-server/pkg/app/config"
+	"github.com/grokloc/grokloc-server/pkg/env"
+)
+
+// LevelEnv names the run level (UNIT, DEV, STAGE, PROD)
+const LevelEnv = "GROKLOC_ENV"
+
+// Usage describes the command line
+const Usage = `usage:
+  grokloc-server [serve]                serve the api (default)
+  grokloc-server migrate status         list migrations and whether applied
+  grokloc-server migrate up             apply pending migrations
+  grokloc-server migrate down VERSION   revert migrations newer than VERSION
+  grokloc-server history ID daily       store the line counts of the mirrored
+                                        repository ID at one commit per day
+  grokloc-server history ID every N     ... at every Nth commit
+  grokloc-server reencrypt              enqueue a job rewriting users encrypted
+                                        with a retired db key`
+
+func main() {
+	err := run(os.Args[1:])
+	if err != nil {
+		log.Printf("grokloc-server: %v", err)
+		os.Exit(1)
+	}
+}
+
+// run loads the config for the level found in the environment and
+// dispatches to the subcommand in args
+func run(args []string) error {
+	level, err := env.NewLevel(os.Getenv(LevelEnv))
+	if err != nil {
+		return fmt.Errorf("%s: %w", LevelEnv, err)
+	}
+
+	cfg, err := config.Load(level)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	if len(args) == 0 || args[0] == "serve" {
+		return serve(cfg)
+	}
+	if args[0] == "migrate" {
+		return migrateCmd(cfg, args[1:])
+	}
+	if args[0] == "history" {
+		return historyCmd(cfg, args[1:])
+	}
+	if args[0] == "reencrypt" {
+		return reencryptCmd(cfg, args[1:])
+	}
+	return errors.New(Usage)
+}
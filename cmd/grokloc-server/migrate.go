@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/config"
+	"github.com/grokloc/grokloc-server/pkg/app/migrate"
+	"github.com/grokloc/grokloc-server/pkg/app/state"
+)
+
+// migrateCmd runs the migrate subcommand in args against the master db
+func migrateCmd(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(Usage)
+	}
+
+	db, err := state.Master(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close() // nolint
+
+	ctx := context.Background()
+	switch args[0] {
+	case "status":
+	case "up":
+		err = migrate.Up(ctx, db)
+	case "down":
+		if len(args) != 2 {
+			return errors.New(Usage)
+		}
+		version, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			return fmt.Errorf("version: %w", convErr)
+		}
+		err = migrate.Down(ctx, db, app.Migrations, version)
+	default:
+		return errors.New(Usage)
+	}
+	if err != nil {
+		return err
+	}
+
+	statuses, err := migrate.Report(ctx, db, app.Migrations)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, s := range statuses {
+		applied := "pending"
+		if s.Applied {
+			applied = time.Unix(s.AppliedAt, 0).UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/grokloc/grokloc-server/pkg/app/config"
+	"github.com/grokloc/grokloc-server/pkg/app/job"
+	"github.com/grokloc/grokloc-server/pkg/app/state"
+	"github.com/grokloc/grokloc-server/pkg/app/sweep"
+)
+
+// reencryptCmd enqueues a job, run by the serving job pool, that
+// rewrites every user encrypted with a retired db key
+func reencryptCmd(cfg *config.Config, args []string) error {
+	if len(args) != 0 {
+		return errors.New(Usage)
+	}
+
+	st, err := state.FromConfig(cfg)
+	if err != nil {
+		return err
+	}
+	defer st.Close() // nolint
+
+	j, err := job.Enqueue(context.Background(), st.RootOrg, sweep.ReencryptKind, nil, st.Master)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("job %s enqueued to re-encrypt users with db key %s\n", j.ID, st.DBKeys.Current())
+	return nil
+}
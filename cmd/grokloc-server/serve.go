@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/grokloc/grokloc-server/pkg/app/admin/user"
+	"github.com/grokloc/grokloc-server/pkg/app/config"
+	"github.com/grokloc/grokloc-server/pkg/app/job"
+	"github.com/grokloc/grokloc-server/pkg/app/mirror"
+	"github.com/grokloc/grokloc-server/pkg/app/server"
+	"github.com/grokloc/grokloc-server/pkg/app/sweep"
+	"go.uber.org/zap"
+)
+
+// serve builds the server instance for cfg, serves until SIGINT or
+// SIGTERM is received, then drains in-flight requests and closes all
+// db handles
+func serve(cfg *config.Config) error {
+	srv, err := server.NewFromConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("server instance: %w", err)
+	}
+	defer func() {
+		closeErr := srv.ST.Close()
+		if closeErr != nil {
+			zap.L().Error("close state", zap.Error(closeErr))
+		}
+		_ = zap.L().Sync()
+	}()
+
+	zap.L().Info("config", zap.Stringer("config", cfg))
+
+	// passwords still to be rehashed on login; only informational, so
+	// failing to count them does not stop the server
+	legacy, malformed, err := user.LegacyPasswords(context.Background(), srv.ST.Argon2Cfg, srv.ST.Master)
+	if err != nil {
+		zap.L().Error("count legacy passwords", zap.Error(err))
+	} else {
+		user.LegacyPasswordsGauge.Set(int64(legacy))
+		user.MalformedPasswordsGauge.Set(int64(malformed))
+		zap.L().Info("passwords", zap.Int("legacy", legacy), zap.Int("malformed", malformed))
+	}
+
+	// shredded users stay in backups until the db key is retired
+	pending, err := user.PendingShreds(context.Background(), srv.ST.DBKeys, srv.ST.Master)
+	if err != nil {
+		zap.L().Error("count pending shreds", zap.Error(err))
+	} else if pending != 0 {
+		zap.L().Warn("shreds pending db key rotation", zap.Int("users", pending))
+	}
+
+	// bind before serving so a bad address fails at startup
+	ln, err := net.Listen("tcp", cfg.Addr())
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+
+	httpServer := &http.Server{
+		Handler:           srv.Router(),
+		ReadHeaderTimeout: time.Duration(cfg.RequestTimeout),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+
+	// stop background workers, and let them finish, before state is closed
+	var workers sync.WaitGroup
+	defer workers.Wait()
+	defer stop()
+
+	if cfg.SweepInterval > 0 {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			sweep.Run(ctx, srv.ST, time.Duration(cfg.SweepInterval))
+		}()
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			sweep.RunPrune(ctx, srv.ST, time.Duration(cfg.SweepInterval))
+		}()
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			sweep.RunPasswords(ctx, srv.ST, time.Duration(cfg.SweepInterval))
+		}()
+	}
+
+	if cfg.MirrorInterval > 0 {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			mirror.Run(ctx, srv.ST, time.Duration(cfg.MirrorInterval))
+		}()
+	}
+
+	if cfg.JobWorkers > 0 {
+		pool := job.NewPool(cfg.JobWorkers, time.Duration(cfg.JobVisibility))
+		pool.Register(mirror.SyncKind, mirror.SyncJob)
+		pool.Register(mirror.HistoryKind, mirror.HistoryJob)
+		pool.Register(sweep.ReencryptKind, sweep.ReencryptJob)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			pool.Run(ctx, srv.ST)
+		}()
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- httpServer.Serve(ln)
+	}()
+
+	zap.L().Info("serving", zap.String("addr", ln.Addr().String()))
+
+	select {
+	case err = <-serveErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return fmt.Errorf("serve: %w", err)
+	case <-ctx.Done():
+	}
+
+	zap.L().Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	err = httpServer.Shutdown(shutdownCtx)
+	if err != nil {
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	return nil
+}
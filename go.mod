@@ -11,10 +11,26 @@ replace (
 	github.com/grokloc/grokloc-server/pkg/app/admin/user => ./pkg/app/admin/user
 	github.com/grokloc/grokloc-server/pkg/app/admin/user/events => ./pkg/app/admin/user/events
 	github.com/grokloc/grokloc-server/pkg/app/admin/user/testing => ./pkg/app/admin/user/testing
+	github.com/grokloc/grokloc-server/pkg/app/analysis => ./pkg/app/analysis
 	github.com/grokloc/grokloc-server/pkg/app/audit => ./pkg/app/audit
 	github.com/grokloc/grokloc-server/pkg/app/audit/testing => ./pkg/app/audit/testing
+	github.com/grokloc/grokloc-server/pkg/app/config => ./pkg/app/config
+	github.com/grokloc/grokloc-server/pkg/app/contribution => ./pkg/app/contribution
+	github.com/grokloc/grokloc-server/pkg/app/job => ./pkg/app/job
+	github.com/grokloc/grokloc-server/pkg/app/lockout => ./pkg/app/lockout
+	github.com/grokloc/grokloc-server/pkg/app/migrate => ./pkg/app/migrate
+	github.com/grokloc/grokloc-server/pkg/app/mirror => ./pkg/app/mirror
+	github.com/grokloc/grokloc-server/pkg/app/refresh => ./pkg/app/refresh
+	github.com/grokloc/grokloc-server/pkg/app/refresh/testing => ./pkg/app/refresh/testing
+	github.com/grokloc/grokloc-server/pkg/app/repository => ./pkg/app/repository
+	github.com/grokloc/grokloc-server/pkg/app/repository/events => ./pkg/app/repository/events
+	github.com/grokloc/grokloc-server/pkg/app/repository/testing => ./pkg/app/repository/testing
 	github.com/grokloc/grokloc-server/pkg/app/state => ./pkg/app/state
+	github.com/grokloc/grokloc-server/pkg/app/stats => ./pkg/app/stats
+	github.com/grokloc/grokloc-server/pkg/app/sweep => ./pkg/app/sweep
+	github.com/grokloc/grokloc-server/pkg/app/tokenkey => ./pkg/app/tokenkey
 	github.com/grokloc/grokloc-server/pkg/env => ./pkg/env
+	github.com/grokloc/grokloc-server/pkg/git => ./pkg/git
 	github.com/grokloc/grokloc-server/pkg/grokloc => ./pkg/grokloc
 	github.com/grokloc/grokloc-server/pkg/models => ./pkg/models
 	github.com/grokloc/grokloc-server/pkg/safe => ./pkg/safe
@@ -24,7 +24,7 @@ func (c *Controller) Create(ctx context.Context, event events.Create) (*Org, err
 		event.OwnerDisplayName,
 		event.OwnerEmail,
 		event.OwnerPassword,
-		c.state.DBKey,
+		c.state.DBKeys,
 		c.state.Master,
 	)
 
@@ -10,6 +10,7 @@ import (
 	"github.com/grokloc/grokloc-server/pkg/app/admin/user"
 	"github.com/grokloc/grokloc-server/pkg/app/audit"
 	"github.com/grokloc/grokloc-server/pkg/models"
+	"github.com/grokloc/grokloc-server/pkg/security"
 )
 
 // Create instantiates a new owner, inserts it, and inserts a new org
@@ -17,7 +18,7 @@ import (
 func Create(
 	ctx context.Context,
 	name, ownerDisplayName, ownerEmail, ownerPassword string,
-	key []byte,
+	keys *security.Keyring,
 	db *sql.DB) (*Org, error) {
 
 	// generate org id
@@ -31,7 +32,7 @@ func Create(
 		ownerEmail,
 		id,
 		ownerPassword, // assumed derived
-		key)
+		keys)
 	if err != nil {
 		return nil, err
 	}
@@ -122,9 +123,10 @@ func Read(ctx context.Context, id string, db *sql.DB) (*Org, error) {
 		return nil, err
 	}
 
-	if o.Meta.SchemaVersion != Version {
-		// handle migrating different versions, or err
-		return nil, models.ErrModelMigrate
+	// rows at an older schema version are upgraded in memory
+	err = o.upgrade(ctx)
+	if err != nil {
+		return nil, err
 	}
 
 	return o, nil
@@ -72,7 +72,7 @@ func (s *OrgSuite) TestUpdateStatus() {
 		uuid.NewString(), // org owner display name
 		uuid.NewString(), // org owner email
 		ownerPassword,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.Master,
 	)
 	require.Nil(s.T(), err)
@@ -106,7 +106,7 @@ func (s *OrgSuite) TestUpdateOwner() {
 		uuid.NewString(), // org owner display name
 		uuid.NewString(), // org owner email
 		ownerPassword,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.Master,
 	)
 	require.Nil(s.T(), err)
@@ -120,7 +120,7 @@ func (s *OrgSuite) TestUpdateOwner() {
 		uuid.NewString(), // email
 		o.ID,
 		newOwnerPassword,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.Master,
 	)
 	require.Nil(s.T(), err)
@@ -162,7 +162,7 @@ func (s *OrgSuite) TestUpdateOwnerWrongOrg() {
 		uuid.NewString(), // org owner display name
 		uuid.NewString(), // org owner email
 		ownerPassword,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.Master,
 	)
 	require.Nil(s.T(), err)
@@ -173,7 +173,7 @@ func (s *OrgSuite) TestUpdateOwnerWrongOrg() {
 		uuid.NewString(), // org owner display name
 		uuid.NewString(), // org owner email
 		ownerPassword,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.Master,
 	)
 	require.Nil(s.T(), err)
@@ -199,7 +199,7 @@ func (s *OrgSuite) TestUpdateOwnerMissing() {
 		uuid.NewString(), // org owner display name
 		uuid.NewString(), // org owner email
 		ownerPassword,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.Master,
 	)
 	require.Nil(s.T(), err)
@@ -226,7 +226,7 @@ func (s *OrgSuite) TestDuplicateInsert() {
 		uuid.NewString(), // org owner display name
 		uuid.NewString(), // org owner email
 		ownerPassword,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.Master,
 	)
 	require.Nil(s.T(), err)
@@ -239,7 +239,7 @@ func (s *OrgSuite) TestDuplicateInsert() {
 		uuid.NewString(), // org owner display name
 		uuid.NewString(), // org owner email
 		ownerPassword2,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.Master,
 	)
 	require.Equal(s.T(), models.ErrConflict, err)
@@ -281,7 +281,7 @@ func (s *OrgSuite) TestUpdateOwnerEvent() {
 		uuid.NewString(), // org owner display name
 		uuid.NewString(), // org owner email
 		uuid.NewString(), // org owner password
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.Master,
 	)
 	require.Nil(s.T(), err)
@@ -296,7 +296,7 @@ func (s *OrgSuite) TestUpdateOwnerEvent() {
 		uuid.NewString(), // email
 		o.ID,
 		newOwnerPassword,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.Master,
 	)
 	require.Nil(s.T(), err)
@@ -369,6 +369,71 @@ func (s *OrgSuite) TestUpdateStatusEvent() {
 	require.Equal(s.T(), models.StatusInactive, oUpdate.Meta.Status)
 }
 
+func (s *OrgSuite) TestUpgrade() {
+	ctx := context.Background()
+	org.RegisterUpgrade(-1, func(ctx context.Context, o *org.Org) error {
+		o.Name = o.Name + "-upgraded"
+		return nil
+	})
+
+	ownerPassword, err := security.DerivePassword(uuid.NewString(), s.st.Argon2Cfg)
+	require.Nil(s.T(), err)
+
+	o, err := org.Create(
+		ctx,
+		uuid.NewString(), // org name
+		uuid.NewString(), // org owner display name
+		uuid.NewString(), // org owner email
+		ownerPassword,
+		s.st.DBKeys,
+		s.st.Master,
+	)
+	require.Nil(s.T(), err)
+
+	err = models.Update(ctx, app.OrgsTableName, o.ID, "schema_version", -1, s.st.Master)
+	require.Nil(s.T(), err)
+
+	// read upgrades in memory only
+	o_read, err := org.Read(ctx, o.ID, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), org.Version, o_read.Meta.SchemaVersion)
+	require.Equal(s.T(), o.Name+"-upgraded", o_read.Name)
+	var stored int
+	err = s.st.Master.QueryRow(`select schema_version from orgs where id = ?`, o.ID).Scan(&stored)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), -1, stored)
+
+	// migrate writes back
+	migrated, err := org.Migrate(ctx, o.ID, s.st.Master)
+	require.Nil(s.T(), err)
+	require.True(s.T(), migrated)
+	err = s.st.Master.QueryRow(`select schema_version from orgs where id = ?`, o.ID).Scan(&stored)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), org.Version, stored)
+	o_read, err = org.Read(ctx, o.ID, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), o.Name+"-upgraded", o_read.Name)
+
+	migrated, err = org.Migrate(ctx, o.ID, s.st.Master)
+	require.Nil(s.T(), err)
+	require.False(s.T(), migrated)
+
+	// no upgrade registered
+	err = models.Update(ctx, app.OrgsTableName, o.ID, "schema_version", -2, s.st.Master)
+	require.Nil(s.T(), err)
+	_, err = org.Read(ctx, o.ID, s.st.Master)
+	require.Equal(s.T(), models.ErrModelMigrate, err)
+
+	// newer than this code
+	err = models.Update(ctx, app.OrgsTableName, o.ID, "schema_version", org.Version+1, s.st.Master)
+	require.Nil(s.T(), err)
+	_, err = org.Read(ctx, o.ID, s.st.Master)
+	require.Equal(s.T(), models.ErrModelMigrate, err)
+
+	err = models.Update(ctx, app.OrgsTableName, o.ID, "schema_version", org.Version, s.st.Master)
+	require.Nil(s.T(), err)
+}
+
 func TestOrgSuite(t *testing.T) {
 	suite.Run(t, new(OrgSuite))
 }
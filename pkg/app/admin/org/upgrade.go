@@ -0,0 +1,97 @@
+package org
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/models"
+)
+
+// Upgrade transforms an org read at schema version v into version v+1,
+// in memory only
+type Upgrade func(ctx context.Context, o *Org) error
+
+// upgrades maps a schema version to the Upgrade from that version
+var upgrades = map[int]Upgrade{}
+
+// RegisterUpgrade sets the Upgrade for orgs at schema version from
+//
+// Call from init; registration is not synchronized with reads
+func RegisterUpgrade(from int, f Upgrade) {
+	upgrades[from] = f
+}
+
+// upgrade applies registered upgrades until o is at Version
+func (o *Org) upgrade(ctx context.Context) error {
+	if o.Meta.SchemaVersion > Version {
+		return models.ErrModelMigrate
+	}
+	for o.Meta.SchemaVersion < Version {
+		f, ok := upgrades[o.Meta.SchemaVersion]
+		if !ok {
+			return models.ErrModelMigrate
+		}
+		err := f(ctx, o)
+		if err != nil {
+			return err
+		}
+		o.Meta.SchemaVersion++
+	}
+	return nil
+}
+
+// Migrate reads the org with id (upgrading it in memory) and, if it was
+// stored at an older schema version, writes the upgraded org back
+//
+// Returns true if the row was rewritten
+func Migrate(ctx context.Context, id string, db *sql.DB) (bool, error) {
+	q := fmt.Sprintf(`select schema_version from %s where id = ?`, app.OrgsTableName)
+	var stored int
+	err := db.QueryRowContext(ctx, q, id).Scan(&stored)
+	if err != nil {
+		return false, err
+	}
+	if stored == Version {
+		return false, nil
+	}
+
+	o, err := Read(ctx, id, db)
+	if err != nil {
+		return false, err
+	}
+
+	// only overwrite the version that was upgraded
+	q = fmt.Sprintf(`update %s
+                         set name = ?,
+                         owner = ?,
+                         status = ?,
+                         schema_version = ?
+                         where id = ?
+                         and schema_version = ?`,
+		app.OrgsTableName)
+
+	result, err := db.ExecContext(ctx,
+		q,
+		o.Name,
+		o.Owner,
+		o.Meta.Status,
+		o.Meta.SchemaVersion,
+		o.ID,
+		stored)
+	if err != nil {
+		return false, err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if updated != 1 {
+		return false, models.ErrRowsAffected
+	}
+
+	return true, nil
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/grokloc/grokloc-server/pkg/app"
 	"github.com/grokloc/grokloc-server/pkg/app/admin/user/events"
+	"github.com/grokloc/grokloc-server/pkg/app/refresh"
 	"github.com/grokloc/grokloc-server/pkg/models"
 	"github.com/grokloc/grokloc-server/pkg/security"
 )
@@ -25,7 +26,7 @@ func (c *Controller) Create(ctx context.Context, event events.Create) (*User, er
 		event.Email,
 		event.Org,
 		event.Password,
-		c.state.DBKey,
+		c.state.DBKeys,
 		c.state.Master,
 	)
 
@@ -37,7 +38,7 @@ func (c *Controller) Create(ctx context.Context, event events.Create) (*User, er
 }
 
 func (c *Controller) Read(ctx context.Context, id string) (*User, error) {
-	return Read(ctx, id, c.state.DBKey, c.state.RandomReplica())
+	return Read(ctx, id, c.state.DBKeys, c.state.RandomReplica())
 }
 
 func (c *Controller) UpdateDisplayName(ctx context.Context, event events.UpdateDisplayName) (*User, error) {
@@ -53,7 +54,7 @@ func (c *Controller) UpdateDisplayName(ctx context.Context, event events.UpdateD
 		return nil, models.ErrNotFound
 	}
 
-	err = user.UpdateDisplayName(ctx, event.DisplayName, c.state.DBKey, c.state.Master)
+	err = user.UpdateDisplayName(ctx, event.DisplayName, c.state.DBKeys, c.state.Master)
 	if err != nil {
 		return nil, err
 	}
@@ -91,6 +92,27 @@ func (c *Controller) UpdatePassword(ctx context.Context, event events.UpdatePass
 	return user, nil
 }
 
+func (c *Controller) RotateAPISecret(ctx context.Context, event events.RotateAPISecret) (*User, error) {
+
+	user, err := c.Read(ctx, event.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// no user found with ID
+	if user == nil {
+		return nil, models.ErrNotFound
+	}
+
+	err = user.RotateAPISecret(ctx, event.Grace, c.state.DBKeys, c.state.Master)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
 func (c *Controller) UpdateStatus(ctx context.Context, event events.UpdateStatus) (*User, error) {
 
 	user, err := c.Read(ctx, event.ID)
@@ -109,5 +131,13 @@ func (c *Controller) UpdateStatus(ctx context.Context, event events.UpdateStatus
 		return nil, err
 	}
 
+	// end the sessions of users that can no longer sign in
+	if event.Status != models.StatusActive {
+		err = refresh.RevokeUser(ctx, user.ID, c.state.Master)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return user, nil
 }
@@ -0,0 +1,219 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/audit"
+	"github.com/grokloc/grokloc-server/pkg/app/refresh"
+	"github.com/grokloc/grokloc-server/pkg/models"
+	"github.com/grokloc/grokloc-server/pkg/security"
+)
+
+// Each user has a random data key, stored in UserKeysTableName encrypted
+// with the db keyring, that encrypts their api secret, display name and
+// email. The data key has the user ID as its key ID
+//
+// Destroying the stored data key (see Shred) erases those fields from
+// the live db at once. Backups taken before the shred still hold the
+// stored data key, encrypted with the db key of the time, so the fields
+// are only erased from them once that db key is rotated, every stored
+// value is re-encrypted (see sweep.ReencryptJob), and the key is dropped
+// from the retired keys. Until then the shred is pending; see
+// PendingShreds
+//
+// Users created before data keys have none until Reencrypt gives them
+// one; until then their fields are encrypted with the db keyring
+
+// newDataKey returns a random data key for the user with id, as keys with
+// the data key added as the current key, along with the data key
+// encrypted with keys and its digest, for storage
+func newDataKey(id string, keys *security.Keyring) (*security.Keyring, string, string, error) {
+	bs := make([]byte, security.KeyLen)
+	_, err := rand.Read(bs)
+	if err != nil {
+		return nil, "", "", err
+	}
+	encoded := hex.EncodeToString(bs)
+	encrypted, err := keys.Encrypt(encoded)
+	if err != nil {
+		return nil, "", "", err
+	}
+	userKeys, err := keys.With(id, bs)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return userKeys, encrypted, security.EncodedSHA256(encoded), nil
+}
+
+// dataKeyring returns keys with the stored data key of the user with id
+// added as the current key
+func dataKeyring(id, encrypted, digest string, keys *security.Keyring) (*security.Keyring, error) {
+	encoded, err := keys.Decrypt(encrypted, digest)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return keys.With(id, bs)
+}
+
+// readKeyring returns the keyring for the fields of the user with id:
+// keys with the user data key added as the current key, or just keys if
+// the user has no data key
+func readKeyring(ctx context.Context, id string, keys *security.Keyring, db *sql.DB) (*security.Keyring, error) {
+	q := fmt.Sprintf(`select key, key_digest from %s where user = ?`, app.UserKeysTableName)
+	var encrypted, digest string
+	err := db.QueryRowContext(ctx, q, id).Scan(&encrypted, &digest)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return keys, nil
+		}
+		return nil, err
+	}
+	return dataKeyring(id, encrypted, digest, keys)
+}
+
+// insertDataKey stores the encrypted data key of the user with id
+func insertDataKey(ctx context.Context, id, encrypted, digest string, tx *sql.Tx) error {
+	q := fmt.Sprintf(`insert into %s
+                          (user,
+                           key,
+                           key_digest)
+                          values
+                          (?,?,?)`,
+		app.UserKeysTableName)
+	_, err := tx.ExecContext(ctx, q, id, encrypted, digest)
+	return err
+}
+
+// Shred destroys the data key of the user, erasing their api secret,
+// display name and email; the user is made inactive, and then reads as
+// sql.ErrNoRows
+//
+// The digests of the erased fields are replaced so that they cannot be
+// matched against guesses. A user without a data key cannot be shredded
+// and returns models.ErrRowsAffected
+//
+// Their email is also erased from the contributions to repositories of
+// their org, which are not encrypted with the data key; its digest, keyed
+// with digestKey as by contribution.EmailDigest, is recorded so that it
+// is not stored again when contributions are next analyzed
+//
+// The id of the db key that encrypted the data key is recorded, as the
+// fields can be recovered from backups until that key is retired; see
+// PendingShreds. The sessions of the user are then revoked
+func (u *User) Shred(ctx context.Context, digestKey []byte, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint
+
+	q := fmt.Sprintf(`select key from %s where user = ?`, app.UserKeysTableName)
+	var encrypted string
+	err = tx.QueryRowContext(ctx, q, u.ID).Scan(&encrypted)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return models.ErrRowsAffected
+		}
+		return err
+	}
+
+	q = fmt.Sprintf(`delete from %s where user = ?`, app.UserKeysTableName)
+	_, err = tx.ExecContext(ctx, q, u.ID)
+	if err != nil {
+		return err
+	}
+
+	contributionDigest := security.EncodedHMAC(u.Email, digestKey)
+	q = fmt.Sprintf(`insert into %s (user, key_id, email_digest) values (?,?,?)`, app.UserShredsTableName)
+	_, err = tx.ExecContext(ctx, q, u.ID, security.KeyID(encrypted), contributionDigest)
+	if err != nil {
+		return err
+	}
+
+	q = fmt.Sprintf(`update %s set email = ''
+                         where email_digest = ?
+                         and repository in (select id from %s where org = ?)`,
+		app.ContributionsTableName,
+		app.RepositoriesTableName)
+	_, err = tx.ExecContext(ctx, q, contributionDigest, u.Org)
+	if err != nil {
+		return err
+	}
+
+	q = fmt.Sprintf(`update %s
+                         set api_secret_digest = ?,
+                         display_name_digest = ?,
+                         email_digest = ?,
+                         status = ?
+                         where id = ?`,
+		app.UsersTableName)
+	_, err = tx.ExecContext(ctx, q,
+		security.EncodedSHA256(uuid.NewString()),
+		security.EncodedSHA256(uuid.NewString()),
+		security.EncodedSHA256(uuid.NewString()),
+		models.StatusInactive,
+		u.ID)
+	if err != nil {
+		return err
+	}
+
+	q = fmt.Sprintf(`delete from %s where user = ?`, app.APISecretGraceTableName)
+	_, err = tx.ExecContext(ctx, q, u.ID)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	u.APISecret, u.APISecretDigest = "", ""
+	u.DisplayName, u.DisplayNameDigest = "", ""
+	u.Email, u.EmailDigest = "", ""
+	u.Meta.Status = models.StatusInactive
+
+	_ = audit.Insert(ctx, audit.USER_SHRED, app.UsersTableName, u.ID, db)
+
+	return refresh.RevokeUser(ctx, u.ID, db)
+}
+
+// PendingShreds returns the number of shredded users whose data key was
+// encrypted with a db key still in keys, so that backups taken before
+// they were shredded can still recover their fields
+//
+// Shreds stop being pending once the db key is rotated, stored values
+// are re-encrypted, and the old key is dropped from the retired keys.
+// Keys retired before a shred are assumed to have been dropped with it
+func PendingShreds(ctx context.Context, keys *security.Keyring, db *sql.DB) (int, error) {
+	q := fmt.Sprintf(`select key_id, count(*) from %s group by key_id`, app.UserShredsTableName)
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	pending := 0
+	for rows.Next() {
+		var keyID string
+		var count int
+		err = rows.Scan(&keyID, &count)
+		if err != nil {
+			return 0, err
+		}
+		if keys.Has(keyID) {
+			pending += count
+		}
+	}
+	return pending, rows.Err()
+}
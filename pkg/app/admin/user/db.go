@@ -4,17 +4,26 @@ package user
 import (
 	"context"
 	"database/sql"
+	"expvar"
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/grokloc/grokloc-server/pkg/app"
 	"github.com/grokloc/grokloc-server/pkg/app/audit"
 	"github.com/grokloc/grokloc-server/pkg/models"
 	"github.com/grokloc/grokloc-server/pkg/security"
+	"github.com/matthewhartstonge/argon2"
 )
 
 func (u User) Insert(ctx context.Context, db *sql.DB) error {
 
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint
+
 	q := fmt.Sprintf(`insert into %s
                           (id,
                            api_secret,
@@ -31,7 +40,7 @@ func (u User) Insert(ctx context.Context, db *sql.DB) error {
                           (?,?,?,?,?,?,?,?,?,?,?)`,
 		app.UsersTableName)
 
-	result, err := db.ExecContext(ctx,
+	result, err := tx.ExecContext(ctx,
 		q,
 		u.ID,
 		u.APISecret,
@@ -61,6 +70,18 @@ func (u User) Insert(ctx context.Context, db *sql.DB) error {
 		return models.ErrRowsAffected
 	}
 
+	if len(u.dataKey) != 0 {
+		err = insertDataKey(ctx, u.ID, u.dataKey, u.dataKeyDigest, tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
 	_ = audit.Insert(ctx, audit.USER_INSERT, app.UsersTableName, u.ID, db)
 
 	return nil
@@ -74,7 +95,7 @@ func Create(
 	email,
 	org,
 	password string,
-	key []byte,
+	keys *security.Keyring,
 	db *sql.DB) (*User, error) {
 
 	// check that org exists and is active
@@ -97,7 +118,7 @@ func Create(
 	}
 
 	// generate encrypted user
-	u, err := Encrypted(ctx, displayName, email, org, password, key)
+	u, err := Encrypted(ctx, displayName, email, org, password, keys)
 	if err != nil {
 		return nil, err
 	}
@@ -108,7 +129,7 @@ func Create(
 		return nil, err
 	}
 
-	user, err := Read(ctx, u.ID, key, db)
+	user, err := Read(ctx, u.ID, keys, db)
 	if err != nil {
 		return nil, err
 	}
@@ -116,29 +137,36 @@ func Create(
 	return user, nil
 }
 
-// Encrypted creates a new user that can be inserted
+// Encrypted creates a new user that can be inserted, with fields
+// encrypted with a new data key
 func Encrypted(
 	ctx context.Context,
 	displayName, email, org, password string,
-	key []byte) (*User, error) {
+	keys *security.Keyring) (*User, error) {
+
+	id := uuid.NewString()
+	userKeys, dataKey, dataKeyDigest, err := newDataKey(id, keys)
+	if err != nil {
+		return nil, err
+	}
 
 	apiSecret := uuid.NewString()
-	apiSecretEncrypted, err := security.Encrypt(apiSecret, key)
+	apiSecretEncrypted, err := userKeys.Encrypt(apiSecret)
 	if err != nil {
 		return nil, err
 	}
-	displayNameEncrypted, err := security.Encrypt(displayName, key)
+	displayNameEncrypted, err := userKeys.Encrypt(displayName)
 	if err != nil {
 		return nil, err
 	}
-	emailEncrypted, err := security.Encrypt(email, key)
+	emailEncrypted, err := userKeys.Encrypt(email)
 	if err != nil {
 		return nil, err
 	}
 
 	return &User{
 		Base: models.Base{
-			ID: uuid.NewString(),
+			ID: id,
 			Meta: models.Meta{
 				SchemaVersion: Version,
 				Status:        models.StatusUnconfirmed,
@@ -153,32 +181,42 @@ func Encrypted(
 		EmailDigest:       security.EncodedSHA256(email),
 		Org:               org,
 		Password:          password,
+		dataKey:           dataKey,
+		dataKeyDigest:     dataKeyDigest,
 	}, nil
 }
 
-func Read(ctx context.Context, id string, key []byte, db *sql.DB) (*User, error) {
+// Read reads the user with id
+//
+// A user whose data key was destroyed by Shred reads as sql.ErrNoRows
+func Read(ctx context.Context, id string, keys *security.Keyring, db *sql.DB) (*User, error) {
 
 	q := fmt.Sprintf(`select
-                          api_secret,
-                          api_secret_digest,
-                          display_name,
-                          display_name_digest,
-                          email,
-                          email_digest,
-                          org,
-                          password,
-                          ctime,
-                          mtime,
-                          status,
-                          schema_version
-                          from %s
-                          where id = ?`,
-		app.UsersTableName)
+                          u.api_secret,
+                          u.api_secret_digest,
+                          u.display_name,
+                          u.display_name_digest,
+                          u.email,
+                          u.email_digest,
+                          u.org,
+                          u.password,
+                          u.ctime,
+                          u.mtime,
+                          u.status,
+                          u.schema_version,
+                          coalesce(k.key, ''),
+                          coalesce(k.key_digest, '')
+                          from %s u
+                          left join %s k on k.user = u.id
+                          where u.id = ?`,
+		app.UsersTableName,
+		app.UserKeysTableName)
 
 	var statusRaw int
 	u := &User{}
 	u.ID = id
 	var encryptedAPISecret, encryptedDisplayName, encryptedEmail string
+	var dataKey, dataKeyDigest string
 
 	err := db.QueryRowContext(ctx, q, id).Scan(
 		&encryptedAPISecret,
@@ -192,22 +230,35 @@ func Read(ctx context.Context, id string, key []byte, db *sql.DB) (*User, error)
 		&u.Meta.Ctime,
 		&u.Meta.Mtime,
 		&statusRaw,
-		&u.Meta.SchemaVersion)
+		&u.Meta.SchemaVersion,
+		&dataKey,
+		&dataKeyDigest)
 	if err != nil {
 		return nil, err
 	}
 
-	u.APISecret, err = security.Decrypt(encryptedAPISecret, u.APISecretDigest, key)
+	userKeys := keys
+	if len(dataKey) != 0 {
+		userKeys, err = dataKeyring(id, dataKey, dataKeyDigest, keys)
+		if err != nil {
+			return nil, err
+		}
+	} else if security.KeyID(encryptedEmail) == id {
+		// encrypted with a data key that was destroyed
+		return nil, sql.ErrNoRows
+	}
+
+	u.APISecret, err = userKeys.Decrypt(encryptedAPISecret, u.APISecretDigest)
 	if err != nil {
 		return nil, err
 	}
 
-	u.DisplayName, err = security.Decrypt(encryptedDisplayName, u.DisplayNameDigest, key)
+	u.DisplayName, err = userKeys.Decrypt(encryptedDisplayName, u.DisplayNameDigest)
 	if err != nil {
 		return nil, err
 	}
 
-	u.Email, err = security.Decrypt(encryptedEmail, u.EmailDigest, key)
+	u.Email, err = userKeys.Decrypt(encryptedEmail, u.EmailDigest)
 	if err != nil {
 		return nil, err
 	}
@@ -217,22 +268,43 @@ func Read(ctx context.Context, id string, key []byte, db *sql.DB) (*User, error)
 		return nil, err
 	}
 
-	if u.Meta.SchemaVersion != Version {
-		// handle migrating different versions, or err
-		return nil, models.ErrModelMigrate
+	// rows at an older schema version are upgraded in memory
+	err = u.upgrade(ctx)
+	if err != nil {
+		return nil, err
 	}
 
 	return u, nil
 }
 
+// ReadByEmail reads the user with email in org
+//
+// sql.ErrNoRows is returned if org has no such user
+func ReadByEmail(ctx context.Context, org, email string, keys *security.Keyring, db *sql.DB) (*User, error) {
+	q := fmt.Sprintf(`select id from %s where email_digest = ? and org = ?`,
+		app.UsersTableName)
+
+	var id string
+	err := db.QueryRowContext(ctx, q, security.EncodedSHA256(email), org).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	return Read(ctx, id, keys, db)
+}
+
 // UpdateDisplayName sets the user display name
 func (u *User) UpdateDisplayName(ctx context.Context,
 	displayName string,
-	key []byte,
+	keys *security.Keyring,
 	db *sql.DB) error {
 
+	userKeys, err := readKeyring(ctx, u.ID, keys, db)
+	if err != nil {
+		return err
+	}
+
 	// both the display name and the digest must be reset
-	encryptedDisplayName, err := security.Encrypt(displayName, key)
+	encryptedDisplayName, err := userKeys.Encrypt(displayName)
 	if err != nil {
 		return err
 	}
@@ -278,15 +350,71 @@ func (u *User) UpdatePassword(ctx context.Context,
 	password string,
 	db *sql.DB) error {
 
+	return u.updatePassword(ctx, password, audit.USER_PASSWORD, db)
+}
+
+// RehashPassword sets the user password to the same password derived
+// again with stronger parameters
+// password assumed derived
+func (u *User) RehashPassword(ctx context.Context,
+	password string,
+	db *sql.DB) error {
+
+	return u.updatePassword(ctx, password, audit.USER_PASSWORD_REHASH, db)
+}
+
+// updatePassword sets the user password, audited as code
+func (u *User) updatePassword(ctx context.Context,
+	password string,
+	code int,
+	db *sql.DB) error {
+
 	err := models.Update(ctx, app.UsersTableName, u.ID, "password", password, db)
 	if err == nil {
 		u.Password = password
-		_ = audit.Insert(ctx, audit.USER_PASSWORD, app.UsersTableName, u.ID, db)
+		_ = audit.Insert(ctx, code, app.UsersTableName, u.ID, db)
 	}
 
 	return err
 }
 
+// Gauges of the counts returned by LegacyPasswords, published with
+// expvar
+var (
+	LegacyPasswordsGauge    = expvar.NewInt("legacy_passwords")
+	MalformedPasswordsGauge = expvar.NewInt("malformed_passwords")
+)
+
+// LegacyPasswords returns the number of users with a password derived
+// with parameters weaker than cfg, see security.NeedsRehash, and the
+// number with a password that cannot be decoded at all
+func LegacyPasswords(ctx context.Context, cfg argon2.Config, db *sql.DB) (int, int, error) {
+	q := fmt.Sprintf(`select password from %s`, app.UsersTableName)
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	legacy, malformed := 0, 0
+	for rows.Next() {
+		var password string
+		err = rows.Scan(&password)
+		if err != nil {
+			return 0, 0, err
+		}
+		rehash, err := security.NeedsRehash(password, cfg)
+		if err != nil {
+			malformed++
+			continue
+		}
+		if rehash {
+			legacy++
+		}
+	}
+	return legacy, malformed, rows.Err()
+}
+
 // UpdateStatus sets the user status
 func (u *User) UpdateStatus(ctx context.Context,
 	status models.Status,
@@ -305,3 +433,110 @@ func (u *User) UpdateStatus(ctx context.Context,
 
 	return err
 }
+
+// tokenRequestDigest is the stored form of the token request for id
+// and apiSecret; the request itself is a credential
+func tokenRequestDigest(id, apiSecret string) string {
+	return security.EncodedSHA256(security.EncodedSHA256(id + apiSecret))
+}
+
+// RotateAPISecret replaces the user api secret with a new one
+//
+// The token request for the old api secret is still accepted by
+// VerifyTokenRequest for grace seconds; a grace of 0 also ends the
+// grace period of any earlier secrets
+func (u *User) RotateAPISecret(ctx context.Context,
+	grace int64,
+	keys *security.Keyring,
+	db *sql.DB) error {
+
+	userKeys, err := readKeyring(ctx, u.ID, keys, db)
+	if err != nil {
+		return err
+	}
+
+	apiSecret := uuid.NewString()
+	apiSecretEncrypted, err := userKeys.Encrypt(apiSecret)
+	if err != nil {
+		return err
+	}
+	apiSecretDigest := security.EncodedSHA256(apiSecret)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint
+
+	q := fmt.Sprintf(`update %s
+                          set api_secret = ?,
+                          api_secret_digest = ?
+                          where id = ?`,
+		app.UsersTableName)
+	result, err := tx.ExecContext(ctx, q, apiSecretEncrypted, apiSecretDigest, u.ID)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if updated != 1 {
+		return models.ErrRowsAffected
+	}
+
+	// drop expired grace periods, or all of them if there is no grace
+	now := time.Now().Unix()
+	q = fmt.Sprintf(`delete from %s where user = ? and (expires <= ? or ? = 0)`,
+		app.APISecretGraceTableName)
+	_, err = tx.ExecContext(ctx, q, u.ID, now, grace)
+	if err != nil {
+		return err
+	}
+	if grace > 0 {
+		q = fmt.Sprintf(`insert into %s
+                                 (user,
+                                  digest,
+                                  expires)
+                                 values
+                                 (?,?,?)`,
+			app.APISecretGraceTableName)
+		_, err = tx.ExecContext(ctx, q, u.ID, tokenRequestDigest(u.ID, u.APISecret), now+grace)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	u.APISecret = apiSecret
+	u.APISecretDigest = apiSecretDigest
+
+	_ = audit.Insert(ctx, audit.USER_API_SECRET, app.UsersTableName, u.ID, db)
+
+	return nil
+}
+
+// VerifyTokenRequest reports whether request is the token request for
+// the user api secret, or for a rotated api secret in its grace period
+func (u *User) VerifyTokenRequest(ctx context.Context, request string, db *sql.DB) (bool, error) {
+	if request == security.EncodedSHA256(u.ID+u.APISecret) {
+		return true, nil
+	}
+
+	q := fmt.Sprintf(`select count(*) from %s where user = ? and digest = ? and expires > ?`,
+		app.APISecretGraceTableName)
+	var count int
+	err := db.QueryRowContext(ctx, q,
+		u.ID,
+		security.EncodedSHA256(request),
+		time.Now().Unix()).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count != 0, nil
+}
@@ -0,0 +1,65 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/grokloc/grokloc-server/pkg/models"
+	"github.com/grokloc/grokloc-server/pkg/safe"
+)
+
+// MaxAPISecretGrace is the longest time, in seconds, a rotated api
+// secret can remain valid
+const MaxAPISecretGrace = 7 * 86400
+
+type RotateAPISecret struct {
+	ID string `json:"id"`
+	// Grace is how long, in seconds, the old api secret remains valid;
+	// 0 invalidates it immediately
+	Grace int64 `json:"grace"`
+}
+
+func (e *RotateAPISecret) UnmarshalJSON(bs []byte) error {
+	// clone type for a default unmarshal
+	type rotateAPISecretEvent_ RotateAPISecret
+	var e_ rotateAPISecretEvent_
+	err := json.Unmarshal(bs, &e_)
+	if err != nil {
+		return err
+	}
+
+	// use the fields from the default unmarshal to try to
+	// construct a RotateAPISecret
+	n, err := NewRotateAPISecret(
+		context.Background(),
+		e_.ID,
+		e_.Grace,
+	)
+	if err != nil {
+		return err
+	}
+
+	e.ID = n.ID
+	e.Grace = n.Grace
+	return nil
+}
+
+func NewRotateAPISecret(
+	ctx context.Context,
+	id string,
+	grace int64) (*RotateAPISecret, error) {
+
+	idErr := safe.IDIs(id)
+	if idErr != nil {
+		return nil, idErr
+	}
+
+	if grace < 0 || grace > MaxAPISecretGrace {
+		return nil, models.ErrDisallowedValue
+	}
+
+	return &RotateAPISecret{
+		ID:    id,
+		Grace: grace,
+	}, nil
+}
@@ -0,0 +1,42 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type RotateAPISecretSuite struct {
+	suite.Suite
+}
+
+func (s *RotateAPISecretSuite) TestUnmarshalRotateAPISecretEvent() {
+	id := uuid.NewString()
+	bs := []byte(fmt.Sprintf(`{"id":"%s","grace":3600}`, id))
+	var e RotateAPISecret
+	require.NoError(s.T(), json.Unmarshal(bs, &e))
+	require.Equal(s.T(), int64(3600), e.Grace)
+
+	// grace is optional
+	bs = []byte(fmt.Sprintf(`{"id":"%s"}`, id))
+	require.NoError(s.T(), json.Unmarshal(bs, &e))
+	require.Equal(s.T(), int64(0), e.Grace)
+
+	// has empty id
+	bs = []byte(`{"id":"","grace":0}`)
+	require.Error(s.T(), json.Unmarshal(bs, &e))
+
+	// grace out of range
+	bs = []byte(fmt.Sprintf(`{"id":"%s","grace":-1}`, id))
+	require.Error(s.T(), json.Unmarshal(bs, &e))
+	bs = []byte(fmt.Sprintf(`{"id":"%s","grace":%d}`, id, MaxAPISecretGrace+1))
+	require.Error(s.T(), json.Unmarshal(bs, &e))
+}
+
+func TestRotateAPISecretSuite(t *testing.T) {
+	suite.Run(t, new(RotateAPISecretSuite))
+}
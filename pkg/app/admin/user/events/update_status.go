@@ -9,6 +9,11 @@ import (
 // UpdateStatus is identical to, and operates identically to, the org event
 type UpdateStatus org_event.UpdateStatus
 
+func (e *UpdateStatus) UnmarshalJSON(bs []byte) error {
+	// the defined type does not inherit the org event's validation
+	return (*org_event.UpdateStatus)(e).UnmarshalJSON(bs)
+}
+
 func NewUpdateStatus(
 	ctx context.Context,
 	id string,
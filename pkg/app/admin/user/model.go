@@ -14,6 +14,10 @@ type User struct {
 	Org               string `json:"org"`
 	// Password is assumed initialized as derived
 	Password string `json:"-"`
+	// dataKey and dataKeyDigest are the encrypted data key set by
+	// Encrypted, stored by Insert
+	dataKey       string
+	dataKeyDigest string
 }
 
 const Version = 0
@@ -0,0 +1,203 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/security"
+)
+
+// StaleKeyIDs returns, in order, up to limit ids greater than after of
+// users with a column not encrypted with their data key, or with a data
+// key not encrypted with the current key of keys
+func StaleKeyIDs(ctx context.Context, after string, limit int, keys *security.Keyring, db *sql.DB) ([]string, error) {
+	prefix := keys.Prefix()
+	q := fmt.Sprintf(`select u.id from %s u
+                          left join %s k on k.user = u.id
+                          where u.id > ?
+                          and (substr(u.api_secret, 1, length(u.id) + 1) != (u.id || ?)
+                               or substr(u.display_name, 1, length(u.id) + 1) != (u.id || ?)
+                               or substr(u.email, 1, length(u.id) + 1) != (u.id || ?)
+                               or substr(k.key, 1, ?) != ?)
+                          order by u.id
+                          limit ?`,
+		app.UsersTableName,
+		app.UserKeysTableName)
+	sep := security.KeyIDSep
+	rows, err := db.QueryContext(ctx, q,
+		after,
+		sep,
+		sep,
+		sep,
+		len(prefix), prefix,
+		limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Reencrypt rewrites the encrypted columns of the user with id under
+// their data key, creating one if there is none, and rewrites the data
+// key under the current key of keys
+//
+// Rows are only overwritten if they are unchanged since they were read;
+// returns true if anything was rewritten
+func Reencrypt(ctx context.Context, id string, keys *security.Keyring, db *sql.DB) (bool, error) {
+	q := fmt.Sprintf(`select
+                          u.api_secret,
+                          u.api_secret_digest,
+                          u.display_name,
+                          u.display_name_digest,
+                          u.email,
+                          u.email_digest,
+                          coalesce(k.key, ''),
+                          coalesce(k.key_digest, '')
+                          from %s u
+                          left join %s k on k.user = u.id
+                          where u.id = ?`,
+		app.UsersTableName,
+		app.UserKeysTableName)
+	var stored, digests [3]string
+	var dataKey, dataKeyDigest string
+	err := db.QueryRowContext(ctx, q, id).Scan(
+		&stored[0],
+		&digests[0],
+		&stored[1],
+		&digests[1],
+		&stored[2],
+		&digests[2],
+		&dataKey,
+		&dataKeyDigest)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback() // nolint
+
+	var userKeys *security.Keyring
+	changed := false
+	switch {
+	case len(dataKey) == 0:
+		if security.KeyID(stored[2]) == id {
+			// encrypted with a data key that was destroyed
+			return false, nil
+		}
+		var encrypted, digest string
+		userKeys, encrypted, digest, err = newDataKey(id, keys)
+		if err != nil {
+			return false, err
+		}
+		err = insertDataKey(ctx, id, encrypted, digest, tx)
+		if err != nil {
+			return false, err
+		}
+		changed = true
+	default:
+		userKeys, err = dataKeyring(id, dataKey, dataKeyDigest, keys)
+		if err != nil {
+			return false, err
+		}
+		if !keys.Stale(dataKey) {
+			break
+		}
+		encoded, err := keys.Decrypt(dataKey, dataKeyDigest)
+		if err != nil {
+			return false, err
+		}
+		encrypted, err := keys.Encrypt(encoded)
+		if err != nil {
+			return false, err
+		}
+		q = fmt.Sprintf(`update %s set key = ? where user = ? and key = ?`, app.UserKeysTableName)
+		result, err := tx.ExecContext(ctx, q, encrypted, id, dataKey)
+		if err != nil {
+			return false, err
+		}
+		updated, err := result.RowsAffected()
+		if err != nil {
+			// the db does not support a basic feature
+			panic("cannot exec RowsAffected:" + err.Error())
+		}
+		if updated != 1 {
+			return false, nil
+		}
+		changed = true
+	}
+
+	var rewritten [3]string
+	rewrite := false
+	for i := range stored {
+		rewritten[i] = stored[i]
+		if !userKeys.Stale(stored[i]) {
+			continue
+		}
+		v, err := userKeys.Decrypt(stored[i], digests[i])
+		if err != nil {
+			return false, err
+		}
+		rewritten[i], err = userKeys.Encrypt(v)
+		if err != nil {
+			return false, err
+		}
+		rewrite = true
+	}
+
+	if rewrite {
+		// a concurrent update will have used the data key already
+		q = fmt.Sprintf(`update %s
+                                 set api_secret = ?,
+                                 display_name = ?,
+                                 email = ?
+                                 where id = ?
+                                 and api_secret = ?
+                                 and display_name = ?
+                                 and email = ?`,
+			app.UsersTableName)
+		result, err := tx.ExecContext(ctx, q,
+			rewritten[0],
+			rewritten[1],
+			rewritten[2],
+			id,
+			stored[0],
+			stored[1],
+			stored[2])
+		if err != nil {
+			return false, err
+		}
+		updated, err := result.RowsAffected()
+		if err != nil {
+			// the db does not support a basic feature
+			panic("cannot exec RowsAffected:" + err.Error())
+		}
+		if updated != 1 {
+			return false, nil
+		}
+	}
+
+	if !changed && !rewrite {
+		return false, nil
+	}
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -5,6 +5,7 @@ package testing
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"testing"
 
 	"github.com/google/uuid"
@@ -12,6 +13,7 @@ import (
 	"github.com/grokloc/grokloc-server/pkg/app/admin/org"
 	"github.com/grokloc/grokloc-server/pkg/app/admin/user"
 	"github.com/grokloc/grokloc-server/pkg/app/admin/user/events"
+	"github.com/grokloc/grokloc-server/pkg/app/audit"
 	"github.com/grokloc/grokloc-server/pkg/app/state"
 	"github.com/grokloc/grokloc-server/pkg/env"
 	"github.com/grokloc/grokloc-server/pkg/models"
@@ -48,7 +50,7 @@ func (s *UserSuite) TestCreate() {
 		uuid.NewString(), // org owner display name
 		uuid.NewString(), // org owner email
 		ownerPassword,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.Master,
 	)
 	require.Nil(s.T(), err)
@@ -56,7 +58,7 @@ func (s *UserSuite) TestCreate() {
 	u_read, err := user.Read(
 		ctx,
 		o.Owner,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.RandomReplica(),
 	)
 	require.Nil(s.T(), err)
@@ -72,7 +74,7 @@ func (s *UserSuite) TestReadUser() {
 	u, err := user.Read(
 		context.Background(),
 		s.st.RootUser,
-		s.st.DBKey,
+		s.st.DBKeys,
 		replica,
 	)
 	require.Nil(s.T(), err)
@@ -88,13 +90,41 @@ func (s *UserSuite) TestReadUserMiss() {
 	_, err := user.Read(
 		context.Background(),
 		uuid.NewString(),
-		s.st.DBKey,
+		s.st.DBKeys,
 		replica,
 	)
 	require.Error(s.T(), err)
 	require.Equal(s.T(), sql.ErrNoRows, err)
 }
 
+func (s *UserSuite) TestReadByEmail() {
+	ctx := context.Background()
+	ownerPassword, err := security.DerivePassword(uuid.NewString(), s.st.Argon2Cfg)
+	require.Nil(s.T(), err)
+	email := uuid.NewString()
+	o, err := org.Create(
+		ctx,
+		uuid.NewString(), // org name
+		uuid.NewString(), // org owner display name
+		email,            // org owner email
+		ownerPassword,
+		s.st.DBKeys,
+		s.st.Master,
+	)
+	require.Nil(s.T(), err)
+
+	u, err := user.ReadByEmail(ctx, o.ID, email, s.st.DBKeys, s.st.RandomReplica())
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), o.Owner, u.ID)
+	require.Equal(s.T(), email, u.Email)
+
+	// emails are matched only within the org
+	_, err = user.ReadByEmail(ctx, s.st.RootOrg, email, s.st.DBKeys, s.st.RandomReplica())
+	require.Equal(s.T(), sql.ErrNoRows, err)
+	_, err = user.ReadByEmail(ctx, o.ID, uuid.NewString(), s.st.DBKeys, s.st.RandomReplica())
+	require.Equal(s.T(), sql.ErrNoRows, err)
+}
+
 func (s *UserSuite) TestUpdateDisplayName() {
 	ctx := context.Background()
 	ownerPassword, err := security.DerivePassword(uuid.NewString(), s.st.Argon2Cfg)
@@ -106,7 +136,7 @@ func (s *UserSuite) TestUpdateDisplayName() {
 		uuid.NewString(), // org owner display name
 		uuid.NewString(), // org owner email
 		ownerPassword,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.Master,
 	)
 	require.Nil(s.T(), err)
@@ -114,7 +144,7 @@ func (s *UserSuite) TestUpdateDisplayName() {
 	u, err := user.Read(
 		ctx,
 		o.Owner,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.RandomReplica(),
 	)
 	require.Nil(s.T(), err)
@@ -125,7 +155,7 @@ func (s *UserSuite) TestUpdateDisplayName() {
 	err = u.UpdateDisplayName(
 		ctx,
 		newDisplayName,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.Master,
 	)
 	require.Nil(s.T(), err)
@@ -135,7 +165,7 @@ func (s *UserSuite) TestUpdateDisplayName() {
 	u_read, err := user.Read(
 		ctx,
 		o.Owner,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.RandomReplica(),
 	)
 	require.Nil(s.T(), err)
@@ -154,7 +184,7 @@ func (s *UserSuite) TestUpdatePassword() {
 		uuid.NewString(), // org owner display name
 		uuid.NewString(), // org owner email
 		ownerPassword,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.Master,
 	)
 	require.Nil(s.T(), err)
@@ -162,7 +192,7 @@ func (s *UserSuite) TestUpdatePassword() {
 	u, err := user.Read(
 		ctx,
 		o.Owner,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.RandomReplica(),
 	)
 	require.Nil(s.T(), err)
@@ -182,7 +212,7 @@ func (s *UserSuite) TestUpdatePassword() {
 	u_read, err := user.Read(
 		ctx,
 		o.Owner,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.RandomReplica(),
 	)
 	require.Nil(s.T(), err)
@@ -203,7 +233,7 @@ func (s *UserSuite) TestUpdateStatus() {
 		uuid.NewString(), // org owner display name
 		uuid.NewString(), // org owner email
 		ownerPassword,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.Master,
 	)
 	require.Nil(s.T(), err)
@@ -217,7 +247,7 @@ func (s *UserSuite) TestUpdateStatus() {
 		uuid.NewString(), // email
 		o.ID,
 		newUserPassword,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.Master,
 	)
 	require.Nil(s.T(), err)
@@ -233,7 +263,7 @@ func (s *UserSuite) TestUpdateStatus() {
 	u_read, err := user.Read(
 		ctx,
 		u.ID,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.RandomReplica(),
 	)
 	require.Nil(s.T(), err)
@@ -253,12 +283,12 @@ func (s *UserSuite) TestDuplicateInsert() {
 		uuid.NewString(), // org owner display name
 		email,
 		ownerPassword,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.Master,
 	)
 	require.Nil(s.T(), err)
 
-	_, err = user.Read(ctx, o.Owner, s.st.DBKey, s.st.Master)
+	_, err = user.Read(ctx, o.Owner, s.st.DBKeys, s.st.Master)
 	require.Nil(s.T(), err)
 
 	userPassword, err := security.DerivePassword(uuid.NewString(), s.st.Argon2Cfg)
@@ -269,7 +299,7 @@ func (s *UserSuite) TestDuplicateInsert() {
 		email,            // RE-USED -> conflict
 		o.ID,
 		userPassword,
-		s.st.DBKey,
+		s.st.DBKeys,
 	)
 	require.Nil(s.T(), err)
 
@@ -369,6 +399,71 @@ func (s *UserSuite) TestUpdatePasswordEvent() {
 	require.True(s.T(), match)
 }
 
+func (s *UserSuite) TestRotateAPISecret() {
+	ctx := context.Background()
+	c, err := user.NewController(ctx, s.st)
+	require.Nil(s.T(), err)
+
+	password, err := security.DerivePassword(uuid.NewString(), s.st.Argon2Cfg)
+	require.Nil(s.T(), err)
+	event, err := events.NewCreate(
+		ctx,
+		uuid.NewString(), // display name
+		uuid.NewString(), // email
+		s.st.RootOrg,
+		password,
+	)
+	require.Nil(s.T(), err)
+	u, err := c.Create(ctx, *event)
+	require.Nil(s.T(), err)
+	first := u.APISecret
+	request := func(apiSecret string) string {
+		return security.EncodedSHA256(u.ID + apiSecret)
+	}
+
+	// with a grace period, the old secret is still accepted
+	rotateEvent, err := events.NewRotateAPISecret(ctx, u.ID, 3600)
+	require.Nil(s.T(), err)
+	u, err = c.RotateAPISecret(ctx, *rotateEvent)
+	require.Nil(s.T(), err)
+	second := u.APISecret
+	require.NotEqual(s.T(), first, second)
+	uRead, err := user.Read(ctx, u.ID, s.st.DBKeys, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), second, uRead.APISecret)
+	require.Equal(s.T(), security.EncodedSHA256(second), uRead.APISecretDigest)
+	for _, apiSecret := range []string{first, second} {
+		valid, err := uRead.VerifyTokenRequest(ctx, request(apiSecret), s.st.Master)
+		require.Nil(s.T(), err)
+		require.True(s.T(), valid)
+	}
+	valid, err := uRead.VerifyTokenRequest(ctx, request(uuid.NewString()), s.st.Master)
+	require.Nil(s.T(), err)
+	require.False(s.T(), valid)
+
+	// without one, no earlier secret is
+	rotateEvent, err = events.NewRotateAPISecret(ctx, u.ID, 0)
+	require.Nil(s.T(), err)
+	u, err = c.RotateAPISecret(ctx, *rotateEvent)
+	require.Nil(s.T(), err)
+	for _, apiSecret := range []string{first, second} {
+		valid, err := u.VerifyTokenRequest(ctx, request(apiSecret), s.st.Master)
+		require.Nil(s.T(), err)
+		require.False(s.T(), valid)
+	}
+	valid, err = u.VerifyTokenRequest(ctx, request(u.APISecret), s.st.Master)
+	require.Nil(s.T(), err)
+	require.True(s.T(), valid)
+
+	// each rotation is audited
+	var count int
+	err = s.st.Master.QueryRowContext(ctx,
+		fmt.Sprintf(`select count(*) from %s where code = ? and source_id = ?`, app.AuditTableName),
+		audit.USER_API_SECRET, u.ID).Scan(&count)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 2, count)
+}
+
 func (s *UserSuite) TestUpdateStatusEvent() {
 	ctx := context.Background()
 	c, err := user.NewController(ctx, s.st)
@@ -417,6 +512,300 @@ func (s *UserSuite) TestUpdateStatusEvent() {
 	require.Equal(s.T(), models.StatusInactive, uUpdate.Meta.Status)
 }
 
+func (s *UserSuite) TestUpgrade() {
+	ctx := context.Background()
+	user.RegisterUpgrade(-1, func(ctx context.Context, u *user.User) error {
+		u.DisplayName = u.DisplayName + "-upgraded"
+		u.DisplayNameDigest = security.EncodedSHA256(u.DisplayName)
+		return nil
+	})
+
+	password, err := security.DerivePassword(uuid.NewString(), s.st.Argon2Cfg)
+	require.Nil(s.T(), err)
+
+	displayName := uuid.NewString()
+	u, err := user.Create(
+		ctx,
+		displayName,
+		uuid.NewString(), // email
+		s.st.RootOrg,
+		password,
+		s.st.DBKeys,
+		s.st.Master,
+	)
+	require.Nil(s.T(), err)
+
+	err = models.Update(ctx, app.UsersTableName, u.ID, "schema_version", -1, s.st.Master)
+	require.Nil(s.T(), err)
+
+	// read upgrades in memory only
+	u_read, err := user.Read(ctx, u.ID, s.st.DBKeys, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), user.Version, u_read.Meta.SchemaVersion)
+	require.Equal(s.T(), displayName+"-upgraded", u_read.DisplayName)
+
+	// migrate writes back, re-encrypting
+	migrated, err := user.Migrate(ctx, u.ID, s.st.DBKeys, s.st.Master)
+	require.Nil(s.T(), err)
+	require.True(s.T(), migrated)
+	var stored int
+	err = s.st.Master.QueryRow(`select schema_version from users where id = ?`, u.ID).Scan(&stored)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), user.Version, stored)
+	u_read, err = user.Read(ctx, u.ID, s.st.DBKeys, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), displayName+"-upgraded", u_read.DisplayName)
+	require.Equal(s.T(), u.APISecret, u_read.APISecret)
+	require.Equal(s.T(), u.Email, u_read.Email)
+	require.Equal(s.T(), u.Password, u_read.Password)
+
+	// newer than this code
+	err = models.Update(ctx, app.UsersTableName, u.ID, "schema_version", user.Version+1, s.st.Master)
+	require.Nil(s.T(), err)
+	_, err = user.Read(ctx, u.ID, s.st.DBKeys, s.st.Master)
+	require.Equal(s.T(), models.ErrModelMigrate, err)
+	_, err = user.Migrate(ctx, u.ID, s.st.DBKeys, s.st.Master)
+	require.Equal(s.T(), models.ErrModelMigrate, err)
+
+	err = models.Update(ctx, app.UsersTableName, u.ID, "schema_version", user.Version, s.st.Master)
+	require.Nil(s.T(), err)
+}
+
+func (s *UserSuite) TestReencrypt() {
+	ctx := context.Background()
+	oldKey, err := security.MakeKey(uuid.NewString())
+	require.Nil(s.T(), err)
+	newKey, err := security.MakeKey(uuid.NewString())
+	require.Nil(s.T(), err)
+	oldID, newID := uuid.NewString(), uuid.NewString()
+	oldKeys, err := security.NewKeyring(oldID, map[string][]byte{oldID: oldKey})
+	require.Nil(s.T(), err)
+	bothKeys, err := security.NewKeyring(newID, map[string][]byte{oldID: oldKey, newID: newKey})
+	require.Nil(s.T(), err)
+	newKeys, err := security.NewKeyring(newID, map[string][]byte{newID: newKey})
+	require.Nil(s.T(), err)
+
+	password, err := security.DerivePassword(uuid.NewString(), s.st.Argon2Cfg)
+	require.Nil(s.T(), err)
+	u, err := user.Create(
+		ctx,
+		uuid.NewString(), // display name
+		uuid.NewString(), // email
+		s.st.RootOrg,
+		password,
+		oldKeys,
+		s.st.Master,
+	)
+	require.Nil(s.T(), err)
+
+	// readable with the old key retired, but not once it is dropped
+	_, err = user.Read(ctx, u.ID, bothKeys, s.st.Master)
+	require.Nil(s.T(), err)
+	_, err = user.Read(ctx, u.ID, newKeys, s.st.Master)
+	require.ErrorIs(s.T(), err, security.ErrKeyID)
+
+	rewritten, err := user.Reencrypt(ctx, u.ID, bothKeys, s.st.Master)
+	require.Nil(s.T(), err)
+	require.True(s.T(), rewritten)
+	u_read, err := user.Read(ctx, u.ID, newKeys, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), u.APISecret, u_read.APISecret)
+	require.Equal(s.T(), u.DisplayName, u_read.DisplayName)
+	require.Equal(s.T(), u.Email, u_read.Email)
+
+	// already current
+	rewritten, err = user.Reencrypt(ctx, u.ID, bothKeys, s.st.Master)
+	require.Nil(s.T(), err)
+	require.False(s.T(), rewritten)
+}
+
+func (s *UserSuite) TestReencryptLegacy() {
+	ctx := context.Background()
+	password, err := security.DerivePassword(uuid.NewString(), s.st.Argon2Cfg)
+	require.Nil(s.T(), err)
+	u, err := user.Create(
+		ctx,
+		uuid.NewString(), // display name
+		uuid.NewString(), // email
+		s.st.RootOrg,
+		password,
+		s.st.DBKeys,
+		s.st.Master,
+	)
+	require.Nil(s.T(), err)
+
+	// as stored before data keys
+	encrypted := make([]string, 3)
+	for i, v := range []string{u.APISecret, u.DisplayName, u.Email} {
+		encrypted[i], err = s.st.DBKeys.Encrypt(v)
+		require.Nil(s.T(), err)
+	}
+	_, err = s.st.Master.ExecContext(ctx,
+		fmt.Sprintf(`update %s set api_secret = ?, display_name = ?, email = ? where id = ?`, app.UsersTableName),
+		encrypted[0], encrypted[1], encrypted[2], u.ID)
+	require.Nil(s.T(), err)
+	_, err = s.st.Master.ExecContext(ctx,
+		fmt.Sprintf(`delete from %s where user = ?`, app.UserKeysTableName),
+		u.ID)
+	require.Nil(s.T(), err)
+	u_read, err := user.Read(ctx, u.ID, s.st.DBKeys, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), u.Email, u_read.Email)
+
+	ids, err := user.StaleKeyIDs(ctx, "", 1000000, s.st.DBKeys, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Contains(s.T(), ids, u.ID)
+
+	// given a data key
+	rewritten, err := user.Reencrypt(ctx, u.ID, s.st.DBKeys, s.st.Master)
+	require.Nil(s.T(), err)
+	require.True(s.T(), rewritten)
+	var email string
+	err = s.st.Master.QueryRowContext(ctx,
+		fmt.Sprintf(`select email from %s where id = ?`, app.UsersTableName),
+		u.ID).Scan(&email)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), u.ID, security.KeyID(email))
+	u_read, err = user.Read(ctx, u.ID, s.st.DBKeys, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), u.APISecret, u_read.APISecret)
+	require.Equal(s.T(), u.DisplayName, u_read.DisplayName)
+	require.Equal(s.T(), u.Email, u_read.Email)
+
+	ids, err = user.StaleKeyIDs(ctx, "", 1000000, s.st.DBKeys, s.st.Master)
+	require.Nil(s.T(), err)
+	require.NotContains(s.T(), ids, u.ID)
+}
+
+func (s *UserSuite) TestShred() {
+	ctx := context.Background()
+	password, err := security.DerivePassword(uuid.NewString(), s.st.Argon2Cfg)
+	require.Nil(s.T(), err)
+	email := uuid.NewString()
+	u, err := user.Create(
+		ctx,
+		uuid.NewString(), // display name
+		email,
+		s.st.RootOrg,
+		password,
+		s.st.DBKeys,
+		s.st.Master,
+	)
+	require.Nil(s.T(), err)
+
+	// a backup of the row
+	var encryptedEmail, emailDigest string
+	err = s.st.Master.QueryRowContext(ctx,
+		fmt.Sprintf(`select email, email_digest from %s where id = ?`, app.UsersTableName),
+		u.ID).Scan(&encryptedEmail, &emailDigest)
+	require.Nil(s.T(), err)
+
+	// the shared unit db holds shreds from other tests
+	pending, err := user.PendingShreds(ctx, s.st.DBKeys, s.st.Master)
+	require.Nil(s.T(), err)
+
+	require.Nil(s.T(), u.Shred(ctx, s.st.DigestKey, s.st.Master))
+	require.Equal(s.T(), "", u.Email)
+
+	// backups can still recover the data key until the db key is retired
+	after, err := user.PendingShreds(ctx, s.st.DBKeys, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), pending+1, after)
+	key, err := security.MakeKey(uuid.NewString())
+	require.Nil(s.T(), err)
+	rotated, err := security.NewKeyring("rotated", map[string][]byte{"rotated": key})
+	require.Nil(s.T(), err)
+	after, err = user.PendingShreds(ctx, rotated, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 0, after)
+	require.Equal(s.T(), models.StatusInactive, u.Meta.Status)
+
+	_, err = user.Read(ctx, u.ID, s.st.DBKeys, s.st.Master)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+	_, err = user.ReadByEmail(ctx, s.st.RootOrg, email, s.st.DBKeys, s.st.Master)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+
+	// the db keys cannot read the backup
+	_, err = s.st.DBKeys.Decrypt(encryptedEmail, emailDigest)
+	require.ErrorIs(s.T(), err, security.ErrKeyID)
+
+	// nothing left to rewrite
+	ids, err := user.StaleKeyIDs(ctx, "", 1000000, s.st.DBKeys, s.st.Master)
+	require.Nil(s.T(), err)
+	require.NotContains(s.T(), ids, u.ID)
+	rewritten, err := user.Reencrypt(ctx, u.ID, s.st.DBKeys, s.st.Master)
+	require.Nil(s.T(), err)
+	require.False(s.T(), rewritten)
+
+	require.Equal(s.T(), models.ErrRowsAffected, u.Shred(ctx, s.st.DigestKey, s.st.Master))
+
+	// the email can be used again
+	_, err = user.Create(
+		ctx,
+		uuid.NewString(), // display name
+		email,
+		s.st.RootOrg,
+		password,
+		s.st.DBKeys,
+		s.st.Master,
+	)
+	require.Nil(s.T(), err)
+
+	var count int
+	err = s.st.Master.QueryRowContext(ctx,
+		fmt.Sprintf(`select count(*) from %s where code = ? and source_id = ?`, app.AuditTableName),
+		audit.USER_SHRED, u.ID).Scan(&count)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 1, count)
+}
+
+func (s *UserSuite) TestLegacyPasswords() {
+	ctx := context.Background()
+	weak := s.st.Argon2Cfg
+	weak.MemoryCost /= 2
+	password, err := security.DerivePassword(uuid.NewString(), weak)
+	require.Nil(s.T(), err)
+
+	// the shared unit db holds users from other tests
+	before, malformed, err := user.LegacyPasswords(ctx, s.st.Argon2Cfg, s.st.Master)
+	require.Nil(s.T(), err)
+
+	u, err := user.Create(
+		ctx,
+		uuid.NewString(), // display name
+		uuid.NewString(), // email
+		s.st.RootOrg,
+		password,
+		s.st.DBKeys,
+		s.st.Master,
+	)
+	require.Nil(s.T(), err)
+	legacy, _, err := user.LegacyPasswords(ctx, s.st.Argon2Cfg, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), before+1, legacy)
+
+	// not legacy under the weaker parameters
+	legacy, _, err = user.LegacyPasswords(ctx, weak, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Less(s.T(), legacy, before+1)
+
+	password, err = security.DerivePassword(uuid.NewString(), s.st.Argon2Cfg)
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), u.UpdatePassword(ctx, password, s.st.Master))
+	legacy, _, err = user.LegacyPasswords(ctx, s.st.Argon2Cfg, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), before, legacy)
+
+	// passwords that cannot be decoded are counted apart
+	err = models.Update(ctx, app.UsersTableName, u.ID, "password", uuid.NewString(), s.st.Master)
+	require.Nil(s.T(), err)
+	legacy, reread, err := user.LegacyPasswords(ctx, s.st.Argon2Cfg, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), before, legacy)
+	require.Equal(s.T(), malformed+1, reread)
+	require.Nil(s.T(), u.UpdatePassword(ctx, password, s.st.Master))
+}
+
 func TestUserSuite(t *testing.T) {
 	suite.Run(t, new(UserSuite))
 }
@@ -0,0 +1,130 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/models"
+	"github.com/grokloc/grokloc-server/pkg/security"
+)
+
+// Upgrade transforms a user read at schema version v into version v+1,
+// in memory only
+//
+// Encrypted fields are already decrypted when an Upgrade is applied;
+// an Upgrade that changes one must also set its digest
+type Upgrade func(ctx context.Context, u *User) error
+
+// upgrades maps a schema version to the Upgrade from that version
+var upgrades = map[int]Upgrade{}
+
+// RegisterUpgrade sets the Upgrade for users at schema version from
+//
+// Call from init; registration is not synchronized with reads
+func RegisterUpgrade(from int, f Upgrade) {
+	upgrades[from] = f
+}
+
+// upgrade applies registered upgrades until u is at Version
+func (u *User) upgrade(ctx context.Context) error {
+	if u.Meta.SchemaVersion > Version {
+		return models.ErrModelMigrate
+	}
+	for u.Meta.SchemaVersion < Version {
+		f, ok := upgrades[u.Meta.SchemaVersion]
+		if !ok {
+			return models.ErrModelMigrate
+		}
+		err := f(ctx, u)
+		if err != nil {
+			return err
+		}
+		u.Meta.SchemaVersion++
+	}
+	return nil
+}
+
+// Migrate reads the user with id (upgrading it in memory) and, if it was
+// stored at an older schema version, writes the upgraded user back
+//
+// Returns true if the row was rewritten
+func Migrate(ctx context.Context, id string, keys *security.Keyring, db *sql.DB) (bool, error) {
+	q := fmt.Sprintf(`select schema_version from %s where id = ?`, app.UsersTableName)
+	var stored int
+	err := db.QueryRowContext(ctx, q, id).Scan(&stored)
+	if err != nil {
+		return false, err
+	}
+	if stored == Version {
+		return false, nil
+	}
+
+	u, err := Read(ctx, id, keys, db)
+	if err != nil {
+		return false, err
+	}
+
+	userKeys, err := readKeyring(ctx, id, keys, db)
+	if err != nil {
+		return false, err
+	}
+	apiSecretEncrypted, err := userKeys.Encrypt(u.APISecret)
+	if err != nil {
+		return false, err
+	}
+	displayNameEncrypted, err := userKeys.Encrypt(u.DisplayName)
+	if err != nil {
+		return false, err
+	}
+	emailEncrypted, err := userKeys.Encrypt(u.Email)
+	if err != nil {
+		return false, err
+	}
+
+	// only overwrite the version that was upgraded
+	q = fmt.Sprintf(`update %s
+                         set api_secret = ?,
+                         api_secret_digest = ?,
+                         display_name = ?,
+                         display_name_digest = ?,
+                         email = ?,
+                         email_digest = ?,
+                         org = ?,
+                         password = ?,
+                         status = ?,
+                         schema_version = ?
+                         where id = ?
+                         and schema_version = ?`,
+		app.UsersTableName)
+
+	result, err := db.ExecContext(ctx,
+		q,
+		apiSecretEncrypted,
+		u.APISecretDigest,
+		displayNameEncrypted,
+		u.DisplayNameDigest,
+		emailEncrypted,
+		u.EmailDigest,
+		u.Org,
+		u.Password,
+		u.Meta.Status,
+		u.Meta.SchemaVersion,
+		u.ID,
+		stored)
+	if err != nil {
+		return false, err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if updated != 1 {
+		return false, models.ErrRowsAffected
+	}
+
+	return true, nil
+}
@@ -0,0 +1,247 @@
+// Package analysis counts lines of code in mirrored repositories
+package analysis
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grokloc/grokloc-server/pkg/git"
+)
+
+// MaxFileSize is the largest file analyzed; larger files are skipped
+const MaxFileSize = 1 << 20
+
+// binarySniffLen is how much of a file is checked for NUL bytes
+// to detect binary content
+const binarySniffLen = 8000
+
+// File is the line counts for one file
+type File struct {
+	Path     string `json:"path"`
+	Language string `json:"language"`
+	Counts
+}
+
+// LanguageCounts is the line counts for all files in one language
+type LanguageCounts struct {
+	Language string `json:"language"`
+	Files    int    `json:"files"`
+	Counts
+}
+
+// Analysis is the line counts for a repository at a commit
+type Analysis struct {
+	Repository string           `json:"repository"`
+	Commit     string           `json:"commit"`
+	Total      Counts           `json:"total"`
+	Languages  []LanguageCounts `json:"languages"` // most code first
+	Files      []File           `json:"files"`     // by path
+	Ctime      int64            `json:"ctime"`
+}
+
+// entry is a blob listed by ls-tree
+type entry struct {
+	hash string
+	path string
+}
+
+// Analyze counts lines in every recognized file in the tree of rev
+// in the repository at gitDir
+//
+// Symlinks, submodules, binary files and files larger than MaxFileSize
+// are skipped, as are files in no recognized language
+func Analyze(ctx context.Context, gitDir, repository, rev string) (*Analysis, error) {
+	commit, err := git.ResolveCommit(ctx, gitDir, rev)
+	if err != nil {
+		return nil, err
+	}
+	return analyzeCommit(ctx, gitDir, repository, commit, map[entry]*File{})
+}
+
+// analyzeCommit is Analyze for a resolved commit
+//
+// cache maps each entry already read to its File, or nil if the entry
+// was skipped; only entries missing from cache are read, and are then
+// added to it
+func analyzeCommit(ctx context.Context, gitDir, repository, commit string, cache map[entry]*File) (*Analysis, error) {
+	entries, err := listBlobs(ctx, gitDir, commit)
+	if err != nil {
+		return nil, err
+	}
+
+	uncached := []entry{}
+	for _, e := range entries {
+		if _, ok := cache[e]; !ok {
+			uncached = append(uncached, e)
+		}
+	}
+	err = readBlobs(ctx, gitDir, uncached, func(e entry, content []byte) {
+		cache[e] = count(e, content)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Analysis{
+		Repository: repository,
+		Commit:     commit,
+		Languages:  []LanguageCounts{},
+		Files:      []File{},
+	}
+	byLanguage := map[string]*LanguageCounts{}
+	for _, e := range entries {
+		f := cache[e]
+		if f == nil {
+			continue
+		}
+		a.Files = append(a.Files, *f)
+		a.Total.Add(f.Counts)
+		lc, ok := byLanguage[f.Language]
+		if !ok {
+			lc = &LanguageCounts{Language: f.Language}
+			byLanguage[f.Language] = lc
+		}
+		lc.Files++
+		lc.Add(f.Counts)
+	}
+
+	for _, lc := range byLanguage {
+		a.Languages = append(a.Languages, *lc)
+	}
+	SortLanguages(a.Languages)
+	// ls-tree order differs from plain path order for some names
+	sort.Slice(a.Files, func(i, j int) bool { return a.Files[i].Path < a.Files[j].Path })
+	return a, nil
+}
+
+// count returns the File for e with content, or nil if e is skipped
+func count(e entry, content []byte) *File {
+	if isBinary(content) {
+		return nil
+	}
+	l := Classify(e.path, content)
+	if l == nil {
+		return nil
+	}
+	return &File{Path: e.path, Language: l.Name, Counts: Count(l, content)}
+}
+
+// SortLanguages orders ls by code lines, most first, then by name
+func SortLanguages(ls []LanguageCounts) {
+	sort.Slice(ls, func(i, j int) bool {
+		if ls[i].Code != ls[j].Code {
+			return ls[i].Code > ls[j].Code
+		}
+		return ls[i].Language < ls[j].Language
+	})
+}
+
+// isBinary reports whether content looks binary, i.e. has a NUL byte
+// near its start
+func isBinary(content []byte) bool {
+	if len(content) > binarySniffLen {
+		content = content[:binarySniffLen]
+	}
+	return bytes.IndexByte(content, 0) >= 0
+}
+
+// listBlobs lists the regular files in the tree of commit no larger
+// than MaxFileSize
+func listBlobs(ctx context.Context, gitDir, commit string) ([]entry, error) {
+	out, err := git.Output(ctx, gitDir, "ls-tree", "-r", "-z", "--long", "--full-tree", commit)
+	if err != nil {
+		return nil, err
+	}
+	entries := []entry{}
+	for _, record := range strings.Split(out, "\x00") {
+		if len(record) == 0 {
+			continue
+		}
+		// <mode> SP <type> SP <hash> SP+ <size> TAB <path>
+		tab := strings.IndexByte(record, '\t')
+		if tab < 0 {
+			return nil, fmt.Errorf("ls-tree record %q", record)
+		}
+		fields := strings.Fields(record[:tab])
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("ls-tree record %q", record)
+		}
+		mode, kind, hash := fields[0], fields[1], fields[2]
+		if kind != "blob" || mode == "120000" {
+			continue
+		}
+		size, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("ls-tree record %q: %w", record, err)
+		}
+		if size > MaxFileSize {
+			continue
+		}
+		entries = append(entries, entry{hash: hash, path: record[tab+1:]})
+	}
+	return entries, nil
+}
+
+// readBlobs calls f with the content of each entry, read through a
+// single git cat-file process
+func readBlobs(ctx context.Context, gitDir string, entries []entry, f func(entry, []byte)) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	cmd := git.Command(ctx, gitDir, "cat-file", "--batch")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	readErr := func() error {
+		r := bufio.NewReader(stdout)
+		for _, e := range entries {
+			_, err := io.WriteString(stdin, e.hash+"\n")
+			if err != nil {
+				return err
+			}
+			// <hash> SP <type> SP <size> LF <content> LF
+			header, err := r.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			fields := strings.Fields(header)
+			if len(fields) != 3 || fields[1] != "blob" {
+				return fmt.Errorf("cat-file header %q", header)
+			}
+			size, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return fmt.Errorf("cat-file header %q: %w", header, err)
+			}
+			content := make([]byte, size+1)
+			_, err = io.ReadFull(r, content)
+			if err != nil {
+				return err
+			}
+			f(e, content[:size])
+		}
+		return nil
+	}()
+
+	_ = stdin.Close()
+	waitErr := cmd.Wait()
+	if readErr != nil {
+		return readErr
+	}
+	return waitErr
+}
@@ -0,0 +1,147 @@
+package analysis
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/org"
+	"github.com/grokloc/grokloc-server/pkg/app/repository"
+	"github.com/grokloc/grokloc-server/pkg/app/state"
+	"github.com/grokloc/grokloc-server/pkg/env"
+	"github.com/grokloc/grokloc-server/pkg/git"
+	"github.com/grokloc/grokloc-server/pkg/security"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+)
+
+type AnalysisSuite struct {
+	suite.Suite
+	st  *app.State
+	dir string // working tree of the upstream
+}
+
+func (s *AnalysisSuite) SetupTest() {
+	var err error
+	s.st, err = state.New(env.Unit)
+	if err != nil {
+		zap.L().Fatal("setup",
+			zap.Error(err),
+		)
+	}
+
+	s.dir = s.T().TempDir()
+	s.run("init", "--quiet")
+	s.write("main.go", "// Package main\npackage main\n\nfunc main() {}\n")
+	s.write("lib/util.py", "# util\n\ndef f():\n    return 1  # one\n")
+	s.write("bin/tool", "#!/usr/bin/env bash\necho tool\n")
+	s.write("README", "not code\n")
+	s.write("image.c", "\x00\x01binary")
+	s.write("big.go", strings.Repeat("x\n", MaxFileSize))
+	require.Nil(s.T(), os.Symlink("main.go", filepath.Join(s.dir, "link.go")))
+	s.run("add", "--all")
+	s.run("commit", "--quiet", "-m", "c")
+}
+
+// run runs the git command with args in the upstream working tree
+func (s *AnalysisSuite) run(args ...string) string {
+	args = append([]string{"-c", "user.name=test", "-c", "user.email=test@localhost"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = s.dir
+	out, err := cmd.Output()
+	require.Nil(s.T(), err, strings.Join(args, " "))
+	return strings.TrimSpace(string(out))
+}
+
+// write writes content to name in the upstream working tree
+func (s *AnalysisSuite) write(name, content string) {
+	p := filepath.Join(s.dir, name)
+	require.Nil(s.T(), os.MkdirAll(filepath.Dir(p), 0700))
+	require.Nil(s.T(), os.WriteFile(p, []byte(content), 0600))
+}
+
+func (s *AnalysisSuite) TestAnalyze() {
+	a, err := Analyze(context.Background(), filepath.Join(s.dir, ".git"), uuid.NewString(), "HEAD")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), s.run("rev-parse", "HEAD"), a.Commit)
+
+	// binary, oversized, unrecognized and symlinked files are skipped
+	require.Equal(s.T(), []File{
+		{Path: "bin/tool", Language: "Shell", Counts: Counts{Code: 1, Comment: 1}},
+		{Path: "lib/util.py", Language: "Python", Counts: Counts{Code: 2, Comment: 1, Blank: 1}},
+		{Path: "main.go", Language: "Go", Counts: Counts{Code: 2, Comment: 1, Blank: 1}},
+	}, a.Files)
+	require.Equal(s.T(), []LanguageCounts{
+		{Language: "Go", Files: 1, Counts: Counts{Code: 2, Comment: 1, Blank: 1}},
+		{Language: "Python", Files: 1, Counts: Counts{Code: 2, Comment: 1, Blank: 1}},
+		{Language: "Shell", Files: 1, Counts: Counts{Code: 1, Comment: 1}},
+	}, a.Languages)
+	require.Equal(s.T(), Counts{Code: 5, Comment: 3, Blank: 2}, a.Total)
+
+	_, err = Analyze(context.Background(), filepath.Join(s.dir, ".git"), uuid.NewString(), "nope")
+	require.Equal(s.T(), git.ErrRevision, err)
+}
+
+func (s *AnalysisSuite) TestCreate() {
+	ctx := context.Background()
+	ownerPassword, err := security.DerivePassword(uuid.NewString(), s.st.Argon2Cfg)
+	require.Nil(s.T(), err)
+	o, err := org.Create(
+		ctx,
+		uuid.NewString(), // org name
+		uuid.NewString(), // org owner display name
+		uuid.NewString(), // org owner email
+		ownerPassword,
+		s.st.DBKeys,
+		s.st.Master,
+	)
+	require.Nil(s.T(), err)
+	r, err := repository.Create(
+		ctx,
+		uuid.NewString(), // name
+		o.ID,
+		"file://"+filepath.ToSlash(s.dir),
+		s.st.RepositoryRoot,
+		s.st.Master,
+	)
+	require.Nil(s.T(), err)
+	_, err = git.Output(ctx, "", "clone", "--mirror", "--quiet", "--", r.Upstream, r.Path)
+	require.Nil(s.T(), err)
+
+	_, err = Latest(ctx, r.ID, s.st.Master)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+
+	a, err := Create(ctx, r, "HEAD", s.st.Master)
+	require.Nil(s.T(), err)
+	require.NotZero(s.T(), a.Ctime)
+	require.Equal(s.T(), 3, len(a.Files))
+
+	exists, err := Exists(ctx, r.ID, a.Commit, s.st.Master)
+	require.Nil(s.T(), err)
+	require.True(s.T(), exists)
+
+	// analyzing again replaces the stored result
+	a_again, err := Create(ctx, r, a.Commit, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), a.Files, a_again.Files)
+	require.Equal(s.T(), a.Languages, a_again.Languages)
+
+	latest, err := Latest(ctx, r.ID, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), a.Commit, latest.Commit)
+	require.Equal(s.T(), a.Total, latest.Total)
+
+	_, err = Read(ctx, r.ID, strings.Repeat("0", 40), s.st.Master)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+}
+
+func TestAnalysisSuite(t *testing.T) {
+	suite.Run(t, new(AnalysisSuite))
+}
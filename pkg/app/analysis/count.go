@@ -0,0 +1,128 @@
+package analysis
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+)
+
+// Counts are the numbers of each kind of line in some source
+type Counts struct {
+	Code    int `json:"code"`
+	Comment int `json:"comment"`
+	Blank   int `json:"blank"`
+}
+
+// Add adds o to c
+func (c *Counts) Add(o Counts) {
+	c.Code += o.Code
+	c.Comment += o.Comment
+	c.Blank += o.Blank
+}
+
+// Count counts the code, comment and blank lines of content in l
+//
+// A line with any code on it is a code line. This is a line-based
+// approximation: comment markers inside string literals are treated
+// as comments, and block comments do not nest
+func Count(l *Language, content []byte) Counts {
+	var c Counts
+	var blockEnd string // non-empty while inside a block comment
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, len(content)+1)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			c.Blank++
+			continue
+		}
+		var code, comment bool
+		code, comment, blockEnd = classifyLine(l, line, blockEnd)
+		switch {
+		case code:
+			c.Code++
+		case comment:
+			c.Comment++
+		default:
+			c.Blank++
+		}
+	}
+	return c
+}
+
+// classifyLine reports whether line has code and comments on it, given
+// the end marker of a block comment still open from a previous line;
+// it returns the end marker of any block comment left open
+func classifyLine(l *Language, line, blockEnd string) (bool, bool, string) {
+	var code, comment bool
+	for len(line) != 0 {
+		if len(blockEnd) != 0 {
+			comment = true
+			i := strings.Index(line, blockEnd)
+			if i < 0 {
+				return code, comment, blockEnd
+			}
+			line = strings.TrimSpace(line[i+len(blockEnd):])
+			blockEnd = ""
+			continue
+		}
+
+		// block starts first, as some contain a line comment marker
+		// (e.g. lua --[[)
+		if start, end, ok := blockAt(l, line); ok {
+			comment = true
+			line = line[len(start):]
+			blockEnd = end
+			continue
+		}
+		if lineCommentAt(l, line) {
+			return code, true, ""
+		}
+
+		// code runs until the next comment marker, if any
+		code = true
+		i := nextMarker(l, line)
+		if i < 0 {
+			return code, comment, ""
+		}
+		line = line[i:]
+	}
+	return code, comment, blockEnd
+}
+
+// blockAt returns the block comment markers if s starts with a block start
+func blockAt(l *Language, s string) (string, string, bool) {
+	for _, b := range l.BlockComments {
+		if strings.HasPrefix(s, b[0]) {
+			return b[0], b[1], true
+		}
+	}
+	return "", "", false
+}
+
+// lineCommentAt reports whether s starts with a line comment marker
+func lineCommentAt(l *Language, s string) bool {
+	for _, m := range l.LineComments {
+		if strings.HasPrefix(s, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextMarker returns the index of the first comment marker in s after
+// its first byte, or -1
+func nextMarker(l *Language, s string) int {
+	next := -1
+	markers := append([]string{}, l.LineComments...)
+	for _, b := range l.BlockComments {
+		markers = append(markers, b[0])
+	}
+	for _, m := range markers {
+		i := strings.Index(s[1:], m)
+		if i >= 0 && (next < 0 || i+1 < next) {
+			next = i + 1
+		}
+	}
+	return next
+}
@@ -0,0 +1,57 @@
+package analysis
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type CountSuite struct {
+	suite.Suite
+}
+
+func (s *CountSuite) TestCountGo() {
+	src := `// Package p is a package
+package p
+
+/*
+  block
+
+  comment
+*/
+import "fmt" // trailing comment
+
+/* leading */ var x = 1
+
+func f() { /* open
+  still comment
+*/ fmt.Println("x") }
+`
+	c := Count(Languages["Go"], []byte(src))
+	// code: package, import, var, func, closing line with code after block
+	require.Equal(s.T(), Counts{Code: 5, Comment: 6, Blank: 4}, c)
+}
+
+func (s *CountSuite) TestCountHash() {
+	src := "#!/bin/sh\n\n# comment\necho x # trailing\n  \n"
+	c := Count(Languages["Shell"], []byte(src))
+	require.Equal(s.T(), Counts{Code: 1, Comment: 2, Blank: 2}, c)
+}
+
+func (s *CountSuite) TestCountBlockBeforeLine() {
+	// lua block comments start with the line comment marker
+	src := "--[[ block\nstill\n]] x = 1\n-- line\n"
+	c := Count(Languages["Lua"], []byte(src))
+	require.Equal(s.T(), Counts{Code: 1, Comment: 3}, c)
+}
+
+func (s *CountSuite) TestCountNoComments() {
+	src := "{\r\n  \"a\": \"//\"\r\n}"
+	c := Count(Languages["JSON"], []byte(src))
+	require.Equal(s.T(), Counts{Code: 3}, c)
+}
+
+func TestCountSuite(t *testing.T) {
+	suite.Run(t, new(CountSuite))
+}
@@ -0,0 +1,443 @@
+package analysis
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/repository"
+)
+
+// Insert stores a, replacing any analysis of the same repository and commit
+func (a Analysis) Insert(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint
+
+	for _, tableName := range []string{
+		app.AnalysisFilesTableName,
+		app.AnalysisLanguagesTableName,
+		app.AnalysesTableName,
+	} {
+		q := fmt.Sprintf(`delete from %s where repository = ? and commit_hash = ?`, tableName)
+		_, err = tx.ExecContext(ctx, q, a.Repository, a.Commit)
+		if err != nil {
+			return err
+		}
+	}
+
+	q := fmt.Sprintf(`insert into %s
+                          (repository,
+                           commit_hash,
+                           code,
+                           comment,
+                           blank)
+                          values
+                          (?,?,?,?,?)`,
+		app.AnalysesTableName)
+	_, err = tx.ExecContext(ctx, q,
+		a.Repository,
+		a.Commit,
+		a.Total.Code,
+		a.Total.Comment,
+		a.Total.Blank)
+	if err != nil {
+		return err
+	}
+
+	q = fmt.Sprintf(`insert into %s
+                         (repository,
+                          commit_hash,
+                          language,
+                          files,
+                          code,
+                          comment,
+                          blank)
+                         values
+                         (?,?,?,?,?,?,?)`,
+		app.AnalysisLanguagesTableName)
+	for _, lc := range a.Languages {
+		_, err = tx.ExecContext(ctx, q,
+			a.Repository,
+			a.Commit,
+			lc.Language,
+			lc.Files,
+			lc.Code,
+			lc.Comment,
+			lc.Blank)
+		if err != nil {
+			return err
+		}
+	}
+
+	q = fmt.Sprintf(`insert into %s
+                         (repository,
+                          commit_hash,
+                          path,
+                          language,
+                          code,
+                          comment,
+                          blank)
+                         values
+                         (?,?,?,?,?,?,?)`,
+		app.AnalysisFilesTableName)
+	for _, f := range a.Files {
+		_, err = tx.ExecContext(ctx, q,
+			a.Repository,
+			a.Commit,
+			f.Path,
+			f.Language,
+			f.Code,
+			f.Comment,
+			f.Blank)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Create analyzes rev in the mirror of r and stores the result
+// (read analysis to capture ctime)
+func Create(ctx context.Context, r *repository.Repository, rev string, db *sql.DB) (*Analysis, error) {
+	a, err := Analyze(ctx, r.Path, r.ID, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.Insert(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	return Read(ctx, r.ID, a.Commit, db)
+}
+
+// Exists reports whether repository has been analyzed at commit
+func Exists(ctx context.Context, repository, commit string, db *sql.DB) (bool, error) {
+	q := fmt.Sprintf(`select count(*)
+                          from %s
+                          where repository = ?
+                          and commit_hash = ?`,
+		app.AnalysesTableName)
+
+	var count int
+	err := db.QueryRowContext(ctx, q, repository, commit).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count == 1, nil
+}
+
+// Read reads the analysis of repository at commit
+func Read(ctx context.Context, repository, commit string, db *sql.DB) (*Analysis, error) {
+	a, err := ReadSummary(ctx, repository, commit, db)
+	if err != nil {
+		return nil, err
+	}
+
+	a.Files, err = readFiles(ctx, repository, commit, db)
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// ReadSummary reads the analysis of repository at commit without
+// per-file counts (Files is nil)
+func ReadSummary(ctx context.Context, repository, commit string, db *sql.DB) (*Analysis, error) {
+	q := fmt.Sprintf(`select
+                          code,
+                          comment,
+                          blank,
+                          ctime
+                          from %s
+                          where repository = ?
+                          and commit_hash = ?`,
+		app.AnalysesTableName)
+
+	a := &Analysis{Repository: repository, Commit: commit}
+	err := db.QueryRowContext(ctx, q, repository, commit).Scan(
+		&a.Total.Code,
+		&a.Total.Comment,
+		&a.Total.Blank,
+		&a.Ctime)
+	if err != nil {
+		return nil, err
+	}
+
+	a.Languages, err = readLanguages(ctx, repository, commit, db)
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// latestCommit returns the commit of the most recently stored analysis
+// of repository
+func latestCommit(ctx context.Context, repository string, db *sql.DB) (string, error) {
+	q := fmt.Sprintf(`select commit_hash
+                          from %s
+                          where repository = ?
+                          order by ctime desc, rowid desc
+                          limit 1`,
+		app.AnalysesTableName)
+
+	var commit string
+	err := db.QueryRowContext(ctx, q, repository).Scan(&commit)
+	return commit, err
+}
+
+// Latest reads the most recently stored analysis of repository
+func Latest(ctx context.Context, repository string, db *sql.DB) (*Analysis, error) {
+	commit, err := latestCommit(ctx, repository, db)
+	if err != nil {
+		return nil, err
+	}
+	return Read(ctx, repository, commit, db)
+}
+
+// LatestSummary is Latest without per-file counts
+func LatestSummary(ctx context.Context, repository string, db *sql.DB) (*Analysis, error) {
+	commit, err := latestCommit(ctx, repository, db)
+	if err != nil {
+		return nil, err
+	}
+	return ReadSummary(ctx, repository, commit, db)
+}
+
+func readLanguages(ctx context.Context, repository, commit string, db *sql.DB) ([]LanguageCounts, error) {
+	q := fmt.Sprintf(`select
+                          language,
+                          files,
+                          code,
+                          comment,
+                          blank
+                          from %s
+                          where repository = ?
+                          and commit_hash = ?`,
+		app.AnalysisLanguagesTableName)
+
+	rows, err := db.QueryContext(ctx, q, repository, commit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ls := []LanguageCounts{}
+	for rows.Next() {
+		var lc LanguageCounts
+		err = rows.Scan(&lc.Language, &lc.Files, &lc.Code, &lc.Comment, &lc.Blank)
+		if err != nil {
+			return nil, err
+		}
+		ls = append(ls, lc)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	SortLanguages(ls)
+	return ls, nil
+}
+
+func readFiles(ctx context.Context, repository, commit string, db *sql.DB) ([]File, error) {
+	q := fmt.Sprintf(`select
+                          path,
+                          language,
+                          code,
+                          comment,
+                          blank
+                          from %s
+                          where repository = ?
+                          and commit_hash = ?
+                          order by path`,
+		app.AnalysisFilesTableName)
+
+	rows, err := db.QueryContext(ctx, q, repository, commit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fs := []File{}
+	for rows.Next() {
+		var f File
+		err = rows.Scan(&f.Path, &f.Language, &f.Code, &f.Comment, &f.Blank)
+		if err != nil {
+			return nil, err
+		}
+		fs = append(fs, f)
+	}
+	return fs, rows.Err()
+}
+
+// InsertHistory stores points for repository, replacing any stored
+// points for the same commits
+func InsertHistory(ctx context.Context, repository string, points []Point, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint
+
+	for _, p := range points {
+		for _, tableName := range []string{
+			app.HistoryLanguagesTableName,
+			app.HistoryTableName,
+		} {
+			q := fmt.Sprintf(`delete from %s where repository = ? and commit_hash = ?`, tableName)
+			_, err = tx.ExecContext(ctx, q, repository, p.Commit)
+			if err != nil {
+				return err
+			}
+		}
+
+		q := fmt.Sprintf(`insert into %s
+                                  (repository,
+                                   commit_hash,
+                                   committed,
+                                   code,
+                                   comment,
+                                   blank)
+                                  values
+                                  (?,?,?,?,?,?)`,
+			app.HistoryTableName)
+		_, err = tx.ExecContext(ctx, q,
+			repository,
+			p.Commit,
+			p.Committed,
+			p.Total.Code,
+			p.Total.Comment,
+			p.Total.Blank)
+		if err != nil {
+			return err
+		}
+
+		q = fmt.Sprintf(`insert into %s
+                                 (repository,
+                                  commit_hash,
+                                  language,
+                                  files,
+                                  code,
+                                  comment,
+                                  blank)
+                                 values
+                                 (?,?,?,?,?,?,?)`,
+			app.HistoryLanguagesTableName)
+		for _, lc := range p.Languages {
+			_, err = tx.ExecContext(ctx, q,
+				repository,
+				p.Commit,
+				lc.Language,
+				lc.Files,
+				lc.Code,
+				lc.Comment,
+				lc.Blank)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CreateHistory analyzes the history of rev in the mirror of r selected
+// by sample and stores the resulting points
+func CreateHistory(ctx context.Context, r *repository.Repository, rev string, sample Sample, db *sql.DB) ([]Point, error) {
+	points, err := History(ctx, r.Path, rev, sample)
+	if err != nil {
+		return nil, err
+	}
+
+	err = InsertHistory(ctx, r.ID, points, db)
+	if err != nil {
+		return nil, err
+	}
+
+	return points, nil
+}
+
+// ReadHistory reads all stored points for repository, oldest first
+func ReadHistory(ctx context.Context, repository string, db *sql.DB) ([]Point, error) {
+	q := fmt.Sprintf(`select
+                          commit_hash,
+                          committed,
+                          code,
+                          comment,
+                          blank
+                          from %s
+                          where repository = ?
+                          order by committed, commit_hash`,
+		app.HistoryTableName)
+
+	rows, err := db.QueryContext(ctx, q, repository)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := []Point{}
+	byCommit := map[string]int{}
+	for rows.Next() {
+		p := Point{Languages: []LanguageCounts{}}
+		err = rows.Scan(&p.Commit, &p.Committed, &p.Total.Code, &p.Total.Comment, &p.Total.Blank)
+		if err != nil {
+			return nil, err
+		}
+		byCommit[p.Commit] = len(points)
+		points = append(points, p)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	q = fmt.Sprintf(`select
+                         commit_hash,
+                         language,
+                         files,
+                         code,
+                         comment,
+                         blank
+                         from %s
+                         where repository = ?`,
+		app.HistoryLanguagesTableName)
+
+	rows, err = db.QueryContext(ctx, q, repository)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var commit string
+		var lc LanguageCounts
+		err = rows.Scan(&commit, &lc.Language, &lc.Files, &lc.Code, &lc.Comment, &lc.Blank)
+		if err != nil {
+			return nil, err
+		}
+		i, ok := byCommit[commit]
+		if !ok {
+			continue
+		}
+		points[i].Languages = append(points[i].Languages, lc)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range points {
+		SortLanguages(points[i].Languages)
+	}
+	return points, nil
+}
@@ -0,0 +1,130 @@
+package analysis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grokloc/grokloc-server/pkg/git"
+)
+
+// ErrSample means a Sample does not select commits in exactly one way
+var ErrSample = errors.New("sample must set exactly one of every or daily")
+
+// Sample selects the commits of a history to analyze
+//
+// History follows first parents back from the tip, so merged branches
+// contribute only their merge commit
+type Sample struct {
+	Every int  `json:"every"` // every Nth commit back from the tip, if > 0
+	Daily bool `json:"daily"` // or, the tip-most commit of each UTC day
+	Limit int  `json:"limit"` // at most Limit most recent points; 0 for all
+}
+
+// Validate checks that s selects commits in exactly one way
+func (s Sample) Validate() error {
+	if s.Every < 0 || s.Limit < 0 || (s.Every > 0) == s.Daily {
+		return ErrSample
+	}
+	return nil
+}
+
+// Point is the line counts of a repository at one commit in its history
+type Point struct {
+	Commit    string           `json:"commit"`
+	Committed int64            `json:"committed"` // unix committer time
+	Total     Counts           `json:"total"`
+	Languages []LanguageCounts `json:"languages"` // most code first
+}
+
+// logEntry is a commit listed by git log
+type logEntry struct {
+	hash      string
+	committed int64
+}
+
+// History analyzes the commits of rev's history in the repository at
+// gitDir selected by sample, returning points oldest first
+//
+// Files unchanged between selected commits are only read once
+func History(ctx context.Context, gitDir, rev string, sample Sample) ([]Point, error) {
+	err := sample.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	tip, err := git.ResolveCommit(ctx, gitDir, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	log, err := firstParents(ctx, gitDir, tip)
+	if err != nil {
+		return nil, err
+	}
+	selected := sample.selectFrom(log)
+
+	cache := map[entry]*File{}
+	points := make([]Point, len(selected))
+	// selected is tip first; points are oldest first
+	for i, c := range selected {
+		a, err := analyzeCommit(ctx, gitDir, "", c.hash, cache)
+		if err != nil {
+			return nil, err
+		}
+		points[len(selected)-1-i] = Point{
+			Commit:    c.hash,
+			Committed: c.committed,
+			Total:     a.Total,
+			Languages: a.Languages,
+		}
+	}
+	return points, nil
+}
+
+// firstParents lists the first parent history of tip, tip first
+func firstParents(ctx context.Context, gitDir, tip string) ([]logEntry, error) {
+	out, err := git.Output(ctx, gitDir, "log", "--first-parent", "--format=%H %ct", tip)
+	if err != nil {
+		return nil, err
+	}
+	log := []logEntry{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("log line %q", line)
+		}
+		committed, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("log line %q: %w", line, err)
+		}
+		log = append(log, logEntry{hash: fields[0], committed: committed})
+	}
+	return log, nil
+}
+
+// selectFrom returns the entries of log, tip first, chosen by s
+func (s Sample) selectFrom(log []logEntry) []logEntry {
+	selected := []logEntry{}
+	days := map[string]bool{}
+	for i, c := range log {
+		if s.Limit > 0 && len(selected) == s.Limit {
+			break
+		}
+		if s.Every > 0 {
+			if i%s.Every == 0 {
+				selected = append(selected, c)
+			}
+			continue
+		}
+		day := time.Unix(c.committed, 0).UTC().Format("2006-01-02")
+		if !days[day] {
+			days[day] = true
+			selected = append(selected, c)
+		}
+	}
+	return selected
+}
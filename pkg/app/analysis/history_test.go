@@ -0,0 +1,113 @@
+package analysis
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// commitAt writes the line "x" to name in the upstream and commits it at t
+func (s *AnalysisSuite) commitAt(t time.Time, name string) string {
+	s.write(name, "x\n")
+	s.run("add", "--all")
+	cmd := exec.Command("git",
+		"-c", "user.name=test", "-c", "user.email=test@localhost",
+		"commit", "--quiet", "-m", name)
+	cmd.Dir = s.dir
+	date := t.UTC().Format(time.RFC3339)
+	cmd.Env = append(os.Environ(), "GIT_COMMITTER_DATE="+date, "GIT_AUTHOR_DATE="+date)
+	require.Nil(s.T(), cmd.Run())
+	return s.run("rev-parse", "HEAD")
+}
+
+// newHistory replaces the upstream with one of five commits, each adding
+// one line of go, two on each of two days, then one on a third day
+func (s *AnalysisSuite) newHistory() []string {
+	s.dir = s.T().TempDir()
+	s.run("init", "--quiet")
+	day := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+	return []string{
+		s.commitAt(day, "a.go"),
+		s.commitAt(day.Add(time.Hour), "b.go"),
+		s.commitAt(day.Add(24*time.Hour), "c.go"),
+		s.commitAt(day.Add(25*time.Hour), "d.go"),
+		s.commitAt(day.Add(48*time.Hour), "e.go"),
+	}
+}
+
+func commits(points []Point) []string {
+	cs := []string{}
+	for _, p := range points {
+		cs = append(cs, p.Commit)
+	}
+	return cs
+}
+
+func (s *AnalysisSuite) TestHistory() {
+	ctx := context.Background()
+	hashes := s.newHistory()
+	gitDir := filepath.Join(s.dir, ".git")
+
+	points, err := History(ctx, gitDir, "HEAD", Sample{Every: 1})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), hashes, commits(points))
+	for i, p := range points {
+		// each commit adds a line
+		require.Equal(s.T(), i+1, p.Total.Code)
+		require.Equal(s.T(), []LanguageCounts{{Language: "Go", Files: i + 1, Counts: Counts{Code: i + 1}}}, p.Languages)
+	}
+	require.Equal(s.T(), time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC).Unix(), points[0].Committed)
+
+	// counted back from the tip
+	points, err = History(ctx, gitDir, "HEAD", Sample{Every: 2})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), []string{hashes[0], hashes[2], hashes[4]}, commits(points))
+
+	// the last commit of each day
+	points, err = History(ctx, gitDir, "HEAD", Sample{Daily: true})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), []string{hashes[1], hashes[3], hashes[4]}, commits(points))
+
+	points, err = History(ctx, gitDir, "HEAD", Sample{Daily: true, Limit: 2})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), []string{hashes[3], hashes[4]}, commits(points))
+
+	// from an earlier commit
+	points, err = History(ctx, gitDir, hashes[1], Sample{Every: 1})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), hashes[:2], commits(points))
+
+	for _, sample := range []Sample{{}, {Every: 1, Daily: true}, {Every: -1}, {Daily: true, Limit: -1}} {
+		_, err = History(ctx, gitDir, "HEAD", sample)
+		require.Equal(s.T(), ErrSample, err)
+	}
+}
+
+func (s *AnalysisSuite) TestReadHistory() {
+	ctx := context.Background()
+	hashes := s.newHistory()
+	repository := uuid.NewString()
+
+	points, err := ReadHistory(ctx, repository, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Empty(s.T(), points)
+
+	points, err = History(ctx, filepath.Join(s.dir, ".git"), "HEAD", Sample{Daily: true})
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), InsertHistory(ctx, repository, points, s.st.Master))
+
+	// overlapping points are replaced
+	more, err := History(ctx, filepath.Join(s.dir, ".git"), "HEAD", Sample{Every: 2})
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), InsertHistory(ctx, repository, more, s.st.Master))
+
+	read, err := ReadHistory(ctx, repository, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), []string{hashes[0], hashes[1], hashes[2], hashes[3], hashes[4]}, commits(read))
+	require.Equal(s.T(), points[len(points)-1], read[len(read)-1])
+}
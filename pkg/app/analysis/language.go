@@ -0,0 +1,183 @@
+package analysis
+
+import (
+	"bytes"
+	"path"
+	"strings"
+)
+
+// Language describes how to recognize comments in a source language
+type Language struct {
+	Name          string
+	LineComments  []string    // e.g. "//"
+	BlockComments [][2]string // start and end, e.g. "/*", "*/"
+}
+
+// comment syntaxes shared by many languages
+var (
+	cLine     = []string{"//"}
+	cBlock    = [][2]string{{"/*", "*/"}}
+	hashLine  = []string{"#"}
+	dashLine  = []string{"--"}
+	htmlBlock = [][2]string{{"<!--", "-->"}}
+)
+
+// Languages are all recognized languages, by name
+var Languages = map[string]*Language{
+	"C":          {Name: "C", LineComments: cLine, BlockComments: cBlock},
+	"C#":         {Name: "C#", LineComments: cLine, BlockComments: cBlock},
+	"C++":        {Name: "C++", LineComments: cLine, BlockComments: cBlock},
+	"CSS":        {Name: "CSS", BlockComments: cBlock},
+	"Dockerfile": {Name: "Dockerfile", LineComments: hashLine},
+	"Elixir":     {Name: "Elixir", LineComments: hashLine},
+	"Erlang":     {Name: "Erlang", LineComments: []string{"%"}},
+	"Go":         {Name: "Go", LineComments: cLine, BlockComments: cBlock},
+	"Haskell":    {Name: "Haskell", LineComments: dashLine, BlockComments: [][2]string{{"{-", "-}"}}},
+	"HTML":       {Name: "HTML", BlockComments: htmlBlock},
+	"Java":       {Name: "Java", LineComments: cLine, BlockComments: cBlock},
+	"JavaScript": {Name: "JavaScript", LineComments: cLine, BlockComments: cBlock},
+	"JSON":       {Name: "JSON"},
+	"Kotlin":     {Name: "Kotlin", LineComments: cLine, BlockComments: cBlock},
+	"Lua":        {Name: "Lua", LineComments: dashLine, BlockComments: [][2]string{{"--[[", "]]"}}},
+	"Makefile":   {Name: "Makefile", LineComments: hashLine},
+	"Markdown":   {Name: "Markdown", BlockComments: htmlBlock},
+	"Perl":       {Name: "Perl", LineComments: hashLine},
+	"PHP":        {Name: "PHP", LineComments: []string{"//", "#"}, BlockComments: cBlock},
+	"Python":     {Name: "Python", LineComments: hashLine},
+	"R":          {Name: "R", LineComments: hashLine},
+	"Ruby":       {Name: "Ruby", LineComments: hashLine},
+	"Rust":       {Name: "Rust", LineComments: cLine, BlockComments: cBlock},
+	"Scala":      {Name: "Scala", LineComments: cLine, BlockComments: cBlock},
+	"Shell":      {Name: "Shell", LineComments: hashLine},
+	"SQL":        {Name: "SQL", LineComments: dashLine, BlockComments: cBlock},
+	"Swift":      {Name: "Swift", LineComments: cLine, BlockComments: cBlock},
+	"TOML":       {Name: "TOML", LineComments: hashLine},
+	"TypeScript": {Name: "TypeScript", LineComments: cLine, BlockComments: cBlock},
+	"XML":        {Name: "XML", BlockComments: htmlBlock},
+	"YAML":       {Name: "YAML", LineComments: hashLine},
+}
+
+// extensions maps a lower case file extension to a language name
+var extensions = map[string]string{
+	".bash":  "Shell",
+	".c":     "C",
+	".cc":    "C++",
+	".cpp":   "C++",
+	".cs":    "C#",
+	".css":   "CSS",
+	".cxx":   "C++",
+	".erl":   "Erlang",
+	".ex":    "Elixir",
+	".exs":   "Elixir",
+	".go":    "Go",
+	".h":     "C",
+	".hpp":   "C++",
+	".hs":    "Haskell",
+	".htm":   "HTML",
+	".html":  "HTML",
+	".java":  "Java",
+	".js":    "JavaScript",
+	".json":  "JSON",
+	".jsx":   "JavaScript",
+	".kt":    "Kotlin",
+	".kts":   "Kotlin",
+	".lua":   "Lua",
+	".md":    "Markdown",
+	".mjs":   "JavaScript",
+	".mk":    "Makefile",
+	".php":   "PHP",
+	".pl":    "Perl",
+	".pm":    "Perl",
+	".py":    "Python",
+	".r":     "R",
+	".rb":    "Ruby",
+	".rs":    "Rust",
+	".scala": "Scala",
+	".sh":    "Shell",
+	".sql":   "SQL",
+	".swift": "Swift",
+	".toml":  "TOML",
+	".ts":    "TypeScript",
+	".tsx":   "TypeScript",
+	".xml":   "XML",
+	".yaml":  "YAML",
+	".yml":   "YAML",
+	".zsh":   "Shell",
+}
+
+// filenames maps an exact file name to a language name
+var filenames = map[string]string{
+	"Dockerfile":  "Dockerfile",
+	"GNUmakefile": "Makefile",
+	"Gemfile":     "Ruby",
+	"Makefile":    "Makefile",
+	"Rakefile":    "Ruby",
+	"makefile":    "Makefile",
+}
+
+// interpreters maps a shebang interpreter, without version suffix,
+// to a language name
+var interpreters = map[string]string{
+	"bash":   "Shell",
+	"dash":   "Shell",
+	"ksh":    "Shell",
+	"lua":    "Lua",
+	"node":   "JavaScript",
+	"perl":   "Perl",
+	"php":    "PHP",
+	"python": "Python",
+	"ruby":   "Ruby",
+	"sh":     "Shell",
+	"zsh":    "Shell",
+}
+
+// Classify returns the language of the file at name with content,
+// or nil if it is not recognized
+//
+// Exact file names are checked first, then extensions, then a
+// shebang on the first line
+func Classify(name string, content []byte) *Language {
+	base := path.Base(name)
+	if l, ok := filenames[base]; ok {
+		return Languages[l]
+	}
+	if strings.HasPrefix(base, "Dockerfile.") {
+		return Languages["Dockerfile"]
+	}
+	if l, ok := extensions[strings.ToLower(path.Ext(base))]; ok {
+		return Languages[l]
+	}
+	if l, ok := interpreters[interpreter(content)]; ok {
+		return Languages[l]
+	}
+	return nil
+}
+
+// interpreter returns the versionless interpreter named by a shebang
+// at the start of content, or ""
+func interpreter(content []byte) string {
+	if !bytes.HasPrefix(content, []byte("#!")) {
+		return ""
+	}
+	line := content[2:]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return ""
+	}
+	name := path.Base(fields[0])
+	if name == "env" {
+		// skip env's own flags, e.g. #!/usr/bin/env -S python3 -u
+		name = ""
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "-") {
+				name = path.Base(f)
+				break
+			}
+		}
+	}
+	// python3.11 -> python
+	return strings.TrimRight(name, "0123456789.")
+}
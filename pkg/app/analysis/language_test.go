@@ -0,0 +1,56 @@
+package analysis
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type LanguageSuite struct {
+	suite.Suite
+}
+
+func (s *LanguageSuite) TestClassify() {
+	for _, c := range []struct {
+		name, content, language string
+	}{
+		{"main.go", "", "Go"},
+		{"a/b/C.JAVA", "", "Java"},
+		{"Makefile", "", "Makefile"},
+		{"sub/Dockerfile.base", "", "Dockerfile"},
+		{"run", "#!/bin/bash\necho", "Shell"},
+		{"tool", "#!/usr/bin/env python3.11\n", "Python"},
+		{"tool", "#!/usr/bin/env -S node --flag\n", "JavaScript"},
+		// names win over shebangs
+		{"x.rb", "#!/bin/sh\n", "Ruby"},
+	} {
+		l := Classify(c.name, []byte(c.content))
+		require.NotNil(s.T(), l, c.name)
+		require.Equal(s.T(), c.language, l.Name, c.name)
+	}
+
+	for _, c := range []struct{ name, content string }{
+		{"README", "text"},
+		{"LICENSE", "#!"},
+		{"x.unknown", "#!/usr/bin/env"},
+		{"bin", "#!/usr/bin/awk -f\n"},
+	} {
+		require.Nil(s.T(), Classify(c.name, []byte(c.content)), c.name)
+	}
+}
+
+func (s *LanguageSuite) TestLanguagesComplete() {
+	// every mapped name has a Language
+	for _, m := range []map[string]string{extensions, filenames, interpreters} {
+		for k, name := range m {
+			l, ok := Languages[name]
+			require.True(s.T(), ok, k)
+			require.Equal(s.T(), name, l.Name)
+		}
+	}
+}
+
+func TestLanguageSuite(t *testing.T) {
+	suite.Run(t, new(LanguageSuite))
+}
@@ -12,12 +12,19 @@ import (
 )
 
 const (
-	STATUS            int = 10
-	ORG_INSERT        int = 100
-	ORG_OWNER         int = 101
-	USER_INSERT       int = 200
-	USER_DISPLAY_NAME int = 201
-	USER_PASSWORD     int = 202
+	STATUS               int = 10
+	ORG_INSERT           int = 100
+	ORG_OWNER            int = 101
+	USER_INSERT          int = 200
+	USER_DISPLAY_NAME    int = 201
+	USER_PASSWORD        int = 202
+	USER_API_SECRET      int = 203
+	USER_SHRED           int = 204
+	USER_PASSWORD_REHASH int = 205
+	REPOSITORY_INSERT    int = 300
+	REPOSITORY_UPSTREAM  int = 301
+	TOKEN_KEY            int = 400
+	LOCKOUT              int = 500
 )
 
 func Insert(
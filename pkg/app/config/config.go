@@ -0,0 +1,488 @@
+// Package config loads and validates the settings used to build app state
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/env"
+	"github.com/grokloc/grokloc-server/pkg/security"
+	"github.com/matthewhartstonge/argon2"
+)
+
+// environment variables read by Load
+// (these override values found in the file named by FileEnv)
+const (
+	FileEnv               = "GROKLOC_CONFIG"
+	HostEnv               = "APP_HOST"
+	PortEnv               = "APP_PORT"
+	MasterDSNEnv          = "GROKLOC_MASTER_DSN"
+	ReplicaDSNsEnv        = "GROKLOC_REPLICA_DSNS" // comma-separated
+	DBKeyEnv              = "GROKLOC_DB_KEY"
+	DBKeyIDEnv            = "GROKLOC_DB_KEY_ID"
+	DBRetiredKeysEnv      = "GROKLOC_DB_RETIRED_KEYS" // comma-separated id:key
+	TokenKeyEnv           = "GROKLOC_TOKEN_KEY"
+	DigestKeyEnv          = "GROKLOC_DIGEST_KEY"
+	Argon2MemoryEnv       = "GROKLOC_ARGON2_MEMORY"
+	Argon2TimeEnv         = "GROKLOC_ARGON2_TIME"
+	Argon2ParallelismEnv  = "GROKLOC_ARGON2_PARALLELISM"
+	RootOrgEnv            = "GROKLOC_ROOT_ORG"
+	RootDisplayNameEnv    = "GROKLOC_ROOT_DISPLAY_NAME"
+	RootEmailEnv          = "GROKLOC_ROOT_EMAIL"
+	RootPasswordEnv       = "GROKLOC_ROOT_PASSWORD"
+	RequestTimeoutEnv     = "GROKLOC_REQUEST_TIMEOUT"
+	ShutdownTimeoutEnv    = "GROKLOC_SHUTDOWN_TIMEOUT"
+	SweepIntervalEnv      = "GROKLOC_SWEEP_INTERVAL"
+	RepositoryRootEnv     = "GROKLOC_REPOSITORY_ROOT"
+	MirrorIntervalEnv     = "GROKLOC_MIRROR_INTERVAL"
+	JobWorkersEnv         = "GROKLOC_JOB_WORKERS"
+	JobVisibilityEnv      = "GROKLOC_JOB_VISIBILITY"
+	AllowFileUpstreamsEnv = "GROKLOC_ALLOW_FILE_UPSTREAMS"
+	TrustedProxiesEnv     = "GROKLOC_TRUSTED_PROXIES" // comma-separated ips or cidrs
+)
+
+// defaults applied before the file and env are read
+const (
+	DefaultPort            = "3000"
+	DefaultRootOrgName     = "root"
+	DefaultDevMasterDSN    = "file:grokloc-dev.db?_journal_mode=WAL&_busy_timeout=5000"
+	DefaultRequestTimeout  = Duration(5 * time.Second)
+	DefaultShutdownTimeout = Duration(10 * time.Second)
+	DefaultSweepInterval   = Duration(time.Hour)
+	DefaultRepositoryRoot  = "repositories"
+	DefaultMirrorInterval  = Duration(15 * time.Minute)
+	DefaultJobWorkers      = 2
+	DefaultJobVisibility   = Duration(10 * time.Minute)
+)
+
+// UnitMasterDSN is the shared in-memory db used at the Unit level
+const UnitMasterDSN = "file::memory:?mode=memory&cache=shared"
+
+// ErrInvalid signals a config that failed validation
+var ErrInvalid = errors.New("invalid config")
+
+// Root describes the root org and its owner
+//
+// Only OrgName is needed once the root org exists; the owner fields
+// are used solely when the root org is first created
+type Root struct {
+	OrgName          string `json:"org_name"`
+	OwnerDisplayName string `json:"owner_display_name"`
+	OwnerEmail       string `json:"owner_email"`
+	OwnerPassword    Secret `json:"owner_password"` // cleartext, derived on create
+}
+
+// Argon2 holds the tunable argon2 password derivation parameters
+type Argon2 struct {
+	MemoryCost  uint32 `json:"memory_cost"`
+	TimeCost    uint32 `json:"time_cost"`
+	Parallelism uint8  `json:"parallelism"`
+}
+
+// Config contains all settings needed to build app state and serve
+type Config struct {
+	Level           env.Level         `json:"-"`
+	Host            string            `json:"host"`
+	Port            string            `json:"port"`
+	MasterDSN       string            `json:"master_dsn"`
+	ReplicaDSNs     []string          `json:"replica_dsns"`
+	DBKey           Secret            `json:"db_key"`
+	DBKeyID         string            `json:"db_key_id"`       // tags values encrypted with DBKey
+	DBRetiredKeys   map[string]Secret `json:"db_retired_keys"` // by key id, for reading only
+	TokenKey        Secret            `json:"token_key"`
+	DigestKey       Secret            `json:"digest_key"` // keys digests that must not be checkable by hashing a guess; cannot be rotated
+	Argon2          Argon2            `json:"argon2"`
+	Root            Root              `json:"root"`
+	RequestTimeout  Duration          `json:"request_timeout"`
+	ShutdownTimeout Duration          `json:"shutdown_timeout"`
+	SweepInterval   Duration          `json:"sweep_interval"` // 0 disables
+	RepositoryRoot  string            `json:"repository_root"`
+	MirrorInterval  Duration          `json:"mirror_interval"` // 0 disables
+	JobWorkers      int               `json:"job_workers"`     // 0 disables
+	JobVisibility   Duration          `json:"job_visibility"`  // lease, and timeout, of one job attempt
+	// AllowFileUpstreams permits file:// upstreams, which can read any
+	// path the server can, including other orgs' mirrors
+	AllowFileUpstreams bool `json:"allow_file_upstreams"`
+	// TrustedProxies are the ips or cidrs of proxies whose X-Forwarded-For
+	// and X-Real-IP headers name the client; requests from other peers
+	// are identified by their own address
+	TrustedProxies []string `json:"trusted_proxies"`
+}
+
+// Default returns the default config for level
+//
+// Unit is fully populated, with random keys and root identity; other
+// levels must supply keys, and Stage and Prod must supply DSNs
+func Default(level env.Level) *Config {
+	defaultArgon2 := argon2.DefaultConfig()
+	c := &Config{
+		Level: level,
+		Port:  DefaultPort,
+		Argon2: Argon2{
+			MemoryCost:  defaultArgon2.MemoryCost,
+			TimeCost:    defaultArgon2.TimeCost,
+			Parallelism: defaultArgon2.Parallelism,
+		},
+		DBKeyID:         security.LegacyKeyID,
+		Root:            Root{OrgName: DefaultRootOrgName},
+		RequestTimeout:  DefaultRequestTimeout,
+		ShutdownTimeout: DefaultShutdownTimeout,
+		SweepInterval:   DefaultSweepInterval,
+		MirrorInterval:  DefaultMirrorInterval,
+		JobWorkers:      DefaultJobWorkers,
+		JobVisibility:   DefaultJobVisibility,
+	}
+	switch level {
+	case env.Unit:
+		c.MasterDSN = UnitMasterDSN
+		c.AllowFileUpstreams = true
+		c.RepositoryRoot = filepath.Join(os.TempDir(), "grokloc-unit", DefaultRepositoryRoot)
+		c.DBKey = randomKey()
+		c.TokenKey = randomKey()
+		c.DigestKey = randomKey()
+		c.Root = Root{
+			OrgName:          uuid.NewString(),
+			OwnerDisplayName: uuid.NewString(),
+			OwnerEmail:       uuid.NewString(),
+			OwnerPassword:    Secret(uuid.NewString()),
+		}
+	case env.Dev:
+		c.MasterDSN = DefaultDevMasterDSN
+		c.AllowFileUpstreams = true
+		c.RepositoryRoot = DefaultRepositoryRoot
+	}
+	return c
+}
+
+// randomKey returns a random KeyLen key
+func randomKey() Secret {
+	key, err := security.MakeKey(uuid.NewString())
+	if err != nil {
+		// MakeKey cannot fail for a sha256 input
+		panic(err.Error())
+	}
+	return Secret(key)
+}
+
+// Load builds a config for level from defaults, then the optional
+// JSON file named by FileEnv, then individual environment variables,
+// and validates the result
+func Load(level env.Level) (*Config, error) {
+	c := Default(level)
+
+	path := os.Getenv(FileEnv)
+	if len(path) != 0 {
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("config file: %w", err)
+		}
+		err = json.Unmarshal(bs, c)
+		if err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+
+	err := c.fromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// fromEnv overrides fields with any set environment variables
+func (c *Config) fromEnv() error {
+	setString := func(name string, field *string) {
+		if v, ok := os.LookupEnv(name); ok {
+			*field = v
+		}
+	}
+	setSecret := func(name string, field *Secret) {
+		if v, ok := os.LookupEnv(name); ok {
+			*field = Secret(v)
+		}
+	}
+	setUint := func(name string, bits int, set func(uint64)) error {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil
+		}
+		n, err := strconv.ParseUint(v, 10, bits)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		set(n)
+		return nil
+	}
+	setBool := func(name string, field *bool) error {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		*field = b
+		return nil
+	}
+	setDuration := func(name string, field *Duration) error {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		*field = Duration(d)
+		return nil
+	}
+
+	setString(HostEnv, &c.Host)
+	setString(PortEnv, &c.Port)
+	setString(MasterDSNEnv, &c.MasterDSN)
+	setString(RepositoryRootEnv, &c.RepositoryRoot)
+	if v, ok := os.LookupEnv(ReplicaDSNsEnv); ok {
+		c.ReplicaDSNs = []string{}
+		for _, dsn := range strings.Split(v, ",") {
+			dsn = strings.TrimSpace(dsn)
+			if len(dsn) != 0 {
+				c.ReplicaDSNs = append(c.ReplicaDSNs, dsn)
+			}
+		}
+	}
+	if v, ok := os.LookupEnv(TrustedProxiesEnv); ok {
+		c.TrustedProxies = []string{}
+		for _, proxy := range strings.Split(v, ",") {
+			proxy = strings.TrimSpace(proxy)
+			if len(proxy) != 0 {
+				c.TrustedProxies = append(c.TrustedProxies, proxy)
+			}
+		}
+	}
+	setSecret(DBKeyEnv, &c.DBKey)
+	setString(DBKeyIDEnv, &c.DBKeyID)
+	if v, ok := os.LookupEnv(DBRetiredKeysEnv); ok {
+		c.DBRetiredKeys = map[string]Secret{}
+		for _, pair := range strings.Split(v, ",") {
+			pair = strings.TrimSpace(pair)
+			if len(pair) == 0 {
+				continue
+			}
+			id, key, ok := strings.Cut(pair, ":")
+			if !ok {
+				return fmt.Errorf("%s: entry is not id:key", DBRetiredKeysEnv)
+			}
+			c.DBRetiredKeys[id] = Secret(key)
+		}
+	}
+	setSecret(TokenKeyEnv, &c.TokenKey)
+	setSecret(DigestKeyEnv, &c.DigestKey)
+	setString(RootOrgEnv, &c.Root.OrgName)
+	setString(RootDisplayNameEnv, &c.Root.OwnerDisplayName)
+	setString(RootEmailEnv, &c.Root.OwnerEmail)
+	setSecret(RootPasswordEnv, &c.Root.OwnerPassword)
+
+	err := setUint(Argon2MemoryEnv, 32, func(n uint64) { c.Argon2.MemoryCost = uint32(n) })
+	if err != nil {
+		return err
+	}
+	err = setUint(Argon2TimeEnv, 32, func(n uint64) { c.Argon2.TimeCost = uint32(n) })
+	if err != nil {
+		return err
+	}
+	err = setUint(Argon2ParallelismEnv, 8, func(n uint64) { c.Argon2.Parallelism = uint8(n) })
+	if err != nil {
+		return err
+	}
+	err = setUint(JobWorkersEnv, 16, func(n uint64) { c.JobWorkers = int(n) })
+	if err != nil {
+		return err
+	}
+	err = setDuration(RequestTimeoutEnv, &c.RequestTimeout)
+	if err != nil {
+		return err
+	}
+	err = setDuration(ShutdownTimeoutEnv, &c.ShutdownTimeout)
+	if err != nil {
+		return err
+	}
+	err = setDuration(SweepIntervalEnv, &c.SweepInterval)
+	if err != nil {
+		return err
+	}
+	err = setDuration(MirrorIntervalEnv, &c.MirrorInterval)
+	if err != nil {
+		return err
+	}
+	err = setBool(AllowFileUpstreamsEnv, &c.AllowFileUpstreams)
+	if err != nil {
+		return err
+	}
+	return setDuration(JobVisibilityEnv, &c.JobVisibility)
+}
+
+// Validate checks that all fields are usable for c.Level
+func (c *Config) Validate() error {
+	invalid := func(format string, a ...interface{}) error {
+		return fmt.Errorf("%w: %s", ErrInvalid, fmt.Sprintf(format, a...))
+	}
+	if c.Level == env.None {
+		return invalid("level is None")
+	}
+	if _, err := strconv.ParseUint(c.Port, 10, 16); err != nil {
+		return invalid("port %q", c.Port)
+	}
+	if len(c.MasterDSN) == 0 {
+		return invalid("master dsn is empty")
+	}
+	if (c.Level == env.Stage || c.Level == env.Prod) && len(c.ReplicaDSNs) == 0 {
+		return invalid("replica dsns are required for stage and prod")
+	}
+	for i, dsn := range c.ReplicaDSNs {
+		if len(dsn) == 0 {
+			return invalid("replica dsn %d is empty", i)
+		}
+	}
+	if len(c.RepositoryRoot) == 0 {
+		return invalid("repository root is empty")
+	}
+	for _, proxy := range c.TrustedProxies {
+		if _, err := parseProxy(proxy); err != nil {
+			return invalid("trusted proxy %q", proxy)
+		}
+	}
+	if len(c.DBKey) != security.KeyLen {
+		return invalid("db key length is not %d", security.KeyLen)
+	}
+	if security.ValidKeyID(c.DBKeyID) != nil {
+		return invalid("db key id %q", c.DBKeyID)
+	}
+	for id, key := range c.DBRetiredKeys {
+		if security.ValidKeyID(id) != nil || id == c.DBKeyID {
+			return invalid("db retired key id %q", id)
+		}
+		if len(key) != security.KeyLen {
+			return invalid("db retired key %s length is not %d", id, security.KeyLen)
+		}
+	}
+	if len(c.TokenKey) != security.KeyLen {
+		return invalid("token key length is not %d", security.KeyLen)
+	}
+	if len(c.DigestKey) != security.KeyLen {
+		return invalid("digest key length is not %d", security.KeyLen)
+	}
+	if c.Argon2.MemoryCost == 0 || c.Argon2.TimeCost == 0 || c.Argon2.Parallelism == 0 {
+		return invalid("argon2 costs must be nonzero")
+	}
+	if len(c.Root.OrgName) == 0 {
+		return invalid("root org name is empty")
+	}
+	if c.RequestTimeout <= 0 || c.ShutdownTimeout <= 0 {
+		return invalid("timeouts must be positive")
+	}
+	if c.SweepInterval < 0 {
+		return invalid("sweep interval is negative")
+	}
+	if c.MirrorInterval < 0 {
+		return invalid("mirror interval is negative")
+	}
+	if c.JobWorkers < 0 {
+		return invalid("job workers is negative")
+	}
+	if c.JobVisibility <= 0 {
+		return invalid("job visibility must be positive")
+	}
+	return nil
+}
+
+// Addr is the listen address
+func (c *Config) Addr() string {
+	return net.JoinHostPort(c.Host, c.Port)
+}
+
+// TrustedProxyNets parses TrustedProxies, skipping any that are invalid
+func (c *Config) TrustedProxyNets() []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, proxy := range c.TrustedProxies {
+		n, err := parseProxy(proxy)
+		if err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+// parseProxy parses a cidr, or an ip as the network of just that ip
+func parseProxy(proxy string) (*net.IPNet, error) {
+	if strings.Contains(proxy, "/") {
+		_, n, err := net.ParseCIDR(proxy)
+		return n, err
+	}
+	ip := net.ParseIP(proxy)
+	if ip == nil {
+		return nil, fmt.Errorf("not an ip: %s", proxy)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// Argon2Cfg is argon2.DefaultConfig with the configured costs applied
+func (c *Config) Argon2Cfg() argon2.Config {
+	cfg := argon2.DefaultConfig()
+	cfg.MemoryCost = c.Argon2.MemoryCost
+	cfg.TimeCost = c.Argon2.TimeCost
+	cfg.Parallelism = c.Argon2.Parallelism
+	return cfg
+}
+
+// DBKeyring is the keyring encrypting with DBKey, and decrypting with
+// it and the retired keys
+func (c *Config) DBKeyring() (*security.Keyring, error) {
+	keys := map[string][]byte{c.DBKeyID: []byte(c.DBKey)}
+	for id, key := range c.DBRetiredKeys {
+		keys[id] = []byte(key)
+	}
+	return security.NewKeyring(c.DBKeyID, keys)
+}
+
+// String renders c as JSON with secrets redacted
+func (c Config) String() string {
+	bs, err := json.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("%s %s", c.levelName(), bs)
+}
+
+// levelName is the GROKLOC_ENV spelling of c.Level
+func (c Config) levelName() string {
+	switch c.Level {
+	case env.Unit:
+		return "UNIT"
+	case env.Dev:
+		return "DEV"
+	case env.Stage:
+		return "STAGE"
+	case env.Prod:
+		return "PROD"
+	default:
+		return "NONE"
+	}
+}
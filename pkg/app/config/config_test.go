@@ -0,0 +1,151 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/env"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ConfigSuite struct {
+	suite.Suite
+}
+
+func (s *ConfigSuite) TestUnit() {
+	c, err := Load(env.Unit)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), UnitMasterDSN, c.MasterDSN)
+	require.Equal(s.T(), DefaultPort, c.Port)
+}
+
+func (s *ConfigSuite) TestEnvOverridesFile() {
+	dbKey := uuid.NewString()[:32]
+	tokenKey := uuid.NewString()[:32]
+	digestKey := uuid.NewString()[:32]
+	path := filepath.Join(s.T().TempDir(), "config.json")
+	bs := []byte(fmt.Sprintf(`{"master_dsn":"file:a.db",
+                                   "replica_dsns":["file:a.db?mode=ro"],
+                                   "db_key":"%s",
+                                   "token_key":"%s",
+                                   "digest_key":"%s",
+                                   "port":"4000",
+                                   "repository_root":"/srv/repositories",
+                                   "request_timeout":"2s"}`, dbKey, tokenKey, digestKey))
+	require.Nil(s.T(), os.WriteFile(path, bs, 0600))
+	s.T().Setenv(FileEnv, path)
+	s.T().Setenv(PortEnv, "5000")
+	s.T().Setenv(ReplicaDSNsEnv, "file:b.db?mode=ro, file:c.db?mode=ro")
+	retiredKey := uuid.NewString()[:32]
+	s.T().Setenv(DBKeyIDEnv, "2")
+	s.T().Setenv(DBRetiredKeysEnv, "1:"+retiredKey)
+	s.T().Setenv(TrustedProxiesEnv, "10.0.0.1, fd00::/8")
+
+	c, err := Load(env.Prod)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "file:a.db", c.MasterDSN)
+	require.Equal(s.T(), []string{"file:b.db?mode=ro", "file:c.db?mode=ro"}, c.ReplicaDSNs)
+	require.Equal(s.T(), Secret(dbKey), c.DBKey)
+	require.Equal(s.T(), "2", c.DBKeyID)
+	require.Equal(s.T(), map[string]Secret{"1": Secret(retiredKey)}, c.DBRetiredKeys)
+	keys, err := c.DBKeyring()
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "2", keys.Current())
+	require.Equal(s.T(), Secret(tokenKey), c.TokenKey)
+	require.Equal(s.T(), Secret(digestKey), c.DigestKey)
+	require.Equal(s.T(), "5000", c.Port)
+	require.Equal(s.T(), "/srv/repositories", c.RepositoryRoot)
+	require.Equal(s.T(), Duration(2*time.Second), c.RequestTimeout)
+	require.Equal(s.T(), DefaultShutdownTimeout, c.ShutdownTimeout)
+	require.Equal(s.T(), []string{"10.0.0.1", "fd00::/8"}, c.TrustedProxies)
+	nets := c.TrustedProxyNets()
+	require.Equal(s.T(), 2, len(nets))
+	require.Equal(s.T(), "10.0.0.1/32", nets[0].String())
+	require.True(s.T(), nets[1].Contains(net.ParseIP("fd00::2")))
+}
+
+func (s *ConfigSuite) TestValidate() {
+	c := Default(env.Unit)
+	require.Nil(s.T(), c.Validate())
+
+	c.DBKey = Secret("short")
+	require.ErrorIs(s.T(), c.Validate(), ErrInvalid)
+
+	c = Default(env.Unit)
+	c.DBKeyID = "a:b"
+	require.ErrorIs(s.T(), c.Validate(), ErrInvalid)
+
+	c = Default(env.Unit)
+	c.DBRetiredKeys = map[string]Secret{"1": Secret("short")}
+	require.ErrorIs(s.T(), c.Validate(), ErrInvalid)
+
+	// the current key cannot also be retired
+	c = Default(env.Unit)
+	c.DBRetiredKeys = map[string]Secret{c.DBKeyID: c.DBKey}
+	require.ErrorIs(s.T(), c.Validate(), ErrInvalid)
+
+	c = Default(env.Unit)
+	c.Port = "http"
+	require.ErrorIs(s.T(), c.Validate(), ErrInvalid)
+
+	c = Default(env.Unit)
+	c.Argon2.TimeCost = 0
+	require.ErrorIs(s.T(), c.Validate(), ErrInvalid)
+
+	c = Default(env.Unit)
+	c.RepositoryRoot = ""
+	require.ErrorIs(s.T(), c.Validate(), ErrInvalid)
+
+	c = Default(env.Unit)
+	c.MirrorInterval = -1
+	require.ErrorIs(s.T(), c.Validate(), ErrInvalid)
+
+	c = Default(env.Unit)
+	c.JobWorkers = -1
+	require.ErrorIs(s.T(), c.Validate(), ErrInvalid)
+
+	c = Default(env.Unit)
+	c.JobVisibility = 0
+	require.ErrorIs(s.T(), c.Validate(), ErrInvalid)
+
+	c = Default(env.Unit)
+	c.TrustedProxies = []string{"proxy"}
+	require.ErrorIs(s.T(), c.Validate(), ErrInvalid)
+
+	// stage needs keys and dsns
+	require.ErrorIs(s.T(), Default(env.Stage).Validate(), ErrInvalid)
+
+	s.T().Setenv(Argon2TimeEnv, "-1")
+	_, err := Load(env.Unit)
+	require.Error(s.T(), err)
+}
+
+func (s *ConfigSuite) TestRedacted() {
+	c := Default(env.Unit)
+	retiredKey := uuid.NewString()[:32]
+	c.DBRetiredKeys = map[string]Secret{"1": Secret(retiredKey)}
+	for _, out := range []string{
+		c.String(),
+		fmt.Sprintf("%v", c),
+		fmt.Sprintf("%+v", *c),
+		fmt.Sprintf("%#v", *c),
+	} {
+		require.False(s.T(), strings.Contains(out, string(c.DBKey)), out)
+		require.False(s.T(), strings.Contains(out, string(c.TokenKey)), out)
+		require.False(s.T(), strings.Contains(out, string(c.DigestKey)), out)
+		require.False(s.T(), strings.Contains(out, retiredKey), out)
+		require.False(s.T(), strings.Contains(out, string(c.Root.OwnerPassword)), out)
+		require.True(s.T(), strings.Contains(out, Redacted), out)
+	}
+}
+
+func TestConfigSuite(t *testing.T) {
+	suite.Run(t, new(ConfigSuite))
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Redacted replaces Secret values whenever they are printed or marshaled
+const Redacted = "[REDACTED]"
+
+// Secret is a string that is never printed or marshaled
+//
+// Unmarshaling is not affected, so secrets can be read from a config file
+type Secret string
+
+// String redacts the value
+func (s Secret) String() string {
+	return Redacted
+}
+
+// GoString redacts the value for %#v
+func (s Secret) GoString() string {
+	return Redacted
+}
+
+// MarshalJSON redacts the value
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(Redacted)
+}
+
+// Duration is a time.Duration read and written as a string ("5s")
+type Duration time.Duration
+
+// String formats as time.Duration does
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(bs []byte) error {
+	var s string
+	err := json.Unmarshal(bs, &s)
+	if err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
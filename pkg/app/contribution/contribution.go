@@ -0,0 +1,140 @@
+// Package contribution computes per-author change statistics from
+// mirrored repository histories
+package contribution
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grokloc/grokloc-server/pkg/git"
+)
+
+// secondsPerDay is the granularity at which contributions are stored
+const secondsPerDay = 24 * 60 * 60
+
+// Day is one author's changes on one UTC day
+type Day struct {
+	Email   string
+	Day     int64 // unix time of the start of the day
+	Commits int
+	Added   int
+	Removed int
+}
+
+// Contribution is one author's changes to a repository over a window
+type Contribution struct {
+	Email       string `json:"email"`
+	EmailDigest string `json:"email_digest"`
+	User        string `json:"user"` // id of the user in the repository org with Email, if any
+	Commits     int    `json:"commits"`
+	Added       int    `json:"added"`
+	Removed     int    `json:"removed"`
+}
+
+// header starts each commit in the log output
+const header = "\x01"
+
+// Walk totals the changes of every non-merge commit reachable from rev
+// in the repository at gitDir by author email and author day
+//
+// Author emails are as mapped by any .mailmap in the repository; binary
+// file changes are counted as commits but not as lines
+func Walk(ctx context.Context, gitDir, rev string) ([]Day, error) {
+	tip, err := git.ResolveCommit(ctx, gitDir, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := git.Command(ctx, gitDir, "log", "--no-merges", "--numstat",
+		"--format="+header+"%at %aE", tip)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	type key struct {
+		email string
+		day   int64
+	}
+	days := map[key]*Day{}
+	var current *Day
+	parseErr := func() error {
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, header) {
+				// <author time> SP <author email>
+				fields := strings.SplitN(line[len(header):], " ", 2)
+				if len(fields) != 2 {
+					return fmt.Errorf("log header %q", line)
+				}
+				at, err := strconv.ParseInt(fields[0], 10, 64)
+				if err != nil {
+					return fmt.Errorf("log header %q: %w", line, err)
+				}
+				k := key{email: strings.TrimSpace(fields[1]), day: at - at%secondsPerDay}
+				current = days[k]
+				if current == nil {
+					current = &Day{Email: k.email, Day: k.day}
+					days[k] = current
+				}
+				current.Commits++
+				continue
+			}
+			if len(line) == 0 || current == nil {
+				continue
+			}
+			// <added> TAB <removed> TAB <path>, with - for binary files
+			fields := strings.SplitN(line, "\t", 3)
+			if len(fields) != 3 {
+				return fmt.Errorf("log numstat %q", line)
+			}
+			if fields[0] == "-" {
+				continue
+			}
+			added, err := strconv.Atoi(fields[0])
+			if err != nil {
+				return fmt.Errorf("log numstat %q: %w", line, err)
+			}
+			removed, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return fmt.Errorf("log numstat %q: %w", line, err)
+			}
+			current.Added += added
+			current.Removed += removed
+		}
+		return scanner.Err()
+	}()
+
+	if parseErr != nil {
+		// git may be blocked writing output no longer being read
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, parseErr
+	}
+	waitErr := cmd.Wait()
+	if waitErr != nil {
+		return nil, fmt.Errorf("git log: %w", waitErr)
+	}
+
+	result := make([]Day, 0, len(days))
+	for _, d := range days {
+		result = append(result, *d)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Day != result[j].Day {
+			return result[i].Day < result[j].Day
+		}
+		return result[i].Email < result[j].Email
+	})
+	return result, nil
+}
@@ -0,0 +1,238 @@
+package contribution
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/org"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/user"
+	"github.com/grokloc/grokloc-server/pkg/app/repository"
+	"github.com/grokloc/grokloc-server/pkg/app/state"
+	"github.com/grokloc/grokloc-server/pkg/env"
+	"github.com/grokloc/grokloc-server/pkg/git"
+	"github.com/grokloc/grokloc-server/pkg/security"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+)
+
+// day1 is the start of the first day of the test history
+var day1 = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type ContributionSuite struct {
+	suite.Suite
+	st  *app.State
+	dir string // working tree of the upstream
+}
+
+func (s *ContributionSuite) SetupTest() {
+	var err error
+	s.st, err = state.New(env.Unit)
+	if err != nil {
+		zap.L().Fatal("setup",
+			zap.Error(err),
+		)
+	}
+
+	// a@x adds 3 lines on day 1, then removes 1 on day 2;
+	// b@x adds 2 lines and a binary file on day 2, on a merged branch
+	s.dir = s.T().TempDir()
+	s.run(nil, "init", "--quiet", "--initial-branch=main")
+	s.commit("a@x", day1.Add(time.Hour), "a.txt", "1\n2\n3\n")
+	s.run(nil, "checkout", "--quiet", "-b", "b")
+	s.commit("b@x", day1.Add(25*time.Hour), "b.txt", "1\n2\n")
+	s.commit("b@x", day1.Add(26*time.Hour), "b.bin", "\x00\x01")
+	s.run(nil, "checkout", "--quiet", "main")
+	s.commit("a@x", day1.Add(27*time.Hour), "a.txt", "1\n2\n")
+	s.run(s.env("a@x", day1.Add(28*time.Hour)), "merge", "--quiet", "--no-ff", "-m", "merge", "b")
+}
+
+func (s *ContributionSuite) env(email string, t time.Time) []string {
+	date := t.Format(time.RFC3339)
+	return []string{
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=" + email, "GIT_AUTHOR_DATE=" + date,
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=" + email, "GIT_COMMITTER_DATE=" + date,
+	}
+}
+
+// run runs the git command with args in the upstream working tree
+func (s *ContributionSuite) run(env []string, args ...string) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = s.dir
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	require.Nil(s.T(), err, string(out))
+}
+
+// commit writes content to name and commits it as email at t
+func (s *ContributionSuite) commit(email string, t time.Time, name, content string) {
+	require.Nil(s.T(), os.WriteFile(filepath.Join(s.dir, name), []byte(content), 0600))
+	s.run(nil, "add", "--all")
+	s.run(s.env(email, t), "commit", "--quiet", "-m", name)
+}
+
+func (s *ContributionSuite) TestWalk() {
+	days, err := Walk(context.Background(), filepath.Join(s.dir, ".git"), "HEAD")
+	require.Nil(s.T(), err)
+	day2 := day1.Add(24 * time.Hour).Unix()
+	require.Equal(s.T(), []Day{
+		{Email: "a@x", Day: day1.Unix(), Commits: 1, Added: 3},
+		{Email: "a@x", Day: day2, Commits: 1, Removed: 1},
+		{Email: "b@x", Day: day2, Commits: 2, Added: 2},
+	}, days)
+
+	_, err = Walk(context.Background(), filepath.Join(s.dir, ".git"), "nope")
+	require.Equal(s.T(), git.ErrRevision, err)
+}
+
+func (s *ContributionSuite) TestCreate() {
+	ctx := context.Background()
+	ownerPassword, err := security.DerivePassword(uuid.NewString(), s.st.Argon2Cfg)
+	require.Nil(s.T(), err)
+	o, err := org.Create(
+		ctx,
+		uuid.NewString(), // org name
+		uuid.NewString(), // org owner display name
+		uuid.NewString(), // org owner email
+		ownerPassword,
+		s.st.DBKeys,
+		s.st.Master,
+	)
+	require.Nil(s.T(), err)
+
+	// b@x is a user in the org
+	u, err := user.Create(ctx, uuid.NewString(), "b@x", o.ID, ownerPassword, s.st.DBKeys, s.st.Master)
+	require.Nil(s.T(), err)
+
+	r, err := repository.Create(
+		ctx,
+		uuid.NewString(), // name
+		o.ID,
+		"file://"+filepath.ToSlash(s.dir),
+		s.st.RepositoryRoot,
+		s.st.Master,
+	)
+	require.Nil(s.T(), err)
+	_, err = git.Output(ctx, "", "clone", "--mirror", "--quiet", "--", r.Upstream, r.Path)
+	require.Nil(s.T(), err)
+
+	err = Create(ctx, r, s.st.DBKeys, s.st.DigestKey, s.st.Master)
+	require.Nil(s.T(), err)
+
+	// emails are stored encrypted
+	var stored string
+	err = s.st.Master.QueryRow(`select email from contributions where repository = ? limit 1`, r.ID).Scan(&stored)
+	require.Nil(s.T(), err)
+	require.False(s.T(), strings.Contains(stored, "@"))
+
+	cs, err := Read(ctx, r, 0, 0, s.st.DBKeys, s.st.DigestKey, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), []Contribution{
+		{Email: "a@x", EmailDigest: EmailDigest("a@x", s.st.DigestKey), Commits: 2, Added: 3, Removed: 1},
+		{Email: "b@x", EmailDigest: EmailDigest("b@x", s.st.DigestKey), User: u.ID, Commits: 2, Added: 2},
+	}, cs)
+
+	// day 1 only
+	cs, err = Read(ctx, r, day1.Unix(), day1.Add(24*time.Hour).Unix(), s.st.DBKeys, s.st.DigestKey, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 1, len(cs))
+	require.Equal(s.T(), Contribution{Email: "a@x", EmailDigest: EmailDigest("a@x", s.st.DigestKey), Commits: 1, Added: 3}, cs[0])
+
+	// a repository with the same history in another org has no user match
+	other := *r
+	other.Org = uuid.NewString()
+	cs, err = Read(ctx, &other, 0, 0, s.st.DBKeys, s.st.DigestKey, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Empty(s.T(), cs[1].User)
+
+	// storing again replaces
+	err = Create(ctx, r, s.st.DBKeys, s.st.DigestKey, s.st.Master)
+	require.Nil(s.T(), err)
+	cs, err = Read(ctx, r, 0, 0, s.st.DBKeys, s.st.DigestKey, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 2, cs[0].Commits)
+}
+
+func (s *ContributionSuite) TestShred() {
+	ctx := context.Background()
+	ownerPassword, err := security.DerivePassword(uuid.NewString(), s.st.Argon2Cfg)
+	require.Nil(s.T(), err)
+	o, err := org.Create(
+		ctx,
+		uuid.NewString(), // org name
+		uuid.NewString(), // org owner display name
+		uuid.NewString(), // org owner email
+		ownerPassword,
+		s.st.DBKeys,
+		s.st.Master,
+	)
+	require.Nil(s.T(), err)
+	u, err := user.Create(ctx, uuid.NewString(), "a@x", o.ID, ownerPassword, s.st.DBKeys, s.st.Master)
+	require.Nil(s.T(), err)
+
+	r, err := repository.Create(
+		ctx,
+		uuid.NewString(), // name
+		o.ID,
+		"file://"+filepath.ToSlash(s.dir),
+		s.st.RepositoryRoot,
+		s.st.Master,
+	)
+	require.Nil(s.T(), err)
+	_, err = git.Output(ctx, "", "clone", "--mirror", "--quiet", "--", r.Upstream, r.Path)
+	require.Nil(s.T(), err)
+	err = Create(ctx, r, s.st.DBKeys, s.st.DigestKey, s.st.Master)
+	require.Nil(s.T(), err)
+
+	// digests cannot be matched by hashing a guess
+	var count int
+	err = s.st.Master.QueryRow(`select count(*) from contributions where email_digest = ?`,
+		security.EncodedSHA256("a@x")).Scan(&count)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 0, count)
+
+	require.Nil(s.T(), u.Shred(ctx, s.st.DigestKey, s.st.Master))
+
+	// recoverable neither from the stored rows nor by analyzing again
+	for i := 0; i < 2; i++ {
+		err = s.st.Master.QueryRow(`select count(*) from contributions
+                                            where repository = ?
+                                            and email_digest = ?
+                                            and email != ''`,
+			r.ID, EmailDigest("a@x", s.st.DigestKey)).Scan(&count)
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), 0, count)
+
+		cs, err := Read(ctx, r, 0, 0, s.st.DBKeys, s.st.DigestKey, s.st.Master)
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), []Contribution{
+			{EmailDigest: EmailDigest("a@x", s.st.DigestKey), Commits: 2, Added: 3, Removed: 1},
+			{Email: "b@x", EmailDigest: EmailDigest("b@x", s.st.DigestKey), Commits: 2, Added: 2},
+		}, cs)
+
+		err = Create(ctx, r, s.st.DBKeys, s.st.DigestKey, s.st.Master)
+		require.Nil(s.T(), err)
+	}
+
+	// nothing left to re-encrypt
+	key, err := security.MakeKey(uuid.NewString())
+	require.Nil(s.T(), err)
+	rotated, err := s.st.DBKeys.With("rotated", key)
+	require.Nil(s.T(), err)
+	stale, err := StaleEmails(ctx, Cursor{Repository: r.ID}, 1000000, rotated, s.st.Master)
+	require.Nil(s.T(), err)
+	for _, c := range stale {
+		require.False(s.T(), c.Repository == r.ID && c.EmailDigest == EmailDigest("a@x", s.st.DigestKey))
+	}
+}
+
+func TestContributionSuite(t *testing.T) {
+	suite.Run(t, new(ContributionSuite))
+}
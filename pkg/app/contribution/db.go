@@ -0,0 +1,200 @@
+package contribution
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/repository"
+	"github.com/grokloc/grokloc-server/pkg/security"
+)
+
+// EmailDigest is the stored digest of a contribution email, keyed with
+// digestKey so that stored emails cannot be confirmed by hashing guesses
+func EmailDigest(email string, digestKey []byte) string {
+	return security.EncodedHMAC(email, digestKey)
+}
+
+// Insert replaces all stored days for repository with days, encrypting
+// emails with keys
+//
+// The emails of users shredded from the repository org are not stored;
+// their days are kept, with an empty email
+func Insert(ctx context.Context, repository string, days []Day, keys *security.Keyring, digestKey []byte, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint
+
+	shredded, err := shreddedDigests(ctx, repository, tx)
+	if err != nil {
+		return err
+	}
+
+	q := fmt.Sprintf(`delete from %s where repository = ?`, app.ContributionsTableName)
+	_, err = tx.ExecContext(ctx, q, repository)
+	if err != nil {
+		return err
+	}
+
+	q = fmt.Sprintf(`insert into %s
+                         (repository,
+                          email,
+                          email_digest,
+                          day,
+                          commits,
+                          added,
+                          removed)
+                         values
+                         (?,?,?,?,?,?,?)`,
+		app.ContributionsTableName)
+	for _, d := range days {
+		emailDigest := EmailDigest(d.Email, digestKey)
+		emailEncrypted := ""
+		if !shredded[emailDigest] {
+			emailEncrypted, err = keys.Encrypt(d.Email)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.ExecContext(ctx, q,
+			repository,
+			emailEncrypted,
+			emailDigest,
+			d.Day,
+			d.Commits,
+			d.Added,
+			d.Removed)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// shreddedDigests returns the contribution email digests of the users
+// shredded from the org of repository
+func shreddedDigests(ctx context.Context, repository string, tx *sql.Tx) (map[string]bool, error) {
+	q := fmt.Sprintf(`select s.email_digest
+                          from %s s
+                          join %s u on u.id = s.user
+                          join %s r on r.org = u.org
+                          where r.id = ?
+                          and s.email_digest != ''`,
+		app.UserShredsTableName,
+		app.UsersTableName,
+		app.RepositoriesTableName)
+	rows, err := tx.QueryContext(ctx, q, repository)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shredded := map[string]bool{}
+	for rows.Next() {
+		var digest string
+		err = rows.Scan(&digest)
+		if err != nil {
+			return nil, err
+		}
+		shredded[digest] = true
+	}
+	return shredded, rows.Err()
+}
+
+// Create walks the history of HEAD in the mirror of r and stores it
+func Create(ctx context.Context, r *repository.Repository, keys *security.Keyring, digestKey []byte, db *sql.DB) error {
+	days, err := Walk(ctx, r.Path, "HEAD")
+	if err != nil {
+		return err
+	}
+	return Insert(ctx, r.ID, days, keys, digestKey, db)
+}
+
+// Read totals the stored contributions to r by author for days starting
+// in [since, until), most commits (then most lines changed) first
+//
+// An until of 0 means no upper bound. Authors are matched by email to
+// users in r's org; shredded authors have an empty email
+func Read(ctx context.Context, r *repository.Repository, since, until int64, keys *security.Keyring, digestKey []byte, db *sql.DB) ([]Contribution, error) {
+	if until == 0 {
+		until = math.MaxInt64
+	}
+
+	users, err := orgUsers(ctx, r.Org, db)
+	if err != nil {
+		return nil, err
+	}
+
+	q := fmt.Sprintf(`select
+                          c.email_digest,
+                          max(c.email),
+                          sum(c.commits),
+                          sum(c.added),
+                          sum(c.removed)
+                          from %s c
+                          where c.repository = ?
+                          and c.day >= ?
+                          and c.day < ?
+                          group by c.email_digest
+                          order by
+                            sum(c.commits) desc,
+                            sum(c.added) + sum(c.removed) desc,
+                            c.email_digest`,
+		app.ContributionsTableName)
+
+	rows, err := db.QueryContext(ctx, q, r.ID, since, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contributions := []Contribution{}
+	for rows.Next() {
+		var c Contribution
+		var emailEncrypted string
+		err = rows.Scan(
+			&c.EmailDigest,
+			&emailEncrypted,
+			&c.Commits,
+			&c.Added,
+			&c.Removed)
+		if err != nil {
+			return nil, err
+		}
+		if len(emailEncrypted) != 0 {
+			c.Email, err = keys.DecryptHMAC(emailEncrypted, c.EmailDigest, digestKey)
+			if err != nil {
+				return nil, err
+			}
+			c.User = users[security.EncodedSHA256(c.Email)]
+		}
+		contributions = append(contributions, c)
+	}
+	return contributions, rows.Err()
+}
+
+// orgUsers returns the ids of the users in org by email digest
+func orgUsers(ctx context.Context, org string, db *sql.DB) (map[string]string, error) {
+	q := fmt.Sprintf(`select id, email_digest from %s where org = ?`, app.UsersTableName)
+	rows, err := db.QueryContext(ctx, q, org)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := map[string]string{}
+	for rows.Next() {
+		var id, emailDigest string
+		err = rows.Scan(&id, &emailDigest)
+		if err != nil {
+			return nil, err
+		}
+		users[emailDigest] = id
+	}
+	return users, rows.Err()
+}
@@ -0,0 +1,100 @@
+package contribution
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/models"
+	"github.com/grokloc/grokloc-server/pkg/security"
+)
+
+// Cursor is the key of a stored contribution, ordering them for
+// StaleEmails
+type Cursor struct {
+	Repository  string
+	EmailDigest string
+	Day         int64
+}
+
+// Stale is a stored contribution whose email is not encrypted with the
+// current key
+type Stale struct {
+	Cursor
+	email string
+}
+
+// StaleEmails returns, in order, up to limit contributions after the
+// one at after with an email not encrypted with the current key of keys;
+// emails erased by shredding are skipped
+func StaleEmails(ctx context.Context, after Cursor, limit int, keys *security.Keyring, db *sql.DB) ([]Stale, error) {
+	prefix := keys.Prefix()
+	q := fmt.Sprintf(`select
+                          repository,
+                          email_digest,
+                          day,
+                          email
+                          from %s
+                          where (repository, email_digest, day) > (?, ?, ?)
+                          and email != ''
+                          and substr(email, 1, ?) != ?
+                          order by repository, email_digest, day
+                          limit ?`,
+		app.ContributionsTableName)
+	rows, err := db.QueryContext(ctx, q,
+		after.Repository, after.EmailDigest, after.Day,
+		len(prefix), prefix,
+		limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stale := []Stale{}
+	for rows.Next() {
+		var s Stale
+		err = rows.Scan(&s.Repository, &s.EmailDigest, &s.Day, &s.email)
+		if err != nil {
+			return nil, err
+		}
+		stale = append(stale, s)
+	}
+	return stale, rows.Err()
+}
+
+// Reencrypt rewrites the email of s under the current key of keys
+//
+// The row is only overwritten if it is unchanged since it was read;
+// returns true if it was rewritten
+func Reencrypt(ctx context.Context, s Stale, keys *security.Keyring, digestKey []byte, db *sql.DB) (bool, error) {
+	email, err := keys.DecryptHMAC(s.email, s.EmailDigest, digestKey)
+	if err != nil {
+		return false, err
+	}
+	emailEncrypted, err := keys.Encrypt(email)
+	if err != nil {
+		return false, err
+	}
+
+	q := fmt.Sprintf(`update %s set email = ?
+                          where repository = ?
+                          and email_digest = ?
+                          and day = ?
+                          and email = ?`,
+		app.ContributionsTableName)
+	result, err := db.ExecContext(ctx, q, emailEncrypted, s.Repository, s.EmailDigest, s.Day, s.email)
+	if err != nil {
+		return false, err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if updated > 1 {
+		return false, models.ErrRowsAffected
+	}
+	return updated == 1, nil
+}
@@ -0,0 +1,296 @@
+// Package job is a queue of background work persisted in the app db
+package job
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app"
+)
+
+// job statuses
+const (
+	StatusQueued  = "queued"  // waiting for run_at
+	StatusRunning = "running" // leased by a worker
+	StatusDone    = "done"
+	StatusFailed  = "failed" // attempts exhausted or permanent error
+)
+
+// DefaultMaxAttempts is how many times an enqueued job is tried
+const DefaultMaxAttempts = 5
+
+// retry delays; the nth failed attempt waits BackoffBase * 2^(n-1),
+// up to BackoffMax
+const (
+	BackoffBase = 30 * time.Second
+	BackoffMax  = time.Hour
+)
+
+// ErrLeaseLost signals a job whose lease expired and was taken by
+// another worker before the holder finished
+var ErrLeaseLost = errors.New("job lease lost")
+
+// Job is a unit of background work
+type Job struct {
+	ID          string          `json:"id"`
+	Org         string          `json:"org"` // org that enqueued the job
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       int64           `json:"run_at"`     // unix time the job is next eligible to run
+	LastError   string          `json:"last_error"` // error of the last failed attempt
+	Ctime       int64           `json:"ctime"`
+	Mtime       int64           `json:"mtime"`
+	Lease       string          `json:"-"` // identifies the current lease holder
+	LeaseUntil  int64           `json:"-"` // unix time the lease expires
+}
+
+// permanent is an error that should not be retried
+type permanent struct {
+	err error
+}
+
+func (p permanent) Error() string { return p.err.Error() }
+
+func (p permanent) Unwrap() error { return p.err }
+
+// Permanent wraps err so that a job failing with it is not retried
+func Permanent(err error) error {
+	return permanent{err: err}
+}
+
+// IsPermanent reports whether err was wrapped by Permanent
+func IsPermanent(err error) bool {
+	var p permanent
+	return errors.As(err, &p)
+}
+
+// Backoff is the delay before retrying a job that has failed attempts
+// times
+func Backoff(attempts int) time.Duration {
+	d := BackoffBase
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= BackoffMax {
+			return BackoffMax
+		}
+	}
+	return d
+}
+
+// columns is the select list scanned by scan
+const columns = `id,
+                 org,
+                 kind,
+                 payload,
+                 status,
+                 attempts,
+                 max_attempts,
+                 run_at,
+                 last_error,
+                 ctime,
+                 mtime,
+                 lease,
+                 lease_until`
+
+// scan reads a row selected with columns
+func scan(row interface{ Scan(...interface{}) error }) (*Job, error) {
+	j := &Job{}
+	var payload string
+	err := row.Scan(
+		&j.ID,
+		&j.Org,
+		&j.Kind,
+		&payload,
+		&j.Status,
+		&j.Attempts,
+		&j.MaxAttempts,
+		&j.RunAt,
+		&j.LastError,
+		&j.Ctime,
+		&j.Mtime,
+		&j.Lease,
+		&j.LeaseUntil)
+	if err != nil {
+		return nil, err
+	}
+	j.Payload = json.RawMessage(payload)
+	return j, nil
+}
+
+// Enqueue adds a job of kind for org, to run now with payload
+// marshaled as JSON
+func Enqueue(ctx context.Context, org, kind string, payload interface{}, db *sql.DB) (*Job, error) {
+	bs, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	id := uuid.NewString()
+	q := fmt.Sprintf(`insert into %s
+                          (id,
+                           org,
+                           kind,
+                           payload,
+                           status,
+                           max_attempts,
+                           run_at)
+                          values
+                          (?,?,?,?,?,?,?)`,
+		app.JobsTableName)
+	_, err = db.ExecContext(ctx, q,
+		id,
+		org,
+		kind,
+		string(bs),
+		StatusQueued,
+		DefaultMaxAttempts,
+		time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	return Read(ctx, id, db)
+}
+
+// Read returns the job with id
+func Read(ctx context.Context, id string, db *sql.DB) (*Job, error) {
+	q := fmt.Sprintf(`select %s from %s where id = ?`, columns, app.JobsTableName)
+	return scan(db.QueryRowContext(ctx, q, id))
+}
+
+// Lease claims the next eligible job of one of kinds for visibility,
+// returning sql.ErrNoRows if there is none
+//
+// A job is eligible if it is queued and due, or if it is running and
+// its lease has expired, i.e. its worker died; such a job is retried
+// if it has attempts left and failed otherwise
+func Lease(ctx context.Context, kinds []string, visibility time.Duration, db *sql.DB) (*Job, error) {
+	if len(kinds) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	now := time.Now().Unix()
+	in := strings.TrimSuffix(strings.Repeat("?,", len(kinds)), ",")
+	args := []interface{}{}
+	for _, kind := range kinds {
+		args = append(args, kind)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint
+
+	q := fmt.Sprintf(`update %s set
+                          status = ?,
+                          lease = '',
+                          last_error = 'lease expired'
+                          where kind in (%s)
+                          and status = ?
+                          and lease_until <= ?
+                          and attempts >= max_attempts`,
+		app.JobsTableName, in)
+	_, err = tx.ExecContext(ctx, q,
+		append([]interface{}{StatusFailed}, append(args, StatusRunning, now)...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	q = fmt.Sprintf(`select id from %s
+                         where kind in (%s)
+                         and ((status = ? and run_at <= ?)
+                              or (status = ? and lease_until <= ?))
+                         order by run_at, ctime
+                         limit 1`,
+		app.JobsTableName, in)
+	var id string
+	err = tx.QueryRowContext(ctx, q,
+		append(args, StatusQueued, now, StatusRunning, now)...).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// keep any expired jobs marked failed above
+			commitErr := tx.Commit()
+			if commitErr != nil {
+				return nil, commitErr
+			}
+		}
+		return nil, err
+	}
+
+	q = fmt.Sprintf(`update %s set
+                         last_error = case when status = ? then 'lease expired' else last_error end,
+                         status = ?,
+                         attempts = attempts + 1,
+                         lease = ?,
+                         lease_until = ?
+                         where id = ?`,
+		app.JobsTableName)
+	_, err = tx.ExecContext(ctx, q,
+		StatusRunning,
+		StatusRunning,
+		uuid.NewString(),
+		now+int64((visibility+time.Second-1)/time.Second),
+		id)
+	if err != nil {
+		return nil, err
+	}
+
+	j, err := scan(tx.QueryRowContext(ctx,
+		fmt.Sprintf(`select %s from %s where id = ?`, columns, app.JobsTableName), id))
+	if err != nil {
+		return nil, err
+	}
+	return j, tx.Commit()
+}
+
+// finish updates the leased job j with set, returning ErrLeaseLost if
+// j is no longer held under its lease
+func finish(ctx context.Context, j *Job, set string, db *sql.DB, args ...interface{}) error {
+	q := fmt.Sprintf(`update %s set %s, lease = '' where id = ? and lease = ? and status = ?`,
+		app.JobsTableName, set)
+	result, err := db.ExecContext(ctx, q, append(args, j.ID, j.Lease, StatusRunning)...)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if rows != 1 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// Complete marks the leased job j done
+func Complete(ctx context.Context, j *Job, db *sql.DB) error {
+	return finish(ctx, j, "status = ?", db, StatusDone)
+}
+
+// Fail records cause for the leased job j, and either requeues it after
+// Backoff or marks it failed if it has no attempts left or cause is
+// permanent
+func Fail(ctx context.Context, j *Job, cause error, db *sql.DB) error {
+	if j.Attempts >= j.MaxAttempts || IsPermanent(cause) {
+		return finish(ctx, j, "status = ?, last_error = ?", db, StatusFailed, cause.Error())
+	}
+	runAt := time.Now().Add(Backoff(j.Attempts)).Unix()
+	return finish(ctx, j, "status = ?, last_error = ?, run_at = ?", db,
+		StatusQueued, cause.Error(), runAt)
+}
+
+// Release requeues the leased job j to run now without counting the
+// attempt, for a worker that is stopping
+func Release(ctx context.Context, j *Job, db *sql.DB) error {
+	return finish(ctx, j, "status = ?, attempts = attempts - 1, run_at = ?", db,
+		StatusQueued, time.Now().Unix())
+}
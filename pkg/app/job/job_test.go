@@ -0,0 +1,241 @@
+package job
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/state"
+	"github.com/grokloc/grokloc-server/pkg/env"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+)
+
+type JobSuite struct {
+	suite.Suite
+	st   *app.State
+	ctx  context.Context
+	kind string // unique per test, so tests do not lease each other's jobs
+}
+
+func (s *JobSuite) SetupTest() {
+	var err error
+	s.st, err = state.New(env.Unit)
+	if err != nil {
+		zap.L().Fatal("setup",
+			zap.Error(err),
+		)
+	}
+	s.ctx = context.Background()
+	s.kind = uuid.NewString()
+}
+
+// enqueue adds a job of s.kind
+func (s *JobSuite) enqueue() *Job {
+	j, err := Enqueue(s.ctx, uuid.NewString(), s.kind, map[string]string{"k": "v"}, s.st.Master)
+	require.Nil(s.T(), err)
+	return j
+}
+
+// lease leases the next job of s.kind
+func (s *JobSuite) lease(visibility time.Duration) (*Job, error) {
+	return Lease(s.ctx, []string{s.kind}, visibility, s.st.Master)
+}
+
+func (s *JobSuite) read(id string) *Job {
+	j, err := Read(s.ctx, id, s.st.Master)
+	require.Nil(s.T(), err)
+	return j
+}
+
+func (s *JobSuite) TestEnqueue() {
+	j := s.enqueue()
+	require.Equal(s.T(), s.kind, j.Kind)
+	require.Equal(s.T(), StatusQueued, j.Status)
+	require.Equal(s.T(), 0, j.Attempts)
+	require.Equal(s.T(), DefaultMaxAttempts, j.MaxAttempts)
+	require.JSONEq(s.T(), `{"k":"v"}`, string(j.Payload))
+	require.NotZero(s.T(), j.Ctime)
+
+	_, err := Read(s.ctx, uuid.NewString(), s.st.Master)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+}
+
+func (s *JobSuite) TestLeaseComplete() {
+	enqueued := s.enqueue()
+
+	j, err := s.lease(time.Minute)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), enqueued.ID, j.ID)
+	require.Equal(s.T(), StatusRunning, j.Status)
+	require.Equal(s.T(), 1, j.Attempts)
+	require.NotEmpty(s.T(), j.Lease)
+
+	// leased jobs are not visible to other workers
+	_, err = s.lease(time.Minute)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+
+	// nor are jobs of other kinds
+	_, err = Lease(s.ctx, []string{uuid.NewString()}, time.Minute, s.st.Master)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+
+	require.Nil(s.T(), Complete(s.ctx, j, s.st.Master))
+	require.Equal(s.T(), StatusDone, s.read(j.ID).Status)
+	require.Equal(s.T(), ErrLeaseLost, Complete(s.ctx, j, s.st.Master))
+}
+
+func (s *JobSuite) TestFail() {
+	s.enqueue()
+	j, err := s.lease(time.Minute)
+	require.Nil(s.T(), err)
+
+	require.Nil(s.T(), Fail(s.ctx, j, errors.New("fetch"), s.st.Master))
+	failed := s.read(j.ID)
+	require.Equal(s.T(), StatusQueued, failed.Status)
+	require.Equal(s.T(), "fetch", failed.LastError)
+	require.GreaterOrEqual(s.T(), failed.RunAt, time.Now().Add(Backoff(1)).Unix()-1)
+
+	// not retried until the backoff passes
+	_, err = s.lease(time.Minute)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+}
+
+func (s *JobSuite) TestExhausted() {
+	enqueued := s.enqueue()
+	_, err := s.st.Master.ExecContext(s.ctx,
+		fmt.Sprintf(`update %s set max_attempts = 1 where id = ?`, app.JobsTableName), enqueued.ID)
+	require.Nil(s.T(), err)
+
+	j, err := s.lease(time.Minute)
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), Fail(s.ctx, j, errors.New("fetch"), s.st.Master))
+	failed := s.read(j.ID)
+	require.Equal(s.T(), StatusFailed, failed.Status)
+	require.Equal(s.T(), "fetch", failed.LastError)
+}
+
+func (s *JobSuite) TestPermanent() {
+	s.enqueue()
+	j, err := s.lease(time.Minute)
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), Fail(s.ctx, j, Permanent(errors.New("malformed")), s.st.Master))
+	require.Equal(s.T(), StatusFailed, s.read(j.ID).Status)
+}
+
+func (s *JobSuite) TestExpiredLease() {
+	s.enqueue()
+
+	// a worker that leased the job and died
+	dead, err := s.lease(-time.Second)
+	require.Nil(s.T(), err)
+
+	j, err := s.lease(time.Minute)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), dead.ID, j.ID)
+	require.Equal(s.T(), 2, j.Attempts)
+	require.Equal(s.T(), "lease expired", j.LastError)
+	require.NotEqual(s.T(), dead.Lease, j.Lease)
+
+	// the dead worker cannot record an outcome
+	require.Equal(s.T(), ErrLeaseLost, Complete(s.ctx, dead, s.st.Master))
+	require.Nil(s.T(), Complete(s.ctx, j, s.st.Master))
+}
+
+func (s *JobSuite) TestExpiredLeaseExhausted() {
+	enqueued := s.enqueue()
+	_, err := s.st.Master.ExecContext(s.ctx,
+		fmt.Sprintf(`update %s set max_attempts = 1 where id = ?`, app.JobsTableName), enqueued.ID)
+	require.Nil(s.T(), err)
+
+	_, err = s.lease(-time.Second)
+	require.Nil(s.T(), err)
+	_, err = s.lease(time.Minute)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+	failed := s.read(enqueued.ID)
+	require.Equal(s.T(), StatusFailed, failed.Status)
+	require.Equal(s.T(), "lease expired", failed.LastError)
+}
+
+func (s *JobSuite) TestBackoff() {
+	require.Equal(s.T(), BackoffBase, Backoff(1))
+	require.Equal(s.T(), 2*BackoffBase, Backoff(2))
+	require.Equal(s.T(), 4*BackoffBase, Backoff(3))
+	require.Equal(s.T(), BackoffMax, Backoff(100))
+}
+
+func (s *JobSuite) TestPool() {
+	p := NewPool(1, time.Minute)
+	calls := 0
+	p.Register(s.kind, func(ctx context.Context, st *app.State, j *Job) error {
+		calls++
+		switch calls {
+		case 1:
+			return errors.New("first")
+		case 2:
+			panic("second")
+		}
+		return nil
+	})
+
+	ran, err := p.RunOne(s.ctx, s.st)
+	require.Nil(s.T(), err)
+	require.False(s.T(), ran)
+
+	enqueued := s.enqueue()
+	ran, err = p.RunOne(s.ctx, s.st)
+	require.Nil(s.T(), err)
+	require.True(s.T(), ran)
+	require.Equal(s.T(), "first", s.read(enqueued.ID).LastError)
+
+	// make the retry due now
+	due := func() {
+		_, err := s.st.Master.ExecContext(s.ctx,
+			fmt.Sprintf(`update %s set run_at = 0 where id = ?`, app.JobsTableName), enqueued.ID)
+		require.Nil(s.T(), err)
+	}
+	due()
+	ran, err = p.RunOne(s.ctx, s.st)
+	require.Nil(s.T(), err)
+	require.True(s.T(), ran)
+	require.Equal(s.T(), "panic: second", s.read(enqueued.ID).LastError)
+
+	due()
+	ran, err = p.RunOne(s.ctx, s.st)
+	require.Nil(s.T(), err)
+	require.True(s.T(), ran)
+	done := s.read(enqueued.ID)
+	require.Equal(s.T(), StatusDone, done.Status)
+	require.Equal(s.T(), 3, done.Attempts)
+}
+
+func (s *JobSuite) TestPoolStopping() {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	p := NewPool(1, time.Minute)
+	p.Register(s.kind, func(ctx context.Context, st *app.State, j *Job) error {
+		cancel()
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	enqueued := s.enqueue()
+	ran, err := p.RunOne(ctx, s.st)
+	require.Nil(s.T(), err)
+	require.True(s.T(), ran)
+
+	// released, not failed
+	released := s.read(enqueued.ID)
+	require.Equal(s.T(), StatusQueued, released.Status)
+	require.Equal(s.T(), 0, released.Attempts)
+	require.Empty(s.T(), released.LastError)
+}
+
+func TestJobSuite(t *testing.T) {
+	suite.Run(t, new(JobSuite))
+}
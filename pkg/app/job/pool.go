@@ -0,0 +1,127 @@
+package job
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"go.uber.org/zap"
+)
+
+// DefaultPoll is how long an idle worker waits before looking for
+// another job
+const DefaultPoll = time.Second
+
+// Handler runs a job; a returned error fails the attempt
+type Handler func(ctx context.Context, st *app.State, j *Job) error
+
+// Pool is a set of workers running jobs of the kinds registered with it
+type Pool struct {
+	Workers    int
+	Visibility time.Duration // lease length, and the timeout for each attempt
+	Poll       time.Duration
+	handlers   map[string]Handler
+}
+
+// NewPool returns a pool of workers that lease jobs for visibility
+func NewPool(workers int, visibility time.Duration) *Pool {
+	return &Pool{
+		Workers:    workers,
+		Visibility: visibility,
+		Poll:       DefaultPoll,
+		handlers:   map[string]Handler{},
+	}
+}
+
+// Register sets h as the handler for jobs of kind
+func (p *Pool) Register(kind string, h Handler) {
+	p.handlers[kind] = h
+}
+
+// kinds lists the registered kinds
+func (p *Pool) kinds() []string {
+	kinds := []string{}
+	for kind := range p.handlers {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// RunOne leases and runs one job, reporting whether there was one
+//
+// If ctx is done while the job runs, the job is released to be run
+// again rather than failed
+func (p *Pool) RunOne(ctx context.Context, st *app.State) (bool, error) {
+	j, err := Lease(ctx, p.kinds(), p.Visibility, st.Master)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	runErr := p.run(ctx, st, j)
+
+	// record the outcome even if ctx is done
+	if ctx.Err() != nil {
+		return true, Release(context.Background(), j, st.Master)
+	}
+	if runErr != nil {
+		zap.L().Warn("job",
+			zap.String("id", j.ID),
+			zap.String("kind", j.Kind),
+			zap.Int("attempts", j.Attempts),
+			zap.Error(runErr))
+		return true, Fail(context.Background(), j, runErr, st.Master)
+	}
+	return true, Complete(context.Background(), j, st.Master)
+}
+
+// run calls the handler for j within the visibility timeout,
+// converting a panic to an error
+func (p *Pool) run(ctx context.Context, st *app.State, j *Job) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, p.Visibility)
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return p.handlers[j.Kind](ctx, st, j)
+}
+
+// Run runs Workers workers until ctx is done and they have stopped
+func (p *Pool) Run(ctx context.Context, st *app.State) {
+	var wg sync.WaitGroup
+	for i := 0; i < p.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.work(ctx, st)
+		}()
+	}
+	wg.Wait()
+}
+
+// work runs jobs until ctx is done, waiting Poll whenever none is ready
+func (p *Pool) work(ctx context.Context, st *app.State) {
+	for {
+		ran, err := p.RunOne(ctx, st)
+		if err != nil && ctx.Err() == nil {
+			zap.L().Error("job", zap.Error(err))
+		}
+		if ran && err == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.Poll):
+		}
+	}
+}
@@ -4,10 +4,12 @@ package jwt
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
 	jwt_go "github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
 	"github.com/grokloc/grokloc-server/pkg/security"
 )
 
@@ -15,10 +17,40 @@ import (
 const (
 	Authorization = "Authorization"
 	TokenType     = "Bearer"
-	Expiration    = 86400
+	Expiration    = 900 // access tokens are short-lived; sessions continue by refresh
 )
 
+// token scopes; a write scope also grants the read scope of the same
+// resource
+const (
+	ScopeAll             = "app" // grants every scope
+	ScopeOrgRead         = "org:read"
+	ScopeOrgWrite        = "org:write"
+	ScopeUserRead        = "user:read"
+	ScopeUserWrite       = "user:write"
+	ScopeRepositoryRead  = "repository:read"
+	ScopeRepositoryWrite = "repository:write"
+	ScopeJobRead         = "job:read"
+)
+
+// Scopes lists every scope a token can be requested with
+var Scopes = []string{
+	ScopeAll,
+	ScopeOrgRead,
+	ScopeOrgWrite,
+	ScopeUserRead,
+	ScopeUserWrite,
+	ScopeRepositoryRead,
+	ScopeRepositoryWrite,
+	ScopeJobRead,
+}
+
+// ErrScope signals a requested scope that is not in Scopes
+var ErrScope = errors.New("unknown scope")
+
 // Claims are the JWT claims for the app
+//
+// Scope is a space-separated list of scopes
 type Claims struct {
 	Scope string `json:"scope"`
 	Org   string `json:"org"`
@@ -35,22 +67,76 @@ func VerifyTokenRequest(request, userID, userApiSecret string) bool {
 	return EncodeTokenRequest(userID, userApiSecret) == request
 }
 
-// New returns a new Claims instance
+// New returns a new Claims instance for the user with ScopeAll
 func New(userID, userEmailDigest, orgID string) (*Claims, error) {
+	return NewScoped(userID, userEmailDigest, orgID, ScopeAll)
+}
+
+// NewScoped returns a new Claims instance for the user granting scope,
+// with a unique token id (jti) so that the token can be revoked
+func NewScoped(userID, userEmailDigest, orgID, scope string) (*Claims, error) {
+	scope, err := ParseScope(scope)
+	if err != nil {
+		return nil, err
+	}
 	now := time.Now().Unix()
 	claims := &Claims{
-		"app",
+		scope,
 		orgID,
 		jwt_go.StandardClaims{
 			Audience:  userEmailDigest,
 			ExpiresAt: now + int64(Expiration),
-			Id:        userID,
+			Id:        uuid.NewString(),
 			Issuer:    "GrokLOC.com",
 			IssuedAt:  now,
+			Subject:   userID,
 		}}
 	return claims, nil
 }
 
+// ParseScope validates the space-separated scopes in s, returning them
+// sorted and without duplicates; an empty s is ScopeAll
+func ParseScope(s string) (string, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return ScopeAll, nil
+	}
+	seen := map[string]bool{}
+	scopes := []string{}
+	for _, f := range fields {
+		known := false
+		for _, scope := range Scopes {
+			if f == scope {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return "", fmt.Errorf("%w: %q", ErrScope, f)
+		}
+		if !seen[f] {
+			seen[f] = true
+			scopes = append(scopes, f)
+		}
+	}
+	sort.Strings(scopes)
+	return strings.Join(scopes, " "), nil
+}
+
+// HasScope reports whether the claims grant scope
+func (c *Claims) HasScope(scope string) bool {
+	for _, granted := range strings.Fields(c.Scope) {
+		if granted == ScopeAll || granted == scope {
+			return true
+		}
+		if strings.HasSuffix(scope, ":read") &&
+			granted == strings.TrimSuffix(scope, ":read")+":write" {
+			return true
+		}
+	}
+	return false
+}
+
 // ToHeaderVal prepends the JWTTokenType
 func ToHeaderVal(token string) string {
 	return fmt.Sprintf("%s %s", TokenType, token)
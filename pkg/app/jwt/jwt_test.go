@@ -3,6 +3,7 @@ package jwt
 import (
 	"context"
 	"testing"
+	"time"
 
 	jwt_go "github.com/dgrijalva/jwt-go"
 	"github.com/google/uuid"
@@ -46,7 +47,7 @@ func (s *JWTSuite) TestJWT() {
 		uuid.NewString(), // org owner display name
 		uuid.NewString(), // org owner email
 		ownerPassword,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.Master,
 	)
 	require.Nil(s.T(), err)
@@ -54,7 +55,7 @@ func (s *JWTSuite) TestJWT() {
 	u, err := user.Read(
 		ctx,
 		o.Owner,
-		s.st.DBKey,
+		s.st.DBKeys,
 		s.st.RandomReplica(),
 	)
 	require.Nil(s.T(), err)
@@ -66,7 +67,13 @@ func (s *JWTSuite) TestJWT() {
 	require.Nil(s.T(), err)
 	claimsDecoded, err := Decode(u.ID, signedToken, s.st.TokenKey)
 	require.Nil(s.T(), err)
-	require.Equal(s.T(), u.ID, claimsDecoded.Id)
+	require.Equal(s.T(), u.ID, claimsDecoded.Subject)
+	require.Equal(s.T(), claims.Id, claimsDecoded.Id)
+
+	// token ids are unique
+	other, err := New(u.ID, u.EmailDigest, u.Org)
+	require.Nil(s.T(), err)
+	require.NotEqual(s.T(), claims.Id, other.Id)
 	require.Equal(s.T(), u.Org, claimsDecoded.Org)
 
 	// wrong user
@@ -78,7 +85,7 @@ func (s *JWTSuite) TestJWT() {
 		uuid.NewString(),
 		o.ID,
 		password,
-		s.st.DBKey,
+		s.st.DBKeys,
 	)
 	require.Nil(s.T(), err)
 	uOther.Meta.Status = models.StatusActive
@@ -98,6 +105,73 @@ func (s *JWTSuite) TestJWT() {
 	require.Error(s.T(), err)
 }
 
+func (s *JWTSuite) TestScope() {
+	scope, err := ParseScope("")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), ScopeAll, scope)
+
+	scope, err = ParseScope(" user:read  org:read user:read ")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "org:read user:read", scope)
+
+	_, err = ParseScope("org:read org:delete")
+	require.ErrorIs(s.T(), err, ErrScope)
+	_, err = NewScoped(uuid.NewString(), uuid.NewString(), uuid.NewString(), "root")
+	require.ErrorIs(s.T(), err, ErrScope)
+
+	claims, err := NewScoped(uuid.NewString(), uuid.NewString(), uuid.NewString(),
+		ScopeUserRead+" "+ScopeRepositoryWrite)
+	require.Nil(s.T(), err)
+	require.True(s.T(), claims.HasScope(ScopeUserRead))
+	require.False(s.T(), claims.HasScope(ScopeUserWrite))
+	require.False(s.T(), claims.HasScope(ScopeOrgRead))
+	// write grants read
+	require.True(s.T(), claims.HasScope(ScopeRepositoryWrite))
+	require.True(s.T(), claims.HasScope(ScopeRepositoryRead))
+
+	claims, err = New(uuid.NewString(), uuid.NewString(), uuid.NewString())
+	require.Nil(s.T(), err)
+	for _, scope := range Scopes {
+		require.True(s.T(), claims.HasScope(scope))
+	}
+}
+
+func (s *JWTSuite) TestKeyring() {
+	id := uuid.NewString()
+	claims, err := New(id, uuid.NewString(), uuid.NewString())
+	require.Nil(s.T(), err)
+	now := time.Now().Unix()
+	legacy := SigningKey{ID: security.LegacyKeyID, Key: s.st.TokenKey}
+	current := SigningKey{ID: uuid.NewString(), Key: []byte(uuid.NewString())}
+	keys := NewKeyring(current, SigningKey{ID: legacy.ID, Key: legacy.Key, Expires: now + 60})
+
+	signed, err := Encode(id, claims, keys.Current)
+	require.Nil(s.T(), err)
+	decoded, err := DecodeKeyring(id, signed, keys, now)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), claims.Id, decoded.Id)
+
+	// tokens without a key id were signed with the legacy key, which
+	// verifies until it expires
+	token := jwt_go.NewWithClaims(jwt_go.SigningMethodHS256, claims)
+	unnamed, err := token.SignedString([]byte(id + string(legacy.Key)))
+	require.Nil(s.T(), err)
+	_, err = DecodeKeyring(id, unnamed, keys, now)
+	require.Nil(s.T(), err)
+	_, err = DecodeKeyring(id, unnamed, keys, now+60)
+	require.ErrorIs(s.T(), err, ErrKeyID)
+
+	// unknown key
+	other, err := Encode(id, claims, SigningKey{ID: uuid.NewString(), Key: current.Key})
+	require.Nil(s.T(), err)
+	_, err = DecodeKeyring(id, other, keys, now)
+	require.ErrorIs(s.T(), err, ErrKeyID)
+
+	// the current key never expires
+	_, err = DecodeKeyring(id, signed, keys, now+86400)
+	require.Nil(s.T(), err)
+}
+
 func (s *JWTSuite) TestHeaderVal() {
 	token := uuid.NewString() // it just needs to be some string
 	require.Equal(s.T(), token, FromHeaderVal(ToHeaderVal(token)))
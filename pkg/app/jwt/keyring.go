@@ -0,0 +1,92 @@
+package jwt
+
+import (
+	"errors"
+	"fmt"
+
+	jwt_go "github.com/dgrijalva/jwt-go"
+	"github.com/grokloc/grokloc-server/pkg/security"
+)
+
+// KeyIDHeader is the JWT header naming the key that signed the token;
+// tokens without one were signed with the key security.LegacyKeyID
+const KeyIDHeader = "kid"
+
+// ErrKeyID signals a token signed with a key that is unknown or no
+// longer verifies tokens
+var ErrKeyID = errors.New("token key unknown or expired")
+
+// SigningKey is a key that signs tokens, and verifies them until Expires
+type SigningKey struct {
+	ID      string `json:"id"`
+	Key     []byte `json:"-"`
+	Expires int64  `json:"expires"` // unix time; 0 for the current key
+}
+
+// Keyring is the current signing key and the previous keys that still
+// verify tokens
+type Keyring struct {
+	Current SigningKey
+	keys    map[string]SigningKey
+}
+
+// NewKeyring returns a Keyring signing with current
+func NewKeyring(current SigningKey, previous ...SigningKey) *Keyring {
+	k := &Keyring{Current: current, keys: map[string]SigningKey{}}
+	for _, p := range previous {
+		k.keys[p.ID] = p
+	}
+	k.keys[current.ID] = current
+	return k
+}
+
+// Verifying returns the key with id if it verifies tokens at unix time
+// now
+func (k *Keyring) Verifying(id string, now int64) ([]byte, bool) {
+	key, ok := k.keys[id]
+	if !ok || (key.Expires != 0 && key.Expires <= now) {
+		return nil, false
+	}
+	return key.Key, true
+}
+
+// Encode signs claims for the user with id using key, naming key in the
+// KeyIDHeader
+func Encode(id string, claims *Claims, key SigningKey) (string, error) {
+	token := jwt_go.NewWithClaims(jwt_go.SigningMethodHS256, claims)
+	token.Header[KeyIDHeader] = key.ID
+	return token.SignedString([]byte(id + string(key.Key)))
+}
+
+// DecodeKeyring is Decode with the key in keys named by the token
+func DecodeKeyring(id, token string, keys *Keyring, now int64) (*Claims, error) {
+	f := func(token *jwt_go.Token) (interface{}, error) {
+		kid := security.LegacyKeyID
+		if v, ok := token.Header[KeyIDHeader]; ok {
+			s, ok := v.(string)
+			if !ok {
+				return nil, ErrKeyID
+			}
+			kid = s
+		}
+		key, ok := keys.Verifying(kid, now)
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrKeyID, kid)
+		}
+		return []byte(id + string(key)), nil
+	}
+	parsed, err := jwt_go.ParseWithClaims(token, &Claims{}, f)
+	if err != nil {
+		// jwt_go does not wrap the error from f
+		var ve *jwt_go.ValidationError
+		if errors.As(err, &ve) && errors.Is(ve.Inner, ErrKeyID) {
+			return nil, ve.Inner
+		}
+		return nil, err
+	}
+	claims, ok := parsed.Claims.(*Claims)
+	if ok {
+		return claims, nil
+	}
+	return nil, errors.New("token claims")
+}
@@ -0,0 +1,257 @@
+// Package lockout limits failed authentication attempts
+//
+// Failures are counted per Counter in the db, so counts survive restarts
+// and are shared by every server using the db. After Policy.Free
+// failures, each further failure delays the next attempt, doubling from
+// one second; at Policy.Lockout failures the counter is locked out for
+// Policy.Duration seconds, which is audited once
+//
+// Counts are forgotten Window seconds after the last failure, or when
+// the attempt succeeds
+package lockout
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/audit"
+	"github.com/grokloc/grokloc-server/pkg/security"
+)
+
+// Window is how long, in seconds, failures are counted after the last
+const Window = 86400
+
+// Policy sets how failures are penalized
+type Policy struct {
+	Free     int64 // failures without delay
+	Lockout  int64 // failures that lock out
+	Duration int64 // seconds locked out
+}
+
+// Policies for the counters below; an address may be shared by many
+// users, so it has more leeway
+var (
+	UserPolicy = Policy{Free: 3, Lockout: 10, Duration: 900}
+	AddrPolicy = Policy{Free: 50, Lockout: 100, Duration: 900}
+)
+
+// Counter counts the failures of one user or address
+type Counter struct {
+	Key    string
+	Policy Policy
+}
+
+// User returns the Counter for token requests of the user with id
+func User(id string) Counter {
+	return Counter{Key: "user:" + id, Policy: UserPolicy}
+}
+
+// Email returns the Counter for logins to org with email, whether or not
+// such a user exists
+func Email(org, email string) Counter {
+	return Counter{Key: "email:" + security.EncodedSHA256(org+email), Policy: UserPolicy}
+}
+
+// Addr returns the Counter for requests from the remote address addr
+func Addr(addr string) Counter {
+	return Counter{Key: "addr:" + addr, Policy: AddrPolicy}
+}
+
+// Delay returns how long, in seconds, an attempt is refused after the
+// failures of a counter with policy p
+func (p Policy) Delay(failures int64) int64 {
+	switch {
+	case failures >= p.Lockout:
+		return p.Duration
+	case failures <= p.Free:
+		return 0
+	}
+	// doubled stepwise, as a shift can overflow
+	delay := int64(1)
+	for i := p.Free + 1; i < failures && delay < p.Duration; i++ {
+		delay *= 2
+	}
+	if delay > p.Duration {
+		return p.Duration
+	}
+	return delay
+}
+
+// queryRower is a *sql.DB or *sql.Tx
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Check returns how long, in seconds, until another attempt is allowed
+// for all of counters; 0 if one is allowed now
+func Check(ctx context.Context, counters []Counter, db *sql.DB) (int64, error) {
+	return check(ctx, counters, time.Now().Unix(), db)
+}
+
+// check is Check at unix time now, reading from q
+func check(ctx context.Context, counters []Counter, now int64, q queryRower) (int64, error) {
+	read := fmt.Sprintf(`select locked_until from %s where key = ?`, app.LoginFailuresTableName)
+	var wait int64
+	for _, c := range counters {
+		var lockedUntil int64
+		err := q.QueryRowContext(ctx, read, c.Key).Scan(&lockedUntil)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				continue
+			}
+			return 0, err
+		}
+		if lockedUntil-now > wait {
+			wait = lockedUntil - now
+		}
+	}
+	return wait, nil
+}
+
+// Reserve counts an attempt as failed for each of counters before it is
+// verified, so that concurrent attempts are delayed by it; an attempt
+// that then succeeds is Reset or Refunded. The unix time the attempt was
+// counted at is returned for Refund
+//
+// If an attempt is not allowed now, nothing is counted and the seconds
+// until one is are returned as wait
+func Reserve(ctx context.Context, counters []Counter, db *sql.DB) (at, wait int64, err error) {
+	return record(ctx, counters, true, db)
+}
+
+// Fail records a failed attempt for each of counters, and audits those
+// that are locked out as a result
+func Fail(ctx context.Context, counters []Counter, db *sql.DB) error {
+	_, _, err := record(ctx, counters, false, db)
+	return err
+}
+
+// record counts a failed attempt for each of counters in one
+// transaction, returning the time it was counted at, or first returning
+// the wait from check instead if reserve and an attempt is not allowed now
+func record(ctx context.Context, counters []Counter, reserve bool, db *sql.DB) (int64, int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback() // nolint
+
+	// writing first holds the db write lock for the check below
+	now := time.Now().Unix()
+	q := fmt.Sprintf(`delete from %s where last <= ?`, app.LoginFailuresTableName)
+	_, err = tx.ExecContext(ctx, q, now-Window)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if reserve {
+		wait, err := check(ctx, counters, now, tx)
+		if err != nil {
+			return 0, 0, err
+		}
+		if wait > 0 {
+			return 0, wait, tx.Commit()
+		}
+	}
+
+	insert := fmt.Sprintf(`insert into %s
+                               (key,
+                                failures,
+                                last)
+                               values
+                               (?,1,?)
+                               on conflict (key) do update
+                               set failures = failures + 1,
+                               last = excluded.last`,
+		app.LoginFailuresTableName)
+	read := fmt.Sprintf(`select failures from %s where key = ?`, app.LoginFailuresTableName)
+	lock := fmt.Sprintf(`update %s set locked_until = ? where key = ?`, app.LoginFailuresTableName)
+	lockedOut := []string{}
+	for _, c := range counters {
+		_, err = tx.ExecContext(ctx, insert, c.Key, now)
+		if err != nil {
+			return 0, 0, err
+		}
+		var failures int64
+		err = tx.QueryRowContext(ctx, read, c.Key).Scan(&failures)
+		if err != nil {
+			return 0, 0, err
+		}
+		_, err = tx.ExecContext(ctx, lock, now+c.Policy.Delay(failures), c.Key)
+		if err != nil {
+			return 0, 0, err
+		}
+		if failures == c.Policy.Lockout {
+			lockedOut = append(lockedOut, c.Key)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, key := range lockedOut {
+		_ = audit.Insert(ctx, audit.LOCKOUT, app.LoginFailuresTableName, key, db)
+	}
+
+	return now, 0, nil
+}
+
+// Refund uncounts an attempt Reserved at for counters that did not fail,
+// and recomputes their delay from the refunded count, so a successful
+// attempt does not delay the next one
+//
+// The attempt was allowed, so any delay before it had passed; a delay
+// only stands if a failure was counted after it
+func Refund(ctx context.Context, counters []Counter, at int64, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint
+
+	read := fmt.Sprintf(`select failures, last from %s where key = ?`, app.LoginFailuresTableName)
+	refund := fmt.Sprintf(`update %s set failures = ?, locked_until = ? where key = ?`,
+		app.LoginFailuresTableName)
+	for _, c := range counters {
+		var failures, last int64
+		err = tx.QueryRowContext(ctx, read, c.Key).Scan(&failures, &last)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				continue
+			}
+			return err
+		}
+		// the failures counted with the attempt have been reset
+		if failures == 0 || last < at {
+			continue
+		}
+		failures--
+		lockedUntil := at
+		if last > at {
+			lockedUntil = last + c.Policy.Delay(failures)
+		}
+		_, err = tx.ExecContext(ctx, refund, failures, lockedUntil, c.Key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Reset forgets the failures of counters
+func Reset(ctx context.Context, counters []Counter, db *sql.DB) error {
+	q := fmt.Sprintf(`delete from %s where key = ?`, app.LoginFailuresTableName)
+	for _, c := range counters {
+		_, err := db.ExecContext(ctx, q, c.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package lockout
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/audit"
+	"github.com/grokloc/grokloc-server/pkg/app/state"
+	"github.com/grokloc/grokloc-server/pkg/env"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type LockoutSuite struct {
+	suite.Suite
+	st  *app.State
+	ctx context.Context
+}
+
+func (s *LockoutSuite) SetupTest() {
+	var err error
+	s.st, err = state.New(env.Unit)
+	require.Nil(s.T(), err)
+	s.ctx = context.Background()
+}
+
+func (s *LockoutSuite) check(c Counter) int64 {
+	wait, err := Check(s.ctx, []Counter{c}, s.st.Master)
+	require.Nil(s.T(), err)
+	return wait
+}
+
+func (s *LockoutSuite) fail(c Counter, n int64) {
+	for i := int64(0); i < n; i++ {
+		require.Nil(s.T(), Fail(s.ctx, []Counter{c}, s.st.Master))
+	}
+}
+
+func (s *LockoutSuite) lockouts(c Counter) int {
+	var count int
+	err := s.st.Master.QueryRowContext(s.ctx,
+		fmt.Sprintf(`select count(*) from %s where code = ? and source_id = ?`, app.AuditTableName),
+		audit.LOCKOUT, c.Key).Scan(&count)
+	require.Nil(s.T(), err)
+	return count
+}
+
+func (s *LockoutSuite) TestDelay() {
+	p := Policy{Free: 3, Lockout: 10, Duration: 900}
+	for failures, delay := range map[int64]int64{
+		0:  0,
+		3:  0,
+		4:  1,
+		5:  2,
+		9:  32,
+		10: 900,
+		20: 900,
+	} {
+		require.Equal(s.T(), delay, p.Delay(failures), failures)
+	}
+
+	// backoff never exceeds a lockout
+	p = Policy{Free: 0, Lockout: 100, Duration: 60}
+	require.Equal(s.T(), int64(60), p.Delay(99))
+}
+
+func (s *LockoutSuite) TestFail() {
+	c := User(uuid.NewString())
+	require.Equal(s.T(), int64(0), s.check(c))
+
+	// free failures
+	s.fail(c, UserPolicy.Free)
+	require.Equal(s.T(), int64(0), s.check(c))
+
+	// backoff
+	s.fail(c, 1)
+	wait := s.check(c)
+	require.Greater(s.T(), wait, int64(0))
+	require.LessOrEqual(s.T(), wait, int64(1))
+	require.Equal(s.T(), 0, s.lockouts(c))
+
+	// lockout, audited once
+	s.fail(c, UserPolicy.Lockout-UserPolicy.Free-1)
+	require.Greater(s.T(), s.check(c), UserPolicy.Duration-5)
+	require.Equal(s.T(), 1, s.lockouts(c))
+	s.fail(c, 1)
+	require.Equal(s.T(), 1, s.lockouts(c))
+
+	// the longest wait of several counters applies
+	other := Addr(uuid.NewString())
+	wait, err := Check(s.ctx, []Counter{other, c}, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), s.check(c), wait)
+
+	require.Nil(s.T(), Reset(s.ctx, []Counter{c}, s.st.Master))
+	require.Equal(s.T(), int64(0), s.check(c))
+}
+
+func (s *LockoutSuite) failures(c Counter) int64 {
+	var failures int64
+	err := s.st.Master.QueryRowContext(s.ctx,
+		fmt.Sprintf(`select failures from %s where key = ?`, app.LoginFailuresTableName),
+		c.Key).Scan(&failures)
+	require.Nil(s.T(), err)
+	return failures
+}
+
+func (s *LockoutSuite) TestReserve() {
+	c := User(uuid.NewString())
+	for i := int64(0); i <= UserPolicy.Free; i++ {
+		_, wait, err := Reserve(s.ctx, []Counter{c}, s.st.Master)
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), int64(0), wait)
+	}
+	require.Equal(s.T(), UserPolicy.Free+1, s.failures(c))
+
+	// an attempt that is not allowed is not counted
+	_, wait, err := Reserve(s.ctx, []Counter{c}, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Greater(s.T(), wait, int64(0))
+	require.Equal(s.T(), UserPolicy.Free+1, s.failures(c))
+}
+
+func (s *LockoutSuite) TestRefund() {
+	c := Counter{Key: uuid.NewString(), Policy: Policy{Free: 0, Lockout: 10, Duration: 900}}
+	s.fail(c, 3)
+	_, err := s.st.Master.ExecContext(s.ctx,
+		fmt.Sprintf(`update %s set last = last - 60, locked_until = 0 where key = ?`, app.LoginFailuresTableName),
+		c.Key)
+	require.Nil(s.T(), err)
+
+	// a reserved attempt that succeeds is uncounted, and does not delay
+	// the next
+	at, wait, err := Reserve(s.ctx, []Counter{c}, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), int64(0), wait)
+	require.Greater(s.T(), s.check(c), int64(0))
+	require.Nil(s.T(), Refund(s.ctx, []Counter{c}, at, s.st.Master))
+	require.Equal(s.T(), int64(3), s.failures(c))
+	require.Equal(s.T(), int64(0), s.check(c))
+
+	// a failure counted after the reservation still delays
+	at, _, err = Reserve(s.ctx, []Counter{c}, s.st.Master)
+	require.Nil(s.T(), err)
+	_, err = s.st.Master.ExecContext(s.ctx,
+		fmt.Sprintf(`update %s set failures = failures + 1, last = ? where key = ?`, app.LoginFailuresTableName),
+		at+1, c.Key)
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), Refund(s.ctx, []Counter{c}, at, s.st.Master))
+	require.Equal(s.T(), int64(4), s.failures(c))
+	require.Greater(s.T(), s.check(c), int64(0))
+
+	// failures reset since the reservation are not refunded
+	at, _, err = Reserve(s.ctx, []Counter{c}, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), Reset(s.ctx, []Counter{c}, s.st.Master))
+	require.Nil(s.T(), Refund(s.ctx, []Counter{c}, at, s.st.Master))
+	require.Equal(s.T(), int64(0), s.check(c))
+}
+
+func (s *LockoutSuite) TestReserveConcurrent() {
+	// only the first of concurrent attempts is allowed once delays apply
+	c := Counter{Key: uuid.NewString(), Policy: Policy{Free: 0, Lockout: 10, Duration: 900}}
+	const attempts = 8
+	waits := make(chan int64, attempts)
+	for i := 0; i < attempts; i++ {
+		go func() {
+			_, wait, err := Reserve(s.ctx, []Counter{c}, s.st.Master)
+			if err != nil {
+				wait = -1
+			}
+			waits <- wait
+		}()
+	}
+	allowed := 0
+	for i := 0; i < attempts; i++ {
+		wait := <-waits
+		require.GreaterOrEqual(s.T(), wait, int64(0))
+		if wait == 0 {
+			allowed++
+		}
+	}
+	require.Equal(s.T(), 1, allowed)
+	require.Equal(s.T(), int64(1), s.failures(c))
+}
+
+func (s *LockoutSuite) TestWindow() {
+	c := Email(uuid.NewString(), uuid.NewString())
+	s.fail(c, UserPolicy.Lockout)
+	require.Greater(s.T(), s.check(c), int64(0))
+
+	// failures before the window are forgotten
+	_, err := s.st.Master.ExecContext(s.ctx,
+		fmt.Sprintf(`update %s set last = ?, locked_until = 0 where key = ?`, app.LoginFailuresTableName),
+		time.Now().Unix()-Window, c.Key)
+	require.Nil(s.T(), err)
+	s.fail(c, 1)
+	require.Equal(s.T(), int64(0), s.check(c))
+}
+
+func TestLockoutSuite(t *testing.T) {
+	suite.Run(t, new(LockoutSuite))
+}
@@ -0,0 +1,213 @@
+// Package migrate applies versioned schema migrations
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/security"
+)
+
+// StmtSeparator separates statements in a migration
+const StmtSeparator = "-- STMT"
+
+// ErrChecksum signals an applied migration that no longer matches its definition
+var ErrChecksum = errors.New("applied migration checksum mismatch")
+
+// ErrUnknown signals an applied migration with no definition
+var ErrUnknown = errors.New("applied migration is not defined")
+
+// ErrSequence signals migrations that do not number 1, 2, 3...
+var ErrSequence = errors.New("migration versions are not sequential from 1")
+
+// ErrIrreversible signals a migration with no Down
+var ErrIrreversible = errors.New("migration has no down")
+
+// Status describes a single migration and whether it has been applied
+type Status struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt int64 // unixtime, 0 if not applied
+}
+
+// applied is a bookkeeping row
+type applied struct {
+	name      string
+	checksum  string
+	appliedAt int64
+}
+
+// Checksum returns the checksum recorded for m
+func Checksum(m app.Migration) string {
+	return security.EncodedSHA256(m.Up)
+}
+
+// Up applies app.Migrations to db
+func Up(ctx context.Context, db *sql.DB) error {
+	return Apply(ctx, db, app.Migrations)
+}
+
+// Apply verifies the migrations already applied to db, then applies
+// each pending migration in its own transaction
+func Apply(ctx context.Context, db *sql.DB, migrations []app.Migration) error {
+	done, err := verify(ctx, db, migrations)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if _, ok := done[m.Version]; ok {
+			continue
+		}
+		err = run(ctx, db, m.Up, func(tx *sql.Tx) error {
+			q := fmt.Sprintf(`insert into %s
+                                          (version,
+                                           name,
+                                           checksum,
+                                           applied_at)
+                                          values
+                                          (?,?,?,?)`,
+				app.SchemaMigrationsTableName)
+			_, err := tx.ExecContext(ctx, q, m.Version, m.Name, Checksum(m), time.Now().Unix())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// Down reverts applied migrations newer than version, newest first
+func Down(ctx context.Context, db *sql.DB, migrations []app.Migration, version int) error {
+	done, err := verify(ctx, db, migrations)
+	if err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version <= version {
+			break
+		}
+		if _, ok := done[m.Version]; !ok {
+			continue
+		}
+		if len(strings.TrimSpace(m.Down)) == 0 {
+			return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, ErrIrreversible)
+		}
+		err = run(ctx, db, m.Down, func(tx *sql.Tx) error {
+			q := fmt.Sprintf(`delete from %s where version = ?`, app.SchemaMigrationsTableName)
+			_, err := tx.ExecContext(ctx, q, m.Version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// Report returns the status of every migration after verifying those applied
+func Report(ctx context.Context, db *sql.DB, migrations []app.Migration) ([]Status, error) {
+	done, err := verify(ctx, db, migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, len(migrations))
+	for i, m := range migrations {
+		statuses[i] = Status{Version: m.Version, Name: m.Name}
+		if a, ok := done[m.Version]; ok {
+			statuses[i].Applied = true
+			statuses[i].AppliedAt = a.appliedAt
+		}
+	}
+	return statuses, nil
+}
+
+// verify creates the bookkeeping table if needed, and checks that every
+// applied migration is defined with an unchanged checksum
+func verify(ctx context.Context, db *sql.DB, migrations []app.Migration) (map[int]applied, error) {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, ErrSequence
+		}
+	}
+
+	q := fmt.Sprintf(`create table if not exists %s (
+                          version integer unique not null,
+                          name text not null,
+                          checksum text not null,
+                          applied_at integer not null,
+                          primary key (version))`,
+		app.SchemaMigrationsTableName)
+	_, err := db.ExecContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	q = fmt.Sprintf(`select version, name, checksum, applied_at from %s`,
+		app.SchemaMigrationsTableName)
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	done := make(map[int]applied)
+	for rows.Next() {
+		var version int
+		var a applied
+		err = rows.Scan(&version, &a.name, &a.checksum, &a.appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		done[version] = a
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for version, a := range done {
+		if version < 1 || version > len(migrations) {
+			return nil, fmt.Errorf("migration %d %s: %w", version, a.name, ErrUnknown)
+		}
+		m := migrations[version-1]
+		if Checksum(m) != a.checksum {
+			return nil, fmt.Errorf("migration %d %s: %w", m.Version, m.Name, ErrChecksum)
+		}
+	}
+	return done, nil
+}
+
+// run executes the statements in s and then record in a single transaction
+func run(ctx context.Context, db *sql.DB, s string, record func(*sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range strings.Split(s, StmtSeparator) {
+		if len(strings.TrimSpace(stmt)) == 0 {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, stmt)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	err = record(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,122 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app"
+	_ "github.com/mattn/go-sqlite3" //
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type MigrateSuite struct {
+	suite.Suite
+	ctx context.Context
+	db  *sql.DB
+}
+
+func (s *MigrateSuite) SetupTest() {
+	var err error
+	s.ctx = context.Background()
+	s.db, err = sql.Open("sqlite3",
+		fmt.Sprintf("file:%s?mode=memory&cache=shared", uuid.NewString()))
+	require.Nil(s.T(), err)
+	s.db.SetMaxOpenConns(1)
+}
+
+func (s *MigrateSuite) TearDownTest() {
+	require.Nil(s.T(), s.db.Close())
+}
+
+func (s *MigrateSuite) TestUp() {
+	require.Nil(s.T(), Up(s.ctx, s.db))
+	// idempotent
+	require.Nil(s.T(), Up(s.ctx, s.db))
+
+	statuses, err := Report(s.ctx, s.db, app.Migrations)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), len(app.Migrations), len(statuses))
+	for _, status := range statuses {
+		require.True(s.T(), status.Applied)
+		require.NotZero(s.T(), status.AppliedAt)
+	}
+
+	var count int
+	err = s.db.QueryRow(fmt.Sprintf(`select count(*) from %s`, app.UsersTableName)).Scan(&count)
+	require.Nil(s.T(), err)
+}
+
+func (s *MigrateSuite) TestPendingAndDown() {
+	migrations := []app.Migration{
+		{Version: 1, Name: "a", Up: `create table a (x integer)`, Down: `drop table a`},
+	}
+	require.Nil(s.T(), Apply(s.ctx, s.db, migrations))
+
+	migrations = append(migrations, app.Migration{
+		Version: 2,
+		Name:    "b",
+		Up: `create table b (x integer);
+-- STMT
+insert into b (x) values (1)`,
+		Down: `drop table b`,
+	})
+	statuses, err := Report(s.ctx, s.db, migrations)
+	require.Nil(s.T(), err)
+	require.True(s.T(), statuses[0].Applied)
+	require.False(s.T(), statuses[1].Applied)
+
+	require.Nil(s.T(), Apply(s.ctx, s.db, migrations))
+	var x int
+	require.Nil(s.T(), s.db.QueryRow(`select x from b`).Scan(&x))
+	require.Equal(s.T(), 1, x)
+
+	require.Nil(s.T(), Down(s.ctx, s.db, migrations, 1))
+	_, err = s.db.Exec(`select x from b`)
+	require.Error(s.T(), err)
+	statuses, err = Report(s.ctx, s.db, migrations)
+	require.Nil(s.T(), err)
+	require.False(s.T(), statuses[1].Applied)
+
+	// no down
+	migrations[0].Down = ""
+	require.ErrorIs(s.T(), Down(s.ctx, s.db, migrations, 0), ErrIrreversible)
+}
+
+func (s *MigrateSuite) TestFailedMigrationRollsBack() {
+	migrations := []app.Migration{
+		{Version: 1, Name: "bad", Up: `create table c (x integer);
+-- STMT
+not sql`},
+	}
+	require.Error(s.T(), Apply(s.ctx, s.db, migrations))
+	_, err := s.db.Exec(`select x from c`)
+	require.Error(s.T(), err)
+	statuses, err := Report(s.ctx, s.db, migrations)
+	require.Nil(s.T(), err)
+	require.False(s.T(), statuses[0].Applied)
+}
+
+func (s *MigrateSuite) TestVerify() {
+	migrations := []app.Migration{
+		{Version: 1, Name: "a", Up: `create table a (x integer)`},
+	}
+	require.Nil(s.T(), Apply(s.ctx, s.db, migrations))
+
+	edited := []app.Migration{
+		{Version: 1, Name: "a", Up: `create table a (x integer, y integer)`},
+	}
+	require.ErrorIs(s.T(), Apply(s.ctx, s.db, edited), ErrChecksum)
+
+	require.ErrorIs(s.T(), Apply(s.ctx, s.db, []app.Migration{}), ErrUnknown)
+
+	gap := []app.Migration{migrations[0], {Version: 3, Name: "c", Up: `select 1`}}
+	require.ErrorIs(s.T(), Apply(s.ctx, s.db, gap), ErrSequence)
+}
+
+func TestMigrateSuite(t *testing.T) {
+	suite.Run(t, new(MigrateSuite))
+}
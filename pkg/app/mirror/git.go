@@ -0,0 +1,50 @@
+package mirror
+
+import (
+	"context"
+
+	"github.com/grokloc/grokloc-server/pkg/git"
+)
+
+// transport returns the git config args that limit an upstream fetch to
+// https, or also local paths if allowFile, and stop git following
+// redirects; repository.CheckUpstream only checks the host of the
+// upstream itself, so a redirect could lead anywhere
+func transport(allowFile bool, args ...string) []string {
+	config := []string{
+		"-c", "http.followRedirects=false",
+		"-c", "protocol.allow=never",
+		"-c", "protocol.https.allow=always",
+	}
+	if allowFile {
+		config = append(config, "-c", "protocol.file.allow=always")
+	}
+	return append(config, args...)
+}
+
+// clone creates a bare mirror of upstream at path
+func clone(ctx context.Context, upstream, path string, allowFile bool) error {
+	_, err := git.Output(ctx, "", transport(allowFile, "clone", "--mirror", "--quiet", "--", upstream, path)...)
+	return err
+}
+
+// fetch points the mirror at path to upstream, then fetches all refs,
+// pruning those deleted upstream
+func fetch(ctx context.Context, upstream, path string, allowFile bool) error {
+	_, err := git.Output(ctx, path, transport(allowFile, "remote", "set-url", "origin", upstream)...)
+	if err != nil {
+		return err
+	}
+	_, err = git.Output(ctx, path, transport(allowFile, "fetch", "--prune", "--quiet", "origin")...)
+	return err
+}
+
+// head returns the commit HEAD resolves to in the mirror at path,
+// or "" if the repository has no commits
+func head(ctx context.Context, path string) string {
+	commit, err := git.ResolveCommit(ctx, path, "HEAD")
+	if err != nil {
+		return ""
+	}
+	return commit
+}
@@ -0,0 +1,126 @@
+package mirror
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/analysis"
+	"github.com/grokloc/grokloc-server/pkg/app/job"
+	"github.com/grokloc/grokloc-server/pkg/app/repository"
+	"github.com/grokloc/grokloc-server/pkg/models"
+	"go.uber.org/zap"
+)
+
+// Kinds of job run on mirrors
+const (
+	SyncKind    = "mirror.sync"    // syncs and analyzes one repository
+	HistoryKind = "mirror.history" // analyzes the history of one repository
+)
+
+// HistorySample selects the commits analyzed by a HistoryKind job
+// enqueued after a sync
+var HistorySample = analysis.Sample{Daily: true}
+
+// errAnalyze and errHistory fail a job whose analysis failed; the cause
+// is logged, as job errors may be read by org members and analysis
+// errors name server paths
+var (
+	errAnalyze = errors.New("analysis failed")
+	errHistory = errors.New("history failed")
+)
+
+// SyncPayload is the payload of a SyncKind job
+type SyncPayload struct {
+	Repository string `json:"repository"`
+}
+
+// HistoryPayload is the payload of a HistoryKind job
+type HistoryPayload struct {
+	Repository string          `json:"repository"`
+	Sample     analysis.Sample `json:"sample"`
+}
+
+// readActive reads the active repository id for a job, failing the job
+// permanently if it is missing or inactive
+func readActive(ctx context.Context, id string, db *sql.DB) (*repository.Repository, error) {
+	r, err := repository.Read(ctx, id, db)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, job.Permanent(err)
+		}
+		return nil, err
+	}
+	if r.Meta.Status != models.StatusActive {
+		return nil, job.Permanent(fmt.Errorf("repository %s is not active", r.ID))
+	}
+	return r, nil
+}
+
+// SyncJob is the job.Handler for SyncKind, doing for one repository
+// what SyncAll does for each
+//
+// Missing and inactive repositories fail the job permanently. A
+// repository being synced fails the attempt, so the job is retried
+// once that sync is done, as it may have fetched too early
+func SyncJob(ctx context.Context, st *app.State, j *job.Job) error {
+	var p SyncPayload
+	err := json.Unmarshal(j.Payload, &p)
+	if err != nil {
+		return job.Permanent(err)
+	}
+	r, err := readActive(ctx, p.Repository, st.Master)
+	if err != nil {
+		return err
+	}
+	m, err := Sync(ctx, r, st.AllowFileUpstreams, st.Master)
+	if err != nil {
+		return err
+	}
+	_, err = analyze(ctx, st, r, m)
+	if err != nil {
+		zap.L().Warn("mirror analyze", zap.String("id", r.ID), zap.Error(err))
+		return errAnalyze
+	}
+	return nil
+}
+
+// HistoryJob is the job.Handler for HistoryKind, storing the history
+// of the mirrored head of one repository selected by the payload sample
+//
+// Missing, inactive and never synced repositories, and invalid samples,
+// fail the job permanently
+func HistoryJob(ctx context.Context, st *app.State, j *job.Job) error {
+	var p HistoryPayload
+	err := json.Unmarshal(j.Payload, &p)
+	if err != nil {
+		return job.Permanent(err)
+	}
+	err = p.Sample.Validate()
+	if err != nil {
+		return job.Permanent(err)
+	}
+	r, err := readActive(ctx, p.Repository, st.Master)
+	if err != nil {
+		return err
+	}
+	m, err := Read(ctx, r.ID, st.Master)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return job.Permanent(err)
+		}
+		return err
+	}
+	if len(m.Head) == 0 {
+		return job.Permanent(fmt.Errorf("repository %s has no head", r.ID))
+	}
+	_, err = analysis.CreateHistory(ctx, r, m.Head, p.Sample, st.Master)
+	if err != nil {
+		zap.L().Warn("mirror history", zap.String("id", r.ID), zap.Error(err))
+		return errHistory
+	}
+	return nil
+}
@@ -0,0 +1,387 @@
+// Package mirror keeps a local bare mirror of each repository upstream
+package mirror
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/analysis"
+	"github.com/grokloc/grokloc-server/pkg/app/contribution"
+	"github.com/grokloc/grokloc-server/pkg/app/job"
+	"github.com/grokloc/grokloc-server/pkg/app/repository"
+	"github.com/grokloc/grokloc-server/pkg/models"
+	"go.uber.org/zap"
+)
+
+// Mirror is the fetch state of the local copy of a repository
+type Mirror struct {
+	Repository string `json:"repository"`
+	Head       string `json:"head"`
+	LastFetch  int64  `json:"last_fetch"` // unix time of the last successful fetch
+	LastError  string `json:"last_error"` // empty if the last fetch succeeded
+}
+
+// LeaseDuration bounds how long one Sync may hold a repository; a
+// clone or fetch still running then is cancelled
+const LeaseDuration = 30 * time.Minute
+
+// ErrLeased is returned by Sync if the repository is already being
+// synced
+var ErrLeased = errors.New("repository is being synced")
+
+// Result counts the repositories synced by SyncAll, the new commits
+// analyzed, and the repositories that failed either step
+type Result struct {
+	Synced   int
+	Analyzed int
+	Failed   int
+}
+
+// Read returns the mirror state for repository
+//
+// sql.ErrNoRows is returned if the repository has never been synced
+func Read(ctx context.Context, repository string, db *sql.DB) (*Mirror, error) {
+	q := fmt.Sprintf(`select
+                          head,
+                          last_fetch,
+                          last_error
+                          from %s
+                          where repository = ?
+                          and (last_fetch != 0 or last_error != '')`,
+		app.MirrorsTableName)
+
+	m := &Mirror{Repository: repository}
+	err := db.QueryRowContext(ctx, q, repository).Scan(
+		&m.Head,
+		&m.LastFetch,
+		&m.LastError)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// write inserts or replaces the row for m
+func (m Mirror) write(ctx context.Context, db *sql.DB) error {
+	q := fmt.Sprintf(`insert into %s
+                          (repository,
+                           head,
+                           last_fetch,
+                           last_error)
+                          values
+                          (?,?,?,?)
+                          on conflict (repository) do update set
+                           head = excluded.head,
+                           last_fetch = excluded.last_fetch,
+                           last_error = excluded.last_error`,
+		app.MirrorsTableName)
+
+	result, err := db.ExecContext(ctx, q, m.Repository, m.Head, m.LastFetch, m.LastError)
+	if err != nil {
+		return err
+	}
+
+	written, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if written != 1 {
+		return models.ErrRowsAffected
+	}
+	return nil
+}
+
+// acquire leases the mirror of repository for LeaseDuration, returning
+// the lease, or ErrLeased if another unexpired lease holds it
+func acquire(ctx context.Context, repository string, db *sql.DB) (string, error) {
+	now := time.Now().Unix()
+	lease := uuid.NewString()
+	q := fmt.Sprintf(`insert into %s
+                          (repository,
+                           lease,
+                           lease_until)
+                          values
+                          (?,?,?)
+                          on conflict (repository) do update set
+                           lease = excluded.lease,
+                           lease_until = excluded.lease_until
+                          where lease_until <= ?`,
+		app.MirrorsTableName)
+
+	result, err := db.ExecContext(ctx, q,
+		repository, lease, now+int64(LeaseDuration/time.Second), now)
+	if err != nil {
+		return "", err
+	}
+
+	acquired, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if acquired != 1 {
+		return "", ErrLeased
+	}
+	return lease, nil
+}
+
+// release gives up lease on the mirror of repository
+func release(ctx context.Context, repository, lease string, db *sql.DB) error {
+	q := fmt.Sprintf(`update %s set
+                          lease = '',
+                          lease_until = 0
+                          where repository = ?
+                          and lease = ?`,
+		app.MirrorsTableName)
+	_, err := db.ExecContext(ctx, q, repository, lease)
+	return err
+}
+
+// syncError is a failed clone or fetch
+//
+// Its message, which is recorded as LastError and may be read by org
+// members, only gives the operation and any git exit status, as the
+// errors of git and the file system name server paths
+type syncError struct {
+	op  string
+	err error
+}
+
+func (e syncError) Error() string {
+	var exit *exec.ExitError
+	if errors.As(e.err, &exit) && exit.ExitCode() >= 0 {
+		return fmt.Sprintf("%s failed: git exit status %d", e.op, exit.ExitCode())
+	}
+	return e.op + " failed"
+}
+
+func (e syncError) Unwrap() error { return e.err }
+
+// Sync clones r's upstream to r.Path if there is no mirror there yet,
+// otherwise fetches into the existing mirror, then records the outcome
+//
+// A failed clone or fetch is logged, and recorded without detail as
+// LastError (the previous Head and LastFetch are kept) and also
+// returned. The upstream is checked
+// with repository.CheckUpstream first, as its host may now resolve
+// elsewhere
+//
+// Each repository is synced by one caller at a time, across servers
+// sharing the db; ErrLeased is returned if r is being synced
+func Sync(ctx context.Context, r *repository.Repository, allowFile bool, db *sql.DB) (*Mirror, error) {
+	lease, err := acquire(ctx, r.ID, db)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// a lease that is not released expires
+		_ = release(context.Background(), r.ID, lease, db)
+	}()
+
+	m, err := Read(ctx, r.ID, db)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			return nil, err
+		}
+		m = &Mirror{Repository: r.ID}
+	}
+
+	syncErr := repository.CheckUpstream(ctx, r.Upstream, allowFile, true)
+	if syncErr != nil {
+		syncErr = fmt.Errorf("upstream: %w", syncErr)
+	} else {
+		gitCtx, cancel := context.WithTimeout(ctx, LeaseDuration)
+		syncErr = cloneOrFetch(gitCtx, r, allowFile)
+		cancel()
+		if syncErr != nil {
+			zap.L().Warn("mirror sync",
+				zap.String("id", r.ID),
+				zap.String("err", errors.Unwrap(syncErr).Error()))
+		}
+	}
+	if syncErr != nil {
+		m.LastError = syncErr.Error()
+	} else {
+		m.Head = head(ctx, r.Path)
+		m.LastFetch = time.Now().Unix()
+		m.LastError = ""
+	}
+
+	err = m.write(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	return m, syncErr
+}
+
+// cloneOrFetch clones r if it has no mirror yet, otherwise fetches it;
+// errors are syncErrors
+func cloneOrFetch(ctx context.Context, r *repository.Repository, allowFile bool) error {
+	_, err := os.Stat(r.Path)
+	switch {
+	case err == nil:
+		err = fetch(ctx, r.Upstream, r.Path, allowFile)
+		if err != nil {
+			return syncError{op: "fetch", err: err}
+		}
+	case errors.Is(err, os.ErrNotExist):
+		err = cloneInPlace(ctx, r, allowFile)
+		if err != nil {
+			return syncError{op: "clone", err: err}
+		}
+	default:
+		return syncError{op: "sync", err: err}
+	}
+	return nil
+}
+
+// cloneInPlace clones r beside r.Path and renames it into place, so a
+// failed clone only removes what it created
+func cloneInPlace(ctx context.Context, r *repository.Repository, allowFile bool) error {
+	err := os.MkdirAll(filepath.Dir(r.Path), 0700)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(r.Path), filepath.Base(r.Path)+".clone-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp) // nolint
+	err = clone(ctx, r.Upstream, tmp, allowFile)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.Path)
+}
+
+// activeIDs returns the ids of all active repositories
+func activeIDs(ctx context.Context, db *sql.DB) ([]string, error) {
+	q := fmt.Sprintf(`select id from %s where status = ?`, app.RepositoriesTableName)
+	rows, err := db.QueryContext(ctx, q, models.StatusActive)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// SyncAll syncs every active repository, then analyzes its HEAD and
+// contributions, and enqueues its history, if that commit has not been
+// analyzed yet
+//
+// A repository that cannot be synced or analyzed is logged and counted
+// as Failed, and one being synced elsewhere is skipped; SyncAll
+// continues with the next repository
+func SyncAll(ctx context.Context, st *app.State) (*Result, error) {
+	result := &Result{}
+
+	ids, err := activeIDs(ctx, st.Master)
+	if err != nil {
+		return result, err
+	}
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		r, err := repository.Read(ctx, id, st.Master)
+		if err != nil {
+			zap.L().Warn("mirror read repository", zap.String("id", id), zap.Error(err))
+			result.Failed++
+			continue
+		}
+		m, err := Sync(ctx, r, st.AllowFileUpstreams, st.Master)
+		if err == ErrLeased {
+			// synced and analyzed by its holder
+			continue
+		}
+		if err != nil {
+			zap.L().Warn("mirror sync", zap.String("id", id), zap.Error(err))
+			result.Failed++
+			continue
+		}
+		result.Synced++
+
+		analyzed, err := analyze(ctx, st, r, m)
+		if err != nil {
+			zap.L().Warn("mirror analyze", zap.String("id", id), zap.Error(err))
+			result.Failed++
+			continue
+		}
+		if analyzed {
+			result.Analyzed++
+		}
+	}
+
+	return result, nil
+}
+
+// analyze analyzes the HEAD of m and the contributions to r if that
+// commit has not been analyzed yet, reporting whether it did, and then
+// enqueues a HistoryKind job for the new head
+func analyze(ctx context.Context, st *app.State, r *repository.Repository, m *Mirror) (bool, error) {
+	// an empty repository has nothing to analyze
+	if len(m.Head) == 0 {
+		return false, nil
+	}
+	analyzed, err := analysis.Exists(ctx, r.ID, m.Head, st.Master)
+	if err != nil || analyzed {
+		return false, err
+	}
+	_, err = analysis.Create(ctx, r, m.Head, st.Master)
+	if err != nil {
+		return false, err
+	}
+	// contributions only change with the head
+	err = contribution.Create(ctx, r, st.DBKeys, st.DigestKey, st.Master)
+	if err != nil {
+		return false, err
+	}
+	_, err = job.Enqueue(ctx, r.Org, HistoryKind,
+		HistoryPayload{Repository: r.ID, Sample: HistorySample}, st.Master)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Run syncs immediately and then every interval until ctx is done
+func Run(ctx context.Context, st *app.State, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		result, err := SyncAll(ctx, st)
+		if err != nil {
+			if ctx.Err() == nil {
+				zap.L().Error("mirror", zap.Error(err))
+			}
+		} else if result.Synced+result.Failed != 0 {
+			zap.L().Info("mirror",
+				zap.Int("synced", result.Synced),
+				zap.Int("analyzed", result.Analyzed),
+				zap.Int("failed", result.Failed))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package mirror
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/org"
+	"github.com/grokloc/grokloc-server/pkg/app/analysis"
+	"github.com/grokloc/grokloc-server/pkg/app/contribution"
+	"github.com/grokloc/grokloc-server/pkg/app/job"
+	"github.com/grokloc/grokloc-server/pkg/app/repository"
+	"github.com/grokloc/grokloc-server/pkg/app/state"
+	"github.com/grokloc/grokloc-server/pkg/env"
+	"github.com/grokloc/grokloc-server/pkg/models"
+	"github.com/grokloc/grokloc-server/pkg/security"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+)
+
+type MirrorSuite struct {
+	suite.Suite
+	st  *app.State
+	org string
+}
+
+func (s *MirrorSuite) SetupTest() {
+	var err error
+	s.st, err = state.New(env.Unit)
+	if err != nil {
+		zap.L().Fatal("setup",
+			zap.Error(err),
+		)
+	}
+
+	ownerPassword, err := security.DerivePassword(uuid.NewString(), s.st.Argon2Cfg)
+	require.Nil(s.T(), err)
+	o, err := org.Create(
+		context.Background(),
+		uuid.NewString(), // org name
+		uuid.NewString(), // org owner display name
+		uuid.NewString(), // org owner email
+		ownerPassword,
+		s.st.DBKeys,
+		s.st.Master,
+	)
+	require.Nil(s.T(), err)
+	s.org = o.ID
+}
+
+// run runs the git command with args in dir, returning trimmed stdout
+func (s *MirrorSuite) run(dir string, args ...string) string {
+	args = append([]string{"-c", "user.name=test", "-c", "user.email=test@localhost"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	require.Nil(s.T(), err, strings.Join(args, " "))
+	return strings.TrimSpace(string(out))
+}
+
+// newUpstream creates a git repository with one commit, returning its
+// directory and file:// url
+func (s *MirrorSuite) newUpstream() (string, string) {
+	dir := s.T().TempDir()
+	s.run(dir, "init", "--quiet")
+	s.commit(dir)
+	return dir, "file://" + filepath.ToSlash(dir)
+}
+
+// commit adds a commit to the repository in dir, returning its hash
+func (s *MirrorSuite) commit(dir string) string {
+	require.Nil(s.T(), os.WriteFile(filepath.Join(dir, uuid.NewString()), []byte("x"), 0600))
+	s.run(dir, "add", "--all")
+	s.run(dir, "commit", "--quiet", "-m", "c")
+	return s.run(dir, "rev-parse", "HEAD")
+}
+
+func (s *MirrorSuite) newRepository(upstream string) *repository.Repository {
+	r, err := repository.Create(
+		context.Background(),
+		uuid.NewString(), // name
+		s.org,
+		upstream,
+		s.st.RepositoryRoot,
+		s.st.Master,
+	)
+	require.Nil(s.T(), err)
+	return r
+}
+
+func (s *MirrorSuite) TestSync() {
+	ctx := context.Background()
+	dir, upstream := s.newUpstream()
+	r := s.newRepository(upstream)
+
+	_, err := Read(ctx, r.ID, s.st.Master)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+
+	// first sync clones
+	m, err := Sync(ctx, r, s.st.AllowFileUpstreams, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), s.run(dir, "rev-parse", "HEAD"), m.Head)
+	require.NotZero(s.T(), m.LastFetch)
+	require.Empty(s.T(), m.LastError)
+	require.Equal(s.T(), "true", s.run(r.Path, "rev-parse", "--is-bare-repository"))
+
+	// later syncs fetch
+	commit := s.commit(dir)
+	m, err = Sync(ctx, r, s.st.AllowFileUpstreams, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), commit, m.Head)
+
+	m_read, err := Read(ctx, r.ID, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), *m, *m_read)
+}
+
+func (s *MirrorSuite) TestSyncUpstreamChanged() {
+	ctx := context.Background()
+	_, upstream := s.newUpstream()
+	r := s.newRepository(upstream)
+	_, err := Sync(ctx, r, s.st.AllowFileUpstreams, s.st.Master)
+	require.Nil(s.T(), err)
+
+	// a new upstream is fetched into the existing mirror
+	dir, upstream := s.newUpstream()
+	err = r.UpdateUpstream(ctx, upstream, s.st.Master)
+	require.Nil(s.T(), err)
+	m, err := Sync(ctx, r, s.st.AllowFileUpstreams, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), s.run(dir, "rev-parse", "HEAD"), m.Head)
+}
+
+func (s *MirrorSuite) TestSyncError() {
+	ctx := context.Background()
+	dir, upstream := s.newUpstream()
+	r := s.newRepository(upstream)
+	m, err := Sync(ctx, r, s.st.AllowFileUpstreams, s.st.Master)
+	require.Nil(s.T(), err)
+	head, lastFetch := m.Head, m.LastFetch
+
+	// upstream is gone; the error is recorded, the last good state kept
+	require.Nil(s.T(), os.RemoveAll(dir))
+	m, err = Sync(ctx, r, s.st.AllowFileUpstreams, s.st.Master)
+	require.NotNil(s.T(), err)
+	require.Equal(s.T(), "fetch failed: git exit status 128", m.LastError)
+	require.Equal(s.T(), m.LastError, err.Error())
+	require.Equal(s.T(), head, m.Head)
+	require.Equal(s.T(), lastFetch, m.LastFetch)
+
+	// a failed clone leaves nothing behind
+	r = s.newRepository("file:///" + uuid.NewString())
+	m, err = Sync(ctx, r, s.st.AllowFileUpstreams, s.st.Master)
+	require.NotNil(s.T(), err)
+	require.Equal(s.T(), "clone failed: git exit status 128", m.LastError)
+	require.Empty(s.T(), m.Head)
+	_, err = os.Stat(r.Path)
+	require.True(s.T(), os.IsNotExist(err))
+	partial, err := filepath.Glob(r.Path + ".clone-*")
+	require.Nil(s.T(), err)
+	require.Empty(s.T(), partial)
+}
+
+func (s *MirrorSuite) TestSyncLeased() {
+	ctx := context.Background()
+	dir, upstream := s.newUpstream()
+	r := s.newRepository(upstream)
+
+	// held elsewhere
+	lease, err := acquire(ctx, r.ID, s.st.Master)
+	require.Nil(s.T(), err)
+	_, err = acquire(ctx, r.ID, s.st.Master)
+	require.Equal(s.T(), ErrLeased, err)
+	_, err = Sync(ctx, r, s.st.AllowFileUpstreams, s.st.Master)
+	require.Equal(s.T(), ErrLeased, err)
+	_, err = os.Stat(r.Path)
+	require.True(s.T(), os.IsNotExist(err))
+	_, err = Read(ctx, r.ID, s.st.Master)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+
+	// released
+	require.Nil(s.T(), release(ctx, r.ID, lease, s.st.Master))
+	_, err = Sync(ctx, r, s.st.AllowFileUpstreams, s.st.Master)
+	require.Nil(s.T(), err)
+
+	// expired
+	lease, err = acquire(ctx, r.ID, s.st.Master)
+	require.Nil(s.T(), err)
+	_, err = s.st.Master.ExecContext(ctx,
+		fmt.Sprintf(`update %s set lease_until = ? where repository = ?`, app.MirrorsTableName),
+		time.Now().Unix()-1, r.ID)
+	require.Nil(s.T(), err)
+	next, err := acquire(ctx, r.ID, s.st.Master)
+	require.Nil(s.T(), err)
+	// the old holder cannot release the new lease
+	require.Nil(s.T(), release(ctx, r.ID, lease, s.st.Master))
+	_, err = acquire(ctx, r.ID, s.st.Master)
+	require.Equal(s.T(), ErrLeased, err)
+	require.Nil(s.T(), release(ctx, r.ID, next, s.st.Master))
+
+	// concurrent syncs of one repository are serialized
+	commit := s.commit(dir)
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := Sync(ctx, r, s.st.AllowFileUpstreams, s.st.Master)
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		err = <-errs
+		require.True(s.T(), err == nil || err == ErrLeased, err)
+	}
+	_, err = Sync(ctx, r, s.st.AllowFileUpstreams, s.st.Master)
+	require.Nil(s.T(), err)
+	m, err := Read(ctx, r.ID, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), commit, m.Head)
+}
+
+func (s *MirrorSuite) TestSyncEmpty() {
+	dir := s.T().TempDir()
+	s.run(dir, "init", "--quiet")
+	r := s.newRepository("file://" + filepath.ToSlash(dir))
+
+	m, err := Sync(context.Background(), r, s.st.AllowFileUpstreams, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Empty(s.T(), m.Head)
+	require.Empty(s.T(), m.LastError)
+}
+
+func (s *MirrorSuite) TestTransport() {
+	ctx := context.Background()
+	// the test servers have self-signed certificates
+	s.T().Setenv("GIT_SSL_NO_VERIFY", "true")
+
+	// served over dumb http
+	upstreamDir, upstream := s.newUpstream()
+	served := s.T().TempDir()
+	s.run(upstreamDir, "clone", "--bare", "--quiet", upstreamDir, filepath.Join(served, "r.git"))
+	s.run(filepath.Join(served, "r.git"), "update-server-info")
+	files := httptest.NewTLSServer(http.FileServer(http.Dir(served)))
+	defer files.Close()
+	redirect := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, files.URL+r.URL.RequestURI(), http.StatusFound)
+	}))
+	defer redirect.Close()
+	plain := httptest.NewServer(http.FileServer(http.Dir(served)))
+	defer plain.Close()
+
+	path := func() string {
+		return filepath.Join(s.T().TempDir(), "r.git")
+	}
+	require.Nil(s.T(), clone(ctx, files.URL+"/r.git", path(), false))
+
+	// redirects are not followed, whatever they lead to
+	require.Error(s.T(), clone(ctx, redirect.URL+"/r.git", path(), false))
+	mirrorPath := path()
+	require.Nil(s.T(), clone(ctx, files.URL+"/r.git", mirrorPath, false))
+	require.Error(s.T(), fetch(ctx, redirect.URL+"/r.git", mirrorPath, false))
+
+	// only https
+	require.Error(s.T(), clone(ctx, plain.URL+"/r.git", path(), false))
+
+	// and local paths where allowed
+	require.Error(s.T(), clone(ctx, upstream, path(), false))
+	require.Error(s.T(), clone(ctx, upstreamDir, path(), false))
+	require.Nil(s.T(), clone(ctx, upstream, path(), true))
+}
+
+func (s *MirrorSuite) TestSyncAll() {
+	ctx := context.Background()
+	_, upstream := s.newUpstream()
+	active := s.newRepository(upstream)
+	inactive := s.newRepository(upstream)
+	err := inactive.UpdateStatus(ctx, models.StatusInactive, s.st.Master)
+	require.Nil(s.T(), err)
+
+	result, err := SyncAll(ctx, s.st)
+	require.Nil(s.T(), err)
+	require.GreaterOrEqual(s.T(), result.Synced, 1)
+	require.GreaterOrEqual(s.T(), result.Analyzed, 1)
+
+	// new heads are analyzed
+	m, err := Read(ctx, active.ID, s.st.Master)
+	require.Nil(s.T(), err)
+	analyzed, err := analysis.Exists(ctx, active.ID, m.Head, s.st.Master)
+	require.Nil(s.T(), err)
+	require.True(s.T(), analyzed)
+	cs, err := contribution.Read(ctx, active, 0, 0, s.st.DBKeys, s.st.DigestKey, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 1, len(cs))
+	require.Equal(s.T(), "test@localhost", cs[0].Email)
+	_, err = Read(ctx, inactive.ID, s.st.Master)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+}
+
+func (s *MirrorSuite) TestSyncJob() {
+	ctx := context.Background()
+	_, upstream := s.newUpstream()
+	r := s.newRepository(upstream)
+	p := job.NewPool(1, time.Minute)
+	p.Register(SyncKind, SyncJob)
+
+	j, err := job.Enqueue(ctx, s.org, SyncKind, SyncPayload{Repository: r.ID}, s.st.Master)
+	require.Nil(s.T(), err)
+	// other tests' jobs may be leased first
+	for j.Status != job.StatusDone && j.Status != job.StatusFailed {
+		ran, err := p.RunOne(ctx, s.st)
+		require.Nil(s.T(), err)
+		require.True(s.T(), ran)
+		j, err = job.Read(ctx, j.ID, s.st.Master)
+		require.Nil(s.T(), err)
+	}
+	require.Equal(s.T(), job.StatusDone, j.Status)
+	m, err := Read(ctx, r.ID, s.st.Master)
+	require.Nil(s.T(), err)
+	analyzed, err := analysis.Exists(ctx, r.ID, m.Head, s.st.Master)
+	require.Nil(s.T(), err)
+	require.True(s.T(), analyzed)
+
+	// missing repositories are not retried
+	j, err = job.Enqueue(ctx, s.org, SyncKind, SyncPayload{Repository: uuid.NewString()}, s.st.Master)
+	require.Nil(s.T(), err)
+	for j.Status != job.StatusDone && j.Status != job.StatusFailed {
+		_, err = p.RunOne(ctx, s.st)
+		require.Nil(s.T(), err)
+		j, err = job.Read(ctx, j.ID, s.st.Master)
+		require.Nil(s.T(), err)
+	}
+	require.Equal(s.T(), job.StatusFailed, j.Status)
+	require.Equal(s.T(), 1, j.Attempts)
+
+	// failed syncs are retried, and recorded without server paths
+	gone := s.newRepository("file:///" + uuid.NewString())
+	j, err = job.Enqueue(ctx, s.org, SyncKind, SyncPayload{Repository: gone.ID}, s.st.Master)
+	require.Nil(s.T(), err)
+	for j.Attempts == 0 || j.Status == job.StatusRunning {
+		_, err = p.RunOne(ctx, s.st)
+		require.Nil(s.T(), err)
+		j, err = job.Read(ctx, j.ID, s.st.Master)
+		require.Nil(s.T(), err)
+	}
+	require.Equal(s.T(), job.StatusQueued, j.Status)
+	require.Equal(s.T(), "clone failed: git exit status 128", j.LastError)
+}
+
+func (s *MirrorSuite) TestHistoryJob() {
+	ctx := context.Background()
+	_, upstream := s.newUpstream()
+	r := s.newRepository(upstream)
+	p := job.NewPool(1, time.Minute)
+	p.Register(HistoryKind, HistoryJob)
+
+	// analyzing a new head enqueues its history
+	m, err := Sync(ctx, r, s.st.AllowFileUpstreams, s.st.Master)
+	require.Nil(s.T(), err)
+	analyzed, err := analyze(ctx, s.st, r, m)
+	require.Nil(s.T(), err)
+	require.True(s.T(), analyzed)
+	payload, err := json.Marshal(HistoryPayload{Repository: r.ID, Sample: HistorySample})
+	require.Nil(s.T(), err)
+	var id string
+	err = s.st.Master.QueryRowContext(ctx,
+		fmt.Sprintf(`select id from %s where kind = ? and payload = ?`, app.JobsTableName),
+		HistoryKind, string(payload)).Scan(&id)
+	require.Nil(s.T(), err)
+	j, err := job.Read(ctx, id, s.st.Master)
+	require.Nil(s.T(), err)
+	for j.Status != job.StatusDone && j.Status != job.StatusFailed {
+		_, err = p.RunOne(ctx, s.st)
+		require.Nil(s.T(), err)
+		j, err = job.Read(ctx, j.ID, s.st.Master)
+		require.Nil(s.T(), err)
+	}
+	require.Equal(s.T(), job.StatusDone, j.Status)
+	points, err := analysis.ReadHistory(ctx, r.ID, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 1, len(points))
+	require.Equal(s.T(), m.Head, points[0].Commit)
+
+	// repositories never synced are not retried
+	unsynced := s.newRepository(upstream)
+	j, err = job.Enqueue(ctx, s.org, HistoryKind,
+		HistoryPayload{Repository: unsynced.ID, Sample: HistorySample}, s.st.Master)
+	require.Nil(s.T(), err)
+	for j.Status != job.StatusDone && j.Status != job.StatusFailed {
+		_, err = p.RunOne(ctx, s.st)
+		require.Nil(s.T(), err)
+		j, err = job.Read(ctx, j.ID, s.st.Master)
+		require.Nil(s.T(), err)
+	}
+	require.Equal(s.T(), job.StatusFailed, j.Status)
+	require.Equal(s.T(), 1, j.Attempts)
+}
+
+func TestMirrorSuite(t *testing.T) {
+	suite.Run(t, new(MirrorSuite))
+}
@@ -0,0 +1,288 @@
+// Package refresh stores rotating refresh tokens, grouped by session into
+// families, and the access tokens issued with them, so that sessions can
+// be revoked
+package refresh
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/models"
+	"github.com/grokloc/grokloc-server/pkg/security"
+)
+
+// Expiration is the lifetime of a refresh token in seconds
+const Expiration = 30 * 86400
+
+// Grace is how long, in seconds, the rows of tokens are kept after they
+// expire or their family is revoked; see Prune
+const Grace = 86400
+
+// valueLen is the number of random bytes in a refresh token
+const valueLen = 32
+
+// ErrInvalid signals a refresh token that is unknown, expired or revoked
+var ErrInvalid = errors.New("refresh token invalid")
+
+// ErrReused signals a refresh token presented after it was rotated; its
+// family is revoked, since either it or its successor was stolen
+var ErrReused = errors.New("refresh token reused")
+
+// ErrRevoked signals an access token that is unknown or whose family
+// has been revoked
+var ErrRevoked = errors.New("token revoked")
+
+// Token is a refresh token
+//
+// Only the digest of Value is stored, so Value is only known when the
+// token is issued
+type Token struct {
+	Value   string `json:"-"`
+	Family  string `json:"family"`
+	User    string `json:"user"`
+	Scope   string `json:"scope"` // of the access tokens issued in the family
+	Expires int64  `json:"expires"`
+}
+
+// issue inserts a new refresh token for family in tx
+func issue(ctx context.Context, family, user, scope string, tx *sql.Tx) (*Token, error) {
+	bs := make([]byte, valueLen)
+	_, err := rand.Read(bs)
+	if err != nil {
+		return nil, err
+	}
+	t := &Token{
+		Value:   hex.EncodeToString(bs),
+		Family:  family,
+		User:    user,
+		Scope:   scope,
+		Expires: time.Now().Unix() + Expiration,
+	}
+
+	q := fmt.Sprintf(`insert into %s
+                          (digest,
+                           family,
+                           expires)
+                          values
+                          (?,?,?)`,
+		app.RefreshTokensTableName)
+	_, err = tx.ExecContext(ctx, q, security.EncodedSHA256(t.Value), t.Family, t.Expires)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Start begins a new family for user granting scope, returning its first
+// refresh token
+func Start(ctx context.Context, user, scope string, db *sql.DB) (*Token, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint
+
+	family := uuid.NewString()
+	q := fmt.Sprintf(`insert into %s (id, user, scope) values (?,?,?)`, app.TokenFamiliesTableName)
+	_, err = tx.ExecContext(ctx, q, family, user, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := issue(ctx, family, user, scope, tx)
+	if err != nil {
+		return nil, err
+	}
+	return t, tx.Commit()
+}
+
+// Rotate exchanges the refresh token value for a new one in the same
+// family; value cannot be used again
+//
+// ErrReused is returned, and the family revoked, if value was already
+// rotated
+func Rotate(ctx context.Context, value string, db *sql.DB) (*Token, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint
+
+	digest := security.EncodedSHA256(value)
+	q := fmt.Sprintf(`select
+                          t.family,
+                          t.expires,
+                          t.used,
+                          f.user,
+                          f.scope,
+                          f.revoked
+                          from %s t join %s f on t.family = f.id
+                          where t.digest = ?`,
+		app.RefreshTokensTableName, app.TokenFamiliesTableName)
+	var family, user, scope string
+	var expires int64
+	var used, revoked bool
+	err = tx.QueryRowContext(ctx, q, digest).Scan(&family, &expires, &used, &user, &scope, &revoked)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalid
+		}
+		return nil, err
+	}
+	if revoked || expires <= time.Now().Unix() {
+		return nil, ErrInvalid
+	}
+	if used {
+		err = revoke(ctx, "id", family, tx)
+		if err != nil {
+			return nil, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrReused
+	}
+
+	q = fmt.Sprintf(`update %s set used = 1 where digest = ? and used = 0`,
+		app.RefreshTokensTableName)
+	result, err := tx.ExecContext(ctx, q, digest)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if updated != 1 {
+		return nil, models.ErrRowsAffected
+	}
+
+	t, err := issue(ctx, family, user, scope, tx)
+	if err != nil {
+		return nil, err
+	}
+	return t, tx.Commit()
+}
+
+// Record stores jti as an access token issued in family, so that it is
+// revoked with the family
+func Record(ctx context.Context, family, jti string, expires int64, db *sql.DB) error {
+	q := fmt.Sprintf(`insert into %s
+                          (jti,
+                           family,
+                           expires)
+                          values
+                          (?,?,?)`,
+		app.AccessTokensTableName)
+	_, err := db.ExecContext(ctx, q, jti, family, expires)
+	return err
+}
+
+// Check returns the family of the access token jti, or ErrRevoked if it
+// was not recorded or its family is revoked
+func Check(ctx context.Context, jti string, db *sql.DB) (string, error) {
+	q := fmt.Sprintf(`select
+                          f.id,
+                          f.revoked
+                          from %s a join %s f on a.family = f.id
+                          where a.jti = ?`,
+		app.AccessTokensTableName, app.TokenFamiliesTableName)
+	var family string
+	var revoked bool
+	err := db.QueryRowContext(ctx, q, jti).Scan(&family, &revoked)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrRevoked
+		}
+		return "", err
+	}
+	if revoked {
+		return "", ErrRevoked
+	}
+	return family, nil
+}
+
+// execer is a *sql.DB or *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// revoke revokes the families where column (id or user) is value
+func revoke(ctx context.Context, column, value string, db execer) error {
+	q := fmt.Sprintf(`update %s set revoked = 1 where %s = ? and revoked = 0`,
+		app.TokenFamiliesTableName, column)
+	_, err := db.ExecContext(ctx, q, value)
+	return err
+}
+
+// Revoke revokes family, ending the session: its refresh and access
+// tokens can no longer be used
+func Revoke(ctx context.Context, family string, db *sql.DB) error {
+	return revoke(ctx, "id", family, db)
+}
+
+// RevokeUser revokes every family of user, ending all their sessions
+func RevokeUser(ctx context.Context, user string, db *sql.DB) error {
+	return revoke(ctx, "user", user, db)
+}
+
+// Prune deletes the refresh and access tokens that expired, or whose
+// family was revoked, by the unix time before, then the families started
+// by then that are left without tokens, returning how many rows were
+// deleted; before is normally Grace seconds ago
+//
+// Pruned tokens are unknown, and so fail as they did before
+func Prune(ctx context.Context, before int64, db *sql.DB) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // nolint
+
+	var pruned int64
+	for _, tableName := range []string{app.RefreshTokensTableName, app.AccessTokensTableName} {
+		q := fmt.Sprintf(`delete from %s
+                                  where expires <= ?
+                                  or family in (select id from %s
+                                                where revoked = 1
+                                                and mtime <= ?)`,
+			tableName, app.TokenFamiliesTableName)
+		result, err := tx.ExecContext(ctx, q, before, before)
+		if err != nil {
+			return 0, err
+		}
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			// the db does not support a basic feature
+			panic("cannot exec RowsAffected:" + err.Error())
+		}
+		pruned += deleted
+	}
+
+	q := fmt.Sprintf(`delete from %s
+                          where ctime <= ?
+                          and id not in (select family from %s)
+                          and id not in (select family from %s)`,
+		app.TokenFamiliesTableName, app.RefreshTokensTableName, app.AccessTokensTableName)
+	result, err := tx.ExecContext(ctx, q, before)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	pruned += deleted
+
+	return pruned, tx.Commit()
+}
@@ -0,0 +1,184 @@
+// Package testing provides tests for the refresh package
+// (broken out to break import cycles)
+package testing
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/jwt"
+	"github.com/grokloc/grokloc-server/pkg/app/refresh"
+	"github.com/grokloc/grokloc-server/pkg/app/state"
+	"github.com/grokloc/grokloc-server/pkg/env"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+)
+
+type RefreshSuite struct {
+	suite.Suite
+	st  *app.State
+	ctx context.Context
+}
+
+func (s *RefreshSuite) SetupTest() {
+	var err error
+	s.st, err = state.New(env.Unit)
+	if err != nil {
+		zap.L().Fatal("setup",
+			zap.Error(err),
+		)
+	}
+	s.ctx = context.Background()
+}
+
+func (s *RefreshSuite) TestRotate() {
+	user := uuid.NewString()
+	t, err := refresh.Start(s.ctx, user, jwt.ScopeAll, s.st.Master)
+	require.Nil(s.T(), err)
+	require.NotEmpty(s.T(), t.Value)
+	require.Equal(s.T(), user, t.User)
+	require.Greater(s.T(), t.Expires, time.Now().Unix())
+
+	rotated, err := refresh.Rotate(s.ctx, t.Value, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), t.Family, rotated.Family)
+	require.Equal(s.T(), jwt.ScopeAll, rotated.Scope)
+	require.Equal(s.T(), user, rotated.User)
+	require.NotEqual(s.T(), t.Value, rotated.Value)
+
+	_, err = refresh.Rotate(s.ctx, uuid.NewString(), s.st.Master)
+	require.Equal(s.T(), refresh.ErrInvalid, err)
+}
+
+func (s *RefreshSuite) TestRotateScoped() {
+	t, err := refresh.Start(s.ctx, uuid.NewString(), jwt.ScopeRepositoryRead, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), jwt.ScopeRepositoryRead, t.Scope)
+
+	rotated, err := refresh.Rotate(s.ctx, t.Value, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), jwt.ScopeRepositoryRead, rotated.Scope)
+}
+
+func (s *RefreshSuite) TestReuse() {
+	t, err := refresh.Start(s.ctx, uuid.NewString(), jwt.ScopeAll, s.st.Master)
+	require.Nil(s.T(), err)
+	rotated, err := refresh.Rotate(s.ctx, t.Value, s.st.Master)
+	require.Nil(s.T(), err)
+	jti := uuid.NewString()
+	require.Nil(s.T(), refresh.Record(s.ctx, rotated.Family, jti, time.Now().Unix()+60, s.st.Master))
+
+	// replaying the old token revokes the whole family
+	_, err = refresh.Rotate(s.ctx, t.Value, s.st.Master)
+	require.Equal(s.T(), refresh.ErrReused, err)
+	_, err = refresh.Rotate(s.ctx, rotated.Value, s.st.Master)
+	require.Equal(s.T(), refresh.ErrInvalid, err)
+	_, err = refresh.Check(s.ctx, jti, s.st.Master)
+	require.Equal(s.T(), refresh.ErrRevoked, err)
+}
+
+func (s *RefreshSuite) TestExpired() {
+	t, err := refresh.Start(s.ctx, uuid.NewString(), jwt.ScopeAll, s.st.Master)
+	require.Nil(s.T(), err)
+	_, err = s.st.Master.ExecContext(s.ctx,
+		fmt.Sprintf(`update %s set expires = 0 where family = ?`, app.RefreshTokensTableName), t.Family)
+	require.Nil(s.T(), err)
+	_, err = refresh.Rotate(s.ctx, t.Value, s.st.Master)
+	require.Equal(s.T(), refresh.ErrInvalid, err)
+}
+
+func (s *RefreshSuite) TestRevoke() {
+	user := uuid.NewString()
+	first, err := refresh.Start(s.ctx, user, jwt.ScopeAll, s.st.Master)
+	require.Nil(s.T(), err)
+	second, err := refresh.Start(s.ctx, user, jwt.ScopeAll, s.st.Master)
+	require.Nil(s.T(), err)
+	firstJTI, secondJTI := uuid.NewString(), uuid.NewString()
+	require.Nil(s.T(), refresh.Record(s.ctx, first.Family, firstJTI, time.Now().Unix()+60, s.st.Master))
+	require.Nil(s.T(), refresh.Record(s.ctx, second.Family, secondJTI, time.Now().Unix()+60, s.st.Master))
+
+	family, err := refresh.Check(s.ctx, firstJTI, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), first.Family, family)
+	_, err = refresh.Check(s.ctx, uuid.NewString(), s.st.Master)
+	require.Equal(s.T(), refresh.ErrRevoked, err)
+
+	// revoking one family leaves the user's other sessions
+	require.Nil(s.T(), refresh.Revoke(s.ctx, first.Family, s.st.Master))
+	_, err = refresh.Check(s.ctx, firstJTI, s.st.Master)
+	require.Equal(s.T(), refresh.ErrRevoked, err)
+	_, err = refresh.Rotate(s.ctx, first.Value, s.st.Master)
+	require.Equal(s.T(), refresh.ErrInvalid, err)
+	_, err = refresh.Check(s.ctx, secondJTI, s.st.Master)
+	require.Nil(s.T(), err)
+
+	require.Nil(s.T(), refresh.RevokeUser(s.ctx, user, s.st.Master))
+	_, err = refresh.Check(s.ctx, secondJTI, s.st.Master)
+	require.Equal(s.T(), refresh.ErrRevoked, err)
+}
+
+// rows counts the rows of tableName in family
+func (s *RefreshSuite) rows(tableName, column, family string) int {
+	var count int
+	err := s.st.Master.QueryRowContext(s.ctx,
+		fmt.Sprintf(`select count(*) from %s where %s = ?`, tableName, column),
+		family).Scan(&count)
+	require.Nil(s.T(), err)
+	return count
+}
+
+func (s *RefreshSuite) TestPrune() {
+	now := time.Now().Unix()
+	live, err := refresh.Start(s.ctx, uuid.NewString(), jwt.ScopeAll, s.st.Master)
+	require.Nil(s.T(), err)
+	liveJTI := uuid.NewString()
+	require.Nil(s.T(), refresh.Record(s.ctx, live.Family, liveJTI, now+60, s.st.Master))
+	expired, err := refresh.Start(s.ctx, uuid.NewString(), jwt.ScopeAll, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), refresh.Record(s.ctx, expired.Family, uuid.NewString(), now-1, s.st.Master))
+	_, err = s.st.Master.ExecContext(s.ctx,
+		fmt.Sprintf(`update %s set expires = ? where family = ?`, app.RefreshTokensTableName),
+		now-1, expired.Family)
+	require.Nil(s.T(), err)
+	revoked, err := refresh.Start(s.ctx, uuid.NewString(), jwt.ScopeAll, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), refresh.Record(s.ctx, revoked.Family, uuid.NewString(), now+60, s.st.Master))
+	require.Nil(s.T(), refresh.Revoke(s.ctx, revoked.Family, s.st.Master))
+
+	// nothing is pruned within the grace period
+	_, err = refresh.Prune(s.ctx, now-refresh.Grace, s.st.Master)
+	require.Nil(s.T(), err)
+	for _, family := range []string{live.Family, expired.Family, revoked.Family} {
+		require.Equal(s.T(), 1, s.rows(app.TokenFamiliesTableName, "id", family))
+		require.Equal(s.T(), 1, s.rows(app.RefreshTokensTableName, "family", family))
+		require.Equal(s.T(), 1, s.rows(app.AccessTokensTableName, "family", family))
+	}
+
+	// after it, expired and revoked tokens, and their families, are
+	pruned, err := refresh.Prune(s.ctx, now+1, s.st.Master)
+	require.Nil(s.T(), err)
+	require.GreaterOrEqual(s.T(), pruned, int64(6))
+	for _, family := range []string{expired.Family, revoked.Family} {
+		require.Equal(s.T(), 0, s.rows(app.TokenFamiliesTableName, "id", family))
+		require.Equal(s.T(), 0, s.rows(app.RefreshTokensTableName, "family", family))
+		require.Equal(s.T(), 0, s.rows(app.AccessTokensTableName, "family", family))
+	}
+	_, err = refresh.Rotate(s.ctx, expired.Value, s.st.Master)
+	require.Equal(s.T(), refresh.ErrInvalid, err)
+
+	// live tokens are kept
+	family, err := refresh.Check(s.ctx, liveJTI, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), live.Family, family)
+	_, err = refresh.Rotate(s.ctx, live.Value, s.st.Master)
+	require.Nil(s.T(), err)
+}
+
+func TestRefreshSuite(t *testing.T) {
+	suite.Run(t, new(RefreshSuite))
+}
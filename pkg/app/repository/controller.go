@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/repository/events"
+	"github.com/grokloc/grokloc-server/pkg/models"
+)
+
+type Controller struct {
+	state *app.State
+}
+
+func NewController(ctx context.Context, state *app.State) (*Controller, error) {
+	return &Controller{state: state}, nil
+}
+
+func (c *Controller) Create(ctx context.Context, event events.Create) (*Repository, error) {
+
+	err := CheckUpstream(ctx, event.Upstream, c.state.AllowFileUpstreams, false)
+	if err != nil {
+		return nil, err
+	}
+
+	repository, err := Create(
+		ctx,
+		event.Name,
+		event.Org,
+		event.Upstream,
+		c.state.RepositoryRoot,
+		c.state.Master,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return repository, nil
+}
+
+func (c *Controller) Read(ctx context.Context, id string) (*Repository, error) {
+	return Read(ctx, id, c.state.RandomReplica())
+}
+
+func (c *Controller) ReadOrg(ctx context.Context, org string) ([]*Repository, error) {
+	return ReadOrg(ctx, org, c.state.RandomReplica())
+}
+
+func (c *Controller) UpdateUpstream(ctx context.Context, event events.UpdateUpstream) (*Repository, error) {
+
+	repository, err := c.Read(ctx, event.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// no repository found with ID
+	if repository == nil {
+		return nil, models.ErrNotFound
+	}
+
+	err = CheckUpstream(ctx, event.Upstream, c.state.AllowFileUpstreams, false)
+	if err != nil {
+		return nil, err
+	}
+
+	err = repository.UpdateUpstream(ctx, event.Upstream, c.state.Master)
+	if err != nil {
+		return nil, err
+	}
+
+	return repository, nil
+}
+
+func (c *Controller) UpdateStatus(ctx context.Context, event events.UpdateStatus) (*Repository, error) {
+
+	repository, err := c.Read(ctx, event.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// no repository found with ID
+	if repository == nil {
+		return nil, models.ErrNotFound
+	}
+
+	err = repository.UpdateStatus(ctx, event.Status, c.state.Master)
+	if err != nil {
+		return nil, err
+	}
+
+	return repository, nil
+}
@@ -0,0 +1,235 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/audit"
+	"github.com/grokloc/grokloc-server/pkg/models"
+)
+
+func (r Repository) Insert(ctx context.Context, db *sql.DB) error {
+
+	q := fmt.Sprintf(`insert into %s
+                          (id,
+                           name,
+                           org,
+                           path,
+                           upstream,
+                           status,
+                           schema_version)
+                          values
+                          (?,?,?,?,?,?,?)`,
+		app.RepositoriesTableName)
+
+	result, err := db.ExecContext(ctx,
+		q,
+		r.ID,
+		r.Name,
+		r.Org,
+		r.Path,
+		r.Upstream,
+		r.Meta.Status,
+		r.Meta.SchemaVersion)
+
+	if err != nil {
+		if models.UniqueConstraint(err) {
+			return models.ErrConflict
+		}
+		return err
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if inserted != 1 {
+		return models.ErrRowsAffected
+	}
+
+	_ = audit.Insert(ctx, audit.REPOSITORY_INSERT, app.RepositoriesTableName, r.ID, db)
+
+	return nil
+}
+
+// Create validates the org, then inserts an active repository
+// with a path under root
+// (read repository to capture ctime, mtime)
+func Create(
+	ctx context.Context,
+	name,
+	org,
+	upstream,
+	root string,
+	db *sql.DB) (*Repository, error) {
+
+	// check that org exists and is active
+	q := fmt.Sprintf(`select count(*)
+                          from %s
+                          where
+                            id = ?
+                          and
+                            status = ?`,
+		app.OrgsTableName)
+
+	var count int
+	err := db.QueryRowContext(ctx, q, org, models.StatusActive).Scan(&count)
+	if err != nil {
+		return nil, err
+	}
+
+	if count != 1 {
+		return nil, models.ErrRelatedOrg
+	}
+
+	id := uuid.NewString()
+	r := &Repository{
+		Base: models.Base{
+			ID: id,
+			Meta: models.Meta{
+				SchemaVersion: Version,
+				Status:        models.StatusActive,
+				// Ctime, Mtime remain 0
+			},
+		},
+		Name:     name,
+		Org:      org,
+		Path:     Path(root, org, id),
+		Upstream: upstream,
+	}
+
+	err = r.Insert(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	return Read(ctx, r.ID, db)
+}
+
+// Path is where the repository with id in org is stored under root
+func Path(root, org, id string) string {
+	return filepath.Join(root, org, id+".git")
+}
+
+func Read(ctx context.Context, id string, db *sql.DB) (*Repository, error) {
+
+	q := fmt.Sprintf(`select
+                          name,
+                          org,
+                          path,
+                          upstream,
+                          ctime,
+                          mtime,
+                          status,
+                          schema_version
+                          from %s
+                          where id = ?`,
+		app.RepositoriesTableName)
+
+	var statusRaw int
+	r := &Repository{}
+	r.ID = id
+
+	err := db.QueryRowContext(ctx, q, id).Scan(
+		&r.Name,
+		&r.Org,
+		&r.Path,
+		&r.Upstream,
+		&r.Meta.Ctime,
+		&r.Meta.Mtime,
+		&statusRaw,
+		&r.Meta.SchemaVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Meta.Status, err = models.NewStatus(statusRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	// rows at an older schema version are upgraded in memory
+	err = r.upgrade(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// ReadOrg reads all repositories in org, ordered by name
+func ReadOrg(ctx context.Context, org string, db *sql.DB) ([]*Repository, error) {
+
+	q := fmt.Sprintf(`select id from %s where org = ? order by name`,
+		app.RepositoriesTableName)
+
+	rows, err := db.QueryContext(ctx, q, org)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// ids are collected first so no cursor is held open during reads
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	repositories := make([]*Repository, 0, len(ids))
+	for _, id := range ids {
+		r, err := Read(ctx, id, db)
+		if err != nil {
+			return nil, err
+		}
+		repositories = append(repositories, r)
+	}
+	return repositories, nil
+}
+
+// UpdateUpstream sets the repository upstream
+func (r *Repository) UpdateUpstream(ctx context.Context,
+	upstream string,
+	db *sql.DB) error {
+
+	err := models.Update(ctx, app.RepositoriesTableName, r.ID, "upstream", upstream, db)
+	if err == nil {
+		r.Upstream = upstream
+		_ = audit.Insert(ctx, audit.REPOSITORY_UPSTREAM, app.RepositoriesTableName, r.ID, db)
+	}
+
+	return err
+}
+
+// UpdateStatus sets the repository status
+func (r *Repository) UpdateStatus(ctx context.Context,
+	status models.Status,
+	db *sql.DB) error {
+
+	// unconfirmed can only be an initial state
+	if status == models.StatusNone || status == models.StatusUnconfirmed {
+		return models.ErrDisallowedValue
+	}
+
+	err := models.Update(ctx, app.RepositoriesTableName, r.ID, "status", status, db)
+	if err == nil {
+		r.Meta.Status = status
+		_ = audit.Insert(ctx, audit.STATUS, app.RepositoriesTableName, r.ID, db)
+	}
+
+	return err
+}
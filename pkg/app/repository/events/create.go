@@ -0,0 +1,69 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/grokloc/grokloc-server/pkg/safe"
+)
+
+type Create struct {
+	Name     string `json:"name"`
+	Org      string `json:"org"`
+	Upstream string `json:"upstream"`
+}
+
+func (e *Create) UnmarshalJSON(bs []byte) error {
+	// clone type for a default unmarshal
+	type createEvent_ Create
+	var e_ createEvent_
+	err := json.Unmarshal(bs, &e_)
+	if err != nil {
+		return err
+	}
+
+	// use the fields from the default unmarshal to try to
+	// construct a Create
+	n, err := NewCreate(
+		context.Background(),
+		e_.Name,
+		e_.Org,
+		e_.Upstream,
+	)
+	if err != nil {
+		return err
+	}
+
+	e.Name = n.Name
+	e.Org = n.Org
+	e.Upstream = n.Upstream
+	return nil
+}
+
+func NewCreate(
+	ctx context.Context,
+	name,
+	org,
+	upstream string) (*Create, error) {
+
+	nameErr := safe.StringIs(name)
+	if nameErr != nil {
+		return nil, nameErr
+	}
+
+	orgErr := safe.IDIs(org)
+	if orgErr != nil {
+		return nil, orgErr
+	}
+
+	upstreamErr := upstreamIs(upstream)
+	if upstreamErr != nil {
+		return nil, upstreamErr
+	}
+
+	return &Create{
+		Name:     name,
+		Org:      org,
+		Upstream: upstream,
+	}, nil
+}
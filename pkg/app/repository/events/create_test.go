@@ -0,0 +1,58 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type CreateSuite struct {
+	suite.Suite
+}
+
+func (s *CreateSuite) TestUnmarshalCreateEvent() {
+	bs := []byte(fmt.Sprintf(`{"name":"n","org":"%s","upstream":"https://example.com/r.git"}`,
+		uuid.NewString()))
+	var e Create
+	require.NoError(s.T(), json.Unmarshal(bs, &e))
+
+	// has empty name
+	bs = []byte(fmt.Sprintf(`{"name":"","org":"%s","upstream":"https://example.com/r.git"}`,
+		uuid.NewString()))
+	require.Error(s.T(), json.Unmarshal(bs, &e))
+
+	// org is not an id
+	bs = []byte(`{"name":"n","org":"o","upstream":"https://example.com/r.git"}`)
+	require.Error(s.T(), json.Unmarshal(bs, &e))
+}
+
+func (s *CreateSuite) TestUpstream() {
+	for _, upstream := range []string{
+		"https://example.com/r.git",
+		"http://example.com/r",
+		"ssh://git@example.com/r.git",
+		"git://example.com/r.git",
+		"file:///srv/git/r.git",
+	} {
+		require.Nil(s.T(), upstreamIs(upstream), upstream)
+	}
+
+	for _, upstream := range []string{
+		"",
+		"-uhttps://example.com/r.git",
+		"example.com/r.git",
+		"ftp://example.com/r.git",
+		"https://example.com",
+		"ext::sh -c touch% /tmp/x",
+	} {
+		require.NotNil(s.T(), upstreamIs(upstream), upstream)
+	}
+}
+
+func TestCreateSuite(t *testing.T) {
+	suite.Run(t, new(CreateSuite))
+}
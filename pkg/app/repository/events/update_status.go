@@ -0,0 +1,28 @@
+package events
+
+import (
+	"context"
+
+	org_event "github.com/grokloc/grokloc-server/pkg/app/admin/org/events"
+)
+
+// UpdateStatus is identical to, and operates identically to, the org event
+type UpdateStatus org_event.UpdateStatus
+
+func (e *UpdateStatus) UnmarshalJSON(bs []byte) error {
+	// the defined type does not inherit the org event's validation
+	return (*org_event.UpdateStatus)(e).UnmarshalJSON(bs)
+}
+
+func NewUpdateStatus(
+	ctx context.Context,
+	id string,
+	statusInt int) (*UpdateStatus, error) {
+
+	event, err := org_event.NewUpdateStatus(ctx, id, statusInt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UpdateStatus{ID: id, Status: event.Status}, nil
+}
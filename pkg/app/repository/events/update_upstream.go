@@ -0,0 +1,59 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/grokloc/grokloc-server/pkg/safe"
+)
+
+type UpdateUpstream struct {
+	ID       string `json:"id"`
+	Upstream string `json:"upstream"`
+}
+
+func (e *UpdateUpstream) UnmarshalJSON(bs []byte) error {
+	// clone type for a default unmarshal
+	type updateUpstreamEvent_ UpdateUpstream
+	var e_ updateUpstreamEvent_
+	err := json.Unmarshal(bs, &e_)
+	if err != nil {
+		return err
+	}
+
+	// use the fields from the default unmarshal to try to
+	// construct a UpdateUpstream
+	n, err := NewUpdateUpstream(
+		context.Background(),
+		e_.ID,
+		e_.Upstream,
+	)
+	if err != nil {
+		return err
+	}
+
+	e.ID = n.ID
+	e.Upstream = n.Upstream
+	return nil
+}
+
+func NewUpdateUpstream(
+	ctx context.Context,
+	id string,
+	upstream string) (*UpdateUpstream, error) {
+
+	idErr := safe.IDIs(id)
+	if idErr != nil {
+		return nil, idErr
+	}
+
+	upstreamErr := upstreamIs(upstream)
+	if upstreamErr != nil {
+		return nil, upstreamErr
+	}
+
+	return &UpdateUpstream{
+		ID:       id,
+		Upstream: upstream,
+	}, nil
+}
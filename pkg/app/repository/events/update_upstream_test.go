@@ -0,0 +1,35 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type UpdateUpstreamSuite struct {
+	suite.Suite
+}
+
+func (s *UpdateUpstreamSuite) TestUnmarshalUpdateUpstreamEvent() {
+	bs := []byte(fmt.Sprintf(`{"id":"%s","upstream":"https://example.com/r.git"}`,
+		uuid.NewString()))
+	var e UpdateUpstream
+	require.NoError(s.T(), json.Unmarshal(bs, &e))
+
+	// has empty id
+	bs = []byte(`{"id":"","upstream":"https://example.com/r.git"}`)
+	require.Error(s.T(), json.Unmarshal(bs, &e))
+
+	// unsupported scheme
+	bs = []byte(fmt.Sprintf(`{"id":"%s","upstream":"ftp://example.com/r.git"}`,
+		uuid.NewString()))
+	require.Error(s.T(), json.Unmarshal(bs, &e))
+}
+
+func TestUpdateUpstreamSuite(t *testing.T) {
+	suite.Run(t, new(UpdateUpstreamSuite))
+}
@@ -0,0 +1,37 @@
+package events
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/grokloc/grokloc-server/pkg/models"
+	"github.com/grokloc/grokloc-server/pkg/safe"
+)
+
+// upstreamSchemes are the url schemes allowed for an upstream
+var upstreamSchemes = map[string]bool{
+	"file":  true,
+	"git":   true,
+	"http":  true,
+	"https": true,
+	"ssh":   true,
+}
+
+// upstreamIs returns nil if s is a safe upstream url
+func upstreamIs(s string) error {
+	err := safe.StringIs(s)
+	if err != nil {
+		return err
+	}
+
+	// never allow something that could be read as a command line flag
+	if strings.HasPrefix(s, "-") {
+		return models.ErrDisallowedValue
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || !upstreamSchemes[u.Scheme] || len(u.Path) == 0 {
+		return models.ErrDisallowedValue
+	}
+	return nil
+}
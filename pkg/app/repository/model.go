@@ -0,0 +1,14 @@
+// Package repository contains package methods for repository support
+package repository
+
+import "github.com/grokloc/grokloc-server/pkg/models"
+
+type Repository struct {
+	models.Base
+	Name     string `json:"name"`
+	Org      string `json:"org"`
+	Path     string `json:"-"` // local to the server
+	Upstream string `json:"upstream"`
+}
+
+const Version = 0
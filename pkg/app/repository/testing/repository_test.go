@@ -0,0 +1,279 @@
+// Package testing provides tests for the repository package
+// (broken out to break import cycles)
+package testing
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/org"
+	"github.com/grokloc/grokloc-server/pkg/app/repository"
+	"github.com/grokloc/grokloc-server/pkg/app/repository/events"
+	"github.com/grokloc/grokloc-server/pkg/app/state"
+	"github.com/grokloc/grokloc-server/pkg/env"
+	"github.com/grokloc/grokloc-server/pkg/models"
+	"github.com/grokloc/grokloc-server/pkg/security"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+)
+
+const upstream = "https://example.com/r.git"
+
+type RepositorySuite struct {
+	suite.Suite
+	st *app.State
+}
+
+func (s *RepositorySuite) SetupTest() {
+	var err error
+	s.st, err = state.New(env.Unit)
+	if err != nil {
+		zap.L().Fatal("setup",
+			zap.Error(err),
+		)
+	}
+}
+
+func (s *RepositorySuite) newOrg() *org.Org {
+	ownerPassword, err := security.DerivePassword(uuid.NewString(), s.st.Argon2Cfg)
+	require.Nil(s.T(), err)
+
+	o, err := org.Create(
+		context.Background(),
+		uuid.NewString(), // org name
+		uuid.NewString(), // org owner display name
+		uuid.NewString(), // org owner email
+		ownerPassword,
+		s.st.DBKeys,
+		s.st.Master,
+	)
+	require.Nil(s.T(), err)
+	return o
+}
+
+func (s *RepositorySuite) TestCreate() {
+	ctx := context.Background()
+	o := s.newOrg()
+
+	r, err := repository.Create(
+		ctx,
+		uuid.NewString(), // name
+		o.ID,
+		upstream,
+		s.st.RepositoryRoot,
+		s.st.Master,
+	)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), models.StatusActive, r.Meta.Status)
+	require.Equal(s.T(), filepath.Join(s.st.RepositoryRoot, o.ID, r.ID+".git"), r.Path)
+	require.NotZero(s.T(), r.Meta.Ctime)
+
+	r_read, err := repository.Read(ctx, r.ID, s.st.RandomReplica())
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), r.Name, r_read.Name)
+	require.Equal(s.T(), upstream, r_read.Upstream)
+}
+
+func (s *RepositorySuite) TestCreateOrgMissing() {
+	_, err := repository.Create(
+		context.Background(),
+		uuid.NewString(), // name
+		uuid.NewString(), // org doesn't exist
+		upstream,
+		s.st.RepositoryRoot,
+		s.st.Master,
+	)
+	require.Equal(s.T(), models.ErrRelatedOrg, err)
+}
+
+func (s *RepositorySuite) TestCreateOrgInactive() {
+	ctx := context.Background()
+	o := s.newOrg()
+	err := o.UpdateStatus(ctx, models.StatusInactive, s.st.Master)
+	require.Nil(s.T(), err)
+
+	_, err = repository.Create(
+		ctx,
+		uuid.NewString(), // name
+		o.ID,
+		upstream,
+		s.st.RepositoryRoot,
+		s.st.Master,
+	)
+	require.Equal(s.T(), models.ErrRelatedOrg, err)
+}
+
+func (s *RepositorySuite) TestReadMiss() {
+	_, err := repository.Read(
+		context.Background(),
+		uuid.NewString(),
+		s.st.RandomReplica(),
+	)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+}
+
+func (s *RepositorySuite) TestDuplicateInsert() {
+	ctx := context.Background()
+	o := s.newOrg()
+
+	name := uuid.NewString()
+	_, err := repository.Create(ctx, name, o.ID, upstream, s.st.RepositoryRoot, s.st.Master)
+	require.Nil(s.T(), err)
+
+	// RE-USED name in the same org -> conflict
+	_, err = repository.Create(ctx, name, o.ID, upstream, s.st.RepositoryRoot, s.st.Master)
+	require.Equal(s.T(), models.ErrConflict, err)
+
+	// the same name in another org is fine
+	_, err = repository.Create(ctx, name, s.newOrg().ID, upstream, s.st.RepositoryRoot, s.st.Master)
+	require.Nil(s.T(), err)
+}
+
+func (s *RepositorySuite) TestReadOrg() {
+	ctx := context.Background()
+	o := s.newOrg()
+
+	rs, err := repository.ReadOrg(ctx, o.ID, s.st.RandomReplica())
+	require.Nil(s.T(), err)
+	require.Empty(s.T(), rs)
+
+	for _, name := range []string{"b", "a"} {
+		_, err = repository.Create(ctx, name, o.ID, upstream, s.st.RepositoryRoot, s.st.Master)
+		require.Nil(s.T(), err)
+	}
+	// a repository in another org is not included
+	_, err = repository.Create(ctx, "c", s.newOrg().ID, upstream, s.st.RepositoryRoot, s.st.Master)
+	require.Nil(s.T(), err)
+
+	rs, err = repository.ReadOrg(ctx, o.ID, s.st.RandomReplica())
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 2, len(rs))
+	require.Equal(s.T(), "a", rs[0].Name)
+	require.Equal(s.T(), "b", rs[1].Name)
+}
+
+func (s *RepositorySuite) TestUpdateUpstreamEvent() {
+	ctx := context.Background()
+	c, err := repository.NewController(ctx, s.st)
+	require.Nil(s.T(), err)
+
+	createEvent, err := events.NewCreate(ctx, uuid.NewString(), s.newOrg().ID, upstream)
+	require.Nil(s.T(), err)
+
+	r, err := c.Create(ctx, *createEvent)
+	require.Nil(s.T(), err)
+
+	updateUpstreamEvent, err := events.NewUpdateUpstream(ctx, r.ID, "https://example.com/other.git")
+	require.Nil(s.T(), err)
+
+	rUpdate, err := c.UpdateUpstream(ctx, *updateUpstreamEvent)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "https://example.com/other.git", rUpdate.Upstream)
+
+	r_read, err := c.Read(ctx, r.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "https://example.com/other.git", r_read.Upstream)
+}
+
+func (s *RepositorySuite) TestUpdateStatusEvent() {
+	ctx := context.Background()
+	c, err := repository.NewController(ctx, s.st)
+	require.Nil(s.T(), err)
+
+	createEvent, err := events.NewCreate(ctx, uuid.NewString(), s.newOrg().ID, upstream)
+	require.Nil(s.T(), err)
+
+	r, err := c.Create(ctx, *createEvent)
+	require.Nil(s.T(), err)
+
+	updateStatusEvent, err := events.NewUpdateStatus(ctx, r.ID, int(models.StatusInactive))
+	require.Nil(s.T(), err)
+
+	rUpdate, err := c.UpdateStatus(ctx, *updateStatusEvent)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), models.StatusInactive, rUpdate.Meta.Status)
+
+	// no repository with this id
+	updateStatusEvent, err = events.NewUpdateStatus(ctx, uuid.NewString(), int(models.StatusInactive))
+	require.Nil(s.T(), err)
+	_, err = c.UpdateStatus(ctx, *updateStatusEvent)
+	require.Equal(s.T(), sql.ErrNoRows, err)
+}
+
+func (s *RepositorySuite) TestUpgrade() {
+	ctx := context.Background()
+	repository.RegisterUpgrade(-1, func(ctx context.Context, r *repository.Repository) error {
+		r.Name = r.Name + "-upgraded"
+		return nil
+	})
+
+	r, err := repository.Create(ctx, uuid.NewString(), s.newOrg().ID, upstream, s.st.RepositoryRoot, s.st.Master)
+	require.Nil(s.T(), err)
+
+	err = models.Update(ctx, app.RepositoriesTableName, r.ID, "schema_version", -1, s.st.Master)
+	require.Nil(s.T(), err)
+
+	// read upgrades in memory only
+	r_read, err := repository.Read(ctx, r.ID, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), r.Name+"-upgraded", r_read.Name)
+
+	// migrate writes back
+	migrated, err := repository.Migrate(ctx, r.ID, s.st.Master)
+	require.Nil(s.T(), err)
+	require.True(s.T(), migrated)
+	var stored int
+	err = s.st.Master.QueryRow(`select schema_version from repositories where id = ?`, r.ID).Scan(&stored)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), repository.Version, stored)
+
+	migrated, err = repository.Migrate(ctx, r.ID, s.st.Master)
+	require.Nil(s.T(), err)
+	require.False(s.T(), migrated)
+}
+
+func (s *RepositorySuite) TestCheckUpstream() {
+	ctx := context.Background()
+	for _, upstream := range []string{
+		upstream,
+		"https://203.0.113.9/r.git",
+		"https://[2001:db8::1]/r.git",
+	} {
+		require.Nil(s.T(), repository.CheckUpstream(ctx, upstream, false, false), upstream)
+	}
+
+	for _, upstream := range []string{
+		"file:///srv/git/r.git",
+		"http://example.com/r.git",
+		"ssh://git@example.com/r.git",
+		"git://example.com/r.git",
+		"https://localhost/r.git",
+		"https://git.localhost/r.git",
+		"https://127.0.0.1/r.git",
+		"https://[::1]/r.git",
+		"https://10.1.2.3/r.git",
+		"https://192.168.0.1/r.git",
+		"https://169.254.169.254/latest",
+		"https://0.0.0.0/r.git",
+	} {
+		require.Equal(s.T(), models.ErrDisallowedValue,
+			repository.CheckUpstream(ctx, upstream, false, false), upstream)
+	}
+
+	// local paths where allowed
+	require.Nil(s.T(), repository.CheckUpstream(ctx, "file:///srv/git/r.git", true, false))
+
+	// hosts that do not resolve are only checked when fetched
+	unresolved := "https://" + uuid.NewString() + ".invalid/r.git"
+	require.Nil(s.T(), repository.CheckUpstream(ctx, unresolved, false, false))
+	require.Equal(s.T(), models.ErrDisallowedValue, repository.CheckUpstream(ctx, unresolved, false, true))
+}
+
+func TestRepositorySuite(t *testing.T) {
+	suite.Run(t, new(RepositorySuite))
+}
@@ -0,0 +1,101 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/models"
+)
+
+// Upgrade transforms a repository read at schema version v into version v+1,
+// in memory only
+type Upgrade func(ctx context.Context, r *Repository) error
+
+// upgrades maps a schema version to the Upgrade from that version
+var upgrades = map[int]Upgrade{}
+
+// RegisterUpgrade sets the Upgrade for repositories at schema version from
+//
+// Call from init; registration is not synchronized with reads
+func RegisterUpgrade(from int, f Upgrade) {
+	upgrades[from] = f
+}
+
+// upgrade applies registered upgrades until r is at Version
+func (r *Repository) upgrade(ctx context.Context) error {
+	if r.Meta.SchemaVersion > Version {
+		return models.ErrModelMigrate
+	}
+	for r.Meta.SchemaVersion < Version {
+		f, ok := upgrades[r.Meta.SchemaVersion]
+		if !ok {
+			return models.ErrModelMigrate
+		}
+		err := f(ctx, r)
+		if err != nil {
+			return err
+		}
+		r.Meta.SchemaVersion++
+	}
+	return nil
+}
+
+// Migrate reads the repository with id (upgrading it in memory) and, if it was
+// stored at an older schema version, writes the upgraded repository back
+//
+// Returns true if the row was rewritten
+func Migrate(ctx context.Context, id string, db *sql.DB) (bool, error) {
+	q := fmt.Sprintf(`select schema_version from %s where id = ?`, app.RepositoriesTableName)
+	var stored int
+	err := db.QueryRowContext(ctx, q, id).Scan(&stored)
+	if err != nil {
+		return false, err
+	}
+	if stored == Version {
+		return false, nil
+	}
+
+	r, err := Read(ctx, id, db)
+	if err != nil {
+		return false, err
+	}
+
+	// only overwrite the version that was upgraded
+	q = fmt.Sprintf(`update %s
+                         set name = ?,
+                         org = ?,
+                         path = ?,
+                         upstream = ?,
+                         status = ?,
+                         schema_version = ?
+                         where id = ?
+                         and schema_version = ?`,
+		app.RepositoriesTableName)
+
+	result, err := db.ExecContext(ctx,
+		q,
+		r.Name,
+		r.Org,
+		r.Path,
+		r.Upstream,
+		r.Meta.Status,
+		r.Meta.SchemaVersion,
+		r.ID,
+		stored)
+	if err != nil {
+		return false, err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+	if updated != 1 {
+		return false, models.ErrRowsAffected
+	}
+
+	return true, nil
+}
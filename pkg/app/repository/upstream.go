@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/grokloc/grokloc-server/pkg/models"
+)
+
+// lookupIPAddr resolves hosts for CheckUpstream
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// CheckUpstream returns models.ErrDisallowedValue if the server should
+// not fetch from upstream: a local path unless allowFile, a url that is
+// not https, as mirrors are only fetched over https, or a host that is,
+// or resolves to, a loopback, link-local, private or unspecified address
+//
+// Hosts that cannot be resolved are allowed unless strict; they are
+// checked again when fetched
+func CheckUpstream(ctx context.Context, upstream string, allowFile, strict bool) error {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return models.ErrDisallowedValue
+	}
+	if u.Scheme == "file" {
+		if !allowFile {
+			return models.ErrDisallowedValue
+		}
+		return nil
+	}
+	if u.Scheme != "https" {
+		return models.ErrDisallowedValue
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if len(host) == 0 || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return models.ErrDisallowedValue
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !publicIP(ip) {
+			return models.ErrDisallowedValue
+		}
+		return nil
+	}
+	addrs, err := lookupIPAddr(ctx, host)
+	if err != nil {
+		if strict {
+			return models.ErrDisallowedValue
+		}
+		return nil
+	}
+	for _, addr := range addrs {
+		if !publicIP(addr.IP) {
+			return models.ErrDisallowedValue
+		}
+	}
+	return nil
+}
+
+// publicIP reports whether ip may be fetched from
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified())
+}
@@ -4,9 +4,133 @@ const OrgsTableName = "orgs"
 const UsersTableName = "users"
 const RepositoriesTableName = "repositories"
 const AuditTableName = "audit"
+const MirrorsTableName = "mirrors"
+const AnalysesTableName = "analyses"
+const AnalysisLanguagesTableName = "analysis_languages"
+const AnalysisFilesTableName = "analysis_files"
+const HistoryTableName = "history"
+const HistoryLanguagesTableName = "history_languages"
+const ContributionsTableName = "contributions"
+const JobsTableName = "jobs"
+const TokenFamiliesTableName = "token_families"
+const RefreshTokensTableName = "refresh_tokens"
+const AccessTokensTableName = "access_tokens"
+const APISecretGraceTableName = "api_secret_grace"
+const TokenKeysTableName = "token_keys"
+const UserKeysTableName = "user_keys"
+const LoginFailuresTableName = "login_failures"
+const UserShredsTableName = "user_shreds"
+const SchemaMigrationsTableName = "schema_migrations"
 
-// Schema is the full schema to recreate the app db
-const Schema = `
+// Migration is a numbered schema change
+//
+// Statements in Up and Down are separated by "-- STMT"; Down is optional
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Migrations is the full, ordered list of schema changes to build the app db
+//
+// Versions start at 1 and increase by 1. The checksum of each applied Up
+// is verified on every run, so a released migration must never be edited;
+// add a new migration instead
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial",
+		Up:      initialUp,
+		Down:    initialDown,
+	},
+	{
+		Version: 2,
+		Name:    "mirrors",
+		Up:      mirrorsUp,
+		Down:    mirrorsDown,
+	},
+	{
+		Version: 3,
+		Name:    "analyses",
+		Up:      analysesUp,
+		Down:    analysesDown,
+	},
+	{
+		Version: 4,
+		Name:    "history",
+		Up:      historyUp,
+		Down:    historyDown,
+	},
+	{
+		Version: 5,
+		Name:    "contributions",
+		Up:      contributionsUp,
+		Down:    contributionsDown,
+	},
+	{
+		Version: 6,
+		Name:    "jobs",
+		Up:      jobsUp,
+		Down:    jobsDown,
+	},
+	{
+		Version: 7,
+		Name:    "tokens",
+		Up:      tokensUp,
+		Down:    tokensDown,
+	},
+	{
+		Version: 8,
+		Name:    "api_secret_grace",
+		Up:      apiSecretGraceUp,
+		Down:    apiSecretGraceDown,
+	},
+	{
+		Version: 9,
+		Name:    "token_scopes",
+		Up:      tokenScopesUp,
+		Down:    tokenScopesDown,
+	},
+	{
+		Version: 10,
+		Name:    "token_keys",
+		Up:      tokenKeysUp,
+		Down:    tokenKeysDown,
+	},
+	{
+		Version: 11,
+		Name:    "user_keys",
+		Up:      userKeysUp,
+		Down:    userKeysDown,
+	},
+	{
+		Version: 12,
+		Name:    "login_failures",
+		Up:      loginFailuresUp,
+		Down:    loginFailuresDown,
+	},
+	{
+		Version: 13,
+		Name:    "mirror_leases",
+		Up:      mirrorLeasesUp,
+		Down:    mirrorLeasesDown,
+	},
+	{
+		Version: 14,
+		Name:    "user_shreds",
+		Up:      userShredsUp,
+		Down:    userShredsDown,
+	},
+	{
+		Version: 15,
+		Name:    "contribution_digests",
+		Up:      contributionDigestsUp,
+		Down:    contributionDigestsDown,
+	},
+}
+
+const initialUp = `
 create table if not exists users (
        api_secret text unique not null,
        api_secret_digest text unique not null,
@@ -115,3 +239,410 @@ create trigger if not exists audit_mtime_trigger after update on audit
       where id = new.id;
 end;
 `
+
+const initialDown = `
+drop table if exists audit;
+-- STMT
+drop table if exists repositories;
+-- STMT
+drop table if exists orgs;
+-- STMT
+drop table if exists users;
+`
+
+const mirrorsUp = `
+create table if not exists mirrors (
+       repository text unique not null,
+       head text not null default '',
+       last_fetch integer not null default 0,
+       last_error text not null default '',
+       ctime integer,
+       mtime integer,
+       primary key (repository));
+-- STMT
+create trigger if not exists mirrors_ctime_trigger after insert on mirrors
+begin
+        update mirrors set
+        ctime = strftime('%s','now'),
+        mtime = strftime('%s','now')
+        where repository = new.repository;
+end;
+-- STMT
+create trigger if not exists mirrors_mtime_trigger after update on mirrors
+begin
+        update mirrors set mtime = strftime('%s','now')
+        where repository = new.repository;
+end;
+`
+
+const mirrorsDown = `
+drop table if exists mirrors;
+`
+
+const analysesUp = `
+create table if not exists analyses (
+       repository text not null,
+       commit_hash text not null,
+       code integer not null,
+       comment integer not null,
+       blank integer not null,
+       ctime integer,
+       mtime integer,
+       primary key (repository, commit_hash));
+-- STMT
+create trigger if not exists analyses_ctime_trigger after insert on analyses
+begin
+        update analyses set
+        ctime = strftime('%s','now'),
+        mtime = strftime('%s','now')
+        where repository = new.repository and commit_hash = new.commit_hash;
+end;
+-- STMT
+create trigger if not exists analyses_mtime_trigger after update on analyses
+begin
+        update analyses set mtime = strftime('%s','now')
+        where repository = new.repository and commit_hash = new.commit_hash;
+end;
+-- STMT
+create table if not exists analysis_languages (
+       repository text not null,
+       commit_hash text not null,
+       language text not null,
+       files integer not null,
+       code integer not null,
+       comment integer not null,
+       blank integer not null,
+       primary key (repository, commit_hash, language));
+-- STMT
+create table if not exists analysis_files (
+       repository text not null,
+       commit_hash text not null,
+       path text not null,
+       language text not null,
+       code integer not null,
+       comment integer not null,
+       blank integer not null,
+       primary key (repository, commit_hash, path));
+`
+
+const analysesDown = `
+drop table if exists analysis_files;
+-- STMT
+drop table if exists analysis_languages;
+-- STMT
+drop table if exists analyses;
+`
+
+const historyUp = `
+create table if not exists history (
+       repository text not null,
+       commit_hash text not null,
+       committed integer not null,
+       code integer not null,
+       comment integer not null,
+       blank integer not null,
+       ctime integer,
+       mtime integer,
+       primary key (repository, commit_hash));
+-- STMT
+create index if not exists history_repository_committed on history (repository, committed);
+-- STMT
+create trigger if not exists history_ctime_trigger after insert on history
+begin
+        update history set
+        ctime = strftime('%s','now'),
+        mtime = strftime('%s','now')
+        where repository = new.repository and commit_hash = new.commit_hash;
+end;
+-- STMT
+create trigger if not exists history_mtime_trigger after update on history
+begin
+        update history set mtime = strftime('%s','now')
+        where repository = new.repository and commit_hash = new.commit_hash;
+end;
+-- STMT
+create table if not exists history_languages (
+       repository text not null,
+       commit_hash text not null,
+       language text not null,
+       files integer not null,
+       code integer not null,
+       comment integer not null,
+       blank integer not null,
+       primary key (repository, commit_hash, language));
+`
+
+const historyDown = `
+drop table if exists history_languages;
+-- STMT
+drop table if exists history;
+`
+
+const contributionsUp = `
+create table if not exists contributions (
+       repository text not null,
+       email text not null,
+       email_digest text not null,
+       day integer not null,
+       commits integer not null,
+       added integer not null,
+       removed integer not null,
+       primary key (repository, email_digest, day));
+-- STMT
+create index if not exists contributions_repository_day on contributions (repository, day);
+`
+
+const contributionsDown = `
+drop table if exists contributions;
+`
+
+const jobsUp = `
+create table if not exists jobs (
+       id text unique not null,
+       org text not null,
+       kind text not null,
+       payload text not null,
+       status text not null,
+       attempts integer not null default 0,
+       max_attempts integer not null,
+       run_at integer not null,
+       lease text not null default '',
+       lease_until integer not null default 0,
+       last_error text not null default '',
+       ctime integer,
+       mtime integer,
+       primary key (id));
+-- STMT
+create index if not exists jobs_status_run_at on jobs (status, run_at);
+-- STMT
+create trigger if not exists jobs_ctime_trigger after insert on jobs
+begin
+        update jobs set
+        ctime = strftime('%s','now'),
+        mtime = strftime('%s','now')
+        where id = new.id;
+end;
+-- STMT
+create trigger if not exists jobs_mtime_trigger after update on jobs
+begin
+        update jobs set mtime = strftime('%s','now')
+        where id = new.id;
+end;
+`
+
+const jobsDown = `
+drop table if exists jobs;
+`
+
+const tokensUp = `
+create table if not exists token_families (
+       id text unique not null,
+       user text not null,
+       revoked integer not null default 0,
+       ctime integer,
+       mtime integer,
+       primary key (id));
+-- STMT
+create index if not exists token_families_user on token_families (user);
+-- STMT
+create trigger if not exists token_families_ctime_trigger after insert on token_families
+begin
+        update token_families set
+        ctime = strftime('%s','now'),
+        mtime = strftime('%s','now')
+        where id = new.id;
+end;
+-- STMT
+create trigger if not exists token_families_mtime_trigger after update on token_families
+begin
+        update token_families set mtime = strftime('%s','now')
+        where id = new.id;
+end;
+-- STMT
+create table if not exists refresh_tokens (
+       digest text unique not null,
+       family text not null,
+       expires integer not null,
+       used integer not null default 0,
+       primary key (digest));
+-- STMT
+create index if not exists refresh_tokens_family on refresh_tokens (family);
+-- STMT
+create table if not exists access_tokens (
+       jti text unique not null,
+       family text not null,
+       expires integer not null,
+       primary key (jti));
+-- STMT
+create index if not exists access_tokens_family on access_tokens (family);
+`
+
+const tokensDown = `
+drop table if exists access_tokens;
+-- STMT
+drop table if exists refresh_tokens;
+-- STMT
+drop table if exists token_families;
+`
+
+const apiSecretGraceUp = `
+create table if not exists api_secret_grace (
+       user text not null,
+       digest text not null,
+       expires integer not null,
+       primary key (user, digest));
+`
+
+const apiSecretGraceDown = `
+drop table if exists api_secret_grace;
+`
+
+const tokenScopesUp = `
+alter table token_families add column scope text not null default 'app';
+`
+
+const tokenScopesDown = `
+alter table token_families drop column scope;
+`
+
+const tokenKeysUp = `
+create table if not exists token_keys (
+       id text unique not null,
+       key text not null,
+       key_digest text not null,
+       expires integer not null default 0,
+       ctime integer,
+       mtime integer,
+       primary key (id));
+-- STMT
+create unique index if not exists token_keys_current on token_keys (expires) where expires = 0;
+-- STMT
+create trigger if not exists token_keys_ctime_trigger after insert on token_keys
+begin
+        update token_keys set
+        ctime = strftime('%s','now'),
+        mtime = strftime('%s','now')
+        where id = new.id;
+end;
+-- STMT
+create trigger if not exists token_keys_mtime_trigger after update on token_keys
+begin
+        update token_keys set mtime = strftime('%s','now')
+        where id = new.id;
+end;
+`
+
+const tokenKeysDown = `
+drop table if exists token_keys;
+`
+
+const userKeysUp = `
+create table if not exists user_keys (
+       user text unique not null,
+       key text not null,
+       key_digest text not null,
+       ctime integer,
+       mtime integer,
+       primary key (user));
+-- STMT
+create trigger if not exists user_keys_ctime_trigger after insert on user_keys
+begin
+        update user_keys set
+        ctime = strftime('%s','now'),
+        mtime = strftime('%s','now')
+        where user = new.user;
+end;
+-- STMT
+create trigger if not exists user_keys_mtime_trigger after update on user_keys
+begin
+        update user_keys set mtime = strftime('%s','now')
+        where user = new.user;
+end;
+`
+
+const userKeysDown = `
+drop table if exists user_keys;
+`
+
+const loginFailuresUp = `
+create table if not exists login_failures (
+       key text unique not null,
+       failures integer not null,
+       last integer not null,
+       locked_until integer not null default 0,
+       ctime integer,
+       mtime integer,
+       primary key (key));
+-- STMT
+create index if not exists login_failures_last on login_failures (last);
+-- STMT
+create trigger if not exists login_failures_ctime_trigger after insert on login_failures
+begin
+        update login_failures set
+        ctime = strftime('%s','now'),
+        mtime = strftime('%s','now')
+        where key = new.key;
+end;
+-- STMT
+create trigger if not exists login_failures_mtime_trigger after update on login_failures
+begin
+        update login_failures set mtime = strftime('%s','now')
+        where key = new.key;
+end;
+`
+
+const loginFailuresDown = `
+drop table if exists login_failures;
+`
+
+const mirrorLeasesUp = `
+alter table mirrors add column lease text not null default '';
+-- STMT
+alter table mirrors add column lease_until integer not null default 0;
+`
+
+const mirrorLeasesDown = `
+alter table mirrors drop column lease_until;
+-- STMT
+alter table mirrors drop column lease;
+`
+
+const userShredsUp = `
+create table if not exists user_shreds (
+       user text unique not null,
+       key_id text not null,
+       ctime integer,
+       mtime integer,
+       primary key (user));
+-- STMT
+create trigger if not exists user_shreds_ctime_trigger after insert on user_shreds
+begin
+        update user_shreds set
+        ctime = strftime('%s','now'),
+        mtime = strftime('%s','now')
+        where user = new.user;
+end;
+-- STMT
+create trigger if not exists user_shreds_mtime_trigger after update on user_shreds
+begin
+        update user_shreds set mtime = strftime('%s','now')
+        where user = new.user;
+end;
+`
+
+const userShredsDown = `
+drop table if exists user_shreds;
+`
+
+// contributions are derived from mirrors, so those with unkeyed email
+// digests are dropped rather than rewritten, and are stored again with
+// keyed digests by the next analysis of each repository
+const contributionDigestsUp = `
+alter table user_shreds add column email_digest text not null default '';
+-- STMT
+delete from contributions;
+`
+
+const contributionDigestsDown = `
+alter table user_shreds drop column email_digest;
+`
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"io"
@@ -9,8 +10,14 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/org"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/user"
+	"github.com/grokloc/grokloc-server/pkg/app/jwt"
 	"github.com/grokloc/grokloc-server/pkg/env"
+	"github.com/grokloc/grokloc-server/pkg/models"
 	"github.com/grokloc/grokloc-server/pkg/security"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -60,6 +67,95 @@ func (s *AdminSuite) SetupTest() {
 	s.token = &tok
 }
 
+// newSession requests a Token for the user with id and apiSecret
+func (s *AdminSuite) newSession(id, apiSecret string) *Token {
+	return s.newScopedSession(id, apiSecret, "")
+}
+
+// newScopedSession is newSession requesting scope
+func (s *AdminSuite) newScopedSession(id, apiSecret, scope string) *Token {
+	req, err := http.NewRequest(http.MethodPut, s.ts.URL+TokenRoute, nil)
+	require.Nil(s.T(), err)
+	req.Header.Add(IDHeader, id)
+	req.Header.Add(TokenRequestHeader, security.EncodedSHA256(id+apiSecret))
+	if len(scope) != 0 {
+		req.Header.Add(ScopeHeader, scope)
+	}
+	resp, err := s.c.Do(req)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	respBody, err := io.ReadAll(resp.Body)
+	require.Nil(s.T(), err)
+	var tok Token
+	require.Nil(s.T(), json.Unmarshal(respBody, &tok))
+	require.NotEmpty(s.T(), tok.Refresh)
+	require.Greater(s.T(), tok.RefreshExpires, tok.Expires)
+	return &tok
+}
+
+// newToken requests a token for the user with id and apiSecret
+func (s *AdminSuite) newToken(id, apiSecret string) string {
+	return s.newSession(id, apiSecret).Bearer
+}
+
+// newOrg creates an org, returning it and its owner
+func (s *AdminSuite) newOrg() (*org.Org, *user.User) {
+	ownerPassword, err := security.DerivePassword(uuid.NewString(), s.srv.ST.Argon2Cfg)
+	require.Nil(s.T(), err)
+
+	o, err := org.Create(
+		s.ctx,
+		uuid.NewString(), // org name
+		uuid.NewString(), // org owner display name
+		uuid.NewString(), // org owner email
+		ownerPassword,
+		s.srv.ST.DBKeys,
+		s.srv.ST.Master,
+	)
+	require.Nil(s.T(), err)
+
+	owner, err := user.Read(
+		s.ctx,
+		o.Owner,
+		s.srv.ST.DBKeys,
+		s.srv.ST.RandomReplica(),
+	)
+	require.Nil(s.T(), err)
+	return o, owner
+}
+
+// newUser creates an active user in orgID
+func (s *AdminSuite) newUser(orgID string) *user.User {
+	password, err := security.DerivePassword(uuid.NewString(), s.srv.ST.Argon2Cfg)
+	require.Nil(s.T(), err)
+	u, err := user.Encrypted(
+		s.ctx,
+		uuid.NewString(), // display name
+		uuid.NewString(), // email
+		orgID,
+		password,
+		s.srv.ST.DBKeys,
+	)
+	require.Nil(s.T(), err)
+	u.Meta.Status = models.StatusActive
+	err = u.Insert(s.ctx, s.srv.ST.Master)
+	require.Nil(s.T(), err)
+	u, err = user.Read(s.ctx, u.ID, s.srv.ST.DBKeys, s.srv.ST.Master)
+	require.Nil(s.T(), err)
+	return u
+}
+
+// do sends an authenticated request as the user with id
+func (s *AdminSuite) do(method, route, id, bearer string, body []byte) *http.Response {
+	req, err := http.NewRequest(method, s.ts.URL+route, bytes.NewBuffer(body))
+	require.Nil(s.T(), err)
+	req.Header.Add(IDHeader, id)
+	req.Header.Add(jwt.Authorization, jwt.ToHeaderVal(bearer))
+	resp, err := s.c.Do(req)
+	require.Nil(s.T(), err)
+	return resp
+}
+
 func TestAdminSuite(t *testing.T) {
 	suite.Run(t, new(AdminSuite))
 }
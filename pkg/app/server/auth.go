@@ -4,15 +4,20 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"time"
 
-	jwt_go "github.com/dgrijalva/jwt-go"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/grokloc/grokloc-server/pkg/app/admin/org"
 	"github.com/grokloc/grokloc-server/pkg/app/admin/user"
 	"github.com/grokloc/grokloc-server/pkg/app/jwt"
+	"github.com/grokloc/grokloc-server/pkg/app/lockout"
+	"github.com/grokloc/grokloc-server/pkg/app/refresh"
 	"github.com/grokloc/grokloc-server/pkg/models"
 	"github.com/grokloc/grokloc-server/pkg/security"
 	"go.uber.org/zap"
@@ -39,7 +44,7 @@ func (srv *Instance) WithSession(next http.Handler) http.Handler {
 			return
 		}
 
-		user, err := user.Read(ctx, id, srv.ST.DBKey, srv.ST.RandomReplica())
+		user, err := user.Read(ctx, id, srv.ST.DBKeys, srv.ST.RandomReplica())
 		if err != nil {
 			if err == sql.ErrNoRows {
 				http.Error(w, "user not found", http.StatusBadRequest)
@@ -92,9 +97,11 @@ func (srv *Instance) WithSession(next http.Handler) http.Handler {
 
 // WithToken extracts the JWT from the X-GrokLOC-Token header
 // and validates the claims
-func (srv Instance) WithToken(next http.Handler) http.Handler {
+func (srv *Instance) WithToken(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
+		defer zap.L().Sync() // nolint
+		sugar := zap.L().Sugar()
 
 		session, ok := ctx.Value(sessionCtxKey).(Session)
 		if !ok {
@@ -105,12 +112,34 @@ func (srv Instance) WithToken(next http.Handler) http.Handler {
 			http.Error(w, fmt.Sprintf("missing: %s", jwt.Authorization), http.StatusBadRequest)
 			return
 		}
-		claims, err := jwt.Decode(session.User.ID, token, srv.ST.TokenKey)
+		// the master is read so a newly promoted key is known at once
+		keys, err := srv.tokenKeys.Load(ctx, srv.ST, srv.ST.Master)
+		if err != nil {
+			sugar.Debugw("load token keys",
+				"reqid", middleware.GetReqID(ctx),
+				"err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		claims, err := jwt.DecodeKeyring(session.User.ID, token, keys, time.Now().Unix())
+		if errors.Is(err, jwt.ErrKeyID) {
+			// the key may have been promoted by another server since
+			// the keys were cached
+			keys, err = srv.tokenKeys.Refresh(ctx, srv.ST, srv.ST.Master)
+			if err != nil {
+				sugar.Debugw("load token keys",
+					"reqid", middleware.GetReqID(ctx),
+					"err", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			claims, err = jwt.DecodeKeyring(session.User.ID, token, keys, time.Now().Unix())
+		}
 		if err != nil {
 			http.Error(w, "token decode error", http.StatusUnauthorized)
 			return
 		}
-		if claims.Id != session.User.ID || claims.Org != session.Org.ID {
+		if claims.Subject != session.User.ID || claims.Org != session.Org.ID {
 			http.Error(w, "token contents incorrect", http.StatusBadRequest)
 			return
 		}
@@ -118,18 +147,61 @@ func (srv Instance) WithToken(next http.Handler) http.Handler {
 			http.Error(w, "token expired", http.StatusUnauthorized)
 			return
 		}
+		// the master is read so a token can be used as soon as it is issued
+		family, err := refresh.Check(ctx, claims.Id, srv.ST.Master)
+		if err != nil {
+			if err == refresh.ErrRevoked {
+				http.Error(w, "token revoked", http.StatusUnauthorized)
+				return
+			}
+			sugar.Debugw("check token",
+				"reqid", middleware.GetReqID(ctx),
+				"err", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		r = r.WithContext(context.WithValue(ctx, familyCtxKey, family))
+		// r.Context() to get ctx with family
+		r = r.WithContext(context.WithValue(r.Context(), claimsCtxKey, claims))
 		next.ServeHTTP(w, r)
 	}
 	return http.HandlerFunc(fn)
 }
 
-// Token describes the token value and the expiration unixtime
+// RequireScope returns middleware, following WithToken, that rejects
+// requests whose token does not grant scope
+//
+// Scopes narrow what a token can do; the auth level checks made by each
+// handler still apply
+func (srv *Instance) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := r.Context().Value(claimsCtxKey).(*jwt.Claims)
+			if !ok {
+				panic("claims missing")
+			}
+			if !claims.HasScope(scope) {
+				http.Error(w, "token scope inadequate", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// Token describes the token value and the expiration unixtime, and the
+// refresh token that replaces it
 type Token struct {
-	Bearer  string `json:"bearer"`
-	Expires int64  `json:"expires"`
+	Bearer         string `json:"bearer"`
+	Expires        int64  `json:"expires"`
+	Refresh        string `json:"refresh"`
+	RefreshExpires int64  `json:"refresh_expires"`
+	Scope          string `json:"scope"`
 }
 
-// NewToken returns a response containing a new JWT
+// NewToken returns a response containing a new JWT, with the scopes
+// requested in ScopeHeader
 func (srv *Instance) NewToken(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	defer zap.L().Sync() // nolint
@@ -144,20 +216,70 @@ func (srv *Instance) NewToken(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("missing: %s", TokenRequestHeader), http.StatusBadRequest)
 		return
 	}
-	validate := security.EncodedSHA256(session.User.ID + session.User.APISecret)
-	if tokenRequest != validate {
+	scope, err := jwt.ParseScope(r.Header.Get(ScopeHeader))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the attempt counts as failed until it succeeds
+	addrCounter, userCounter := lockout.Addr(remoteAddr(r)), lockout.User(session.User.ID)
+	at, done := srv.reserve(w, r, []lockout.Counter{addrCounter, userCounter})
+	if done {
+		return
+	}
+
+	// rotated api secrets are accepted during their grace period
+	valid, err := session.User.VerifyTokenRequest(ctx, tokenRequest, srv.ST.Master)
+	if err != nil {
+		sugar.Debugw("verify token request",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
 		sugar.Debugw("verify token request",
 			"reqid", middleware.GetReqID(ctx),
-			"tokenrequest", tokenRequest,
-			"validate", validate,
-			"id", session.User.ID)
+			"id", session.User.ID,
+			"addr", remoteAddr(r))
 		http.Error(w, "token request invalid", http.StatusUnauthorized)
 		return
 	}
-	claims, err := jwt.New(
-		session.User.ID,
-		session.User.EmailDigest,
-		session.User.Org,
+	srv.succeed(ctx, userCounter, addrCounter, at)
+	srv.startSession(w, r, session.User, scope)
+}
+
+// startSession begins a new refresh token family for u granting scope,
+// and writes its first Token
+func (srv *Instance) startSession(w http.ResponseWriter, r *http.Request, u user.User, scope string) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	rt, err := refresh.Start(ctx, u.ID, scope, srv.ST.Master)
+	if err != nil {
+		sugar.Debugw("start refresh family",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	srv.writeToken(w, r, u, rt)
+}
+
+// writeToken writes a new JWT for u, recorded in the family of rt, as a
+// Token with rt
+func (srv *Instance) writeToken(w http.ResponseWriter, r *http.Request, u user.User, rt *refresh.Token) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	claims, err := jwt.NewScoped(
+		u.ID,
+		u.EmailDigest,
+		u.Org,
+		rt.Scope,
 	)
 	if err != nil {
 		sugar.Debugw("create new claims",
@@ -166,8 +288,23 @@ func (srv *Instance) NewToken(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
-	token := jwt_go.NewWithClaims(jwt_go.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString([]byte(session.User.ID + string(srv.ST.TokenKey)))
+	err = refresh.Record(ctx, rt.Family, claims.Id, claims.ExpiresAt, srv.ST.Master)
+	if err != nil {
+		sugar.Debugw("record token",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	keys, err := srv.tokenKeys.Load(ctx, srv.ST, srv.ST.Master)
+	if err != nil {
+		sugar.Debugw("load token keys",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	signedToken, err := jwt.Encode(u.ID, claims, keys.Current)
 	if err != nil {
 		sugar.Debugw("encode token",
 			"reqid", middleware.GetReqID(ctx),
@@ -176,7 +313,13 @@ func (srv *Instance) NewToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	bs, err := json.Marshal(Token{Bearer: signedToken, Expires: claims.ExpiresAt})
+	bs, err := json.Marshal(Token{
+		Bearer:         signedToken,
+		Expires:        claims.ExpiresAt,
+		Refresh:        rt.Value,
+		RefreshExpires: rt.Expires,
+		Scope:          claims.Scope,
+	})
 	if err != nil {
 		sugar.Debugw("marshal token",
 			"reqid", middleware.GetReqID(ctx),
@@ -190,3 +333,328 @@ func (srv *Instance) NewToken(w http.ResponseWriter, r *http.Request) {
 		panic(err.Error())
 	}
 }
+
+// maxAuthBody is the largest body, in bytes, read by the unauthenticated
+// Login and Refresh handlers
+const maxAuthBody = 4 << 10
+
+// Login is the body of a login request
+type Login struct {
+	Org      string `json:"org"`
+	Email    string `json:"email"`
+	Password string `json:"password"` // cleartext
+	Scope    string `json:"scope"`    // optional, as for ScopeHeader
+}
+
+// Login returns a response containing a new JWT for the active user
+// with the email and password in an active org
+//
+// All credential failures are reported alike, so as to not leak which
+// users exist
+func (srv *Instance) Login(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAuthBody))
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var login Login
+	err = json.Unmarshal(body, &login)
+	if err != nil || len(login.Org) == 0 || len(login.Email) == 0 || len(login.Password) == 0 {
+		http.Error(w, "malformed login", http.StatusBadRequest)
+		return
+	}
+
+	scope, err := jwt.ParseScope(login.Scope)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the attempt counts as failed until it succeeds; unknown emails are
+	// counted alike so lockouts do not reveal users
+	addrCounter, emailCounter := lockout.Addr(remoteAddr(r)), lockout.Email(login.Org, login.Email)
+	at, done := srv.reserve(w, r, []lockout.Counter{addrCounter, emailCounter})
+	if done {
+		return
+	}
+
+	u, err := user.ReadByEmail(ctx, login.Org, login.Email, srv.ST.DBKeys, srv.ST.RandomReplica())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// the same work as a wrong password, so timing does not
+			// reveal which emails have users
+			_, _ = security.VerifyPassword(login.Password, srv.dummyPassword)
+			http.Error(w, "login failed", http.StatusUnauthorized)
+			return
+		}
+		sugar.Debugw("read user",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	match, err := security.VerifyPassword(login.Password, u.Password)
+	if err != nil {
+		sugar.Debugw("verify password",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !match {
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+
+	active, err := srv.active(ctx, u)
+	if err != nil {
+		sugar.Debugw("read org",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !active {
+		// the password was right, so this is not a failure
+		srv.refund(ctx, []lockout.Counter{addrCounter, emailCounter}, at)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+
+	srv.succeed(ctx, emailCounter, addrCounter, at)
+	srv.rehash(ctx, u, login.Password)
+
+	srv.startSession(w, r, *u, scope)
+}
+
+// remoteAddr is the host of the client address, as set by RealIP
+func remoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// reserve counts an attempt for counters with lockout.Reserve, returning
+// the time it was counted at, or writes a response and returns done if
+// an attempt is not allowed now
+func (srv *Instance) reserve(w http.ResponseWriter, r *http.Request, counters []lockout.Counter) (at int64, done bool) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	at, wait, err := lockout.Reserve(ctx, counters, srv.ST.Master)
+	if err != nil {
+		sugar.Debugw("reserve attempt",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return 0, true
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(wait, 10))
+		http.Error(w, "too many failed attempts", http.StatusTooManyRequests)
+		return 0, true
+	}
+	return at, false
+}
+
+// succeed forgets the failures of c after a successful attempt, and
+// uncounts the attempt reserved at for addr
+//
+// Address counters are not reset, as one valid account would otherwise
+// clear the failures of every other user at the address
+func (srv *Instance) succeed(ctx context.Context, c, addr lockout.Counter, at int64) {
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	err := lockout.Reset(ctx, []lockout.Counter{c}, srv.ST.Master)
+	if err != nil {
+		sugar.Debugw("reset failures",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+	}
+	srv.refund(ctx, []lockout.Counter{addr}, at)
+}
+
+// refund uncounts an attempt reserved at for counters that did not fail;
+// the response is the same if it cannot be
+func (srv *Instance) refund(ctx context.Context, counters []lockout.Counter, at int64) {
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	err := lockout.Refund(ctx, counters, at, srv.ST.Master)
+	if err != nil {
+		sugar.Debugw("refund attempt",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+	}
+}
+
+// rehash derives password again and stores it if the stored password of
+// u was derived with parameters weaker than State.Argon2Cfg
+//
+// Failures are logged but do not fail the login; the next login will
+// try again
+func (srv *Instance) rehash(ctx context.Context, u *user.User, password string) {
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	rehash, err := security.NeedsRehash(u.Password, srv.ST.Argon2Cfg)
+	if err != nil {
+		sugar.Debugw("decode password",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		return
+	}
+	if !rehash {
+		return
+	}
+
+	derived, err := security.DerivePassword(password, srv.ST.Argon2Cfg)
+	if err != nil {
+		sugar.Debugw("derive password",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		return
+	}
+	err = u.RehashPassword(ctx, derived, srv.ST.Master)
+	if err != nil {
+		sugar.Debugw("update password",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		return
+	}
+	// recounted by each sweep.CountPasswords
+	if user.LegacyPasswordsGauge.Value() > 0 {
+		user.LegacyPasswordsGauge.Add(-1)
+	}
+	sugar.Infow("rehash",
+		"reqid", middleware.GetReqID(ctx),
+		"id", u.ID)
+}
+
+// active reports whether u and its org are active
+func (srv *Instance) active(ctx context.Context, u *user.User) (bool, error) {
+	if u.Meta.Status != models.StatusActive {
+		return false, nil
+	}
+	o, err := org.Read(ctx, u.Org, srv.ST.RandomReplica())
+	if err != nil {
+		return false, err
+	}
+	return o.Meta.Status == models.StatusActive, nil
+}
+
+// Refresh is the body of a refresh request
+type Refresh struct {
+	Refresh string `json:"refresh"`
+}
+
+// Refresh exchanges a refresh token for a new Token in the same family
+//
+// Presenting a refresh token that was already exchanged revokes its
+// family, ending the session for both holders
+func (srv *Instance) Refresh(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAuthBody))
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var req Refresh
+	err = json.Unmarshal(body, &req)
+	if err != nil || len(req.Refresh) == 0 {
+		http.Error(w, "malformed refresh", http.StatusBadRequest)
+		return
+	}
+
+	rt, err := refresh.Rotate(ctx, req.Refresh, srv.ST.Master)
+	if err != nil {
+		if err == refresh.ErrInvalid || err == refresh.ErrReused {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		sugar.Debugw("rotate refresh token",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	u, err := user.Read(ctx, rt.User, srv.ST.DBKeys, srv.ST.RandomReplica())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// the user was deleted or shredded; end the session
+			err = refresh.Revoke(ctx, rt.Family, srv.ST.Master)
+			if err != nil {
+				sugar.Debugw("revoke token family",
+					"reqid", middleware.GetReqID(ctx),
+					"err", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			http.Error(w, "refresh token invalid", http.StatusUnauthorized)
+			return
+		}
+		sugar.Debugw("read user",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	active, err := srv.active(ctx, u)
+	if err != nil {
+		sugar.Debugw("read org",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !active {
+		http.Error(w, "refresh token invalid", http.StatusUnauthorized)
+		return
+	}
+
+	srv.writeToken(w, r, *u, rt)
+}
+
+// Logout revokes the refresh token family of the caller's token, ending
+// the session
+func (srv *Instance) Logout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	family, ok := ctx.Value(familyCtxKey).(string)
+	if !ok {
+		panic("token family missing")
+	}
+
+	err := refresh.Revoke(ctx, family, srv.ST.Master)
+	if err != nil {
+		sugar.Debugw("revoke token family",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/grokloc/grokloc-server/pkg/app/job"
+	"go.uber.org/zap"
+)
+
+// ReadJob returns the status of a job enqueued by the caller's org
+//
+// Root sees all jobs; jobs of other orgs are not found
+func (srv *Instance) ReadJob(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	authLevel, ok := ctx.Value(authLevelCtxKey).(int)
+	if !ok {
+		panic("auth missing")
+	}
+
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	j, err := job.Read(ctx, chi.URLParam(r, IDParam), srv.ST.RandomReplica())
+	if err == nil && authLevel != AuthRoot && session.Org.ID != j.Org {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("read job",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, j)
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app/job"
+	"github.com/grokloc/grokloc-server/pkg/app/mirror"
+	"github.com/grokloc/grokloc-server/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+func (s *AdminSuite) TestSyncRepositoryReadJob() {
+	o, owner := s.newOrg()
+	member := s.newUser(o.ID)
+	_, otherOwner := s.newOrg()
+	ownerBearer := s.newToken(owner.ID, owner.APISecret)
+	memberBearer := s.newToken(member.ID, member.APISecret)
+	rp := s.newRepository(o.ID)
+	route := RepositoryRoute + "/" + rp.ID + SyncPath
+
+	// members cannot sync
+	resp := s.do(http.MethodPost, route, member.ID, memberBearer, nil)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// other orgs cannot see the repository
+	resp = s.do(http.MethodPost, route, otherOwner.ID,
+		s.newToken(otherOwner.ID, otherOwner.APISecret), nil)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+
+	resp = s.do(http.MethodPost, route, owner.ID, ownerBearer, nil)
+	require.Equal(s.T(), http.StatusAccepted, resp.StatusCode)
+	location := resp.Header.Get("location")
+	require.NotEmpty(s.T(), location)
+	respBody, err := io.ReadAll(resp.Body)
+	require.Nil(s.T(), err)
+	var enqueued job.Job
+	require.Nil(s.T(), json.Unmarshal(respBody, &enqueued))
+	require.Equal(s.T(), JobRoute+"/"+enqueued.ID, location)
+	require.Equal(s.T(), mirror.SyncKind, enqueued.Kind)
+	require.Equal(s.T(), job.StatusQueued, enqueued.Status)
+
+	readAs := func(id, bearer string) int {
+		resp := s.do(http.MethodGet, location, id, bearer, nil)
+		if resp.StatusCode == http.StatusOK {
+			respBody, err := io.ReadAll(resp.Body)
+			require.Nil(s.T(), err)
+			var read job.Job
+			require.Nil(s.T(), json.Unmarshal(respBody, &read))
+			require.Equal(s.T(), enqueued.ID, read.ID)
+			require.Equal(s.T(), o.ID, read.Org)
+		}
+		return resp.StatusCode
+	}
+
+	// the enqueuing org, including members, and root see the job
+	require.Equal(s.T(), http.StatusOK, readAs(owner.ID, ownerBearer))
+	require.Equal(s.T(), http.StatusOK, readAs(member.ID, memberBearer))
+	require.Equal(s.T(), http.StatusOK, readAs(s.srv.ST.RootUser, s.token.Bearer))
+
+	// other orgs do not
+	require.Equal(s.T(), http.StatusNotFound,
+		readAs(otherOwner.ID, s.newToken(otherOwner.ID, otherOwner.APISecret)))
+
+	// missing
+	resp = s.do(http.MethodGet, JobRoute+"/"+uuid.NewString(), s.srv.ST.RootUser, s.token.Bearer, nil)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+
+	// inactive repositories are not synced
+	require.Nil(s.T(), rp.UpdateStatus(s.ctx, models.StatusInactive, s.srv.ST.Master))
+	resp = s.do(http.MethodPost, route, owner.ID, ownerBearer, nil)
+	require.Equal(s.T(), http.StatusConflict, resp.StatusCode)
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/lockout"
+	"github.com/grokloc/grokloc-server/pkg/security"
+	"github.com/stretchr/testify/require"
+)
+
+// unlock ends the delay of c as though it had passed, keeping its
+// failures
+func (s *AdminSuite) unlock(c lockout.Counter) {
+	_, err := s.srv.ST.Master.ExecContext(s.ctx,
+		fmt.Sprintf(`update %s set locked_until = 0 where key = ?`, app.LoginFailuresTableName),
+		c.Key)
+	require.Nil(s.T(), err)
+}
+
+// failures returns the failures counted for c
+func (s *AdminSuite) failures(c lockout.Counter) int64 {
+	var failures int64
+	err := s.srv.ST.Master.QueryRowContext(s.ctx,
+		fmt.Sprintf(`select failures from %s where key = ?`, app.LoginFailuresTableName),
+		c.Key).Scan(&failures)
+	if err == sql.ErrNoRows {
+		return 0
+	}
+	require.Nil(s.T(), err)
+	return failures
+}
+
+// proxied returns a server behind a trusted loopback proxy, and a
+// random client address for it to forward, as other tests share the
+// loopback address
+func (s *AdminSuite) proxied() (*httptest.Server, string) {
+	s.srv.Config.TrustedProxies = []string{"127.0.0.0/8", "::1"}
+	ts := httptest.NewServer(s.srv.Router())
+	s.T().Cleanup(ts.Close)
+	ip := make(net.IP, net.IPv6len)
+	_, err := rand.Read(ip)
+	require.Nil(s.T(), err)
+	return ts, ip.String()
+}
+
+func (s *AdminSuite) TestTokenRequestLockout() {
+	o, _ := s.newOrg()
+	u := s.newUser(o.ID)
+	ts, addr := s.proxied()
+
+	tokenRequest := func(apiSecret string) *http.Response {
+		req, err := http.NewRequest(http.MethodPut, ts.URL+TokenRoute, nil)
+		require.Nil(s.T(), err)
+		req.Header.Add(IDHeader, u.ID)
+		req.Header.Add(TokenRequestHeader, security.EncodedSHA256(u.ID+apiSecret))
+		req.Header.Add("X-Forwarded-For", addr)
+		resp, err := s.c.Do(req)
+		require.Nil(s.T(), err)
+		return resp
+	}
+
+	for i := int64(0); i <= lockout.UserPolicy.Free; i++ {
+		require.Equal(s.T(), http.StatusUnauthorized, tokenRequest(uuid.NewString()).StatusCode)
+	}
+
+	// even the right api secret must wait
+	resp := tokenRequest(u.APISecret)
+	require.Equal(s.T(), http.StatusTooManyRequests, resp.StatusCode)
+	wait, err := strconv.ParseInt(resp.Header.Get("Retry-After"), 10, 64)
+	require.Nil(s.T(), err)
+	require.Greater(s.T(), wait, int64(0))
+
+	// and succeeds after, which forgets the failures
+	s.unlock(lockout.User(u.ID))
+	require.Equal(s.T(), http.StatusOK, tokenRequest(u.APISecret).StatusCode)
+	wait, err = lockout.Check(s.ctx, []lockout.Counter{lockout.User(u.ID)}, s.srv.ST.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), int64(0), wait)
+	require.Equal(s.T(), http.StatusUnauthorized, tokenRequest(uuid.NewString()).StatusCode)
+
+	// the address keeps the failures, but not the successful attempt
+	require.Equal(s.T(), lockout.UserPolicy.Free+2, s.failures(lockout.Addr(addr)))
+}
+
+func (s *AdminSuite) TestLoginLockout() {
+	// unknown emails are limited alike
+	orgID, email := s.srv.ST.RootOrg, uuid.NewString()
+	ts, addr := s.proxied()
+
+	login := func() *http.Response {
+		bs, err := json.Marshal(Login{Org: orgID, Email: email, Password: uuid.NewString()})
+		require.Nil(s.T(), err)
+		req, err := http.NewRequest(http.MethodPost, ts.URL+LoginRoute, bytes.NewBuffer(bs))
+		require.Nil(s.T(), err)
+		req.Header.Add("X-Forwarded-For", addr)
+		resp, err := s.c.Do(req)
+		require.Nil(s.T(), err)
+		return resp
+	}
+
+	for i := int64(0); i <= lockout.UserPolicy.Free; i++ {
+		require.Equal(s.T(), http.StatusUnauthorized, login().StatusCode)
+	}
+	// one more failure, so the delay is not a second that may elapse
+	// before the next attempt
+	require.Nil(s.T(), lockout.Fail(s.ctx, []lockout.Counter{lockout.Email(orgID, email)}, s.srv.ST.Master))
+	require.Equal(s.T(), http.StatusTooManyRequests, login().StatusCode)
+
+	// the address is counted too
+	wait, err := lockout.Check(s.ctx, []lockout.Counter{lockout.Addr(addr)}, s.srv.ST.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), int64(0), wait)
+	s.unlock(lockout.Email(orgID, email))
+	for i := lockout.UserPolicy.Free + 1; i < lockout.AddrPolicy.Free; i++ {
+		require.Nil(s.T(), lockout.Fail(s.ctx, []lockout.Counter{lockout.Addr(addr)}, s.srv.ST.Master))
+	}
+	require.Equal(s.T(), http.StatusUnauthorized, login().StatusCode)
+	s.unlock(lockout.Email(orgID, email))
+	// one more failure, so the address delay is not a second that may
+	// elapse before the next attempt
+	require.Nil(s.T(), lockout.Fail(s.ctx, []lockout.Counter{lockout.Addr(addr)}, s.srv.ST.Master))
+	require.Equal(s.T(), http.StatusTooManyRequests, login().StatusCode)
+}
+
+func (s *AdminSuite) TestLockoutPeerAddr() {
+	// without trusted proxies, forwarding headers are ignored
+	spoofed := uuid.NewString()
+	req, err := http.NewRequest(http.MethodPut, s.ts.URL+TokenRoute, nil)
+	require.Nil(s.T(), err)
+	req.Header.Add(IDHeader, s.srv.ST.RootUser)
+	req.Header.Add(TokenRequestHeader, security.EncodedSHA256(s.srv.ST.RootUser+s.srv.ST.RootUserAPISecret))
+	req.Header.Add("X-Real-IP", spoofed)
+	req.Header.Add("X-Forwarded-For", spoofed)
+	resp, err := s.c.Do(req)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var rows int
+	err = s.srv.ST.Master.QueryRowContext(s.ctx,
+		fmt.Sprintf(`select count(*) from %s where key = ?`, app.LoginFailuresTableName),
+		lockout.Addr(spoofed).Key).Scan(&rows)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 0, rows)
+}
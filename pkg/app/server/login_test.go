@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/org"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/user"
+	user_events "github.com/grokloc/grokloc-server/pkg/app/admin/user/events"
+	"github.com/grokloc/grokloc-server/pkg/app/audit"
+	"github.com/grokloc/grokloc-server/pkg/models"
+	"github.com/grokloc/grokloc-server/pkg/security"
+	"github.com/stretchr/testify/require"
+)
+
+func (s *AdminSuite) TestLogin() {
+	password := uuid.NewString()
+	derived, err := security.DerivePassword(password, s.srv.ST.Argon2Cfg)
+	require.Nil(s.T(), err)
+	email := uuid.NewString()
+	o, err := org.Create(
+		s.ctx,
+		uuid.NewString(), // org name
+		uuid.NewString(), // org owner display name
+		email,
+		derived,
+		s.srv.ST.DBKeys,
+		s.srv.ST.Master,
+	)
+	require.Nil(s.T(), err)
+
+	login := func(orgID, email, password string) *http.Response {
+		bs, err := json.Marshal(Login{Org: orgID, Email: email, Password: password})
+		require.Nil(s.T(), err)
+		resp, err := s.c.Post(s.ts.URL+LoginRoute, "application/json", bytes.NewBuffer(bs))
+		require.Nil(s.T(), err)
+		return resp
+	}
+
+	resp := login(o.ID, email, password)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	require.Equal(s.T(), "application/json", resp.Header.Get("content-type"))
+	respBody, err := io.ReadAll(resp.Body)
+	require.Nil(s.T(), err)
+	var tok Token
+	require.Nil(s.T(), json.Unmarshal(respBody, &tok))
+	require.GreaterOrEqual(s.T(), tok.Expires, time.Now().Unix())
+
+	// the token authenticates the owner
+	resp = s.do(http.MethodGet, OrgRoute+"/"+o.ID, o.Owner, tok.Bearer, nil)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// wrong password, unknown email, and the email in another org
+	// all fail alike
+	for _, resp := range []*http.Response{
+		login(o.ID, email, uuid.NewString()),
+		login(o.ID, uuid.NewString(), password),
+		login(s.srv.ST.RootOrg, email, password),
+	} {
+		require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	}
+	// unknown emails are verified against a password costing the same
+	rehash, err := security.NeedsRehash(s.srv.dummyPassword, s.srv.ST.Argon2Cfg)
+	require.Nil(s.T(), err)
+	require.False(s.T(), rehash)
+
+	// missing fields
+	resp = login(o.ID, email, "")
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+
+	// inactive users cannot log in
+	owner, err := user.Read(s.ctx, o.Owner, s.srv.ST.DBKeys, s.srv.ST.Master)
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), owner.UpdateStatus(s.ctx, models.StatusInactive, s.srv.ST.Master))
+	resp = login(o.ID, email, password)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+}
+
+func (s *AdminSuite) TestAuthBodyLimit() {
+	// unauthenticated bodies are read only up to a limit
+	bs, err := json.Marshal(Login{Org: uuid.NewString(), Email: uuid.NewString(), Password: strings.Repeat("x", maxAuthBody)})
+	require.Nil(s.T(), err)
+	for _, route := range []string{LoginRoute, RefreshRoute} {
+		resp, err := s.c.Post(s.ts.URL+route, "application/json", bytes.NewBuffer(bs))
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), http.StatusRequestEntityTooLarge, resp.StatusCode)
+	}
+}
+
+func (s *AdminSuite) TestLoginRehash() {
+	password := uuid.NewString()
+	weak := s.srv.ST.Argon2Cfg
+	weak.MemoryCost /= 2
+	derived, err := security.DerivePassword(password, weak)
+	require.Nil(s.T(), err)
+	email := uuid.NewString()
+	o, err := org.Create(
+		s.ctx,
+		uuid.NewString(), // org name
+		uuid.NewString(), // org owner display name
+		email,
+		derived,
+		s.srv.ST.DBKeys,
+		s.srv.ST.Master,
+	)
+	require.Nil(s.T(), err)
+
+	bs, err := json.Marshal(Login{Org: o.ID, Email: email, Password: password})
+	require.Nil(s.T(), err)
+	resp, err := s.c.Post(s.ts.URL+LoginRoute, "application/json", bytes.NewBuffer(bs))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// the password is derived again with the current parameters
+	owner, err := user.Read(s.ctx, o.Owner, s.srv.ST.DBKeys, s.srv.ST.Master)
+	require.Nil(s.T(), err)
+	require.NotEqual(s.T(), derived, owner.Password)
+	rehash, err := security.NeedsRehash(owner.Password, s.srv.ST.Argon2Cfg)
+	require.Nil(s.T(), err)
+	require.False(s.T(), rehash)
+	match, err := security.VerifyPassword(password, owner.Password)
+	require.Nil(s.T(), err)
+	require.True(s.T(), match)
+
+	var count int
+	err = s.srv.ST.Master.QueryRowContext(s.ctx,
+		fmt.Sprintf(`select count(*) from %s where code = ? and source_id = ?`, app.AuditTableName),
+		audit.USER_PASSWORD_REHASH, o.Owner).Scan(&count)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 1, count)
+	// the password was not changed
+	err = s.srv.ST.Master.QueryRowContext(s.ctx,
+		fmt.Sprintf(`select count(*) from %s where code = ? and source_id = ?`, app.AuditTableName),
+		audit.USER_PASSWORD, o.Owner).Scan(&count)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 0, count)
+
+	// and not again
+	resp, err = s.c.Post(s.ts.URL+LoginRoute, "application/json", bytes.NewBuffer(bs))
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	reread, err := user.Read(s.ctx, o.Owner, s.srv.ST.DBKeys, s.srv.ST.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), owner.Password, reread.Password)
+}
+
+// refresh exchanges the refresh token for a new Token
+func (s *AdminSuite) refresh(value string) (int, *Token) {
+	bs, err := json.Marshal(Refresh{Refresh: value})
+	require.Nil(s.T(), err)
+	resp, err := s.c.Post(s.ts.URL+RefreshRoute, "application/json", bytes.NewBuffer(bs))
+	require.Nil(s.T(), err)
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	require.Nil(s.T(), err)
+	var tok Token
+	require.Nil(s.T(), json.Unmarshal(respBody, &tok))
+	return resp.StatusCode, &tok
+}
+
+func (s *AdminSuite) TestRefresh() {
+	o, owner := s.newOrg()
+	route := OrgRoute + "/" + o.ID
+	first := s.newSession(owner.ID, owner.APISecret)
+
+	status, second := s.refresh(first.Refresh)
+	require.Equal(s.T(), http.StatusOK, status)
+	require.NotEqual(s.T(), first.Bearer, second.Bearer)
+	require.NotEqual(s.T(), first.Refresh, second.Refresh)
+	resp := s.do(http.MethodGet, route, owner.ID, second.Bearer, nil)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// unknown
+	status, _ = s.refresh(uuid.NewString())
+	require.Equal(s.T(), http.StatusUnauthorized, status)
+
+	// replaying a rotated refresh token ends the session
+	status, _ = s.refresh(first.Refresh)
+	require.Equal(s.T(), http.StatusUnauthorized, status)
+	status, _ = s.refresh(second.Refresh)
+	require.Equal(s.T(), http.StatusUnauthorized, status)
+	resp = s.do(http.MethodGet, route, owner.ID, second.Bearer, nil)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+}
+
+func (s *AdminSuite) TestRefreshUserGone() {
+	o, _ := s.newOrg()
+	live := func(id string) int {
+		var count int
+		err := s.srv.ST.Master.QueryRowContext(s.ctx,
+			fmt.Sprintf(`select count(*) from %s where user = ? and revoked = 0`, app.TokenFamiliesTableName),
+			id).Scan(&count)
+		require.Nil(s.T(), err)
+		return count
+	}
+
+	// deleted users' sessions are ended when next refreshed
+	deleted := s.newUser(o.ID)
+	tok := s.newSession(deleted.ID, deleted.APISecret)
+	_, err := s.srv.ST.Master.ExecContext(s.ctx,
+		fmt.Sprintf(`delete from %s where id = ?`, app.UsersTableName), deleted.ID)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 1, live(deleted.ID))
+	status, _ := s.refresh(tok.Refresh)
+	require.Equal(s.T(), http.StatusUnauthorized, status)
+	require.Equal(s.T(), 0, live(deleted.ID))
+
+	// shredded users' sessions are ended at once
+	shredded := s.newUser(o.ID)
+	tok = s.newSession(shredded.ID, shredded.APISecret)
+	require.Nil(s.T(), shredded.Shred(s.ctx, s.srv.ST.DigestKey, s.srv.ST.Master))
+	require.Equal(s.T(), 0, live(shredded.ID))
+	status, _ = s.refresh(tok.Refresh)
+	require.Equal(s.T(), http.StatusUnauthorized, status)
+}
+
+func (s *AdminSuite) TestLogout() {
+	o, owner := s.newOrg()
+	route := OrgRoute + "/" + o.ID
+	tok := s.newSession(owner.ID, owner.APISecret)
+	other := s.newSession(owner.ID, owner.APISecret)
+
+	resp := s.do(http.MethodPost, LogoutRoute, owner.ID, tok.Bearer, nil)
+	require.Equal(s.T(), http.StatusNoContent, resp.StatusCode)
+
+	resp = s.do(http.MethodGet, route, owner.ID, tok.Bearer, nil)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	status, _ := s.refresh(tok.Refresh)
+	require.Equal(s.T(), http.StatusUnauthorized, status)
+
+	// other sessions continue
+	resp = s.do(http.MethodGet, route, owner.ID, other.Bearer, nil)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+}
+
+func (s *AdminSuite) TestDeactivateRevokes() {
+	o, owner := s.newOrg()
+	member := s.newUser(o.ID)
+	tok := s.newSession(member.ID, member.APISecret)
+	ownerBearer := s.newToken(owner.ID, owner.APISecret)
+	route := UserRoute + "/" + member.ID
+
+	setStatus := func(status models.Status) {
+		bs, err := json.Marshal(user_events.UpdateStatus{ID: member.ID, Status: status})
+		require.Nil(s.T(), err)
+		resp := s.do(http.MethodPut, route, owner.ID, ownerBearer, bs)
+		require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	}
+	setStatus(models.StatusInactive)
+	setStatus(models.StatusActive)
+
+	// sessions from before deactivation stay ended
+	resp := s.do(http.MethodGet, route, member.ID, tok.Bearer, nil)
+	require.Equal(s.T(), http.StatusUnauthorized, resp.StatusCode)
+	status, _ := s.refresh(tok.Refresh)
+	require.Equal(s.T(), http.StatusUnauthorized, status)
+}
@@ -0,0 +1,20 @@
+package server
+
+import (
+	"expvar"
+	"net/http"
+)
+
+// Metrics writes every published expvar variable as JSON, including
+// user.LegacyPasswordsGauge; root only
+func (srv *Instance) Metrics(w http.ResponseWriter, r *http.Request) {
+	authLevel, ok := r.Context().Value(authLevelCtxKey).(int)
+	if !ok {
+		panic("auth missing")
+	}
+	if authLevel != AuthRoot {
+		http.Error(w, "auth inadequate", http.StatusForbidden)
+		return
+	}
+	expvar.Handler().ServeHTTP(w, r)
+}
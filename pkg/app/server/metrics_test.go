@@ -0,0 +1,24 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/grokloc/grokloc-server/pkg/app/admin/user"
+	"github.com/stretchr/testify/require"
+)
+
+func (s *AdminSuite) TestMetrics() {
+	user.LegacyPasswordsGauge.Set(3)
+	resp := s.do(http.MethodGet, MetricsRoute, s.srv.ST.RootUser, s.token.Bearer, nil)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var vars map[string]interface{}
+	require.Nil(s.T(), json.NewDecoder(resp.Body).Decode(&vars))
+	require.Equal(s.T(), float64(3), vars["legacy_passwords"])
+	require.Contains(s.T(), vars, "malformed_passwords")
+
+	// root only
+	_, owner := s.newOrg()
+	resp = s.do(http.MethodGet, MetricsRoute, owner.ID, s.newToken(owner.ID, owner.APISecret), nil)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+}
@@ -1,12 +1,16 @@
 package server
 
 import (
+	"database/sql"
 	"encoding/json"
 	"io"
 	"net/http"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/org"
 	"github.com/grokloc/grokloc-server/pkg/app/admin/org/events"
+	"github.com/grokloc/grokloc-server/pkg/app/stats"
 	"github.com/grokloc/grokloc-server/pkg/models"
 	"github.com/grokloc/grokloc-server/pkg/security"
 	"go.uber.org/zap"
@@ -91,3 +95,222 @@ func (srv *Instance) CreateOrg(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+func (srv *Instance) ReadOrg(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	authLevel, ok := ctx.Value(authLevelCtxKey).(int)
+	if !ok {
+		panic("auth missing")
+	}
+
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	id := chi.URLParam(r, IDParam)
+
+	// only root can read other orgs; anyone else is told the org
+	// is not found so as to not leak its existence
+	if authLevel != AuthRoot && session.Org.ID != id {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	o, err := srv.OrgController.Read(ctx, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("read org",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	bs, err := json.Marshal(o)
+	if err != nil {
+		sugar.Debugw("marshal org json",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(bs)
+	if err != nil {
+		sugar.Debugw("write http output",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (srv *Instance) UpdateOrg(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	authLevel, ok := ctx.Value(authLevelCtxKey).(int)
+	if !ok {
+		panic("auth missing")
+	}
+
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	id := chi.URLParam(r, IDParam)
+
+	// as with ReadOrg, other orgs are not found for non-root callers
+	if authLevel != AuthRoot && session.Org.ID != id {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// the body is either an UpdateOwner or an UpdateStatus event,
+	// distinguished by which field is present
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(body, &fields)
+	if err != nil {
+		http.Error(w, "malformed org update event", http.StatusBadRequest)
+		return
+	}
+	_, hasOwner := fields["owner"]
+	_, hasStatus := fields["status"]
+	if hasOwner == hasStatus {
+		http.Error(w, "malformed org update event", http.StatusBadRequest)
+		return
+	}
+
+	var o *org.Org
+	if hasOwner {
+		var event events.UpdateOwner
+		err = json.Unmarshal(body, &event)
+		if err != nil || event.ID != id {
+			http.Error(w, "malformed org owner event", http.StatusBadRequest)
+			return
+		}
+		// root, or the current owner, can transfer ownership
+		if authLevel != AuthRoot && authLevel != AuthOrg {
+			http.Error(w, "auth inadequate", http.StatusForbidden)
+			return
+		}
+		o, err = srv.OrgController.UpdateOwner(ctx, event)
+	} else {
+		var event events.UpdateStatus
+		err = json.Unmarshal(body, &event)
+		if err != nil || event.ID != id {
+			http.Error(w, "malformed org status event", http.StatusBadRequest)
+			return
+		}
+		// only root can change org status
+		if authLevel != AuthRoot {
+			http.Error(w, "auth inadequate", http.StatusForbidden)
+			return
+		}
+		o, err = srv.OrgController.UpdateStatus(ctx, event)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows || err == models.ErrNotFound {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err == models.ErrRelatedUser || err == models.ErrDisallowedValue {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sugar.Debugw("update org",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	bs, err := json.Marshal(o)
+	if err != nil {
+		sugar.Debugw("marshal org json",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(bs)
+	if err != nil {
+		sugar.Debugw("write http output",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ReadOrgStats returns the aggregate line counts of the org's repositories
+func (srv *Instance) ReadOrgStats(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	authLevel, ok := ctx.Value(authLevelCtxKey).(int)
+	if !ok {
+		panic("auth missing")
+	}
+
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	id := chi.URLParam(r, IDParam)
+
+	// as with ReadOrg, other orgs are not found for non-root callers
+	if authLevel != AuthRoot && session.Org.ID != id {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	// confirm the org exists; an unknown id has no repositories
+	// but should not report empty stats
+	_, err := srv.OrgController.Read(ctx, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("read org",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	o, err := stats.ReadOrg(ctx, id, srv.ST.RandomReplica())
+	if err != nil {
+		sugar.Debugw("read org stats",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, o)
+}
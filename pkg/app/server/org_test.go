@@ -3,10 +3,18 @@ package server
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"strings"
 
 	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/org"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/user"
+	"github.com/grokloc/grokloc-server/pkg/app/analysis"
 	"github.com/grokloc/grokloc-server/pkg/app/jwt"
+	"github.com/grokloc/grokloc-server/pkg/app/stats"
+	"github.com/grokloc/grokloc-server/pkg/models"
 	"github.com/grokloc/grokloc-server/pkg/security"
 	"github.com/stretchr/testify/require"
 
@@ -48,3 +56,166 @@ func (s *AdminSuite) TestCreateOrg() {
 	require.Nil(s.T(), err)
 	require.Equal(s.T(), http.StatusConflict, resp.StatusCode)
 }
+
+func (s *AdminSuite) TestReadOrg() {
+	o, owner := s.newOrg()
+	member := s.newUser(o.ID)
+	other, otherOwner := s.newOrg()
+
+	readAs := func(id, bearer string) (int, *org.Org) {
+		resp := s.do(http.MethodGet, OrgRoute+"/"+o.ID, id, bearer, nil)
+		if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, nil
+		}
+		require.Equal(s.T(), "application/json", resp.Header.Get("content-type"))
+		respBody, err := io.ReadAll(resp.Body)
+		require.Nil(s.T(), err)
+		var read org.Org
+		require.Nil(s.T(), json.Unmarshal(respBody, &read))
+		return resp.StatusCode, &read
+	}
+
+	// root, owner and member can read
+	for _, u := range []*user.User{
+		{Base: models.Base{ID: s.srv.ST.RootUser}, APISecret: s.srv.ST.RootUserAPISecret},
+		owner,
+		member,
+	} {
+		bearer := s.token.Bearer
+		if u.ID != s.srv.ST.RootUser {
+			bearer = s.newToken(u.ID, u.APISecret)
+		}
+		status, read := readAs(u.ID, bearer)
+		require.Equal(s.T(), http.StatusOK, status)
+		require.Equal(s.T(), o.ID, read.ID)
+		require.Equal(s.T(), o.Name, read.Name)
+		require.Equal(s.T(), o.Owner, read.Owner)
+		require.Equal(s.T(), models.StatusActive, read.Meta.Status)
+	}
+
+	// owner of another org cannot see it exists
+	status, _ := readAs(otherOwner.ID, s.newToken(otherOwner.ID, otherOwner.APISecret))
+	require.Equal(s.T(), http.StatusNotFound, status)
+
+	// but can read their own
+	resp := s.do(http.MethodGet, OrgRoute+"/"+other.ID, otherOwner.ID,
+		s.newToken(otherOwner.ID, otherOwner.APISecret), nil)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// missing
+	resp = s.do(http.MethodGet, OrgRoute+"/"+uuid.NewString(), s.srv.ST.RootUser, s.token.Bearer, nil)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+}
+
+func (s *AdminSuite) TestUpdateOrg() {
+	o, owner := s.newOrg()
+	member := s.newUser(o.ID)
+	_, otherOwner := s.newOrg()
+	ownerBearer := s.newToken(owner.ID, owner.APISecret)
+	memberBearer := s.newToken(member.ID, member.APISecret)
+	route := OrgRoute + "/" + o.ID
+
+	decode := func(resp *http.Response) *org.Org {
+		respBody, err := io.ReadAll(resp.Body)
+		require.Nil(s.T(), err)
+		var read org.Org
+		require.Nil(s.T(), json.Unmarshal(respBody, &read))
+		return &read
+	}
+
+	ownerEvent, err := org_events.NewUpdateOwner(s.ctx, o.ID, member.ID)
+	require.Nil(s.T(), err)
+	ownerBody, err := json.Marshal(ownerEvent)
+	require.Nil(s.T(), err)
+
+	statusEvent, err := org_events.NewUpdateStatus(s.ctx, o.ID, int(models.StatusInactive))
+	require.Nil(s.T(), err)
+	statusBody, err := json.Marshal(statusEvent)
+	require.Nil(s.T(), err)
+
+	// other orgs are not found
+	resp := s.do(http.MethodPut, route, otherOwner.ID,
+		s.newToken(otherOwner.ID, otherOwner.APISecret), ownerBody)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+
+	// members cannot transfer ownership
+	resp = s.do(http.MethodPut, route, member.ID, memberBearer, ownerBody)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// neither event
+	resp = s.do(http.MethodPut, route, owner.ID, ownerBearer,
+		[]byte(fmt.Sprintf(`{"id":"%s"}`, o.ID)))
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+
+	// event for a different org
+	resp = s.do(http.MethodPut, route, owner.ID, ownerBearer,
+		[]byte(fmt.Sprintf(`{"id":"%s","owner":"%s"}`, uuid.NewString(), member.ID)))
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+
+	// new owner must be in the org
+	resp = s.do(http.MethodPut, route, owner.ID, ownerBearer,
+		[]byte(fmt.Sprintf(`{"id":"%s","owner":"%s"}`, o.ID, otherOwner.ID)))
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+
+	// owner transfers to member
+	resp = s.do(http.MethodPut, route, owner.ID, ownerBearer, ownerBody)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	require.Equal(s.T(), member.ID, decode(resp).Owner)
+
+	// previous owner is now just a member
+	resp = s.do(http.MethodPut, route, owner.ID, ownerBearer,
+		[]byte(fmt.Sprintf(`{"id":"%s","owner":"%s"}`, o.ID, owner.ID)))
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// only root can change status
+	resp = s.do(http.MethodPut, route, member.ID, memberBearer, statusBody)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	resp = s.do(http.MethodPut, route, s.srv.ST.RootUser, s.token.Bearer, statusBody)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	require.Equal(s.T(), models.StatusInactive, decode(resp).Meta.Status)
+
+	// root can transfer ownership back
+	resp = s.do(http.MethodPut, route, s.srv.ST.RootUser, s.token.Bearer,
+		[]byte(fmt.Sprintf(`{"id":"%s","owner":"%s"}`, o.ID, owner.ID)))
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	require.Equal(s.T(), owner.ID, decode(resp).Owner)
+}
+
+func (s *AdminSuite) TestReadOrgStats() {
+	o, owner := s.newOrg()
+	_, otherOwner := s.newOrg()
+	rp := s.newRepository(o.ID)
+	a := analysis.Analysis{
+		Repository: rp.ID,
+		Commit:     strings.Repeat("a", 40),
+		Total:      analysis.Counts{Code: 3},
+		Languages:  []analysis.LanguageCounts{{Language: "Go", Files: 1, Counts: analysis.Counts{Code: 3}}},
+	}
+	require.Nil(s.T(), a.Insert(s.ctx, s.srv.ST.Master))
+	route := OrgRoute + "/" + o.ID + StatsPath
+
+	for _, reader := range []struct{ id, bearer string }{
+		{owner.ID, s.newToken(owner.ID, owner.APISecret)},
+		{s.srv.ST.RootUser, s.token.Bearer},
+	} {
+		resp := s.do(http.MethodGet, route, reader.id, reader.bearer, nil)
+		require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+		respBody, err := io.ReadAll(resp.Body)
+		require.Nil(s.T(), err)
+		var read stats.Org
+		require.Nil(s.T(), json.Unmarshal(respBody, &read))
+		require.Equal(s.T(), 1, read.Repositories)
+		require.Equal(s.T(), 3, read.Total.Code)
+		require.Equal(s.T(), rp.ID, read.Largest[0].ID)
+	}
+
+	// other orgs cannot see it exists
+	resp := s.do(http.MethodGet, route, otherOwner.ID,
+		s.newToken(otherOwner.ID, otherOwner.APISecret), nil)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+
+	// missing
+	resp = s.do(http.MethodGet, OrgRoute+"/"+uuid.NewString()+StatsPath, s.srv.ST.RootUser, s.token.Bearer, nil)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+}
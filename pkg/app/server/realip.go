@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RealIP is a middleware that sets the request RemoteAddr to the client
+// named by the X-Forwarded-For or X-Real-IP headers, but only for
+// requests from a trusted proxy; from other peers those headers are
+// spoofable, so the peer address is kept
+//
+// X-Forwarded-For is read from the right, skipping trusted proxies, as
+// the client may have prepended its own entries
+func RealIP(trusted []*net.IPNet) func(http.Handler) http.Handler {
+	isTrusted := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return false
+		}
+		for _, n := range trusted {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if len(trusted) != 0 && isTrusted(remoteAddr(r)) {
+				if client := forwardedFor(r, isTrusted); len(client) != 0 {
+					r.RemoteAddr = client
+				}
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// forwardedFor returns the client address a trusted proxy forwarded r
+// for, or "" if there is none
+func forwardedFor(r *http.Request, isTrusted func(string) bool) string {
+	hops := []string{}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			return ""
+		}
+		if !isTrusted(hop) {
+			return hop
+		}
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return ""
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRealIP(t *testing.T) {
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	require.Nil(t, err)
+
+	for _, tc := range []struct {
+		trusted []*net.IPNet
+		peer    string
+		headers map[string]string
+		want    string
+	}{
+		// untrusted peers are not believed
+		{nil, "203.0.113.1:1000", map[string]string{"X-Real-IP": "198.51.100.1"}, "203.0.113.1:1000"},
+		{[]*net.IPNet{proxies}, "203.0.113.1:1000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.1:1000"},
+		// trusted proxies are skipped from the right
+		{[]*net.IPNet{proxies}, "10.0.0.1:1000", map[string]string{"X-Forwarded-For": "192.0.2.9, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{[]*net.IPNet{proxies}, "10.0.0.1:1000", map[string]string{"X-Real-IP": "198.51.100.1"}, "198.51.100.1"},
+		// garbage is not an address
+		{[]*net.IPNet{proxies}, "10.0.0.1:1000", map[string]string{"X-Forwarded-For": "x"}, "10.0.0.1:1000"},
+	} {
+		var got string
+		h := RealIP(tc.trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r.RemoteAddr
+		}))
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.peer
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		require.Equal(t, tc.want, got, tc.headers)
+	}
+}
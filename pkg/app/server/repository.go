@@ -0,0 +1,529 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/grokloc/grokloc-server/pkg/app/analysis"
+	"github.com/grokloc/grokloc-server/pkg/app/contribution"
+	"github.com/grokloc/grokloc-server/pkg/app/job"
+	"github.com/grokloc/grokloc-server/pkg/app/mirror"
+	"github.com/grokloc/grokloc-server/pkg/app/repository"
+	"github.com/grokloc/grokloc-server/pkg/app/repository/events"
+	"github.com/grokloc/grokloc-server/pkg/git"
+	"github.com/grokloc/grokloc-server/pkg/models"
+	"go.uber.org/zap"
+)
+
+func (srv *Instance) CreateRepository(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	authLevel, ok := ctx.Value(authLevelCtxKey).(int)
+	if !ok {
+		panic("auth missing")
+	}
+
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var event events.Create
+	err = json.Unmarshal(body, &event)
+	if err != nil {
+		http.Error(w, "malformed repository create event", http.StatusBadRequest)
+		return
+	}
+
+	if (authLevel == AuthOrg && session.Org.ID != event.Org) ||
+		(authLevel == AuthUser) {
+		// caller was either org owner (but not for org of prospective
+		// repository), or was just a regular user
+		http.Error(w, "auth inadequate", http.StatusForbidden)
+		return
+	}
+
+	rp, err := srv.RepositoryController.Create(ctx, event)
+	if err != nil {
+		if err == models.ErrConflict {
+			http.Error(w, "duplicate repository args", http.StatusConflict)
+			return
+		}
+		if err == models.ErrRelatedOrg || err == models.ErrDisallowedValue {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sugar.Debugw("insert repository",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	bs, err := json.Marshal(rp)
+	if err != nil {
+		sugar.Debugw("marshal repository json",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("location", RepositoryRoute+"/"+rp.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_, err = w.Write(bs)
+	if err != nil {
+		sugar.Debugw("write http output",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// readVisibleRepository reads the repository with id if the session can
+// see it: root sees all repositories, everyone else sees those in their org
+//
+// Repositories that are not visible are reported as sql.ErrNoRows so as to
+// not leak their existence
+func (srv *Instance) readVisibleRepository(ctx context.Context, authLevel int, session Session, id string) (*repository.Repository, error) {
+	rp, err := srv.RepositoryController.Read(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if authLevel == AuthRoot || session.Org.ID == rp.Org {
+		return rp, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+// writeJSON writes v as json
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	bs, err := json.Marshal(v)
+	if err != nil {
+		sugar.Debugw("marshal json",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(bs)
+	if err != nil {
+		sugar.Debugw("write http output",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ListRepositories lists the repositories in the caller's org
+func (srv *Instance) ListRepositories(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	rps, err := srv.RepositoryController.ReadOrg(ctx, session.Org.ID)
+	if err != nil {
+		sugar.Debugw("read org repositories",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, rps)
+}
+
+func (srv *Instance) ReadRepository(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	authLevel, ok := ctx.Value(authLevelCtxKey).(int)
+	if !ok {
+		panic("auth missing")
+	}
+
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	rp, err := srv.readVisibleRepository(ctx, authLevel, session, chi.URLParam(r, IDParam))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("read repository",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, rp)
+}
+
+func (srv *Instance) UpdateRepository(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	authLevel, ok := ctx.Value(authLevelCtxKey).(int)
+	if !ok {
+		panic("auth missing")
+	}
+
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	id := chi.URLParam(r, IDParam)
+
+	_, err := srv.readVisibleRepository(ctx, authLevel, session, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("read repository",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// org members can see, but not change, repositories
+	if authLevel == AuthUser {
+		http.Error(w, "auth inadequate", http.StatusForbidden)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// the body is either an UpdateUpstream or an UpdateStatus event,
+	// distinguished by which field is present
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(body, &fields)
+	if err != nil {
+		http.Error(w, "malformed repository update event", http.StatusBadRequest)
+		return
+	}
+	_, hasUpstream := fields["upstream"]
+	_, hasStatus := fields["status"]
+	if hasUpstream == hasStatus {
+		http.Error(w, "malformed repository update event", http.StatusBadRequest)
+		return
+	}
+
+	var rp *repository.Repository
+	if hasUpstream {
+		var event events.UpdateUpstream
+		err = json.Unmarshal(body, &event)
+		if err != nil || event.ID != id {
+			http.Error(w, "malformed repository upstream event", http.StatusBadRequest)
+			return
+		}
+		rp, err = srv.RepositoryController.UpdateUpstream(ctx, event)
+	} else {
+		var event events.UpdateStatus
+		err = json.Unmarshal(body, &event)
+		if err != nil || event.ID != id {
+			http.Error(w, "malformed repository status event", http.StatusBadRequest)
+			return
+		}
+		rp, err = srv.RepositoryController.UpdateStatus(ctx, event)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows || err == models.ErrNotFound {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err == models.ErrDisallowedValue {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sugar.Debugw("update repository",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, rp)
+}
+
+// ReadAnalysis returns the analysis of a visible repository at the commit
+// named by the commit query parameter, or the latest analysis if absent
+func (srv *Instance) ReadAnalysis(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	authLevel, ok := ctx.Value(authLevelCtxKey).(int)
+	if !ok {
+		panic("auth missing")
+	}
+
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	rp, err := srv.readVisibleRepository(ctx, authLevel, session, chi.URLParam(r, IDParam))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("read repository",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var a *analysis.Analysis
+	rev := r.URL.Query().Get(CommitParam)
+	if len(rev) == 0 {
+		a, err = analysis.Latest(ctx, rp.ID, srv.ST.RandomReplica())
+	} else {
+		// revisions are resolved in the mirror, so branch names and
+		// abbreviated hashes can be used
+		var commit string
+		commit, err = git.ResolveCommit(ctx, rp.Path, rev)
+		if err == git.ErrRevision {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			a, err = analysis.Read(ctx, rp.ID, commit, srv.ST.RandomReplica())
+		}
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("read analysis",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, a)
+}
+
+// ReadHistory returns the stored line count history of a visible
+// repository, oldest first
+func (srv *Instance) ReadHistory(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	authLevel, ok := ctx.Value(authLevelCtxKey).(int)
+	if !ok {
+		panic("auth missing")
+	}
+
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	rp, err := srv.readVisibleRepository(ctx, authLevel, session, chi.URLParam(r, IDParam))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("read repository",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	points, err := analysis.ReadHistory(ctx, rp.ID, srv.ST.RandomReplica())
+	if err != nil {
+		sugar.Debugw("read history",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, points)
+}
+
+// ReadContributions returns the per-author contributions to a visible
+// repository for the window given by the since and until query
+// parameters, either of which may be absent
+func (srv *Instance) ReadContributions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	authLevel, ok := ctx.Value(authLevelCtxKey).(int)
+	if !ok {
+		panic("auth missing")
+	}
+
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	var window [2]int64
+	for i, param := range []string{SinceParam, UntilParam} {
+		v := r.URL.Query().Get(param)
+		if len(v) == 0 {
+			continue
+		}
+		t, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || t < 0 {
+			http.Error(w, "malformed "+param, http.StatusBadRequest)
+			return
+		}
+		window[i] = t
+	}
+
+	rp, err := srv.readVisibleRepository(ctx, authLevel, session, chi.URLParam(r, IDParam))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("read repository",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	contributions, err := contribution.Read(ctx, rp, window[0], window[1], srv.ST.DBKeys, srv.ST.DigestKey, srv.ST.RandomReplica())
+	if err != nil {
+		sugar.Debugw("read contributions",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, contributions)
+}
+
+// SyncRepository enqueues a job to sync and analyze a visible
+// repository now, rather than at the next mirror interval
+//
+// The job is returned with its location under JobRoute
+func (srv *Instance) SyncRepository(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	authLevel, ok := ctx.Value(authLevelCtxKey).(int)
+	if !ok {
+		panic("auth missing")
+	}
+
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	rp, err := srv.readVisibleRepository(ctx, authLevel, session, chi.URLParam(r, IDParam))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("read repository",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// org members can see, but not sync, repositories
+	if authLevel == AuthUser {
+		http.Error(w, "auth inadequate", http.StatusForbidden)
+		return
+	}
+
+	if rp.Meta.Status != models.StatusActive {
+		http.Error(w, "repository is not active", http.StatusConflict)
+		return
+	}
+
+	j, err := job.Enqueue(ctx, session.Org.ID, mirror.SyncKind,
+		mirror.SyncPayload{Repository: rp.ID}, srv.ST.Master)
+	if err != nil {
+		sugar.Debugw("enqueue sync",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	bs, err := json.Marshal(j)
+	if err != nil {
+		sugar.Debugw("marshal job json",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("location", JobRoute+"/"+j.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_, err = w.Write(bs)
+	if err != nil {
+		sugar.Debugw("write http output",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+}
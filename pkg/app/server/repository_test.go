@@ -0,0 +1,341 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app/analysis"
+	"github.com/grokloc/grokloc-server/pkg/app/contribution"
+	"github.com/grokloc/grokloc-server/pkg/app/mirror"
+	"github.com/grokloc/grokloc-server/pkg/app/repository"
+	repository_events "github.com/grokloc/grokloc-server/pkg/app/repository/events"
+	"github.com/grokloc/grokloc-server/pkg/git"
+	"github.com/grokloc/grokloc-server/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+// newRepository creates a repository in orgID
+func (s *AdminSuite) newRepository(orgID string) *repository.Repository {
+	rp, err := repository.Create(
+		s.ctx,
+		uuid.NewString(), // name
+		orgID,
+		"https://example.com/r.git",
+		s.srv.ST.RepositoryRoot,
+		s.srv.ST.Master,
+	)
+	require.Nil(s.T(), err)
+	return rp
+}
+
+func (s *AdminSuite) TestCreateRepository() {
+	o, owner := s.newOrg()
+	member := s.newUser(o.ID)
+	_, otherOwner := s.newOrg()
+
+	event := func(orgID string) []byte {
+		return []byte(fmt.Sprintf(`{"name":"%s","org":"%s","upstream":"https://example.com/r.git"}`,
+			uuid.NewString(), orgID))
+	}
+
+	// root creates in any org
+	resp := s.do(http.MethodPost, RepositoryRoute, s.srv.ST.RootUser, s.token.Bearer, event(o.ID))
+	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
+	require.NotEmpty(s.T(), resp.Header.Get("location"))
+
+	// owners create in their own org
+	ownerBearer := s.newToken(owner.ID, owner.APISecret)
+	bs := event(o.ID)
+	resp = s.do(http.MethodPost, RepositoryRoute, owner.ID, ownerBearer, bs)
+	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
+
+	// duplicate
+	resp = s.do(http.MethodPost, RepositoryRoute, owner.ID, ownerBearer, bs)
+	require.Equal(s.T(), http.StatusConflict, resp.StatusCode)
+
+	// but not in other orgs
+	resp = s.do(http.MethodPost, RepositoryRoute, otherOwner.ID,
+		s.newToken(otherOwner.ID, otherOwner.APISecret), event(o.ID))
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// members cannot create
+	resp = s.do(http.MethodPost, RepositoryRoute, member.ID,
+		s.newToken(member.ID, member.APISecret), event(o.ID))
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// org must exist
+	resp = s.do(http.MethodPost, RepositoryRoute, s.srv.ST.RootUser, s.token.Bearer, event(uuid.NewString()))
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+
+	// upstream must be a url
+	resp = s.do(http.MethodPost, RepositoryRoute, s.srv.ST.RootUser, s.token.Bearer,
+		[]byte(fmt.Sprintf(`{"name":"n","org":"%s","upstream":"-x"}`, o.ID)))
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+
+	// and not a local address, nor other than https
+	for _, upstream := range []string{"https://127.0.0.1/r.git", "https://10.0.0.1/r.git", "ssh://git@example.com/r.git"} {
+		resp = s.do(http.MethodPost, RepositoryRoute, s.srv.ST.RootUser, s.token.Bearer,
+			[]byte(fmt.Sprintf(`{"name":"%s","org":"%s","upstream":"%s"}`, uuid.NewString(), o.ID, upstream)))
+		require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// nor a local path, where not allowed
+	s.srv.ST.AllowFileUpstreams = false
+	resp = s.do(http.MethodPost, RepositoryRoute, s.srv.ST.RootUser, s.token.Bearer,
+		[]byte(fmt.Sprintf(`{"name":"%s","org":"%s","upstream":"file:///srv/git/r.git"}`, uuid.NewString(), o.ID)))
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+}
+
+func (s *AdminSuite) TestRepositoryPathHidden() {
+	o, _ := s.newOrg()
+	rp := s.newRepository(o.ID)
+	resp := s.do(http.MethodGet, RepositoryRoute+"/"+rp.ID, s.srv.ST.RootUser, s.token.Bearer, nil)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	var fields map[string]interface{}
+	require.Nil(s.T(), json.NewDecoder(resp.Body).Decode(&fields))
+	require.Equal(s.T(), rp.ID, fields["id"])
+	require.NotContains(s.T(), fields, "path")
+}
+
+func (s *AdminSuite) TestReadRepository() {
+	o, _ := s.newOrg()
+	member := s.newUser(o.ID)
+	_, otherOwner := s.newOrg()
+	rp := s.newRepository(o.ID)
+	route := RepositoryRoute + "/" + rp.ID
+
+	// members and root can read
+	for _, reader := range []struct{ id, bearer string }{
+		{member.ID, s.newToken(member.ID, member.APISecret)},
+		{s.srv.ST.RootUser, s.token.Bearer},
+	} {
+		resp := s.do(http.MethodGet, route, reader.id, reader.bearer, nil)
+		require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+		respBody, err := io.ReadAll(resp.Body)
+		require.Nil(s.T(), err)
+		var read repository.Repository
+		require.Nil(s.T(), json.Unmarshal(respBody, &read))
+		require.Equal(s.T(), rp.Name, read.Name)
+	}
+
+	// other orgs cannot see it exists
+	resp := s.do(http.MethodGet, route, otherOwner.ID,
+		s.newToken(otherOwner.ID, otherOwner.APISecret), nil)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+
+	// missing
+	resp = s.do(http.MethodGet, RepositoryRoute+"/"+uuid.NewString(), s.srv.ST.RootUser, s.token.Bearer, nil)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+}
+
+func (s *AdminSuite) TestListRepositories() {
+	o, _ := s.newOrg()
+	member := s.newUser(o.ID)
+	otherOrg, _ := s.newOrg()
+	rp := s.newRepository(o.ID)
+	_ = s.newRepository(otherOrg.ID)
+
+	resp := s.do(http.MethodGet, RepositoryRoute, member.ID, s.newToken(member.ID, member.APISecret), nil)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	respBody, err := io.ReadAll(resp.Body)
+	require.Nil(s.T(), err)
+	var rps []repository.Repository
+	require.Nil(s.T(), json.Unmarshal(respBody, &rps))
+	require.Equal(s.T(), 1, len(rps))
+	require.Equal(s.T(), rp.ID, rps[0].ID)
+}
+
+func (s *AdminSuite) TestUpdateRepository() {
+	o, owner := s.newOrg()
+	member := s.newUser(o.ID)
+	_, otherOwner := s.newOrg()
+	rp := s.newRepository(o.ID)
+	route := RepositoryRoute + "/" + rp.ID
+	ownerBearer := s.newToken(owner.ID, owner.APISecret)
+
+	upstream := "https://example.com/other.git"
+	bs, err := json.Marshal(repository_events.UpdateUpstream{ID: rp.ID, Upstream: upstream})
+	require.Nil(s.T(), err)
+
+	// members cannot update
+	resp := s.do(http.MethodPut, route, member.ID, s.newToken(member.ID, member.APISecret), bs)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// owners of other orgs cannot see it
+	resp = s.do(http.MethodPut, route, otherOwner.ID,
+		s.newToken(otherOwner.ID, otherOwner.APISecret), bs)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+
+	// more than one event
+	resp = s.do(http.MethodPut, route, owner.ID, ownerBearer,
+		[]byte(fmt.Sprintf(`{"id":"%s","upstream":"%s","status":3}`, rp.ID, upstream)))
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+
+	// owner sets upstream
+	resp = s.do(http.MethodPut, route, owner.ID, ownerBearer, bs)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	respBody, err := io.ReadAll(resp.Body)
+	require.Nil(s.T(), err)
+	var updated repository.Repository
+	require.Nil(s.T(), json.Unmarshal(respBody, &updated))
+	require.Equal(s.T(), upstream, updated.Upstream)
+
+	// root sets status
+	bs, err = json.Marshal(repository_events.UpdateStatus{ID: rp.ID, Status: models.StatusInactive})
+	require.Nil(s.T(), err)
+	resp = s.do(http.MethodPut, route, s.srv.ST.RootUser, s.token.Bearer, bs)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	read, err := repository.Read(s.ctx, rp.ID, s.srv.ST.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), models.StatusInactive, read.Meta.Status)
+}
+
+func (s *AdminSuite) TestReadAnalysis() {
+	o, _ := s.newOrg()
+	member := s.newUser(o.ID)
+	memberBearer := s.newToken(member.ID, member.APISecret)
+	_, otherOwner := s.newOrg()
+
+	// upstream with a single go file
+	dir := s.T().TempDir()
+	_, err := git.Output(s.ctx, "", "init", "--quiet", dir)
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0600))
+	_, err = git.Output(s.ctx, "", "-C", dir, "add", "main.go")
+	require.Nil(s.T(), err)
+	_, err = git.Output(s.ctx, "", "-C", dir,
+		"-c", "user.name=test", "-c", "user.email=test@localhost",
+		"commit", "--quiet", "-m", "c")
+	require.Nil(s.T(), err)
+
+	rp, err := repository.Create(
+		s.ctx,
+		uuid.NewString(), // name
+		o.ID,
+		"file://"+filepath.ToSlash(dir),
+		s.srv.ST.RepositoryRoot,
+		s.srv.ST.Master,
+	)
+	require.Nil(s.T(), err)
+	route := RepositoryRoute + "/" + rp.ID + AnalysisPath
+
+	// not yet mirrored or analyzed
+	resp := s.do(http.MethodGet, route, member.ID, memberBearer, nil)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+
+	m, err := mirror.Sync(s.ctx, rp, s.srv.ST.AllowFileUpstreams, s.srv.ST.Master)
+	require.Nil(s.T(), err)
+	_, err = analysis.Create(s.ctx, rp, m.Head, s.srv.ST.Master)
+	require.Nil(s.T(), err)
+
+	decode := func(resp *http.Response) *analysis.Analysis {
+		respBody, err := io.ReadAll(resp.Body)
+		require.Nil(s.T(), err)
+		var a analysis.Analysis
+		require.Nil(s.T(), json.Unmarshal(respBody, &a))
+		return &a
+	}
+
+	// latest
+	resp = s.do(http.MethodGet, route, member.ID, memberBearer, nil)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	a := decode(resp)
+	require.Equal(s.T(), m.Head, a.Commit)
+	require.Equal(s.T(), 1, a.Total.Code)
+
+	// by abbreviated commit
+	resp = s.do(http.MethodGet, route+"?"+CommitParam+"="+m.Head[:10], member.ID, memberBearer, nil)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	require.Equal(s.T(), m.Head, decode(resp).Commit)
+
+	// unknown revision
+	resp = s.do(http.MethodGet, route+"?"+CommitParam+"=nope", member.ID, memberBearer, nil)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+
+	// other orgs cannot see it exists
+	resp = s.do(http.MethodGet, route, otherOwner.ID,
+		s.newToken(otherOwner.ID, otherOwner.APISecret), nil)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+}
+
+func (s *AdminSuite) TestReadHistory() {
+	o, _ := s.newOrg()
+	member := s.newUser(o.ID)
+	memberBearer := s.newToken(member.ID, member.APISecret)
+	_, otherOwner := s.newOrg()
+	rp := s.newRepository(o.ID)
+	route := RepositoryRoute + "/" + rp.ID + HistoryPath
+
+	resp := s.do(http.MethodGet, route, member.ID, memberBearer, nil)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	respBody, err := io.ReadAll(resp.Body)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "[]", string(respBody))
+
+	points := []analysis.Point{
+		{Commit: strings.Repeat("b", 40), Committed: 2, Total: analysis.Counts{Code: 2},
+			Languages: []analysis.LanguageCounts{{Language: "Go", Files: 1, Counts: analysis.Counts{Code: 2}}}},
+		{Commit: strings.Repeat("a", 40), Committed: 1, Total: analysis.Counts{Code: 1},
+			Languages: []analysis.LanguageCounts{{Language: "Go", Files: 1, Counts: analysis.Counts{Code: 1}}}},
+	}
+	require.Nil(s.T(), analysis.InsertHistory(s.ctx, rp.ID, points, s.srv.ST.Master))
+
+	resp = s.do(http.MethodGet, route, member.ID, memberBearer, nil)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	respBody, err = io.ReadAll(resp.Body)
+	require.Nil(s.T(), err)
+	var read []analysis.Point
+	require.Nil(s.T(), json.Unmarshal(respBody, &read))
+	require.Equal(s.T(), []analysis.Point{points[1], points[0]}, read)
+
+	// other orgs cannot see it exists
+	resp = s.do(http.MethodGet, route, otherOwner.ID,
+		s.newToken(otherOwner.ID, otherOwner.APISecret), nil)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+}
+
+func (s *AdminSuite) TestReadContributions() {
+	o, _ := s.newOrg()
+	member := s.newUser(o.ID)
+	memberBearer := s.newToken(member.ID, member.APISecret)
+	rp := s.newRepository(o.ID)
+	route := RepositoryRoute + "/" + rp.ID + ContributionsPath
+
+	days := []contribution.Day{
+		{Email: member.ID + "@x", Day: 0, Commits: 1, Added: 1},
+		{Email: member.ID + "@x", Day: 86400, Commits: 2, Added: 2, Removed: 1},
+	}
+	require.Nil(s.T(), contribution.Insert(s.ctx, rp.ID, days, s.srv.ST.DBKeys, s.srv.ST.DigestKey, s.srv.ST.Master))
+
+	read := func(query string) []contribution.Contribution {
+		resp := s.do(http.MethodGet, route+query, member.ID, memberBearer, nil)
+		require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+		respBody, err := io.ReadAll(resp.Body)
+		require.Nil(s.T(), err)
+		var cs []contribution.Contribution
+		require.Nil(s.T(), json.Unmarshal(respBody, &cs))
+		return cs
+	}
+
+	cs := read("")
+	require.Equal(s.T(), 1, len(cs))
+	require.Equal(s.T(), member.ID+"@x", cs[0].Email)
+	require.Equal(s.T(), 3, cs[0].Commits)
+
+	cs = read("?" + SinceParam + "=86400")
+	require.Equal(s.T(), 2, cs[0].Commits)
+
+	cs = read("?" + UntilParam + "=86400")
+	require.Equal(s.T(), 1, cs[0].Commits)
+
+	require.Empty(s.T(), read("?"+SinceParam+"=172800"))
+
+	resp := s.do(http.MethodGet, route+"?"+SinceParam+"=yesterday", member.ID, memberBearer, nil)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+}
@@ -1,26 +1,44 @@
 package server
 
 import (
+	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/grokloc/grokloc-server/pkg/app/jwt"
 )
 
 // path/route constants
 const (
-	APIPath    = "/api/" + Version
-	TokenRoute = APIPath + "/token"
-
-	OkPath      = "/ok"
-	OkRoute     = APIPath + OkPath
-	OrgPath     = "/org"
-	OrgRoute    = APIPath + OrgPath
-	StatusPath  = "/status"
-	StatusRoute = APIPath + StatusPath // auth + Ok
-	UserPath    = "/user"
-	UserRoute   = APIPath + UserPath
+	APIPath       = "/api/" + Version
+	TokenRoute    = APIPath + "/token"
+	LoginRoute    = APIPath + "/login"
+	RefreshRoute  = APIPath + "/refresh"
+	LogoutRoute   = APIPath + "/logout"
+	TokenKeyRoute = APIPath + "/token_key"
+
+	AnalysisPath      = "/analysis"      // under RepositoryRoute/{id}
+	APISecretPath     = "/api_secret"    // under UserRoute/{id}
+	ContributionsPath = "/contributions" // under RepositoryRoute/{id}
+	HistoryPath       = "/history"       // under RepositoryRoute/{id}
+	JobPath           = "/job"
+	JobRoute          = APIPath + JobPath
+	MetricsPath       = "/metrics"
+	MetricsRoute      = APIPath + MetricsPath // expvar json
+	OkPath            = "/ok"
+	OkRoute           = APIPath + OkPath
+	OrgPath           = "/org"
+	OrgRoute          = APIPath + OrgPath
+	RepositoryPath    = "/repository"
+	RepositoryRoute   = APIPath + RepositoryPath
+	StatsPath         = "/stats" // under OrgRoute/{id}
+	StatusPath        = "/status"
+	StatusRoute       = APIPath + StatusPath // auth + Ok
+	SyncPath          = "/sync"              // under RepositoryRoute/{id}
+	UserPath          = "/user"
+	UserRoute         = APIPath + UserPath
 )
 
 // URL parameter names
@@ -28,14 +46,24 @@ const (
 	IDParam = "id"
 )
 
+// URL query parameter names
+const (
+	CommitParam = "commit"
+	SinceParam  = "since" // unix time
+	UntilParam  = "until" // unix time
+)
+
 // Router provides API route handlers
+//
+// Routes behind WithToken that read or change a resource also require
+// the corresponding token scope
 func (srv *Instance) Router() *chi.Mux {
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	r.Use(RealIP(srv.Config.TrustedProxyNets()))
 	r.Use(srv.RequestLogger)
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.Timeout(5 * time.Second))
+	r.Use(middleware.Timeout(time.Duration(srv.Config.RequestTimeout)))
 
 	r.Get(OkRoute, Ok)
 
@@ -44,26 +72,63 @@ func (srv *Instance) Router() *chi.Mux {
 		r.Put("/", srv.NewToken)
 	})
 
+	r.Post(LoginRoute, srv.Login)
+	r.Post(RefreshRoute, srv.Refresh)
+
+	r.Route(LogoutRoute, func(r chi.Router) {
+		r.Use(srv.WithSession)
+		r.Use(srv.WithToken)
+		r.Post("/", srv.Logout)
+	})
+
+	r.Route(TokenKeyRoute, func(r chi.Router) {
+		r.Use(srv.WithSession)
+		r.Use(srv.WithToken)
+		r.With(srv.RequireScope(jwt.ScopeAll)).Post("/", srv.PromoteTokenKey)
+	})
+
 	r.Route(APIPath, func(r chi.Router) {
 		r.Use(srv.WithSession)
 		r.Use(srv.WithToken)
 		r.Get(StatusPath, Ok)
+		r.Get(MetricsPath, srv.Metrics)
 	})
 
 	r.Route(OrgRoute, func(r chi.Router) {
 		r.Use(srv.WithSession)
 		r.Use(srv.WithToken)
-		r.Post("/", srv.CreateOrg)
-		//r.Get(fmt.Sprintf("/{%s}", IDParam), srv.ReadOrg)
-		//r.Put(fmt.Sprintf("/{%s}", IDParam), srv.UpdateOrg)
+		r.With(srv.RequireScope(jwt.ScopeOrgWrite)).Post("/", srv.CreateOrg)
+		r.With(srv.RequireScope(jwt.ScopeOrgRead)).Get(fmt.Sprintf("/{%s}", IDParam), srv.ReadOrg)
+		r.With(srv.RequireScope(jwt.ScopeOrgWrite)).Put(fmt.Sprintf("/{%s}", IDParam), srv.UpdateOrg)
+		r.With(srv.RequireScope(jwt.ScopeOrgRead)).Get(fmt.Sprintf("/{%s}%s", IDParam, StatsPath), srv.ReadOrgStats)
 	})
 
 	r.Route(UserRoute, func(r chi.Router) {
 		r.Use(srv.WithSession)
 		r.Use(srv.WithToken)
-		r.Post("/", srv.CreateUser)
-		//r.Get(fmt.Sprintf("/{%s}", IDParam), srv.ReadUser)
-		//r.Put(fmt.Sprintf("/{%s}", IDParam), srv.UpdateUser)
+		r.With(srv.RequireScope(jwt.ScopeUserWrite)).Post("/", srv.CreateUser)
+		r.With(srv.RequireScope(jwt.ScopeUserRead)).Get(fmt.Sprintf("/{%s}", IDParam), srv.ReadUser)
+		r.With(srv.RequireScope(jwt.ScopeUserWrite)).Put(fmt.Sprintf("/{%s}", IDParam), srv.UpdateUser)
+		r.With(srv.RequireScope(jwt.ScopeUserWrite)).Post(fmt.Sprintf("/{%s}%s", IDParam, APISecretPath), srv.RotateAPISecret)
+	})
+
+	r.Route(RepositoryRoute, func(r chi.Router) {
+		r.Use(srv.WithSession)
+		r.Use(srv.WithToken)
+		r.With(srv.RequireScope(jwt.ScopeRepositoryWrite)).Post("/", srv.CreateRepository)
+		r.With(srv.RequireScope(jwt.ScopeRepositoryRead)).Get("/", srv.ListRepositories)
+		r.With(srv.RequireScope(jwt.ScopeRepositoryRead)).Get(fmt.Sprintf("/{%s}", IDParam), srv.ReadRepository)
+		r.With(srv.RequireScope(jwt.ScopeRepositoryWrite)).Put(fmt.Sprintf("/{%s}", IDParam), srv.UpdateRepository)
+		r.With(srv.RequireScope(jwt.ScopeRepositoryRead)).Get(fmt.Sprintf("/{%s}%s", IDParam, AnalysisPath), srv.ReadAnalysis)
+		r.With(srv.RequireScope(jwt.ScopeRepositoryRead)).Get(fmt.Sprintf("/{%s}%s", IDParam, HistoryPath), srv.ReadHistory)
+		r.With(srv.RequireScope(jwt.ScopeRepositoryRead)).Get(fmt.Sprintf("/{%s}%s", IDParam, ContributionsPath), srv.ReadContributions)
+		r.With(srv.RequireScope(jwt.ScopeRepositoryWrite)).Post(fmt.Sprintf("/{%s}%s", IDParam, SyncPath), srv.SyncRepository)
+	})
+
+	r.Route(JobRoute, func(r chi.Router) {
+		r.Use(srv.WithSession)
+		r.Use(srv.WithToken)
+		r.With(srv.RequireScope(jwt.ScopeJobRead)).Get(fmt.Sprintf("/{%s}", IDParam), srv.ReadJob)
 	})
 
 	return r
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	org_events "github.com/grokloc/grokloc-server/pkg/app/admin/org/events"
+	user_events "github.com/grokloc/grokloc-server/pkg/app/admin/user/events"
+	"github.com/grokloc/grokloc-server/pkg/app/jwt"
+	"github.com/grokloc/grokloc-server/pkg/security"
+	"github.com/stretchr/testify/require"
+)
+
+// readOnly is every read scope, in the order ParseScope returns
+var readOnly = strings.Join([]string{
+	jwt.ScopeJobRead,
+	jwt.ScopeOrgRead,
+	jwt.ScopeRepositoryRead,
+	jwt.ScopeUserRead,
+}, " ")
+
+func (s *AdminSuite) TestReadOnlyScope() {
+	o, owner := s.newOrg()
+	root := s.newScopedSession(s.srv.ST.RootUser, s.srv.ST.RootUserAPISecret, readOnly)
+	require.Equal(s.T(), readOnly, root.Scope)
+
+	// cannot create orgs
+	password, err := security.DerivePassword(uuid.NewString(), s.srv.ST.Argon2Cfg)
+	require.Nil(s.T(), err)
+	createOrg, err := org_events.NewCreate(
+		s.ctx,
+		uuid.NewString(), // name
+		uuid.NewString(), // owner display name
+		uuid.NewString(), // owner email
+		password,
+	)
+	require.Nil(s.T(), err)
+	bs, err := json.Marshal(createOrg)
+	require.Nil(s.T(), err)
+	resp := s.do(http.MethodPost, OrgRoute, s.srv.ST.RootUser, root.Bearer, bs)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// cannot create users
+	createUser, err := user_events.NewCreate(
+		s.ctx,
+		uuid.NewString(), // display name
+		uuid.NewString(), // email
+		o.ID,
+		password,
+	)
+	require.Nil(s.T(), err)
+	bs, err = json.Marshal(createUser)
+	require.Nil(s.T(), err)
+	resp = s.do(http.MethodPost, UserRoute, s.srv.ST.RootUser, root.Bearer, bs)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// the org owner is likewise limited
+	tok := s.newScopedSession(owner.ID, owner.APISecret, readOnly)
+	resp = s.do(http.MethodPost, UserRoute, owner.ID, tok.Bearer, bs)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// but can read
+	resp = s.do(http.MethodGet, OrgRoute+"/"+o.ID, s.srv.ST.RootUser, root.Bearer, nil)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	resp = s.do(http.MethodGet, UserRoute+"/"+owner.ID, owner.ID, tok.Bearer, nil)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// refreshed tokens keep the scope
+	status, refreshed := s.refresh(tok.Refresh)
+	require.Equal(s.T(), http.StatusOK, status)
+	require.Equal(s.T(), readOnly, refreshed.Scope)
+	resp = s.do(http.MethodPost, UserRoute, owner.ID, refreshed.Bearer, bs)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// the default scope can do both
+	resp = s.do(http.MethodPost, UserRoute, owner.ID, s.newToken(owner.ID, owner.APISecret), bs)
+	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
+}
+
+func (s *AdminSuite) TestWriteScopeGrantsRead() {
+	o, owner := s.newOrg()
+	tok := s.newScopedSession(owner.ID, owner.APISecret, jwt.ScopeOrgWrite)
+	resp := s.do(http.MethodGet, OrgRoute+"/"+o.ID, owner.ID, tok.Bearer, nil)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// other resources are out of scope
+	resp = s.do(http.MethodGet, UserRoute+"/"+owner.ID, owner.ID, tok.Bearer, nil)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// but the token is still valid for routes needing no scope
+	resp = s.do(http.MethodGet, StatusRoute, owner.ID, tok.Bearer, nil)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+}
+
+func (s *AdminSuite) TestUnknownScope() {
+	req, err := http.NewRequest(http.MethodPut, s.ts.URL+TokenRoute, nil)
+	require.Nil(s.T(), err)
+	req.Header.Add(IDHeader, s.srv.ST.RootUser)
+	req.Header.Add(TokenRequestHeader, security.EncodedSHA256(s.srv.ST.RootUser+s.srv.ST.RootUserAPISecret))
+	req.Header.Add(ScopeHeader, jwt.ScopeOrgRead+" "+uuid.NewString())
+	resp, err := s.c.Do(req)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+}
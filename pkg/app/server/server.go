@@ -5,11 +5,16 @@ import (
 	"context"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/grokloc/grokloc-server/pkg/app"
 	"github.com/grokloc/grokloc-server/pkg/app/admin/org"
 	"github.com/grokloc/grokloc-server/pkg/app/admin/user"
+	"github.com/grokloc/grokloc-server/pkg/app/config"
+	"github.com/grokloc/grokloc-server/pkg/app/repository"
 	"github.com/grokloc/grokloc-server/pkg/app/state"
+	"github.com/grokloc/grokloc-server/pkg/app/tokenkey"
 	"github.com/grokloc/grokloc-server/pkg/env"
+	"github.com/grokloc/grokloc-server/pkg/security"
 )
 
 // Version is the current API version
@@ -17,9 +22,11 @@ const Version = "v0"
 
 // API headers
 // TokenRequest is formatted as security.EncodedSHA256(id+api-secret)
+// Scope is an optional space-separated list of jwt scopes for the token
 const (
 	IDHeader           = "X-GrokLOC-ID"
 	TokenRequestHeader = "X-GrokLOC-TokenRequest"
+	ScopeHeader        = "X-GrokLOC-Scope"
 )
 
 // Auth levels to be found in ctx with key authLevelCtxKey
@@ -38,19 +45,38 @@ type contextKey struct {
 var (
 	sessionCtxKey   = &contextKey{"session"}   // nolint
 	authLevelCtxKey = &contextKey{"authlevel"} // nolint
+	familyCtxKey    = &contextKey{"family"}    // nolint
+	claimsCtxKey    = &contextKey{"claims"}    // nolint
 )
 
 // Instance is a single app server
 type Instance struct {
-	ST             *app.State
-	Started        time.Time
-	OrgController  *org.Controller
-	UserController *user.Controller
+	Config               *config.Config
+	ST                   *app.State
+	Started              time.Time
+	OrgController        *org.Controller
+	UserController       *user.Controller
+	RepositoryController *repository.Controller
+	// dummyPassword is verified against for logins to unknown emails, so
+	// they take as long as logins to known ones
+	dummyPassword string
+	// tokenKeys caches the token signing keys
+	tokenKeys tokenkey.Cache
 }
 
-// New creates a new app server Instance
+// New creates a new app server Instance, with config loaded from
+// the environment
 func New(level env.Level) (*Instance, error) {
-	st, err := state.New(level)
+	cfg, err := config.Load(level)
+	if err != nil {
+		return nil, err
+	}
+	return NewFromConfig(cfg)
+}
+
+// NewFromConfig creates a new app server Instance for cfg
+func NewFromConfig(cfg *config.Config) (*Instance, error) {
+	st, err := state.FromConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -62,10 +88,21 @@ func New(level env.Level) (*Instance, error) {
 	if err != nil {
 		return nil, err
 	}
+	rc, err := repository.NewController(context.Background(), st)
+	if err != nil {
+		return nil, err
+	}
+	dummyPassword, err := security.DerivePassword(uuid.NewString(), st.Argon2Cfg)
+	if err != nil {
+		return nil, err
+	}
 	return &Instance{
-		ST:             st,
-		Started:        time.Now(),
-		OrgController:  oc,
-		UserController: uc,
+		Config:               cfg,
+		ST:                   st,
+		Started:              time.Now(),
+		OrgController:        oc,
+		UserController:       uc,
+		RepositoryController: rc,
+		dummyPassword:        dummyPassword,
 	}, nil
 }
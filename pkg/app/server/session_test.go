@@ -101,7 +101,7 @@ func (s *SessionSuite) TestFoundAndActiveOwner() {
 		uuid.NewString(), // org owner display name
 		uuid.NewString(), // org owner email
 		ownerPassword,
-		s.srv.ST.DBKey,
+		s.srv.ST.DBKeys,
 		s.srv.ST.Master,
 	)
 	require.Nil(s.T(), err)
@@ -109,7 +109,7 @@ func (s *SessionSuite) TestFoundAndActiveOwner() {
 	owner, err := user.Read(
 		s.ctx,
 		o.Owner,
-		s.srv.ST.DBKey,
+		s.srv.ST.DBKeys,
 		s.srv.ST.RandomReplica(),
 	)
 	require.Nil(s.T(), err)
@@ -136,7 +136,7 @@ func (s *SessionSuite) TestFoundAndActiveUser() {
 		uuid.NewString(), // org owner display name
 		uuid.NewString(), // org owner email
 		ownerPassword,
-		s.srv.ST.DBKey,
+		s.srv.ST.DBKeys,
 		s.srv.ST.Master,
 	)
 	require.Nil(s.T(), err)
@@ -149,7 +149,7 @@ func (s *SessionSuite) TestFoundAndActiveUser() {
 		uuid.NewString(),
 		o.ID,
 		password,
-		s.srv.ST.DBKey,
+		s.srv.ST.DBKeys,
 	)
 	require.Nil(s.T(), err)
 
@@ -187,7 +187,7 @@ func (s *SessionSuite) TestUserInactive() {
 		uuid.NewString(), // org owner display name
 		uuid.NewString(), // org owner email
 		ownerPassword,
-		s.srv.ST.DBKey,
+		s.srv.ST.DBKeys,
 		s.srv.ST.Master,
 	)
 	require.Nil(s.T(), err)
@@ -195,7 +195,7 @@ func (s *SessionSuite) TestUserInactive() {
 	u, err := user.Read(
 		s.ctx,
 		o.Owner,
-		s.srv.ST.DBKey,
+		s.srv.ST.DBKeys,
 		s.srv.ST.RandomReplica(),
 	)
 	require.Nil(s.T(), err)
@@ -220,7 +220,7 @@ func (s *SessionSuite) TestOrgInactive() {
 		uuid.NewString(), // org owner display name
 		uuid.NewString(), // org owner email
 		ownerPassword,
-		s.srv.ST.DBKey,
+		s.srv.ST.DBKeys,
 		s.srv.ST.Master,
 	)
 	require.Nil(s.T(), err)
@@ -228,7 +228,7 @@ func (s *SessionSuite) TestOrgInactive() {
 	u, err := user.Read(
 		s.ctx,
 		o.Owner,
-		s.srv.ST.DBKey,
+		s.srv.ST.DBKeys,
 		s.srv.ST.RandomReplica(),
 	)
 	require.Nil(s.T(), err)
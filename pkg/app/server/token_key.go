@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/grokloc/grokloc-server/pkg/app/tokenkey"
+	"github.com/grokloc/grokloc-server/pkg/models"
+	"go.uber.org/zap"
+)
+
+// PromoteTokenKey is the body of a token key promotion
+//
+// Tokens signed with the replaced key continue to verify for Grace
+// seconds
+type PromoteTokenKey struct {
+	Grace int64 `json:"grace"`
+}
+
+// PromoteTokenKey makes a new token signing key current, returning its
+// id; root only
+func (srv *Instance) PromoteTokenKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	authLevel, ok := ctx.Value(authLevelCtxKey).(int)
+	if !ok {
+		panic("auth missing")
+	}
+	if authLevel != AuthRoot {
+		http.Error(w, "auth inadequate", http.StatusForbidden)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var promote PromoteTokenKey
+	err = json.Unmarshal(body, &promote)
+	if err != nil {
+		http.Error(w, "malformed token key promotion", http.StatusBadRequest)
+		return
+	}
+
+	k, err := tokenkey.Promote(ctx, promote.Grace, srv.ST)
+	if err != nil {
+		if err == models.ErrDisallowedValue {
+			http.Error(w, "grace out of range", http.StatusBadRequest)
+			return
+		}
+		sugar.Debugw("promote token key",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// other servers see the key when their caches expire, or when they
+	// are first sent a token it signed
+	srv.tokenKeys.Invalidate()
+
+	writeJSON(w, r, k)
+}
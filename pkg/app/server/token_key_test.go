@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+
+	jwt_go "github.com/dgrijalva/jwt-go"
+	"github.com/grokloc/grokloc-server/pkg/app/config"
+	"github.com/grokloc/grokloc-server/pkg/app/jwt"
+	"github.com/grokloc/grokloc-server/pkg/app/tokenkey"
+	"github.com/grokloc/grokloc-server/pkg/env"
+	"github.com/grokloc/grokloc-server/pkg/security"
+	"github.com/stretchr/testify/require"
+)
+
+// isolate replaces the suite instance with one that has its own db,
+// for tests with changes that would affect every instance using the
+// shared unit db
+func (s *AdminSuite) isolate() {
+	cfg := config.Default(env.Unit)
+	cfg.MasterDSN = fmt.Sprintf("file:%s", filepath.Join(s.T().TempDir(), "master.db"))
+	srv, err := NewFromConfig(cfg)
+	require.Nil(s.T(), err)
+	ts := httptest.NewServer(srv.Router())
+	s.T().Cleanup(func() {
+		ts.Close()
+		_ = srv.ST.Close()
+	})
+	s.srv, s.ts = srv, ts
+}
+
+// promote promotes a new token key with grace as the root user
+func (s *AdminSuite) promote(bearer string, grace int64) (int, *jwt.SigningKey) {
+	bs, err := json.Marshal(PromoteTokenKey{Grace: grace})
+	require.Nil(s.T(), err)
+	resp := s.do(http.MethodPost, TokenKeyRoute, s.srv.ST.RootUser, bearer, bs)
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	require.Nil(s.T(), err)
+	var k jwt.SigningKey
+	require.Nil(s.T(), json.Unmarshal(respBody, &k))
+	return resp.StatusCode, &k
+}
+
+// keyID returns the key id in the header of the token
+func (s *AdminSuite) keyID(bearer string) string {
+	token, _, err := new(jwt_go.Parser).ParseUnverified(bearer, &jwt.Claims{})
+	require.Nil(s.T(), err)
+	kid, _ := token.Header[jwt.KeyIDHeader].(string)
+	return kid
+}
+
+func (s *AdminSuite) TestPromoteTokenKey() {
+	s.isolate()
+	route := OrgRoute + "/" + s.srv.ST.RootOrg
+	before := s.newToken(s.srv.ST.RootUser, s.srv.ST.RootUserAPISecret)
+	require.Equal(s.T(), security.LegacyKeyID, s.keyID(before))
+
+	status, first := s.promote(before, jwt.Expiration)
+	require.Equal(s.T(), http.StatusOK, status)
+	require.NotEqual(s.T(), security.LegacyKeyID, first.ID)
+
+	// outstanding tokens still verify, and new ones use the new key
+	resp := s.do(http.MethodGet, route, s.srv.ST.RootUser, before, nil)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	after := s.newToken(s.srv.ST.RootUser, s.srv.ST.RootUserAPISecret)
+	require.Equal(s.T(), first.ID, s.keyID(after))
+	resp = s.do(http.MethodGet, route, s.srv.ST.RootUser, after, nil)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+
+	// with the least grace, tokens other servers may still sign with the
+	// replaced key verify
+	status, second := s.promote(after, tokenkey.MinGrace)
+	require.Equal(s.T(), http.StatusOK, status)
+	resp = s.do(http.MethodGet, route, s.srv.ST.RootUser, after, nil)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	latest := s.newToken(s.srv.ST.RootUser, s.srv.ST.RootUserAPISecret)
+	require.Equal(s.T(), second.ID, s.keyID(latest))
+	resp = s.do(http.MethodGet, route, s.srv.ST.RootUser, latest, nil)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+}
+
+func (s *AdminSuite) TestPromoteTokenKeyDisallowed() {
+	_, owner := s.newOrg()
+
+	// root only
+	bs, err := json.Marshal(PromoteTokenKey{Grace: jwt.Expiration})
+	require.Nil(s.T(), err)
+	resp := s.do(http.MethodPost, TokenKeyRoute, owner.ID, s.newToken(owner.ID, owner.APISecret), bs)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// with every scope
+	scoped := s.newScopedSession(s.srv.ST.RootUser, s.srv.ST.RootUserAPISecret, jwt.ScopeOrgWrite)
+	status, _ := s.promote(scoped.Bearer, jwt.Expiration)
+	require.Equal(s.T(), http.StatusForbidden, status)
+
+	// grace in range
+	status, _ = s.promote(s.token.Bearer, -1)
+	require.Equal(s.T(), http.StatusBadRequest, status)
+	status, _ = s.promote(s.token.Bearer, tokenkey.MinGrace-1)
+	require.Equal(s.T(), http.StatusBadRequest, status)
+}
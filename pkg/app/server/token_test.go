@@ -74,7 +74,7 @@ func (s *SessionSuite) TestOtherUsersToken() {
 		uuid.NewString(), // org owner display name
 		uuid.NewString(), // org owner email
 		ownerPassword,
-		s.srv.ST.DBKey,
+		s.srv.ST.DBKeys,
 		s.srv.ST.Master,
 	)
 	require.Nil(s.T(), err)
@@ -82,7 +82,7 @@ func (s *SessionSuite) TestOtherUsersToken() {
 	u, err := user.Read(
 		s.ctx,
 		o.Owner,
-		s.srv.ST.DBKey,
+		s.srv.ST.DBKeys,
 		s.srv.ST.RandomReplica(),
 	)
 	require.Nil(s.T(), err)
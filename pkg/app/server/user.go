@@ -1,11 +1,15 @@
 package server
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"io"
 	"net/http"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/user"
 	"github.com/grokloc/grokloc-server/pkg/app/admin/user/events"
 	"github.com/grokloc/grokloc-server/pkg/models"
 	"github.com/grokloc/grokloc-server/pkg/security"
@@ -73,6 +77,49 @@ func (srv *Instance) CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("location", UserRoute+"/"+u.ID)
+	writeUserStatus(w, r, http.StatusCreated, session, u)
+}
+
+// readVisibleUser reads the user with id if the session can see it:
+// root sees all users, org owners see users in their org, and users
+// see themselves
+//
+// Users that are not visible are reported as sql.ErrNoRows so as to not
+// leak their existence
+func (srv *Instance) readVisibleUser(ctx context.Context, authLevel int, session Session, id string) (*user.User, error) {
+	u, err := srv.UserController.Read(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if authLevel == AuthRoot ||
+		session.User.ID == u.ID ||
+		(authLevel == AuthOrg && session.Org.ID == u.Org) {
+		return u, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+// redact clears the api secret from u unless u is the session user
+func redact(session Session, u *user.User) {
+	if session.User.ID != u.ID {
+		u.APISecret = ""
+		u.APISecretDigest = ""
+	}
+}
+
+// writeUser writes u as json, redacted for the session
+func writeUser(w http.ResponseWriter, r *http.Request, session Session, u *user.User) {
+	writeUserStatus(w, r, http.StatusOK, session, u)
+}
+
+// writeUserStatus is writeUser with status
+func writeUserStatus(w http.ResponseWriter, r *http.Request, status int, session Session, u *user.User) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	redact(session, u)
 	bs, err := json.Marshal(u)
 	if err != nil {
 		sugar.Debugw("marshal user json",
@@ -82,9 +129,8 @@ func (srv *Instance) CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("location", UserRoute+"/"+u.ID)
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(status)
 	_, err = w.Write(bs)
 	if err != nil {
 		sugar.Debugw("write http output",
@@ -94,3 +140,213 @@ func (srv *Instance) CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+func (srv *Instance) ReadUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	authLevel, ok := ctx.Value(authLevelCtxKey).(int)
+	if !ok {
+		panic("auth missing")
+	}
+
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	u, err := srv.readVisibleUser(ctx, authLevel, session, chi.URLParam(r, IDParam))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("read user",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	writeUser(w, r, session, u)
+}
+
+func (srv *Instance) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	authLevel, ok := ctx.Value(authLevelCtxKey).(int)
+	if !ok {
+		panic("auth missing")
+	}
+
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	id := chi.URLParam(r, IDParam)
+
+	_, err := srv.readVisibleUser(ctx, authLevel, session, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("read user",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// the body is an UpdateDisplayName, UpdatePassword or UpdateStatus
+	// event, distinguished by which field is present
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(body, &fields)
+	if err != nil {
+		http.Error(w, "malformed user update event", http.StatusBadRequest)
+		return
+	}
+	_, hasDisplayName := fields["display_name"]
+	_, hasPassword := fields["password"]
+	_, hasStatus := fields["status"]
+	present := 0
+	for _, has := range []bool{hasDisplayName, hasPassword, hasStatus} {
+		if has {
+			present++
+		}
+	}
+	if present != 1 {
+		http.Error(w, "malformed user update event", http.StatusBadRequest)
+		return
+	}
+
+	var u *user.User
+	switch {
+	case hasDisplayName:
+		var event events.UpdateDisplayName
+		err = json.Unmarshal(body, &event)
+		if err != nil || event.ID != id {
+			http.Error(w, "malformed user display name event", http.StatusBadRequest)
+			return
+		}
+		u, err = srv.UserController.UpdateDisplayName(ctx, event)
+	case hasPassword:
+		var event events.UpdatePassword
+		err = json.Unmarshal(body, &event)
+		if err != nil || event.ID != id {
+			http.Error(w, "malformed user password event", http.StatusBadRequest)
+			return
+		}
+		u, err = srv.UserController.UpdatePassword(ctx, event)
+	case hasStatus:
+		var event events.UpdateStatus
+		err = json.Unmarshal(body, &event)
+		if err != nil || event.ID != id {
+			http.Error(w, "malformed user status event", http.StatusBadRequest)
+			return
+		}
+		// users cannot change their own status; visible users
+		// are otherwise in the owner's org
+		if authLevel == AuthUser {
+			http.Error(w, "auth inadequate", http.StatusForbidden)
+			return
+		}
+		u, err = srv.UserController.UpdateStatus(ctx, event)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows || err == models.ErrNotFound {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err == models.ErrDisallowedValue {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sugar.Debugw("update user",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	writeUser(w, r, session, u)
+}
+
+// RotateAPISecret replaces the api secret of a visible user
+//
+// The body is a RotateAPISecret event, whose grace sets how long the old
+// secret remains valid. As for reads, only the user sees the new secret
+func (srv *Instance) RotateAPISecret(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	defer zap.L().Sync() // nolint
+	sugar := zap.L().Sugar()
+
+	authLevel, ok := ctx.Value(authLevelCtxKey).(int)
+	if !ok {
+		panic("auth missing")
+	}
+
+	session, ok := ctx.Value(sessionCtxKey).(Session)
+	if !ok {
+		panic("session missing")
+	}
+
+	id := chi.URLParam(r, IDParam)
+
+	_, err := srv.readVisibleUser(ctx, authLevel, session, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("read user",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		sugar.Debugw("read body",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var event events.RotateAPISecret
+	err = json.Unmarshal(body, &event)
+	if err != nil || event.ID != id {
+		http.Error(w, "malformed user api secret event", http.StatusBadRequest)
+		return
+	}
+
+	u, err := srv.UserController.RotateAPISecret(ctx, event)
+	if err != nil {
+		if err == sql.ErrNoRows || err == models.ErrNotFound {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		sugar.Debugw("rotate user api secret",
+			"reqid", middleware.GetReqID(ctx),
+			"err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	writeUser(w, r, session, u)
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/grokloc/grokloc-server/pkg/app/admin/user"
 	user_events "github.com/grokloc/grokloc-server/pkg/app/admin/user/events"
 	"github.com/grokloc/grokloc-server/pkg/app/jwt"
+	"github.com/grokloc/grokloc-server/pkg/models"
 	"github.com/grokloc/grokloc-server/pkg/security"
 	"github.com/stretchr/testify/require"
 )
@@ -26,7 +27,7 @@ func (s *AdminSuite) TestCreateUser() {
 		uuid.NewString(), // org owner display name
 		uuid.NewString(), // org owner email
 		ownerPassword,
-		s.srv.ST.DBKey,
+		s.srv.ST.DBKeys,
 		s.srv.ST.Master,
 	)
 	require.Nil(s.T(), err)
@@ -34,7 +35,7 @@ func (s *AdminSuite) TestCreateUser() {
 	owner, err := user.Read(
 		s.ctx,
 		o.Owner,
-		s.srv.ST.DBKey,
+		s.srv.ST.DBKeys,
 		s.srv.ST.RandomReplica(),
 	)
 	require.Nil(s.T(), err)
@@ -64,6 +65,15 @@ func (s *AdminSuite) TestCreateUser() {
 	location := resp.Header.Get("location")
 	require.NotEmpty(s.T(), location)
 
+	// only the user is given their api secret
+	respBody, err := io.ReadAll(resp.Body)
+	require.Nil(s.T(), err)
+	var created user.User
+	require.Nil(s.T(), json.Unmarshal(respBody, &created))
+	require.Equal(s.T(), UserRoute+"/"+created.ID, location)
+	require.Empty(s.T(), created.APISecret)
+	require.Empty(s.T(), created.APISecretDigest)
+
 	// duplicate
 	req, err = http.NewRequest(http.MethodPost, s.ts.URL+UserRoute, bytes.NewBuffer(bs))
 	require.Nil(s.T(), err)
@@ -80,7 +90,7 @@ func (s *AdminSuite) TestCreateUser() {
 	req.Header.Add(TokenRequestHeader, security.EncodedSHA256(owner.ID+owner.APISecret))
 	resp, err = s.c.Do(req)
 	require.Nil(s.T(), err)
-	respBody, err := io.ReadAll(resp.Body)
+	respBody, err = io.ReadAll(resp.Body)
 	require.Nil(s.T(), err)
 	var tok Token
 	err = json.Unmarshal(respBody, &tok)
@@ -110,4 +120,195 @@ func (s *AdminSuite) TestCreateUser() {
 	require.Equal(s.T(), http.StatusCreated, resp.StatusCode)
 	location = resp.Header.Get("location")
 	require.NotEmpty(s.T(), location)
+	respBody, err = io.ReadAll(resp.Body)
+	require.Nil(s.T(), err)
+	created = user.User{}
+	require.Nil(s.T(), json.Unmarshal(respBody, &created))
+	require.Empty(s.T(), created.APISecret)
+}
+
+func (s *AdminSuite) TestReadUser() {
+	o, owner := s.newOrg()
+	member := s.newUser(o.ID)
+	_, otherOwner := s.newOrg()
+
+	readAs := func(id, bearer, target string) (int, *user.User) {
+		resp := s.do(http.MethodGet, UserRoute+"/"+target, id, bearer, nil)
+		if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, nil
+		}
+		respBody, err := io.ReadAll(resp.Body)
+		require.Nil(s.T(), err)
+		var read user.User
+		require.Nil(s.T(), json.Unmarshal(respBody, &read))
+		return resp.StatusCode, &read
+	}
+
+	// users read themselves, with api secret
+	status, read := readAs(member.ID, s.newToken(member.ID, member.APISecret), member.ID)
+	require.Equal(s.T(), http.StatusOK, status)
+	require.Equal(s.T(), member.DisplayName, read.DisplayName)
+	require.Equal(s.T(), member.APISecret, read.APISecret)
+	require.Empty(s.T(), read.Password)
+
+	// but not other users in the org
+	status, _ = readAs(member.ID, s.newToken(member.ID, member.APISecret), owner.ID)
+	require.Equal(s.T(), http.StatusNotFound, status)
+
+	// owners and root read org users, without api secret
+	for _, reader := range []struct{ id, bearer string }{
+		{owner.ID, s.newToken(owner.ID, owner.APISecret)},
+		{s.srv.ST.RootUser, s.token.Bearer},
+	} {
+		status, read = readAs(reader.id, reader.bearer, member.ID)
+		require.Equal(s.T(), http.StatusOK, status)
+		require.Equal(s.T(), member.ID, read.ID)
+		require.Equal(s.T(), member.Email, read.Email)
+		require.Empty(s.T(), read.APISecret)
+		require.Empty(s.T(), read.APISecretDigest)
+	}
+
+	// owners of other orgs cannot see it exists
+	status, _ = readAs(otherOwner.ID, s.newToken(otherOwner.ID, otherOwner.APISecret), member.ID)
+	require.Equal(s.T(), http.StatusNotFound, status)
+
+	// missing
+	status, _ = readAs(s.srv.ST.RootUser, s.token.Bearer, uuid.NewString())
+	require.Equal(s.T(), http.StatusNotFound, status)
+}
+
+func (s *AdminSuite) TestUpdateUser() {
+	o, owner := s.newOrg()
+	member := s.newUser(o.ID)
+	_, otherOwner := s.newOrg()
+	memberBearer := s.newToken(member.ID, member.APISecret)
+	ownerBearer := s.newToken(owner.ID, owner.APISecret)
+	route := UserRoute + "/" + member.ID
+
+	decode := func(resp *http.Response) *user.User {
+		respBody, err := io.ReadAll(resp.Body)
+		require.Nil(s.T(), err)
+		var read user.User
+		require.Nil(s.T(), json.Unmarshal(respBody, &read))
+		return &read
+	}
+
+	// users update their own display name
+	displayName := uuid.NewString()
+	bs, err := json.Marshal(user_events.UpdateDisplayName{ID: member.ID, DisplayName: displayName})
+	require.Nil(s.T(), err)
+	resp := s.do(http.MethodPut, route, member.ID, memberBearer, bs)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	updated := decode(resp)
+	require.Equal(s.T(), displayName, updated.DisplayName)
+	require.Equal(s.T(), member.APISecret, updated.APISecret)
+
+	// and password
+	password := uuid.NewString()
+	bs, err = json.Marshal(user_events.UpdatePassword{ID: member.ID, Password: password})
+	require.Nil(s.T(), err)
+	resp = s.do(http.MethodPut, route, member.ID, memberBearer, bs)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	u, err := user.Read(s.ctx, member.ID, s.srv.ST.DBKeys, s.srv.ST.Master)
+	require.Nil(s.T(), err)
+	match, err := security.VerifyPassword(password, u.Password)
+	require.Nil(s.T(), err)
+	require.True(s.T(), match)
+
+	// but not their status
+	bs, err = json.Marshal(user_events.UpdateStatus{ID: member.ID, Status: models.StatusInactive})
+	require.Nil(s.T(), err)
+	resp = s.do(http.MethodPut, route, member.ID, memberBearer, bs)
+	require.Equal(s.T(), http.StatusForbidden, resp.StatusCode)
+
+	// nor other users
+	ownerDisplayName, err := json.Marshal(user_events.UpdateDisplayName{ID: owner.ID, DisplayName: displayName})
+	require.Nil(s.T(), err)
+	resp = s.do(http.MethodPut, UserRoute+"/"+owner.ID, member.ID, memberBearer, ownerDisplayName)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+
+	// owners of other orgs cannot see the user
+	resp = s.do(http.MethodPut, route, otherOwner.ID,
+		s.newToken(otherOwner.ID, otherOwner.APISecret), bs)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+
+	// event must match the route
+	resp = s.do(http.MethodPut, route, owner.ID, ownerBearer, ownerDisplayName)
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+
+	// more than one event
+	resp = s.do(http.MethodPut, route, owner.ID, ownerBearer,
+		[]byte(`{"display_name":"d","password":"p"}`))
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
+
+	// owner sets status, and does not see the api secret
+	resp = s.do(http.MethodPut, route, owner.ID, ownerBearer, bs)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	updated = decode(resp)
+	require.Equal(s.T(), models.StatusInactive, updated.Meta.Status)
+	require.Empty(s.T(), updated.APISecret)
+
+	// root sets status
+	bs, err = json.Marshal(user_events.UpdateStatus{ID: member.ID, Status: models.StatusActive})
+	require.Nil(s.T(), err)
+	resp = s.do(http.MethodPut, route, s.srv.ST.RootUser, s.token.Bearer, bs)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	require.Equal(s.T(), models.StatusActive, decode(resp).Meta.Status)
+}
+
+func (s *AdminSuite) TestRotateAPISecret() {
+	o, owner := s.newOrg()
+	member := s.newUser(o.ID)
+	_, otherOwner := s.newOrg()
+	memberBearer := s.newToken(member.ID, member.APISecret)
+	route := UserRoute + "/" + member.ID + APISecretPath
+
+	rotate := func(id, bearer string, grace int64) *http.Response {
+		bs, err := json.Marshal(user_events.RotateAPISecret{ID: member.ID, Grace: grace})
+		require.Nil(s.T(), err)
+		return s.do(http.MethodPost, route, id, bearer, bs)
+	}
+	tokenStatus := func(apiSecret string) int {
+		req, err := http.NewRequest(http.MethodPut, s.ts.URL+TokenRoute, nil)
+		require.Nil(s.T(), err)
+		req.Header.Add(IDHeader, member.ID)
+		req.Header.Add(TokenRequestHeader, security.EncodedSHA256(member.ID+apiSecret))
+		resp, err := s.c.Do(req)
+		require.Nil(s.T(), err)
+		return resp.StatusCode
+	}
+
+	// users rotate their own secret, and see the new one
+	resp := rotate(member.ID, memberBearer, 3600)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	respBody, err := io.ReadAll(resp.Body)
+	require.Nil(s.T(), err)
+	var rotated user.User
+	require.Nil(s.T(), json.Unmarshal(respBody, &rotated))
+	require.NotEmpty(s.T(), rotated.APISecret)
+	require.NotEqual(s.T(), member.APISecret, rotated.APISecret)
+
+	// both secrets work during the grace period
+	require.Equal(s.T(), http.StatusOK, tokenStatus(member.APISecret))
+	require.Equal(s.T(), http.StatusOK, tokenStatus(rotated.APISecret))
+
+	// owners rotate org users' secrets without seeing them
+	resp = rotate(owner.ID, s.newToken(owner.ID, owner.APISecret), 0)
+	require.Equal(s.T(), http.StatusOK, resp.StatusCode)
+	respBody, err = io.ReadAll(resp.Body)
+	require.Nil(s.T(), err)
+	var redacted user.User
+	require.Nil(s.T(), json.Unmarshal(respBody, &redacted))
+	require.Empty(s.T(), redacted.APISecret)
+	require.Equal(s.T(), http.StatusUnauthorized, tokenStatus(member.APISecret))
+	require.Equal(s.T(), http.StatusUnauthorized, tokenStatus(rotated.APISecret))
+
+	// owners of other orgs cannot see the user
+	resp = rotate(otherOwner.ID, s.newToken(otherOwner.ID, otherOwner.APISecret), 0)
+	require.Equal(s.T(), http.StatusNotFound, resp.StatusCode)
+
+	// grace out of range
+	resp = s.do(http.MethodPost, route, s.srv.ST.RootUser, s.token.Bearer,
+		[]byte(`{"id":"`+member.ID+`","grace":-1}`))
+	require.Equal(s.T(), http.StatusBadRequest, resp.StatusCode)
 }
@@ -6,6 +6,7 @@ import (
 	"math/rand"
 
 	"github.com/grokloc/grokloc-server/pkg/env"
+	"github.com/grokloc/grokloc-server/pkg/security"
 	"github.com/matthewhartstonge/argon2"
 	"go.uber.org/zap"
 )
@@ -15,10 +16,13 @@ type State struct {
 	Level                                env.Level
 	Master                               *sql.DB
 	Replicas                             []*sql.DB
-	DBKey                                []byte
+	DBKeys                               *security.Keyring
 	TokenKey                             []byte
+	DigestKey                            []byte
 	Argon2Cfg                            argon2.Config
 	RootOrg, RootUser, RootUserAPISecret string
+	RepositoryRoot                       string
+	AllowFileUpstreams                   bool
 }
 
 // RandomReplica selects a random replica
@@ -29,3 +33,21 @@ func (s *State) RandomReplica() *sql.DB {
 	}
 	return s.Replicas[rand.Intn(l)]
 }
+
+// Close closes the master and all replicas, returning the first error
+// (a replica that is the same handle as the master is closed once)
+func (s *State) Close() error {
+	var first error
+	closed := make(map[*sql.DB]bool)
+	for _, db := range append([]*sql.DB{s.Master}, s.Replicas...) {
+		if db == nil || closed[db] {
+			continue
+		}
+		closed[db] = true
+		err := db.Close()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,98 @@
+package state
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3" //
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/config"
+	"github.com/grokloc/grokloc-server/pkg/app/migrate"
+)
+
+// openDB opens a sqlite db with dsn and verifies it can be reached
+func openDB(ctx context.Context, dsn string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// avoid concurrency bug with the sqlite library
+	db.SetMaxOpenConns(1)
+	err = db.PingContext(ctx)
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("db %s: %w", dsn, err)
+	}
+	return db, nil
+}
+
+// Master opens only the master db for cfg, without applying
+// migrations or bootstrapping the root org
+func Master(cfg *config.Config) (*sql.DB, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return openDB(context.Background(), cfg.MasterDSN)
+}
+
+// open builds state from cfg
+//
+// Every db is reached here so a bad DSN fails at startup rather than
+// on first use; with no replicas configured, the master is the
+// only replica. Pending migrations are applied to the master.
+func open(cfg *config.Config) (*app.State, error) {
+	ctx := context.Background()
+	master, err := openDB(ctx, cfg.MasterDSN)
+	if err != nil {
+		return nil, fmt.Errorf("master: %w", err)
+	}
+
+	dbKeys, err := cfg.DBKeyring()
+	if err != nil {
+		_ = master.Close()
+		return nil, fmt.Errorf("db keys: %w", err)
+	}
+	st := &app.State{
+		Level:              cfg.Level,
+		Master:             master,
+		Replicas:           []*sql.DB{},
+		DBKeys:             dbKeys,
+		TokenKey:           []byte(cfg.TokenKey),
+		DigestKey:          []byte(cfg.DigestKey),
+		Argon2Cfg:          cfg.Argon2Cfg(),
+		RepositoryRoot:     cfg.RepositoryRoot,
+		AllowFileUpstreams: cfg.AllowFileUpstreams,
+	}
+
+	for i, dsn := range cfg.ReplicaDSNs {
+		replica, err := openDB(ctx, dsn)
+		if err != nil {
+			_ = st.Close()
+			return nil, fmt.Errorf("replica %d: %w", i, err)
+		}
+		st.Replicas = append(st.Replicas, replica)
+	}
+	if len(st.Replicas) == 0 {
+		st.Replicas = append(st.Replicas, master)
+	}
+
+	err = migrate.Up(ctx, master)
+	if err != nil {
+		_ = st.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+
+	rootOrg, rootUser, err := bootstrap(ctx, cfg.Root, st.Argon2Cfg, st.DBKeys, master)
+	if err != nil {
+		_ = st.Close()
+		return nil, fmt.Errorf("root: %w", err)
+	}
+
+	st.RootOrg = rootOrg.ID
+	st.RootUser = rootUser.ID
+	st.RootUserAPISecret = rootUser.APISecret
+	return st, nil
+}
@@ -0,0 +1,23 @@
+package state
+
+import (
+	"go.uber.org/zap"
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/config"
+)
+
+// Dev builds an instance for the Dev environment
+//
+// The db is expected to be a persistent sqlite file (WAL mode by
+// default); the root org and user are created on first run only, so
+// restarts retain the same RootOrg, RootUser and RootUserAPISecret
+func Dev(cfg *config.Config) (*app.State, error) {
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		return nil, err
+	}
+	_ = zap.ReplaceGlobals(logger)
+
+	return open(cfg)
+}
@@ -0,0 +1,107 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app/config"
+	"github.com/grokloc/grokloc-server/pkg/app/contribution"
+	"github.com/grokloc/grokloc-server/pkg/app/job"
+	"github.com/grokloc/grokloc-server/pkg/app/repository"
+	"github.com/grokloc/grokloc-server/pkg/app/sweep"
+	"github.com/grokloc/grokloc-server/pkg/env"
+	"github.com/grokloc/grokloc-server/pkg/security"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type DevSuite struct {
+	suite.Suite
+}
+
+func (s *DevSuite) SetupTest() {
+	path := filepath.Join(s.T().TempDir(), "dev.db")
+	s.T().Setenv(config.MasterDSNEnv, fmt.Sprintf("file:%s?_journal_mode=WAL", path))
+	s.T().Setenv(config.DBKeyEnv, uuid.NewString()[:32])
+	s.T().Setenv(config.TokenKeyEnv, uuid.NewString()[:32])
+	s.T().Setenv(config.DigestKeyEnv, uuid.NewString()[:32])
+	s.T().Setenv(config.RootOrgEnv, uuid.NewString())
+	s.T().Setenv(config.RootDisplayNameEnv, uuid.NewString())
+	s.T().Setenv(config.RootEmailEnv, uuid.NewString())
+	s.T().Setenv(config.RootPasswordEnv, uuid.NewString())
+}
+
+func (s *DevSuite) TestRestart() {
+	st, err := New(env.Dev)
+	require.Nil(s.T(), err)
+	var mode string
+	err = st.Master.QueryRow(`pragma journal_mode`).Scan(&mode)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "wal", mode)
+	require.Nil(s.T(), st.Close())
+
+	// owner identity is only needed on first run
+	s.T().Setenv(config.RootPasswordEnv, "")
+	restarted, err := New(env.Dev)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), st.RootOrg, restarted.RootOrg)
+	require.Equal(s.T(), st.RootUser, restarted.RootUser)
+	require.Equal(s.T(), st.RootUserAPISecret, restarted.RootUserAPISecret)
+	require.Nil(s.T(), restarted.Close())
+}
+
+func (s *DevSuite) TestRotateDBKey() {
+	ctx := context.Background()
+	oldKey := uuid.NewString()[:32]
+	s.T().Setenv(config.DBKeyEnv, oldKey)
+	st, err := New(env.Dev)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), security.LegacyKeyID, st.DBKeys.Current())
+	// contribution emails are encrypted with the db key too
+	r := &repository.Repository{Org: st.RootOrg}
+	r.ID = uuid.NewString()
+	email := uuid.NewString()
+	days := []contribution.Day{{Email: email, Day: 86400, Commits: 1}}
+	require.Nil(s.T(), contribution.Insert(ctx, r.ID, days, st.DBKeys, st.DigestKey, st.Master))
+	require.Nil(s.T(), st.Close())
+
+	// a new key, with the old one retired
+	s.T().Setenv(config.DBKeyEnv, uuid.NewString()[:32])
+	s.T().Setenv(config.DBKeyIDEnv, "1")
+	s.T().Setenv(config.DBRetiredKeysEnv, security.LegacyKeyID+":"+oldKey)
+	rotated, err := New(env.Dev)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), st.RootUserAPISecret, rotated.RootUserAPISecret)
+	require.Nil(s.T(), sweep.ReencryptJob(ctx, rotated, &job.Job{}))
+	require.Nil(s.T(), rotated.Close())
+
+	// every user was rewritten, so the old key is no longer needed
+	s.T().Setenv(config.DBRetiredKeysEnv, "")
+	restarted, err := New(env.Dev)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), st.RootUserAPISecret, restarted.RootUserAPISecret)
+	cs, err := contribution.Read(ctx, r, 0, 0, restarted.DBKeys, restarted.DigestKey, restarted.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 1, len(cs))
+	require.Equal(s.T(), email, cs[0].Email)
+	require.Nil(s.T(), restarted.Close())
+}
+
+func (s *DevSuite) TestFirstRunIdentity() {
+	s.T().Setenv(config.RootPasswordEnv, "")
+	_, err := New(env.Dev)
+	require.ErrorIs(s.T(), err, ErrRootIdentity)
+}
+
+func (s *DevSuite) TestKeyLen() {
+	s.T().Setenv(config.DBKeyEnv, "short")
+	_, err := New(env.Dev)
+	require.ErrorIs(s.T(), err, config.ErrInvalid)
+}
+
+func TestDevSuite(t *testing.T) {
+	suite.Run(t, new(DevSuite))
+}
@@ -0,0 +1,9 @@
+package state
+
+import "errors"
+
+// ErrRootIdentity signals the root org must be created but the owner is not fully specified
+var ErrRootIdentity = errors.New("root org owner display name, email and password required on first run")
+
+// ErrNoReplicas signals an empty replica DSN list
+var ErrNoReplicas = errors.New("no replica dbs configured")
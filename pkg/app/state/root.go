@@ -0,0 +1,70 @@
+package state
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/org"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/user"
+	"github.com/grokloc/grokloc-server/pkg/app/config"
+	"github.com/grokloc/grokloc-server/pkg/security"
+	"github.com/matthewhartstonge/argon2"
+)
+
+// bootstrap reads the root org (by name) and its owner, creating them
+// if the root org does not yet exist
+func bootstrap(
+	ctx context.Context,
+	root config.Root,
+	argon2Cfg argon2.Config,
+	keys *security.Keyring,
+	db *sql.DB) (*org.Org, *user.User, error) {
+
+	q := fmt.Sprintf(`select id from %s where name = ?`, app.OrgsTableName)
+
+	var id string
+	err := db.QueryRowContext(ctx, q, root.OrgName).Scan(&id)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, nil, err
+	}
+
+	var rootOrg *org.Org
+	if err == sql.ErrNoRows {
+		// first run
+		if len(root.OwnerDisplayName) == 0 ||
+			len(root.OwnerEmail) == 0 ||
+			len(root.OwnerPassword) == 0 {
+			return nil, nil, ErrRootIdentity
+		}
+		password, err := security.DerivePassword(string(root.OwnerPassword), argon2Cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		rootOrg, err = org.Create(
+			ctx,
+			root.OrgName,
+			root.OwnerDisplayName,
+			root.OwnerEmail,
+			password,
+			keys,
+			db,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		rootOrg, err = org.Read(ctx, id, db)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	rootUser, err := user.Read(ctx, rootOrg.Owner, keys, db)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return rootOrg, rootUser, nil
+}
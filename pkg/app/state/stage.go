@@ -0,0 +1,35 @@
+package state
+
+import (
+	"go.uber.org/zap"
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/config"
+)
+
+// Stage builds an instance for the Stage environment
+func Stage(cfg *config.Config) (*app.State, error) {
+	return replicated(cfg)
+}
+
+// Prod builds an instance for the Prod environment
+func Prod(cfg *config.Config) (*app.State, error) {
+	return replicated(cfg)
+}
+
+// replicated builds an instance with a distinct master and replicas
+//
+// Replicas are expected to be read-only (e.g. file:replica.db?mode=ro)
+func replicated(cfg *config.Config) (*app.State, error) {
+	if len(cfg.ReplicaDSNs) == 0 {
+		return nil, ErrNoReplicas
+	}
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return nil, err
+	}
+	_ = zap.ReplaceGlobals(logger)
+
+	return open(cfg)
+}
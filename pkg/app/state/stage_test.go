@@ -0,0 +1,72 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/user"
+	"github.com/grokloc/grokloc-server/pkg/app/config"
+	"github.com/grokloc/grokloc-server/pkg/env"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type StageSuite struct {
+	suite.Suite
+	path string
+}
+
+func (s *StageSuite) SetupTest() {
+	s.path = filepath.Join(s.T().TempDir(), "master.db")
+	s.T().Setenv(config.MasterDSNEnv, fmt.Sprintf("file:%s?_journal_mode=WAL", s.path))
+	s.T().Setenv(config.DBKeyEnv, uuid.NewString()[:32])
+	s.T().Setenv(config.TokenKeyEnv, uuid.NewString()[:32])
+	s.T().Setenv(config.DigestKeyEnv, uuid.NewString()[:32])
+	s.T().Setenv(config.RepositoryRootEnv, filepath.Join(s.T().TempDir(), "repositories"))
+	s.T().Setenv(config.RootOrgEnv, uuid.NewString())
+	s.T().Setenv(config.RootDisplayNameEnv, uuid.NewString())
+	s.T().Setenv(config.RootEmailEnv, uuid.NewString())
+	s.T().Setenv(config.RootPasswordEnv, uuid.NewString())
+}
+
+func (s *StageSuite) TestStage() {
+	// the master file opened read-only stands in for replicas
+	replica := fmt.Sprintf("file:%s?mode=ro", s.path)
+	s.T().Setenv(config.ReplicaDSNsEnv, replica+", "+replica)
+	st, err := New(env.Stage)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), env.Stage, st.Level)
+	require.Equal(s.T(), 2, len(st.Replicas))
+
+	u, err := user.Read(context.Background(), st.RootUser, st.DBKeys, st.RandomReplica())
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), st.RootUserAPISecret, u.APISecret)
+
+	// replicas are read-only
+	_, err = st.RandomReplica().Exec(`delete from users`)
+	require.Error(s.T(), err)
+	require.Nil(s.T(), st.Close())
+}
+
+func (s *StageSuite) TestNoReplicas() {
+	_, err := New(env.Prod)
+	require.ErrorIs(s.T(), err, config.ErrInvalid)
+
+	cfg := config.Default(env.Prod)
+	_, err = Prod(cfg)
+	require.ErrorIs(s.T(), err, ErrNoReplicas)
+}
+
+func (s *StageSuite) TestUnreachableReplica() {
+	missing := filepath.Join(s.T().TempDir(), "missing.db")
+	s.T().Setenv(config.ReplicaDSNsEnv, fmt.Sprintf("file:%s?mode=ro", missing))
+	_, err := New(env.Prod)
+	require.Error(s.T(), err)
+}
+
+func TestStageSuite(t *testing.T) {
+	suite.Run(t, new(StageSuite))
+}
@@ -5,16 +5,38 @@ import (
 	"errors"
 
 	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/config"
 	"github.com/grokloc/grokloc-server/pkg/env"
 )
 
-// New creates a new state instance for the given level
+// New creates a new state instance for the given level, with
+// config loaded from the environment
 func New(level env.Level) (*app.State, error) {
 	if level == env.None {
 		return nil, errors.New("no instance for None")
 	}
-	if level == env.Unit {
-		return Unit(), nil
+	cfg, err := config.Load(level)
+	if err != nil {
+		return nil, err
+	}
+	return FromConfig(cfg)
+}
+
+// FromConfig creates a new state instance for cfg.Level
+func FromConfig(cfg *config.Config) (*app.State, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.Level {
+	case env.Unit:
+		return Unit(cfg), nil
+	case env.Dev:
+		return Dev(cfg)
+	case env.Stage:
+		return Stage(cfg)
+	case env.Prod:
+		return Prod(cfg)
 	}
 	return nil, errors.New("no state constructor available")
 }
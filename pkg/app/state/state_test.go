@@ -17,6 +17,13 @@ func (s *StateSuite) TestUnit() {
 	require.Nil(s.T(), err)
 }
 
+func (s *StateSuite) TestClose() {
+	st, err := New(env.Unit)
+	require.Nil(s.T(), err)
+	require.Nil(s.T(), st.Close())
+	require.Error(s.T(), st.Master.Ping())
+}
+
 func TestStateSuite(t *testing.T) {
 	suite.Run(t, new(StateSuite))
 }
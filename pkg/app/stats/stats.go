@@ -0,0 +1,121 @@
+// Package stats aggregates repository analyses across an org
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+
+	"github.com/grokloc/grokloc-server/pkg/app/analysis"
+	"github.com/grokloc/grokloc-server/pkg/app/mirror"
+	"github.com/grokloc/grokloc-server/pkg/app/repository"
+	"github.com/grokloc/grokloc-server/pkg/models"
+)
+
+// LargestLimit is the most repositories listed in Org.Largest
+const LargestLimit = 10
+
+// Repository is the latest analysis summary of one repository
+type Repository struct {
+	ID        string          `json:"id"`
+	Name      string          `json:"name"`
+	Commit    string          `json:"commit"`     // latest analyzed commit, "" if none
+	Analyzed  int64           `json:"analyzed"`   // unix time of the latest analysis
+	Head      string          `json:"head"`       // mirror HEAD, "" if never fetched
+	LastFetch int64           `json:"last_fetch"` // unix time of the last mirror fetch
+	Stale     bool            `json:"stale"`      // Head has not been analyzed
+	Total     analysis.Counts `json:"total"`
+}
+
+// Org is the aggregate of the latest analyses of the active repositories
+// in an org
+type Org struct {
+	Org          string                    `json:"org"`
+	Repositories int                       `json:"repositories"` // active
+	Analyzed     int                       `json:"analyzed"`     // with any analysis
+	Total        analysis.Counts           `json:"total"`
+	Languages    []analysis.LanguageCounts `json:"languages"` // most code first
+	Largest      []Repository              `json:"largest"`   // most code first
+	Stale        []Repository              `json:"stale"`     // by name
+}
+
+// ReadOrg aggregates the latest analysis of each active repository in org
+//
+// A repository is stale if its mirror has fetched a HEAD that has not been
+// analyzed; totals use the latest analysis of stale repositories
+func ReadOrg(ctx context.Context, org string, db *sql.DB) (*Org, error) {
+	repositories, err := repository.ReadOrg(ctx, org, db)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &Org{
+		Org:       org,
+		Languages: []analysis.LanguageCounts{},
+		Largest:   []Repository{},
+		Stale:     []Repository{},
+	}
+	byLanguage := map[string]*analysis.LanguageCounts{}
+	analyzed := []Repository{}
+
+	for _, r := range repositories {
+		if r.Meta.Status != models.StatusActive {
+			continue
+		}
+		o.Repositories++
+		rs := Repository{ID: r.ID, Name: r.Name}
+
+		m, err := mirror.Read(ctx, r.ID, db)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if err == nil {
+			rs.Head = m.Head
+			rs.LastFetch = m.LastFetch
+		}
+
+		a, err := analysis.LatestSummary(ctx, r.ID, db)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if err == nil {
+			rs.Commit = a.Commit
+			rs.Analyzed = a.Ctime
+			rs.Total = a.Total
+			o.Analyzed++
+			o.Total.Add(a.Total)
+			for _, lc := range a.Languages {
+				sum, ok := byLanguage[lc.Language]
+				if !ok {
+					sum = &analysis.LanguageCounts{Language: lc.Language}
+					byLanguage[lc.Language] = sum
+				}
+				sum.Files += lc.Files
+				sum.Add(lc.Counts)
+			}
+		}
+
+		rs.Stale = len(rs.Head) != 0 && rs.Head != rs.Commit
+		if rs.Stale {
+			o.Stale = append(o.Stale, rs)
+		}
+		if len(rs.Commit) != 0 {
+			analyzed = append(analyzed, rs)
+		}
+	}
+
+	for _, lc := range byLanguage {
+		o.Languages = append(o.Languages, *lc)
+	}
+	analysis.SortLanguages(o.Languages)
+
+	sort.SliceStable(analyzed, func(i, j int) bool {
+		return analyzed[i].Total.Code > analyzed[j].Total.Code
+	})
+	if len(analyzed) > LargestLimit {
+		analyzed = analyzed[:LargestLimit]
+	}
+	o.Largest = append(o.Largest, analyzed...)
+
+	return o, nil
+}
@@ -0,0 +1,131 @@
+package stats
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/org"
+	"github.com/grokloc/grokloc-server/pkg/app/analysis"
+	"github.com/grokloc/grokloc-server/pkg/app/repository"
+	"github.com/grokloc/grokloc-server/pkg/app/state"
+	"github.com/grokloc/grokloc-server/pkg/env"
+	"github.com/grokloc/grokloc-server/pkg/models"
+	"github.com/grokloc/grokloc-server/pkg/security"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+)
+
+type StatsSuite struct {
+	suite.Suite
+	st *app.State
+}
+
+func (s *StatsSuite) SetupTest() {
+	var err error
+	s.st, err = state.New(env.Unit)
+	if err != nil {
+		zap.L().Fatal("setup",
+			zap.Error(err),
+		)
+	}
+}
+
+// analyze stores an analysis of r at commit with code lines of go and
+// python, and a mirror row with head
+func (s *StatsSuite) analyze(r *repository.Repository, commit, head string, goCode, pyCode int) {
+	ctx := context.Background()
+	if len(commit) != 0 {
+		a := analysis.Analysis{
+			Repository: r.ID,
+			Commit:     commit,
+			Total:      analysis.Counts{Code: goCode + pyCode},
+			Languages: []analysis.LanguageCounts{
+				{Language: "Go", Files: 1, Counts: analysis.Counts{Code: goCode}},
+				{Language: "Python", Files: 1, Counts: analysis.Counts{Code: pyCode}},
+			},
+		}
+		require.Nil(s.T(), a.Insert(ctx, s.st.Master))
+	}
+	if len(head) != 0 {
+		_, err := s.st.Master.Exec(`insert into mirrors (repository, head, last_fetch) values (?,?,?)`,
+			r.ID, head, 1)
+		require.Nil(s.T(), err)
+	}
+}
+
+func (s *StatsSuite) TestReadOrg() {
+	ctx := context.Background()
+	ownerPassword, err := security.DerivePassword(uuid.NewString(), s.st.Argon2Cfg)
+	require.Nil(s.T(), err)
+	o, err := org.Create(
+		ctx,
+		uuid.NewString(), // org name
+		uuid.NewString(), // org owner display name
+		uuid.NewString(), // org owner email
+		ownerPassword,
+		s.st.DBKeys,
+		s.st.Master,
+	)
+	require.Nil(s.T(), err)
+
+	newRepository := func(name string) *repository.Repository {
+		r, err := repository.Create(ctx, name, o.ID, "https://example.com/r.git", s.st.RepositoryRoot, s.st.Master)
+		require.Nil(s.T(), err)
+		return r
+	}
+	a, b, c, d := strings.Repeat("a", 40), strings.Repeat("b", 40), strings.Repeat("c", 40), strings.Repeat("d", 40)
+
+	// current
+	small := newRepository("small")
+	s.analyze(small, a, a, 1, 1)
+	// analyzed, then fetched a new head
+	large := newRepository("large")
+	s.analyze(large, b, c, 10, 0)
+	// fetched but never analyzed
+	fetched := newRepository("fetched")
+	s.analyze(fetched, "", d, 0, 0)
+	// never fetched
+	_ = newRepository("new")
+	// inactive repositories are not included
+	inactive := newRepository("inactive")
+	s.analyze(inactive, a, a, 100, 100)
+	require.Nil(s.T(), inactive.UpdateStatus(ctx, models.StatusInactive, s.st.Master))
+
+	stats, err := ReadOrg(ctx, o.ID, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), o.ID, stats.Org)
+	require.Equal(s.T(), 4, stats.Repositories)
+	require.Equal(s.T(), 2, stats.Analyzed)
+	require.Equal(s.T(), analysis.Counts{Code: 12}, stats.Total)
+	require.Equal(s.T(), []analysis.LanguageCounts{
+		{Language: "Go", Files: 2, Counts: analysis.Counts{Code: 11}},
+		{Language: "Python", Files: 2, Counts: analysis.Counts{Code: 1}},
+	}, stats.Languages)
+
+	require.Equal(s.T(), 2, len(stats.Largest))
+	require.Equal(s.T(), large.ID, stats.Largest[0].ID)
+	require.Equal(s.T(), small.ID, stats.Largest[1].ID)
+	require.False(s.T(), stats.Largest[1].Stale)
+
+	require.Equal(s.T(), 2, len(stats.Stale))
+	require.Equal(s.T(), "fetched", stats.Stale[0].Name)
+	require.Empty(s.T(), stats.Stale[0].Commit)
+	require.Equal(s.T(), "large", stats.Stale[1].Name)
+	require.Equal(s.T(), b, stats.Stale[1].Commit)
+	require.Equal(s.T(), c, stats.Stale[1].Head)
+	require.NotZero(s.T(), stats.Stale[1].Analyzed)
+
+	// no repositories
+	stats, err = ReadOrg(ctx, uuid.NewString(), s.st.Master)
+	require.Nil(s.T(), err)
+	require.Zero(s.T(), stats.Repositories)
+	require.Empty(s.T(), stats.Languages)
+}
+
+func TestStatsSuite(t *testing.T) {
+	suite.Run(t, new(StatsSuite))
+}
@@ -0,0 +1,40 @@
+package sweep
+
+import (
+	"context"
+	"time"
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/user"
+	"go.uber.org/zap"
+)
+
+// CountPasswords counts the legacy and malformed passwords still to be
+// rehashed on login, see user.LegacyPasswords, and sets them in
+// user.LegacyPasswordsGauge and user.MalformedPasswordsGauge
+func CountPasswords(ctx context.Context, st *app.State) (int, int, error) {
+	legacy, malformed, err := user.LegacyPasswords(ctx, st.Argon2Cfg, st.Master)
+	if err != nil {
+		return 0, 0, err
+	}
+	user.LegacyPasswordsGauge.Set(int64(legacy))
+	user.MalformedPasswordsGauge.Set(int64(malformed))
+	return legacy, malformed, nil
+}
+
+// RunPasswords counts passwords immediately and then every interval
+// until ctx is done
+func RunPasswords(ctx context.Context, st *app.State, interval time.Duration) {
+	every(ctx, interval, func() {
+		_, malformed, err := CountPasswords(ctx, st)
+		if err != nil {
+			if ctx.Err() == nil {
+				zap.L().Error("count passwords", zap.Error(err))
+			}
+			return
+		}
+		if malformed != 0 {
+			zap.L().Warn("count passwords", zap.Int("malformed", malformed))
+		}
+	})
+}
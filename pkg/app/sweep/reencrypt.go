@@ -0,0 +1,113 @@
+package sweep
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/user"
+	"github.com/grokloc/grokloc-server/pkg/app/contribution"
+	"github.com/grokloc/grokloc-server/pkg/app/job"
+	"github.com/grokloc/grokloc-server/pkg/app/tokenkey"
+	"go.uber.org/zap"
+)
+
+// ReencryptKind is the kind of job that rewrites every user data key,
+// contribution email and stored token key encrypted with a key other
+// than the current db key, and gives users created before data keys one
+//
+// Once it succeeds, retiring the previous db key erases users shredded
+// before the rotation from backups holding their data key
+const ReencryptKind = "sweep.reencrypt"
+
+// ReencryptBatch is how many users, or contributions, are selected at
+// a time for re-encryption
+const ReencryptBatch = 100
+
+// ReencryptJob is the job.Handler for ReencryptKind
+//
+// Users and contributions are selected by whether they are stale, so a
+// job that is interrupted, or run again after failing, resumes where it
+// left off. A row that cannot be rewritten is logged and skipped, and
+// the job then fails so that it is retried
+func ReencryptJob(ctx context.Context, st *app.State, j *job.Job) error {
+	after := ""
+	rewritten, failed := 0, 0
+	for {
+		ids, err := user.StaleKeyIDs(ctx, after, ReencryptBatch, st.DBKeys, st.Master)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			break
+		}
+		for _, id := range ids {
+			ok, err := user.Reencrypt(ctx, id, st.DBKeys, st.Master)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				zap.L().Warn("reencrypt user", zap.String("id", id), zap.Error(err))
+				failed++
+				continue
+			}
+			if ok {
+				rewritten++
+			}
+		}
+		after = ids[len(ids)-1]
+	}
+
+	cursor := contribution.Cursor{}
+	contributions := 0
+	for {
+		stale, err := contribution.StaleEmails(ctx, cursor, ReencryptBatch, st.DBKeys, st.Master)
+		if err != nil {
+			return err
+		}
+		if len(stale) == 0 {
+			break
+		}
+		for _, c := range stale {
+			ok, err := contribution.Reencrypt(ctx, c, st.DBKeys, st.DigestKey, st.Master)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				zap.L().Warn("reencrypt contribution",
+					zap.String("repository", c.Repository),
+					zap.Int64("day", c.Day),
+					zap.Error(err))
+				failed++
+				continue
+			}
+			if ok {
+				contributions++
+			}
+		}
+		cursor = stale[len(stale)-1].Cursor
+	}
+
+	tokenKeys, err := tokenkey.Reencrypt(ctx, st.DBKeys, st.Master)
+	if err != nil {
+		return err
+	}
+
+	// the previous db key can now be dropped, completing these
+	pending, err := user.PendingShreds(ctx, st.DBKeys, st.Master)
+	if err != nil {
+		return err
+	}
+
+	zap.L().Info("reencrypt",
+		zap.String("key", st.DBKeys.Current()),
+		zap.Int("users", rewritten),
+		zap.Int("contributions", contributions),
+		zap.Int("token_keys", tokenKeys),
+		zap.Int("pending_shreds", pending),
+		zap.Int("failed", failed))
+	if failed != 0 {
+		return fmt.Errorf("%d users or contributions could not be re-encrypted", failed)
+	}
+	return nil
+}
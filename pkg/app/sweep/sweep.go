@@ -0,0 +1,150 @@
+// Package sweep brings stored model rows to their current schema version
+// and db key, prunes expired tokens, and counts legacy passwords; each
+// runs as its own periodic job
+package sweep
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/org"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/user"
+	"github.com/grokloc/grokloc-server/pkg/app/repository"
+	"go.uber.org/zap"
+)
+
+// Result counts the rows rewritten by a sweep, and those that could not be
+type Result struct {
+	Orgs         int
+	Users        int
+	Repositories int
+	Failed       int
+}
+
+// staleIDs returns the ids of rows in tableName not at version
+func staleIDs(ctx context.Context, tableName string, version int, db *sql.DB) ([]string, error) {
+	q := fmt.Sprintf(`select id from %s where schema_version != ?`, tableName)
+	rows, err := db.QueryContext(ctx, q, version)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Sweep migrates every org, user and repository row not at the current
+// schema version
+//
+// A row that cannot be migrated (e.g. no registered Upgrade) is logged
+// and counted as Failed; the sweep continues with the next row, unless
+// ctx is done
+func Sweep(ctx context.Context, st *app.State) (*Result, error) {
+	result := &Result{}
+
+	// ids are collected before any writes so no cursor is held open
+	ids, err := staleIDs(ctx, app.OrgsTableName, org.Version, st.Master)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		migrated, err := org.Migrate(ctx, id, st.Master)
+		if err != nil {
+			zap.L().Warn("sweep org", zap.String("id", id), zap.Error(err))
+			result.Failed++
+			continue
+		}
+		if migrated {
+			result.Orgs++
+		}
+	}
+
+	ids, err = staleIDs(ctx, app.UsersTableName, user.Version, st.Master)
+	if err != nil {
+		return result, err
+	}
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		migrated, err := user.Migrate(ctx, id, st.DBKeys, st.Master)
+		if err != nil {
+			zap.L().Warn("sweep user", zap.String("id", id), zap.Error(err))
+			result.Failed++
+			continue
+		}
+		if migrated {
+			result.Users++
+		}
+	}
+
+	ids, err = staleIDs(ctx, app.RepositoriesTableName, repository.Version, st.Master)
+	if err != nil {
+		return result, err
+	}
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		migrated, err := repository.Migrate(ctx, id, st.Master)
+		if err != nil {
+			zap.L().Warn("sweep repository", zap.String("id", id), zap.Error(err))
+			result.Failed++
+			continue
+		}
+		if migrated {
+			result.Repositories++
+		}
+	}
+
+	return result, nil
+}
+
+// Run sweeps immediately and then every interval until ctx is done
+func Run(ctx context.Context, st *app.State, interval time.Duration) {
+	every(ctx, interval, func() {
+		result, err := Sweep(ctx, st)
+		if err != nil {
+			if ctx.Err() == nil {
+				zap.L().Error("sweep", zap.Error(err))
+			}
+			return
+		}
+		if result.Orgs+result.Users+result.Repositories+result.Failed != 0 {
+			zap.L().Info("sweep",
+				zap.Int("orgs", result.Orgs),
+				zap.Int("users", result.Users),
+				zap.Int("repositories", result.Repositories),
+				zap.Int("failed", result.Failed))
+		}
+	})
+}
+
+// every calls f immediately and then every interval until ctx is done
+func every(ctx context.Context, interval time.Duration, f func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		f()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
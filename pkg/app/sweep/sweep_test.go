@@ -0,0 +1,122 @@
+package sweep
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/org"
+	"github.com/grokloc/grokloc-server/pkg/app/admin/user"
+	"github.com/grokloc/grokloc-server/pkg/app/jwt"
+	"github.com/grokloc/grokloc-server/pkg/app/refresh"
+	"github.com/grokloc/grokloc-server/pkg/app/state"
+	"github.com/grokloc/grokloc-server/pkg/env"
+	"github.com/grokloc/grokloc-server/pkg/models"
+	"github.com/grokloc/grokloc-server/pkg/security"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+)
+
+type SweepSuite struct {
+	suite.Suite
+	st *app.State
+}
+
+func (s *SweepSuite) SetupTest() {
+	var err error
+	s.st, err = state.New(env.Unit)
+	if err != nil {
+		zap.L().Fatal("setup",
+			zap.Error(err),
+		)
+	}
+	org.RegisterUpgrade(-1, func(ctx context.Context, o *org.Org) error { return nil })
+	user.RegisterUpgrade(-1, func(ctx context.Context, u *user.User) error { return nil })
+}
+
+func (s *SweepSuite) TestSweep() {
+	ctx := context.Background()
+	ownerPassword, err := security.DerivePassword(uuid.NewString(), s.st.Argon2Cfg)
+	require.Nil(s.T(), err)
+
+	o, err := org.Create(
+		ctx,
+		uuid.NewString(), // org name
+		uuid.NewString(), // org owner display name
+		uuid.NewString(), // org owner email
+		ownerPassword,
+		s.st.DBKeys,
+		s.st.Master,
+	)
+	require.Nil(s.T(), err)
+
+	err = models.Update(ctx, app.OrgsTableName, o.ID, "schema_version", -1, s.st.Master)
+	require.Nil(s.T(), err)
+	err = models.Update(ctx, app.UsersTableName, o.Owner, "schema_version", -1, s.st.Master)
+	require.Nil(s.T(), err)
+
+	result, err := Sweep(ctx, s.st)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 1, result.Orgs)
+	require.Equal(s.T(), 1, result.Users)
+	require.Equal(s.T(), 0, result.Failed)
+
+	for _, tableName := range []string{app.OrgsTableName, app.UsersTableName} {
+		ids, err := staleIDs(ctx, tableName, 0, s.st.Master)
+		require.Nil(s.T(), err)
+		require.Empty(s.T(), ids)
+	}
+
+	// unmigratable rows are counted and skipped
+	err = models.Update(ctx, app.OrgsTableName, o.ID, "schema_version", org.Version+1, s.st.Master)
+	require.Nil(s.T(), err)
+	result, err = Sweep(ctx, s.st)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 1, result.Failed)
+	err = models.Update(ctx, app.OrgsTableName, o.ID, "schema_version", org.Version, s.st.Master)
+	require.Nil(s.T(), err)
+
+	// a sweep stops when ctx is done
+	err = models.Update(ctx, app.OrgsTableName, o.ID, "schema_version", -1, s.st.Master)
+	require.Nil(s.T(), err)
+	done, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = Sweep(done, s.st)
+	require.ErrorIs(s.T(), err, context.Canceled)
+	ids, err := staleIDs(ctx, app.OrgsTableName, org.Version, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Contains(s.T(), ids, o.ID)
+	_, err = Sweep(ctx, s.st)
+	require.Nil(s.T(), err)
+}
+
+func (s *SweepSuite) TestPruneTokens() {
+	ctx := context.Background()
+	family, err := refresh.Start(ctx, uuid.NewString(), jwt.ScopeAll, s.st.Master)
+	require.Nil(s.T(), err)
+	_, err = s.st.Master.ExecContext(ctx,
+		fmt.Sprintf(`update %s set expires = ? where family = ?`, app.RefreshTokensTableName),
+		time.Now().Unix()-refresh.Grace-1, family.Family)
+	require.Nil(s.T(), err)
+
+	pruned, err := PruneTokens(ctx, s.st)
+	require.Nil(s.T(), err)
+	require.GreaterOrEqual(s.T(), pruned, int64(1))
+	_, err = refresh.Rotate(ctx, family.Value, s.st.Master)
+	require.Equal(s.T(), refresh.ErrInvalid, err)
+}
+
+func (s *SweepSuite) TestCountPasswords() {
+	legacy, malformed, err := CountPasswords(context.Background(), s.st)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), int64(legacy), user.LegacyPasswordsGauge.Value())
+	require.Equal(s.T(), int64(malformed), user.MalformedPasswordsGauge.Value())
+}
+
+func TestSweepSuite(t *testing.T) {
+	suite.Run(t, new(SweepSuite))
+}
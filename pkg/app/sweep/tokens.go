@@ -0,0 +1,34 @@
+package sweep
+
+import (
+	"context"
+	"time"
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/refresh"
+	"go.uber.org/zap"
+)
+
+// PruneTokens deletes the tokens expired or revoked more than
+// refresh.Grace seconds ago, returning how many rows were deleted; see
+// refresh.Prune
+func PruneTokens(ctx context.Context, st *app.State) (int64, error) {
+	return refresh.Prune(ctx, time.Now().Unix()-refresh.Grace, st.Master)
+}
+
+// RunPrune prunes tokens immediately and then every interval until ctx
+// is done
+func RunPrune(ctx context.Context, st *app.State, interval time.Duration) {
+	every(ctx, interval, func() {
+		pruned, err := PruneTokens(ctx, st)
+		if err != nil {
+			if ctx.Err() == nil {
+				zap.L().Error("prune tokens", zap.Error(err))
+			}
+			return
+		}
+		if pruned != 0 {
+			zap.L().Info("prune tokens", zap.Int64("tokens", pruned))
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package tokenkey
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/jwt"
+)
+
+// CacheTTL is how long a Cache serves the keyring it loaded, so how late
+// a server sees a key promoted by another server sharing the db
+const CacheTTL = 30 * time.Second
+
+// cacheMinAge is how long a Cache serves the keyring it loaded even when
+// asked to Refresh, so unknown key ids cannot force a load per request
+const cacheMinAge = time.Second
+
+// Cache holds the keyring returned by Load for CacheTTL; the zero value
+// is empty and ready to use
+//
+// Replaced keys stop verifying when their grace ends whether or not
+// they are cached, as jwt.Keyring checks their expiry
+type Cache struct {
+	mu     sync.Mutex
+	keys   *jwt.Keyring
+	loaded time.Time
+}
+
+// Load is Load, served from c if it was loaded less than CacheTTL ago
+func (c *Cache) Load(ctx context.Context, st *app.State, db *sql.DB) (*jwt.Keyring, error) {
+	return c.load(ctx, CacheTTL, st, db)
+}
+
+// Refresh is Load, served from c only if it was loaded less than a
+// second ago; for tokens naming a key c does not hold, which may have
+// just been promoted elsewhere
+func (c *Cache) Refresh(ctx context.Context, st *app.State, db *sql.DB) (*jwt.Keyring, error) {
+	return c.load(ctx, cacheMinAge, st, db)
+}
+
+// Invalidate empties c, so the next Load reads the db
+func (c *Cache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys = nil
+}
+
+// load is Load, served from c if it was loaded less than maxAge ago
+func (c *Cache) load(ctx context.Context, maxAge time.Duration, st *app.State, db *sql.DB) (*jwt.Keyring, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keys != nil && time.Since(c.loaded) < maxAge {
+		return c.keys, nil
+	}
+	keys, err := Load(ctx, st, db)
+	if err != nil {
+		return nil, err
+	}
+	c.keys, c.loaded = keys, time.Now()
+	return keys, nil
+}
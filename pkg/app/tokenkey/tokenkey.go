@@ -0,0 +1,222 @@
+// Package tokenkey stores the keys that sign and verify JWTs, so that
+// the signing key can be replaced without invalidating every token it
+// signed
+//
+// Until a key is first promoted, the configured State.TokenKey is the
+// current key, with ID security.LegacyKeyID
+package tokenkey
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/audit"
+	"github.com/grokloc/grokloc-server/pkg/app/jwt"
+	"github.com/grokloc/grokloc-server/pkg/models"
+	"github.com/grokloc/grokloc-server/pkg/security"
+)
+
+// MaxGrace is the longest, in seconds, that a replaced key can continue
+// to verify tokens
+const MaxGrace = 86400
+
+// MinGrace is the shortest, in seconds, that a replaced key continues to
+// verify tokens: servers sharing the db go on signing with it until
+// their cached keys expire, and those tokens must verify
+const MinGrace = int64(CacheTTL / time.Second)
+
+// keyLen is the number of random bytes in a signing key
+const keyLen = 32
+
+// Load returns the current key and the replaced keys still in their
+// grace period
+func Load(ctx context.Context, st *app.State, db *sql.DB) (*jwt.Keyring, error) {
+	q := fmt.Sprintf(`select
+                          id,
+                          key,
+                          key_digest,
+                          expires
+                          from %s
+                          where expires = 0 or expires > ?`,
+		app.TokenKeysTableName)
+	rows, err := db.QueryContext(ctx, q, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	current := jwt.SigningKey{ID: security.LegacyKeyID, Key: st.TokenKey}
+	previous := []jwt.SigningKey{}
+	for rows.Next() {
+		var encrypted, digest string
+		k := jwt.SigningKey{}
+		err = rows.Scan(&k.ID, &encrypted, &digest, &k.Expires)
+		if err != nil {
+			return nil, err
+		}
+		if k.ID == security.LegacyKeyID {
+			// the configured key is not stored
+			k.Key = st.TokenKey
+		} else {
+			encoded, err := st.DBKeys.Decrypt(encrypted, digest)
+			if err != nil {
+				return nil, err
+			}
+			k.Key, err = hex.DecodeString(encoded)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if k.Expires == 0 {
+			current = k
+		} else {
+			previous = append(previous, k)
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return jwt.NewKeyring(current, previous...), nil
+}
+
+// Promote makes a new random key current; the key it replaces continues
+// to verify tokens for grace seconds
+//
+// A grace of jwt.Expiration keeps every token signed with the replaced
+// key valid; a grace of MinGrace invalidates them as soon as every
+// server has stopped signing with it. Other servers see the new key
+// within CacheTTL
+func Promote(ctx context.Context, grace int64, st *app.State) (*jwt.SigningKey, error) {
+	if grace < MinGrace || grace > MaxGrace {
+		return nil, models.ErrDisallowedValue
+	}
+	bs := make([]byte, keyLen)
+	_, err := rand.Read(bs)
+	if err != nil {
+		return nil, err
+	}
+	k := &jwt.SigningKey{ID: uuid.NewString(), Key: bs}
+	encoded := hex.EncodeToString(bs)
+	encrypted, err := st.DBKeys.Encrypt(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := st.Master.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint
+
+	now := time.Now().Unix()
+	q := fmt.Sprintf(`delete from %s where expires != 0 and expires <= ?`, app.TokenKeysTableName)
+	_, err = tx.ExecContext(ctx, q, now)
+	if err != nil {
+		return nil, err
+	}
+
+	q = fmt.Sprintf(`update %s set expires = ? where expires = 0`, app.TokenKeysTableName)
+	result, err := tx.ExecContext(ctx, q, now+grace)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		// the db does not support a basic feature
+		panic("cannot exec RowsAffected:" + err.Error())
+	}
+
+	q = fmt.Sprintf(`insert into %s
+                          (id,
+                           key,
+                           key_digest,
+                           expires)
+                          values
+                          (?,?,?,?)`,
+		app.TokenKeysTableName)
+	if updated == 0 {
+		// the configured key is being replaced
+		_, err = tx.ExecContext(ctx, q, security.LegacyKeyID, "", "", now+grace)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = tx.ExecContext(ctx, q, k.ID, encrypted, security.EncodedSHA256(encoded), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	_ = audit.Insert(ctx, audit.TOKEN_KEY, app.TokenKeysTableName, k.ID, st.Master)
+
+	return k, nil
+}
+
+// stored is a stored key, still encrypted
+type stored struct {
+	id, encrypted, digest string
+}
+
+// staleKeys returns the stored keys encrypted with a key other than the
+// current key of keys
+func staleKeys(ctx context.Context, keys *security.Keyring, db *sql.DB) ([]stored, error) {
+	q := fmt.Sprintf(`select id, key, key_digest from %s where key != ''`, app.TokenKeysTableName)
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stale := []stored{}
+	for rows.Next() {
+		var k stored
+		err = rows.Scan(&k.id, &k.encrypted, &k.digest)
+		if err != nil {
+			return nil, err
+		}
+		if keys.Stale(k.encrypted) {
+			stale = append(stale, k)
+		}
+	}
+	return stale, rows.Err()
+}
+
+// Reencrypt rewrites the stored keys encrypted with a key other than the
+// current key of keys, returning how many were rewritten
+func Reencrypt(ctx context.Context, keys *security.Keyring, db *sql.DB) (int, error) {
+	// collected before any writes so no cursor is held open
+	stale, err := staleKeys(ctx, keys, db)
+	if err != nil {
+		return 0, err
+	}
+
+	q := fmt.Sprintf(`update %s set key = ? where id = ? and key = ?`, app.TokenKeysTableName)
+	rewritten := 0
+	for _, k := range stale {
+		encoded, err := keys.Decrypt(k.encrypted, k.digest)
+		if err != nil {
+			return rewritten, err
+		}
+		encrypted, err := keys.Encrypt(encoded)
+		if err != nil {
+			return rewritten, err
+		}
+		_, err = db.ExecContext(ctx, q, encrypted, k.id, k.encrypted)
+		if err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
@@ -0,0 +1,180 @@
+package tokenkey
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grokloc/grokloc-server/pkg/app"
+	"github.com/grokloc/grokloc-server/pkg/app/config"
+	"github.com/grokloc/grokloc-server/pkg/app/jwt"
+	"github.com/grokloc/grokloc-server/pkg/app/state"
+	"github.com/grokloc/grokloc-server/pkg/env"
+	"github.com/grokloc/grokloc-server/pkg/models"
+	"github.com/grokloc/grokloc-server/pkg/security"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type TokenKeySuite struct {
+	suite.Suite
+	cfg *config.Config
+	st  *app.State
+	ctx context.Context
+}
+
+func (s *TokenKeySuite) SetupTest() {
+	// promoted keys are shared by every state using the db, so each
+	// test has its own
+	s.cfg = config.Default(env.Unit)
+	s.cfg.MasterDSN = fmt.Sprintf("file:%s", filepath.Join(s.T().TempDir(), "master.db"))
+	var err error
+	s.st, err = state.FromConfig(s.cfg)
+	require.Nil(s.T(), err)
+	s.ctx = context.Background()
+}
+
+func (s *TokenKeySuite) TearDownTest() {
+	require.Nil(s.T(), s.st.Close())
+}
+
+func (s *TokenKeySuite) load() *jwt.Keyring {
+	keys, err := Load(s.ctx, s.st, s.st.Master)
+	require.Nil(s.T(), err)
+	return keys
+}
+
+func (s *TokenKeySuite) TestPromote() {
+	now := time.Now().Unix()
+
+	// the configured key is current until a key is promoted
+	keys := s.load()
+	require.Equal(s.T(), security.LegacyKeyID, keys.Current.ID)
+	require.Equal(s.T(), s.st.TokenKey, keys.Current.Key)
+
+	first, err := Promote(s.ctx, 60, s.st)
+	require.Nil(s.T(), err)
+	keys = s.load()
+	require.Equal(s.T(), first.ID, keys.Current.ID)
+	require.Equal(s.T(), first.Key, keys.Current.Key)
+	key, ok := keys.Verifying(security.LegacyKeyID, now)
+	require.True(s.T(), ok)
+	require.Equal(s.T(), s.st.TokenKey, key)
+	_, ok = keys.Verifying(security.LegacyKeyID, now+61)
+	require.False(s.T(), ok)
+
+	// the least grace outlasts other servers' caches
+	second, err := Promote(s.ctx, MinGrace, s.st)
+	require.Nil(s.T(), err)
+	keys = s.load()
+	require.Equal(s.T(), second.ID, keys.Current.ID)
+	_, ok = keys.Verifying(first.ID, time.Now().Add(CacheTTL).Unix()-1)
+	require.True(s.T(), ok)
+	_, ok = keys.Verifying(first.ID, time.Now().Unix()+MinGrace+1)
+	require.False(s.T(), ok)
+	_, ok = keys.Verifying(security.LegacyKeyID, now)
+	require.True(s.T(), ok)
+
+	_, err = Promote(s.ctx, MinGrace-1, s.st)
+	require.Equal(s.T(), models.ErrDisallowedValue, err)
+	_, err = Promote(s.ctx, MaxGrace+1, s.st)
+	require.Equal(s.T(), models.ErrDisallowedValue, err)
+}
+
+func (s *TokenKeySuite) TestCache() {
+	var c Cache
+	cached, err := c.Load(s.ctx, s.st, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), security.LegacyKeyID, cached.Current.ID)
+
+	// a promotion is not seen until the cache expires or is invalidated
+	first, err := Promote(s.ctx, 60, s.st)
+	require.Nil(s.T(), err)
+	keys, err := c.Load(s.ctx, s.st, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Same(s.T(), cached, keys)
+	keys, err = c.Refresh(s.ctx, s.st, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Same(s.T(), cached, keys)
+	c.Invalidate()
+	keys, err = c.Load(s.ctx, s.st, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), first.ID, keys.Current.ID)
+
+	// refreshes reload once the keys are a second old
+	second, err := Promote(s.ctx, 60, s.st)
+	require.Nil(s.T(), err)
+	c.loaded = c.loaded.Add(-cacheMinAge)
+	keys, err = c.Load(s.ctx, s.st, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), first.ID, keys.Current.ID)
+	keys, err = c.Refresh(s.ctx, s.st, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), second.ID, keys.Current.ID)
+
+	// and loads once they are CacheTTL old
+	third, err := Promote(s.ctx, 60, s.st)
+	require.Nil(s.T(), err)
+	c.loaded = c.loaded.Add(-CacheTTL)
+	keys, err = c.Load(s.ctx, s.st, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), third.ID, keys.Current.ID)
+}
+
+func (s *TokenKeySuite) TestCachePromote() {
+	var promoting, other Cache
+	_, err := promoting.Load(s.ctx, s.st, s.st.Master)
+	require.Nil(s.T(), err)
+	stale, err := other.Load(s.ctx, s.st, s.st.Master)
+	require.Nil(s.T(), err)
+
+	k, err := Promote(s.ctx, MinGrace, s.st)
+	require.Nil(s.T(), err)
+	promoting.Invalidate()
+	keys, err := promoting.Load(s.ctx, s.st, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), k.ID, keys.Current.ID)
+
+	// the other server signs with the replaced key until its cache
+	// expires, and those tokens verify with the promoting server's keys
+	cached, err := other.Load(s.ctx, s.st, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Same(s.T(), stale, cached)
+	_, ok := keys.Verifying(stale.Current.ID, time.Now().Add(CacheTTL).Unix()-1)
+	require.True(s.T(), ok)
+	other.loaded = other.loaded.Add(-CacheTTL)
+	keys, err = other.Load(s.ctx, s.st, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), k.ID, keys.Current.ID)
+}
+
+func (s *TokenKeySuite) TestReencrypt() {
+	k, err := Promote(s.ctx, MinGrace, s.st)
+	require.Nil(s.T(), err)
+
+	newKey, err := security.MakeKey(uuid.NewString())
+	require.Nil(s.T(), err)
+	both, err := security.NewKeyring("1", map[string][]byte{
+		s.cfg.DBKeyID: []byte(s.cfg.DBKey),
+		"1":           newKey,
+	})
+	require.Nil(s.T(), err)
+	rewritten, err := Reencrypt(s.ctx, both, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 1, rewritten)
+	rewritten, err = Reencrypt(s.ctx, both, s.st.Master)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 0, rewritten)
+
+	// readable once the old db key is dropped
+	s.st.DBKeys, err = security.NewKeyring("1", map[string][]byte{"1": newKey})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), k.Key, s.load().Current.Key)
+}
+
+func TestTokenKeySuite(t *testing.T) {
+	suite.Run(t, new(TokenKeySuite))
+}
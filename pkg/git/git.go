@@ -0,0 +1,57 @@
+// Package git runs the git executable against local repositories
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ErrRevision means a revision could not be resolved to a commit
+var ErrRevision = errors.New("revision does not name a commit")
+
+// Command returns a git command for args, run against the repository at
+// gitDir if gitDir is not empty
+//
+// Prompts are disabled so an operation needing credentials fails
+// rather than blocking
+func Command(ctx context.Context, gitDir string, args ...string) *exec.Cmd {
+	if len(gitDir) != 0 {
+		args = append([]string{"--git-dir", gitDir}, args...)
+	}
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	return cmd
+}
+
+// Output runs the git command for args, returning trimmed stdout;
+// stderr is included in any returned error
+func Output(ctx context.Context, gitDir string, args ...string) (string, error) {
+	cmd := Command(ctx, gitDir, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// ResolveCommit returns the full hash of the commit rev names in the
+// repository at gitDir
+func ResolveCommit(ctx context.Context, gitDir, rev string) (string, error) {
+	// never allow something that could be read as a command line flag
+	if len(rev) == 0 || strings.HasPrefix(rev, "-") {
+		return "", ErrRevision
+	}
+	commit, err := Output(ctx, gitDir, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	if err != nil || len(commit) == 0 {
+		return "", ErrRevision
+	}
+	return commit, nil
+}
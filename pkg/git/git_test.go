@@ -0,0 +1,58 @@
+package git
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type GitSuite struct {
+	suite.Suite
+}
+
+func (s *GitSuite) TestResolveCommit() {
+	ctx := context.Background()
+	dir := s.T().TempDir()
+	_, err := Output(ctx, "", "init", "--quiet", dir)
+	require.Nil(s.T(), err)
+	gitDir := filepath.Join(dir, ".git")
+
+	// no commits yet
+	_, err = ResolveCommit(ctx, gitDir, "HEAD")
+	require.Equal(s.T(), ErrRevision, err)
+
+	require.Nil(s.T(), os.WriteFile(filepath.Join(dir, "f"), []byte("x"), 0600))
+	_, err = Output(ctx, "", "-C", dir, "add", "f")
+	require.Nil(s.T(), err)
+	_, err = Output(ctx, "", "-C", dir,
+		"-c", "user.name=test", "-c", "user.email=test@localhost",
+		"commit", "--quiet", "-m", "c")
+	require.Nil(s.T(), err)
+
+	commit, err := ResolveCommit(ctx, gitDir, "HEAD")
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), 40, len(commit))
+
+	// abbreviations resolve to the full hash
+	abbrev, err := ResolveCommit(ctx, gitDir, commit[:8])
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), commit, abbrev)
+
+	for _, rev := range []string{"", "--all", "nope"} {
+		_, err = ResolveCommit(ctx, gitDir, rev)
+		require.Equal(s.T(), ErrRevision, err, rev)
+	}
+
+	// failures include stderr
+	_, err = Output(ctx, gitDir, "cat-file", "-t", "nope")
+	require.Error(s.T(), err)
+	require.Contains(s.T(), err.Error(), "nope")
+}
+
+func TestGitSuite(t *testing.T) {
+	suite.Run(t, new(GitSuite))
+}
@@ -3,6 +3,7 @@ package security
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
@@ -21,6 +22,15 @@ func EncodedSHA256(s string) string {
 	return hex.EncodeToString(sum[:])
 }
 
+// EncodedHMAC returns the encoded (base16) hmac-sha256 of s with key
+//
+// Unlike EncodedSHA256, guesses at s cannot be checked without key
+func EncodedHMAC(s string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s)) // nolint
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 // MakeKey returns a 32-len byte
 func MakeKey(s string) ([]byte, error) {
 	v := EncodedSHA256(s)
@@ -56,6 +66,31 @@ func Encrypt(s string, key []byte) (string, error) {
 //
 // MakeKey is the best way to derive a key
 func Decrypt(e, expected_sha256 string, key []byte) (string, error) {
+	s, err := decrypt(e, key)
+	if err != nil {
+		return "", err
+	}
+	if EncodedSHA256(s) != expected_sha256 {
+		return "", ErrDigest
+	}
+	return s, nil
+}
+
+// DecryptHMAC is Decrypt for values whose digest is the EncodedHMAC
+// with hmacKey
+func DecryptHMAC(e, expected_hmac string, hmacKey, key []byte) (string, error) {
+	s, err := decrypt(e, key)
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal([]byte(EncodedHMAC(s, hmacKey)), []byte(expected_hmac)) {
+		return "", ErrDigest
+	}
+	return s, nil
+}
+
+// decrypt reverses Encrypt without checking the result
+func decrypt(e string, key []byte) (string, error) {
 	d, err := hex.DecodeString(e)
 	if err != nil {
 		return "", err
@@ -77,11 +112,7 @@ func Decrypt(e, expected_sha256 string, key []byte) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	s := string(bs)
-	if EncodedSHA256(s) != expected_sha256 {
-		return "", ErrDigest
-	}
-	return s, nil
+	return string(bs), nil
 }
 
 // DerivePassword performs a one-way hash on a password using argon2
@@ -97,3 +128,20 @@ func DerivePassword(password string, cfg argon2.Config) (string, error) {
 func VerifyPassword(guess, derived string) (bool, error) {
 	return argon2.VerifyEncoded([]byte(guess), []byte(derived))
 }
+
+// NeedsRehash returns true if derived was formed with parameters weaker
+// than cfg, or with another argon2 mode
+func NeedsRehash(derived string, cfg argon2.Config) (bool, error) {
+	raw, err := argon2.Decode([]byte(derived))
+	if err != nil {
+		return false, err
+	}
+	c := raw.Config
+	return c.Mode != cfg.Mode ||
+		c.Version < cfg.Version ||
+		c.MemoryCost < cfg.MemoryCost ||
+		c.TimeCost < cfg.TimeCost ||
+		c.Parallelism < cfg.Parallelism ||
+		c.HashLength < cfg.HashLength ||
+		uint32(len(raw.Salt)) < cfg.SaltLength, nil
+}
@@ -37,6 +37,29 @@ func (s *CryptSuite) TestEncrypt() {
 	require.Error(s.T(), err)
 }
 
+func (s *CryptSuite) TestEncodedHMAC() {
+	key, err := MakeKey(uuid.NewString())
+	require.Nil(s.T(), err)
+	str := uuid.NewString()
+	digest := EncodedHMAC(str, key)
+	require.Equal(s.T(), digest, EncodedHMAC(str, key))
+	require.NotEqual(s.T(), EncodedSHA256(str), digest)
+	require.NotEqual(s.T(), digest, EncodedHMAC(uuid.NewString(), key))
+	notKey, err := MakeKey(uuid.NewString())
+	require.Nil(s.T(), err)
+	require.NotEqual(s.T(), digest, EncodedHMAC(str, notKey))
+
+	e, err := Encrypt(str, key)
+	require.Nil(s.T(), err)
+	d, err := DecryptHMAC(e, digest, key, key)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), str, d)
+	_, err = DecryptHMAC(e, digest, notKey, key)
+	require.ErrorIs(s.T(), err, ErrDigest)
+	_, err = DecryptHMAC(e, EncodedSHA256(str), key, key)
+	require.ErrorIs(s.T(), err, ErrDigest)
+}
+
 func (s *CryptSuite) TestDerivePassword() {
 	password := uuid.NewString()
 	derived, err := DerivePassword(password, s.Argon2Cfg)
@@ -49,6 +72,37 @@ func (s *CryptSuite) TestDerivePassword() {
 	require.False(s.T(), bad)
 }
 
+func (s *CryptSuite) TestNeedsRehash() {
+	derived, err := DerivePassword(uuid.NewString(), s.Argon2Cfg)
+	require.Nil(s.T(), err)
+	rehash, err := NeedsRehash(derived, s.Argon2Cfg)
+	require.Nil(s.T(), err)
+	require.False(s.T(), rehash)
+
+	// any increased cost
+	for _, f := range []func(*argon2.Config){
+		func(c *argon2.Config) { c.MemoryCost *= 2 },
+		func(c *argon2.Config) { c.TimeCost++ },
+		func(c *argon2.Config) { c.Parallelism++ },
+	} {
+		cfg := s.Argon2Cfg
+		f(&cfg)
+		rehash, err = NeedsRehash(derived, cfg)
+		require.Nil(s.T(), err)
+		require.True(s.T(), rehash)
+	}
+
+	// a decreased cost does not
+	cfg := s.Argon2Cfg
+	cfg.MemoryCost /= 2
+	rehash, err = NeedsRehash(derived, cfg)
+	require.Nil(s.T(), err)
+	require.False(s.T(), rehash)
+
+	_, err = NeedsRehash(uuid.NewString(), s.Argon2Cfg)
+	require.Error(s.T(), err)
+}
+
 func TestCryptSuite(t *testing.T) {
 	suite.Run(t, new(CryptSuite))
 }
@@ -0,0 +1,128 @@
+package security
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// LegacyKeyID is the key ID of ciphertexts that carry none, i.e. those
+// written by Encrypt rather than a Keyring
+const LegacyKeyID = "0"
+
+// KeyIDSep separates the key ID from the ciphertext; it cannot occur in
+// either hex or a valid key ID
+const KeyIDSep = ":"
+
+// ErrKeyID signals a key ID that is malformed or not in a Keyring
+var ErrKeyID = errors.New("key id invalid or unknown")
+
+// ValidKeyID returns an error if id cannot be used as a key ID
+func ValidKeyID(id string) error {
+	if len(id) == 0 || strings.ContainsAny(id, KeyIDSep+", \t\n") {
+		return fmt.Errorf("%w: %q", ErrKeyID, id)
+	}
+	return nil
+}
+
+// Keyring is a set of keys by ID, one of which is current
+//
+// New values are encrypted with the current key and tagged with its ID,
+// so values encrypted with earlier keys can still be decrypted while
+// they are rewritten
+type Keyring struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyring returns a Keyring encrypting with the key with ID current,
+// which must be in keys
+func NewKeyring(current string, keys map[string][]byte) (*Keyring, error) {
+	k := &Keyring{current: current, keys: make(map[string][]byte, len(keys))}
+	for id, key := range keys {
+		err := ValidKeyID(id)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != KeyLen {
+			return nil, fmt.Errorf("key %s length is not %d", id, KeyLen)
+		}
+		k.keys[id] = key
+	}
+	if _, ok := k.keys[current]; !ok {
+		return nil, fmt.Errorf("%w: current %q", ErrKeyID, current)
+	}
+	return k, nil
+}
+
+// Current returns the ID of the key used to encrypt
+func (k *Keyring) Current() string {
+	return k.current
+}
+
+// KeyID returns the ID of the key that encrypted e
+func KeyID(e string) string {
+	i := strings.Index(e, KeyIDSep)
+	if i < 0 {
+		return LegacyKeyID
+	}
+	return e[:i]
+}
+
+// Has reports whether k holds the key with ID id
+func (k *Keyring) Has(id string) bool {
+	_, ok := k.keys[id]
+	return ok
+}
+
+// Stale reports whether e was encrypted with a key other than the
+// current one
+func (k *Keyring) Stale(e string) bool {
+	return KeyID(e) != k.current
+}
+
+// Prefix is the prefix of every value encrypted with the current key
+func (k *Keyring) Prefix() string {
+	return k.current + KeyIDSep
+}
+
+// Encrypt is Encrypt with the current key, tagging the result with its
+// ID
+func (k *Keyring) Encrypt(s string) (string, error) {
+	e, err := Encrypt(s, k.keys[k.current])
+	if err != nil {
+		return "", err
+	}
+	return k.Prefix() + e, nil
+}
+
+// Decrypt is Decrypt with the key that encrypted e
+func (k *Keyring) Decrypt(e, expected_sha256 string) (string, error) {
+	id := KeyID(e)
+	key, ok := k.keys[id]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrKeyID, id)
+	}
+	return Decrypt(strings.TrimPrefix(e, id+KeyIDSep), expected_sha256, key)
+}
+
+// DecryptHMAC is DecryptHMAC with the key that encrypted e
+func (k *Keyring) DecryptHMAC(e, expected_hmac string, hmacKey []byte) (string, error) {
+	id := KeyID(e)
+	key, ok := k.keys[id]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrKeyID, id)
+	}
+	return DecryptHMAC(strings.TrimPrefix(e, id+KeyIDSep), expected_hmac, hmacKey, key)
+}
+
+// With returns a Keyring that encrypts with key, with ID id, and still
+// decrypts with every key of k
+func (k *Keyring) With(id string, key []byte) (*Keyring, error) {
+	keys := make(map[string][]byte, len(k.keys)+1)
+	for kid, v := range k.keys {
+		keys[kid] = v
+	}
+	keys[id] = key
+	return NewKeyring(id, keys)
+}
@@ -0,0 +1,67 @@
+package security
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func (s *CryptSuite) TestKeyring() {
+	old, err := MakeKey(uuid.NewString())
+	require.Nil(s.T(), err)
+	current, err := MakeKey(uuid.NewString())
+	require.Nil(s.T(), err)
+
+	str := uuid.NewString()
+	digest := EncodedSHA256(str)
+	legacy, err := Encrypt(str, old)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), LegacyKeyID, KeyID(legacy))
+
+	k, err := NewKeyring("1", map[string][]byte{LegacyKeyID: old, "1": current})
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "1", k.Current())
+	e, err := k.Encrypt(str)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "1", KeyID(e))
+	require.False(s.T(), k.Stale(e))
+	require.True(s.T(), k.Stale(legacy))
+
+	// both decrypt
+	for _, v := range []string{e, legacy} {
+		d, err := k.Decrypt(v, digest)
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), str, d)
+	}
+
+	// a key added with With encrypts, and the others still decrypt
+	added, err := MakeKey(uuid.NewString())
+	require.Nil(s.T(), err)
+	w, err := k.With("2", added)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "2", w.Current())
+	e2, err := w.Encrypt(str)
+	require.Nil(s.T(), err)
+	require.Equal(s.T(), "2", KeyID(e2))
+	for _, v := range []string{e, e2, legacy} {
+		d, err := w.Decrypt(v, digest)
+		require.Nil(s.T(), err)
+		require.Equal(s.T(), str, d)
+	}
+	require.Equal(s.T(), "1", k.Current())
+
+	// once the old key is dropped, its values cannot be read
+	k, err = NewKeyring("1", map[string][]byte{"1": current})
+	require.Nil(s.T(), err)
+	_, err = k.Decrypt(legacy, digest)
+	require.ErrorIs(s.T(), err, ErrKeyID)
+	require.True(s.T(), k.Has("1"))
+	require.False(s.T(), k.Has(LegacyKeyID))
+
+	// the current key must be present, and ids well formed
+	_, err = NewKeyring("2", map[string][]byte{"1": current})
+	require.ErrorIs(s.T(), err, ErrKeyID)
+	_, err = NewKeyring("a:b", map[string][]byte{"a:b": current})
+	require.ErrorIs(s.T(), err, ErrKeyID)
+	_, err = NewKeyring("1", map[string][]byte{"1": current[1:]})
+	require.Error(s.T(), err)
+}